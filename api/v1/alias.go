@@ -0,0 +1,77 @@
+package v1
+
+import (
+	"github.com/erikvanbrakel/anthology/app"
+	"github.com/erikvanbrakel/anthology/models"
+	"github.com/go-ozzo/ozzo-routing"
+	"net/http"
+)
+
+type (
+	aliasService interface {
+		Aliases(rs app.RequestScope, namespace string) ([]models.ModuleAlias, error)
+		SetAlias(rs app.RequestScope, namespace, name, provider string, target models.ModuleAddress, message string) (*models.ModuleAlias, error)
+		DeleteAlias(rs app.RequestScope, namespace, name, provider string) error
+	}
+
+	aliasResource struct {
+		service aliasService
+	}
+)
+
+func ServeAliasResource(rg *routing.RouteGroup, service aliasService) {
+	r := &aliasResource{service}
+
+	// List the modules of a namespace that moved elsewhere
+	rg.Get("/<namespace>", r.query)
+
+	// Send requests for a module to the module it became
+	rg.Put("/<namespace>/<name>/<provider>", r.set)
+
+	// Remove the alias of a module
+	rg.Delete("/<namespace>/<name>/<provider>", r.delete)
+}
+
+func (r *aliasResource) query(c *routing.Context) error {
+	rs := app.GetRequestScope(c)
+
+	aliases, err := r.service.Aliases(rs, c.Param("namespace"))
+	if err != nil {
+		return writeServiceError(c, err)
+	}
+
+	return c.Write(struct {
+		Aliases []models.ModuleAlias `json:"aliases"`
+	}{aliases})
+}
+
+func (r *aliasResource) set(c *routing.Context) error {
+	rs := app.GetRequestScope(c)
+
+	var request struct {
+		models.ModuleAddress
+		Message string `json:"message"`
+	}
+	if err := c.Read(&request); err != nil || request.Namespace == "" || request.Name == "" || request.Provider == "" {
+		c.Response.WriteHeader(http.StatusBadRequest)
+		return c.Write(apiError{[]string{"namespace, name and provider of the target are required"}})
+	}
+
+	alias, err := r.service.SetAlias(rs, c.Param("namespace"), c.Param("name"), c.Param("provider"), request.ModuleAddress, request.Message)
+	if err != nil {
+		return writeServiceError(c, err)
+	}
+
+	return c.Write(alias)
+}
+
+func (r *aliasResource) delete(c *routing.Context) error {
+	rs := app.GetRequestScope(c)
+
+	if err := r.service.DeleteAlias(rs, c.Param("namespace"), c.Param("name"), c.Param("provider")); err != nil {
+		return writeServiceError(c, err)
+	}
+
+	c.Response.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,80 @@
+package v1_test
+
+import (
+	"bytes"
+	"github.com/erikvanbrakel/anthology/api/v1"
+	"github.com/erikvanbrakel/anthology/registry"
+	"github.com/erikvanbrakel/anthology/services"
+	"github.com/gavv/httpexpect"
+	"github.com/go-ozzo/ozzo-routing"
+	"net/http"
+	"os"
+	"testing"
+)
+
+func TestModuleAliases(t *testing.T) {
+	path := writeTokens(t, "alice:"+tokenHash("alice-token"))
+	defer os.Remove(path)
+
+	r := registry.NewFakeRegistry()
+	r.PublishModule("network", "vpc", "aws", "1.0.0", bytes.NewReader(moduleArchive(map[string]string{"main.tf": "# main.tf"})))
+	r.PublishModule("network", "vpc", "aws", "1.1.0", bytes.NewReader(moduleArchive(map[string]string{"main.tf": "# main.tf"})))
+	r.PublishModule("legacy", "subnets", "aws", "0.1.0", bytes.NewReader(moduleArchive(map[string]string{"main.tf": "# main.tf"})))
+
+	modules := services.NewModuleService(r)
+	modules.Policy = &services.Policy{Grants: []services.Grant{
+		{Subjects: []string{"*"}, Namespaces: []string{"legacy", "network"}, Role: services.RoleReader},
+		{Subjects: []string{"token:alice"}, Namespaces: []string{"legacy"}, Role: services.RoleAdmin},
+	}}
+
+	server := newServer(authenticate(t, path), serveModules(modules), func(router *routing.Router) {
+		v1.ServeAliasResource(router.Group("/v1/aliases"), modules)
+	})
+	defer server.Close()
+	e := newExpect(t, server)
+
+	alice := func(r *httpexpect.Request) *httpexpect.Request {
+		return r.WithHeader("Authorization", "Bearer alice-token")
+	}
+	vpc := map[string]string{"namespace": "network", "name": "vpc", "provider": "aws"}
+
+	e.GET("/v1/modules/legacy/vpc/aws/versions").Expect().Status(http.StatusNotFound)
+
+	e.PUT("/v1/aliases/legacy/vpc/aws").WithJSON(vpc).Expect().Status(http.StatusUnauthorized)
+	alice(e.PUT("/v1/aliases/network/vpc/aws")).WithJSON(vpc).Expect().Status(http.StatusForbidden)
+	alice(e.PUT("/v1/aliases/legacy/vpc/aws")).WithJSON(map[string]string{"namespace": "network"}).
+		Expect().Status(http.StatusBadRequest)
+	alice(e.PUT("/v1/aliases/legacy/vpc/aws")).WithJSON(map[string]string{"namespace": "network", "name": "vpc", "provider": "gcp"}).
+		Expect().Status(http.StatusBadRequest)
+	alice(e.PUT("/v1/aliases/legacy/vpc/aws")).WithJSON(vpc).Expect().Status(http.StatusOK).JSON().Object().
+		ValueEqual("namespace", "legacy").ValueEqual("message", "legacy/vpc/aws has moved to network/vpc/aws").
+		ValueEqual("created_by", "token:alice").Value("target").Equal(vpc)
+
+	versions := e.GET("/v1/modules/legacy/vpc/aws/versions").Expect().Status(http.StatusOK)
+	versions.Header("Deprecation").Equal("true")
+	versions.Header("Warning").Equal(`299 - "legacy/vpc/aws has moved to network/vpc/aws"`)
+	versions.JSON().Path("$.modules[0].source").Equal("network/vpc/aws")
+
+	e.GET("/v1/modules/legacy/vpc/aws").Expect().Status(http.StatusOK).JSON().Object().
+		ValueEqual("namespace", "network").ValueEqual("version", "1.1.0")
+	e.GET("/v1/modules/legacy/vpc/aws/1.0.0").Expect().Status(http.StatusOK).JSON().Object().ValueEqual("namespace", "network")
+	e.GET("/v1/modules/legacy/vpc/aws/1.0.0/download").Expect().Status(http.StatusNoContent).
+		Header("X-Terraform-Get").Equal("/v1/modules/network/vpc/aws/1.0.0/data.tgz")
+	e.GET("/v1/modules/legacy/vpc/aws/download").Expect().Status(http.StatusFound).
+		Header("Location").Equal("/v1/modules/network/vpc/aws/1.1.0/download")
+
+	// modules that still have versions are not redirected
+	alice(e.PUT("/v1/aliases/legacy/subnets/aws")).WithJSON(vpc).Expect().Status(http.StatusOK)
+	e.GET("/v1/modules/legacy/subnets/aws").Expect().Status(http.StatusOK).JSON().Object().ValueEqual("namespace", "legacy")
+
+	// aliases of aliases are refused
+	alice(e.PUT("/v1/aliases/legacy/network/aws")).WithJSON(map[string]string{"namespace": "legacy", "name": "subnets", "provider": "aws"}).
+		Expect().Status(http.StatusBadRequest).JSON().Path("$.errors[0]").Equal("module legacy/subnets/aws is an alias itself")
+
+	alice(e.GET("/v1/aliases/legacy")).Expect().Status(http.StatusOK).JSON().Object().Value("aliases").Array().Length().Equal(2)
+	e.GET("/v1/aliases/legacy").Expect().Status(http.StatusUnauthorized)
+
+	alice(e.DELETE("/v1/aliases/legacy/vpc/aws")).Expect().Status(http.StatusNoContent)
+	alice(e.DELETE("/v1/aliases/legacy/vpc/aws")).Expect().Status(http.StatusNotFound)
+	e.GET("/v1/modules/legacy/vpc/aws/versions").Expect().Status(http.StatusNotFound).Header("Deprecation").Empty()
+}
@@ -4,7 +4,9 @@ import (
 	"net/http/httptest"
 	"testing"
 
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
 	"github.com/erikvanbrakel/anthology/api/v1"
 	"github.com/erikvanbrakel/anthology/app"
 	"github.com/erikvanbrakel/anthology/registry"
@@ -14,6 +16,7 @@ import (
 	"github.com/go-ozzo/ozzo-routing/content"
 	"github.com/sirupsen/logrus"
 	"net/http"
+	"sort"
 )
 
 type apiTestCase struct {
@@ -25,7 +28,13 @@ type apiTestCase struct {
 	assert func(*testing.T, *httpexpect.Response, *httptest.Server)
 }
 
-func newRouter() *routing.Router {
+// resource adds a resource, or a middleware for the resources after it, to a
+// test router.
+type resource func(router *routing.Router)
+
+// newRouter returns a router with the middleware of the server and the given
+// resources.
+func newRouter(resources ...resource) *routing.Router {
 	logger := logrus.New()
 	logger.Level = logrus.PanicLevel
 
@@ -36,31 +45,104 @@ func newRouter() *routing.Router {
 		content.TypeNegotiator(content.JSON),
 	)
 
+	for _, add := range resources {
+		add(router)
+	}
+
 	return router
 }
 
+// newServer starts a test server for a router from newRouter.
+func newServer(resources ...resource) *httptest.Server {
+	return httptest.NewServer(newRouter(resources...))
+}
+
+// newExpect returns an httpexpect for a test server that does not follow
+// redirects.
+func newExpect(t *testing.T, server *httptest.Server) *httpexpect.Expect {
+	return httpexpect.WithConfig(httpexpect.Config{
+		BaseURL:  server.URL,
+		Reporter: httpexpect.NewAssertReporter(t),
+		Client: &http.Client{
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	})
+}
+
+// authenticate authenticates requests with the tokens in a file written by
+// writeTokens.
+func authenticate(t *testing.T, tokensPath string) resource {
+	tokens, err := services.NewFileTokenStore(tokensPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return func(router *routing.Router) {
+		router.Use(app.Authenticate(services.NewTokenAuthenticator(tokens)))
+	}
+}
+
+// serveModules serves the module resource under /v1/modules.
+func serveModules(modules *services.ModuleService) resource {
+	return func(router *routing.Router) {
+		v1.ServeModuleResource(router.Group("/v1/modules"), modules)
+	}
+}
+
+// serveUploads serves the upload resource under /v1/uploads.
+func serveUploads(uploads *services.UploadService) resource {
+	return func(router *routing.Router) {
+		v1.ServeUploadResource(router.Group("/v1/uploads"), uploads)
+	}
+}
+
+// serveProviders serves the provider resource under /v1/providers and the
+// signing keys of its namespaces under /v1/signing-keys.
+func serveProviders(providers *services.ProviderService) resource {
+	return func(router *routing.Router) {
+		v1.ServeProviderResource(router.Group("/v1/providers"), providers)
+		v1.ServeSigningKeyResource(router.Group("/v1/signing-keys"), providers)
+	}
+}
+
+// serveMirror serves the mirror resource under /v1/mirror.
+func serveMirror(mirror *services.MirrorService) resource {
+	return func(router *routing.Router) {
+		v1.ServeMirrorResource(router.Group("/v1/mirror"), mirror)
+	}
+}
+
+// newTestRegistry returns a fake registry with the dataset published.
+func newTestRegistry(dataset []testModule) registry.Registry {
+	r := registry.NewFakeRegistry()
+	for _, m := range dataset {
+		r.PublishModule(m.namespace, m.name, m.provider, m.version, bytes.NewBuffer(m.data))
+	}
+	return r
+}
+
 func runAPITests(t *testing.T, dataset []testModule, tests []apiTestCase) {
+	runAPITestsWithRegistry(t, registry.NewFakeRegistry, dataset, tests)
+}
+
+func runAPITestsWithRegistry(t *testing.T, newRegistry func() registry.Registry, dataset []testModule, tests []apiTestCase) {
 	for _, test := range tests {
 		t.Run(test.tag, func(t *testing.T) {
-			r := registry.NewFakeRegistry()
+			r := newRegistry()
 
 			for _, m := range dataset {
 				r.PublishModule(m.namespace, m.name, m.provider, m.version, bytes.NewBuffer(m.data))
 			}
 
-			router := newRouter()
-			v1.ServeModuleResource(&router.RouteGroup, services.NewModuleService(r))
-			server := httptest.NewServer(router)
+			server := newServer(func(router *routing.Router) {
+				v1.ServeModuleResource(&router.RouteGroup, services.NewModuleService(r))
+			})
 			defer server.Close()
 
-			e := httpexpect.New(t, server.URL)
+			e := newExpect(t, server)
 
 			result := e.Request(test.method, test.url).
-				WithClient(&http.Client{
-					CheckRedirect: func(req *http.Request, via []*http.Request) error {
-						return http.ErrUseLastResponse
-					},
-				}).
 				WithHeader("Content-Type", "application/json").
 				WithBytes([]byte(test.body)).
 				Expect().Status(test.status)
@@ -77,3 +159,27 @@ type testModule struct {
 	version   string
 	data      []byte
 }
+
+// moduleArchive builds a gzipped tarball out of file names and their
+// contents.
+func moduleArchive(files map[string]string) []byte {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+
+	for _, name := range names {
+		content := []byte(files[name])
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content))})
+		tw.Write(content)
+	}
+
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
@@ -0,0 +1,49 @@
+package v1
+
+import (
+	"github.com/erikvanbrakel/anthology/app"
+	"github.com/erikvanbrakel/anthology/models"
+	"github.com/erikvanbrakel/anthology/services"
+	"github.com/go-ozzo/ozzo-routing"
+	"strconv"
+)
+
+type (
+	auditService interface {
+		Query(rs app.RequestScope, q services.AuditQuery) ([]models.AuditEntry, error)
+	}
+
+	auditResource struct {
+		service auditService
+	}
+)
+
+func ServeAuditResource(rg *routing.RouteGroup, service auditService) {
+	r := &auditResource{service}
+
+	// Query the audit log, only entries of namespaces the caller administers
+	// are returned. Without a policy any authenticated caller may query it.
+	rg.Get("", r.query)
+}
+
+func (r *auditResource) query(c *routing.Context) error {
+	rs := app.GetRequestScope(c)
+
+	after, _ := strconv.ParseInt(c.Query("after", "0"), 10, 64)
+	limit, _ := strconv.Atoi(c.Query("limit", "100"))
+
+	entries, err := r.service.Query(rs, services.AuditQuery{
+		Namespace: c.Query("namespace"),
+		Operation: c.Query("operation"),
+		Principal: c.Query("principal"),
+		After:     after,
+		Limit:     limit,
+	})
+	if err != nil {
+		return writeServiceError(c, err)
+	}
+
+	return c.Write(struct {
+		Entries []models.AuditEntry `json:"entries"`
+	}{entries})
+}
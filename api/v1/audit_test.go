@@ -0,0 +1,188 @@
+package v1_test
+
+import (
+	"bytes"
+	"github.com/erikvanbrakel/anthology/api/v1"
+	"github.com/erikvanbrakel/anthology/registry"
+	"github.com/erikvanbrakel/anthology/services"
+	"github.com/gavv/httpexpect"
+	"github.com/go-ozzo/ozzo-routing"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tokens := writeTokens(t, "ci:"+tokenHash("ci-token"))
+	defer os.Remove(tokens)
+
+	auditFile := filepath.Join(dir, "audit.jsonl")
+	audit, err := services.NewFileAuditLog(auditFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	modules := services.NewModuleService(registry.NewFakeRegistry())
+	modules.Audit = audit
+
+	server := newServer(authenticate(t, tokens), serveModules(modules), func(router *routing.Router) {
+		v1.ServeAuditResource(router.Group("/v1/audit"), audit)
+	})
+	defer server.Close()
+	e := httpexpect.New(t, server.URL)
+
+	e.POST("/v1/modules/namespace1/module1/aws/1.0.0").WithBytes(moduleArchive(map[string]string{"main.tf": "# main.tf"})).
+		WithHeader("Authorization", "Bearer ci-token").
+		WithHeader("X-Request-Id", "request-1").
+		Expect().Status(http.StatusNoContent)
+	e.POST("/v1/modules/namespace1/module1/aws/2.0.0").WithBytes([]byte("not an archive")).
+		Expect().Status(http.StatusBadRequest)
+	e.DELETE("/v1/modules/namespace1/module1/aws/1.0.0").
+		Expect().Status(http.StatusNoContent)
+
+	// without a policy the log is only available to authenticated callers
+	e.GET("/v1/audit").Expect().Status(http.StatusUnauthorized)
+
+	ci := func(r *httpexpect.Request) *httpexpect.Request {
+		return r.WithHeader("Authorization", "Bearer ci-token")
+	}
+
+	entries := ci(e.GET("/v1/audit")).Expect().Status(http.StatusOK).JSON().Object().Value("entries").Array()
+	entries.Length().Equal(3)
+
+	published := entries.Element(0).Object()
+	published.ValueEqual("sequence", 1)
+	published.ValueEqual("operation", "module.publish")
+	published.ValueEqual("principal", "token:ci")
+	published.ValueEqual("request_id", "request-1")
+	published.ValueEqual("version", "1.0.0")
+	published.ValueEqual("outcome", "success")
+	published.ValueEqual("previous_hash", "")
+	published.Value("checksum").String().Contains("sha256:")
+
+	failed := entries.Element(1).Object()
+	failed.ValueEqual("principal", "anonymous")
+	failed.ValueEqual("outcome", "failure")
+	failed.Value("error").String().NotEmpty()
+	failed.ValueEqual("previous_hash", published.Value("hash").Raw())
+
+	ci(e.GET("/v1/audit")).WithQuery("operation", "module.delete").
+		Expect().Status(http.StatusOK).JSON().Object().Value("entries").Array().Length().Equal(1)
+	ci(e.GET("/v1/audit")).WithQuery("limit", 1).
+		Expect().Status(http.StatusOK).JSON().Object().Value("entries").Array().
+		Element(0).Object().ValueEqual("sequence", 3)
+
+	if verified, err := audit.Verify(); err != nil || verified != 3 {
+		t.Fatalf("expected 3 verified entries, got %d, %v", verified, err)
+	}
+
+	// a reopened log continues the chain
+	audit, err = services.NewFileAuditLog(auditFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modules.Audit = audit
+	e.DELETE("/v1/modules/namespace1/module1/aws/1.0.0").Expect().Status(http.StatusNotFound)
+
+	if verified, err := audit.Verify(); err != nil || verified != 4 {
+		t.Fatalf("expected 4 verified entries, got %d, %v", verified, err)
+	}
+
+	data, _ := ioutil.ReadFile(auditFile)
+	lines := strings.SplitAfter(strings.TrimSpace(string(data)), "\n")
+
+	ioutil.WriteFile(auditFile, []byte(strings.Replace(string(data), "token:ci", "token:someone-else", 1)), 0644)
+	if _, err := audit.Verify(); err == nil || !strings.Contains(err.Error(), "entry 1 was modified") {
+		t.Errorf("expected a modified entry to be detected, got %v", err)
+	}
+
+	ioutil.WriteFile(auditFile, []byte(lines[0]+strings.Join(lines[2:], "")), 0644)
+	if _, err := audit.Verify(); err == nil {
+		t.Error("expected a removed entry to be detected")
+	}
+}
+
+func TestStorageAuditLog(t *testing.T) {
+	r := registry.NewFakeRegistry()
+
+	audit, err := services.NewStorageAuditLog(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	providers := services.NewProviderService(r)
+	providers.Audit = audit
+
+	server := newServer(serveProviders(providers))
+	defer server.Close()
+	e := httpexpect.New(t, server.URL)
+
+	_, armored := newSigningKey(t)
+	e.POST("/v1/signing-keys/namespace1").WithJSON(map[string]string{"ascii_armor": armored}).
+		Expect().Status(http.StatusCreated)
+
+	keys, _ := r.ListObjects("audit/")
+	if len(keys) != 1 {
+		t.Fatalf("expected one audit entry in the backend, got %v", keys)
+	}
+
+	if verified, err := audit.Verify(); err != nil || verified != 1 {
+		t.Fatalf("expected 1 verified entry, got %d, %v", verified, err)
+	}
+
+	r.PutObject(keys[0], bytes.NewReader([]byte(`{"sequence":1,"operation":"signing-key.add","hash":"forged"}`)))
+	if _, err := audit.Verify(); err == nil {
+		t.Error("expected a modified entry to be detected")
+	}
+}
+
+func TestStorageAuditLogSegments(t *testing.T) {
+	r := registry.NewFakeRegistry()
+
+	audit, err := services.NewStorageAuditLog(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	providers := services.NewProviderService(r)
+	providers.Audit = audit
+
+	server := newServer(serveProviders(providers))
+	defer server.Close()
+	e := httpexpect.New(t, server.URL)
+
+	for i := 0; i < 1001; i++ {
+		e.POST("/v1/signing-keys/namespace1").WithJSON(map[string]string{"ascii_armor": "not a key"}).
+			Expect().Status(http.StatusBadRequest)
+	}
+
+	keys, _ := r.ListObjects("audit/")
+	if len(keys) != 2 {
+		t.Fatalf("expected two audit segments in the backend, got %v", keys)
+	}
+
+	// a reopened log continues in the last segment
+	audit, err = services.NewStorageAuditLog(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	providers.Audit = audit
+	e.POST("/v1/signing-keys/namespace1").WithJSON(map[string]string{"ascii_armor": "not a key"}).
+		Expect().Status(http.StatusBadRequest)
+
+	if keys, _ := r.ListObjects("audit/"); len(keys) != 2 {
+		t.Fatalf("expected two audit segments in the backend, got %v", keys)
+	}
+	if verified, err := audit.Verify(); err != nil || verified != 1002 {
+		t.Fatalf("expected 1002 verified entries, got %d, %v", verified, err)
+	}
+}
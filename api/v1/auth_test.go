@@ -0,0 +1,116 @@
+package v1_test
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"github.com/erikvanbrakel/anthology/app"
+	"github.com/erikvanbrakel/anthology/services"
+	"github.com/gavv/httpexpect"
+	"github.com/go-ozzo/ozzo-routing"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+)
+
+func writeTokens(t *testing.T, lines ...string) string {
+	f, err := ioutil.TempFile("", "tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for _, line := range lines {
+		f.WriteString(line + "\n")
+	}
+
+	return f.Name()
+}
+
+func tokenHash(token string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(token)))
+}
+
+// requireAuthentication requires authentication for the resources after it.
+func requireAuthentication(read, write bool) resource {
+	return func(router *routing.Router) {
+		router.Use(app.RequireAuthentication(read, write))
+	}
+}
+
+var authDataset = []testModule{
+	{"namespace1", "module1", "aws", "1.0.0", moduleArchive(map[string]string{"main.tf": "# main.tf"})},
+}
+
+func TestRequireWrite(t *testing.T) {
+	path := writeTokens(t,
+		"# publishing from CI",
+		"ci:"+tokenHash("ci-token")+":publishers,readers",
+	)
+	defer os.Remove(path)
+
+	server := newServer(authenticate(t, path), requireAuthentication(false, true),
+		serveModules(services.NewModuleService(newTestRegistry(authDataset))))
+	defer server.Close()
+	e := httpexpect.New(t, server.URL)
+
+	e.GET("/v1/modules/namespace1").Expect().Status(http.StatusOK)
+
+	e.POST("/v1/modules/namespace1/module1/aws/2.0.0").WithBytes(moduleArchive(map[string]string{"main.tf": "# main.tf"})).
+		Expect().Status(http.StatusUnauthorized).
+		Header("WWW-Authenticate").Contains("Bearer")
+
+	e.POST("/v1/modules/namespace1/module1/aws/2.0.0").WithBytes(moduleArchive(map[string]string{"main.tf": "# main.tf"})).
+		WithHeader("Authorization", "Bearer wrong-token").
+		Expect().Status(http.StatusUnauthorized)
+
+	e.POST("/v1/modules/namespace1/module1/aws/2.0.0").WithBytes(moduleArchive(map[string]string{"main.tf": "# main.tf"})).
+		WithHeader("Authorization", "Bearer ci-token").
+		Expect().Status(http.StatusNoContent)
+}
+
+func TestRequireRead(t *testing.T) {
+	path := writeTokens(t,
+		"# publishing from CI",
+		"ci:"+tokenHash("ci-token")+":publishers,readers",
+	)
+	defer os.Remove(path)
+
+	server := newServer(authenticate(t, path), requireAuthentication(true, false),
+		serveModules(services.NewModuleService(newTestRegistry(authDataset))))
+	defer server.Close()
+	e := httpexpect.New(t, server.URL)
+
+	e.GET("/v1/modules/namespace1").Expect().Status(http.StatusUnauthorized)
+	e.GET("/v1/modules/namespace1").WithHeader("Authorization", "Bearer ci-token").
+		Expect().Status(http.StatusOK)
+}
+
+func TestFileTokenStore(t *testing.T) {
+	path := writeTokens(t, "ci:"+tokenHash("ci-token")+":publishers,readers")
+	defer os.Remove(path)
+
+	tokens, err := services.NewFileTokenStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := tokens.Lookup("ci-token")
+	if err != nil || p == nil {
+		t.Fatalf("expected ci-token to be found, got %v, %v", p, err)
+	}
+	if p.Name != "ci" || p.Type != "token" || len(p.Groups) != 2 || p.Groups[0] != "publishers" {
+		t.Errorf("unexpected principal %+v", p)
+	}
+
+	if p, _ := tokens.Lookup("other"); p != nil {
+		t.Errorf("expected an unknown token to be rejected, got %+v", p)
+	}
+
+	invalid := writeTokens(t, "ci:not-a-hash")
+	defer os.Remove(invalid)
+
+	if _, err := services.NewFileTokenStore(invalid); err == nil {
+		t.Error("expected an error for a token file without hashes")
+	}
+}
@@ -0,0 +1,101 @@
+package v1
+
+import (
+	"encoding/json"
+	"github.com/erikvanbrakel/anthology/app"
+	"github.com/erikvanbrakel/anthology/models"
+	"github.com/go-ozzo/ozzo-routing"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+)
+
+type (
+	bulkService interface {
+		Publish(rs app.RequestScope, namespace string, data io.Reader, manifest *models.BulkManifest, version string) ([]models.BulkResult, error)
+	}
+
+	bulkResource struct {
+		service bulkService
+	}
+)
+
+func ServeBulkResource(rg *routing.RouteGroup, service bulkService) {
+	r := &bulkResource{service}
+
+	// Publish every module in a monorepo archive
+	rg.Post("/<namespace>", r.publish)
+}
+
+func (r *bulkResource) publish(c *routing.Context) error {
+	rs := app.GetRequestScope(c)
+
+	var (
+		data     io.Reader = c.Request.Body
+		manifest *models.BulkManifest
+		version  = c.Query("version")
+	)
+
+	if mediaType, _, _ := mime.ParseMediaType(c.Request.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+		if err := c.Request.ParseMultipartForm(maxMemory); err != nil {
+			c.Response.WriteHeader(http.StatusBadRequest)
+			return c.Write(apiError{[]string{"invalid multipart form: " + err.Error()}})
+		}
+		defer c.Request.MultipartForm.RemoveAll()
+
+		archive, _, err := c.Request.FormFile("archive")
+		if err != nil {
+			c.Response.WriteHeader(http.StatusBadRequest)
+			return c.Write(apiError{[]string{"the form has no archive file"}})
+		}
+		defer archive.Close()
+		data = archive
+
+		if manifest, err = formManifest(c.Request); err != nil {
+			c.Response.WriteHeader(http.StatusBadRequest)
+			return c.Write(apiError{[]string{"invalid manifest: " + err.Error()}})
+		}
+		if v := c.Request.FormValue("version"); v != "" {
+			version = v
+		}
+	}
+
+	results, err := r.service.Publish(rs, c.Param("namespace"), data, manifest, version)
+	if err != nil {
+		return writeServiceError(c, err)
+	}
+
+	status := http.StatusCreated
+	for _, result := range results {
+		if result.Status != models.BulkPublished {
+			status = http.StatusBadRequest
+		}
+	}
+
+	c.Response.WriteHeader(status)
+	return c.Write(struct {
+		Modules []models.BulkResult `json:"modules"`
+	}{results})
+}
+
+// formManifest reads the manifest of a bulk publish, sent either as a form
+// field or as a file. It returns nil when there is no manifest.
+func formManifest(req *http.Request) (*models.BulkManifest, error) {
+	data := []byte(req.FormValue("manifest"))
+	if f, _, err := req.FormFile("manifest"); err == nil {
+		defer f.Close()
+		if data, err = ioutil.ReadAll(f); err != nil {
+			return nil, err
+		}
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	manifest := &models.BulkManifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
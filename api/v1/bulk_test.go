@@ -0,0 +1,115 @@
+package v1_test
+
+import (
+	"errors"
+	"github.com/erikvanbrakel/anthology/api/v1"
+	"github.com/erikvanbrakel/anthology/models"
+	"github.com/erikvanbrakel/anthology/registry"
+	"github.com/erikvanbrakel/anthology/services"
+	"github.com/gavv/httpexpect"
+	"github.com/go-ozzo/ozzo-routing"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// failingRegistry fails to store modules with a specific name.
+type failingRegistry struct {
+	registry.Registry
+	name string
+}
+
+func (r *failingRegistry) PublishModule(namespace, name, provider, version string, data io.Reader) error {
+	if name == r.name {
+		return errors.New("storage unavailable")
+	}
+	return r.Registry.PublishModule(namespace, name, provider, version, data)
+}
+
+// serveBulk serves the bulk resource under /v1/bulk.
+func serveBulk(modules *services.ModuleService) resource {
+	return func(router *routing.Router) {
+		v1.ServeBulkResource(router.Group("/v1/bulk"), services.NewBulkService(modules))
+	}
+}
+
+func TestBulkPublish(t *testing.T) {
+	modules := services.NewModuleService(registry.NewFakeRegistry())
+	server := newServer(serveModules(modules), serveBulk(modules))
+	defer server.Close()
+	e := httpexpect.New(t, server.URL)
+
+	monorepo := moduleArchive(map[string]string{
+		"README.md":                               "# README.md",
+		"modules/vpc/aws/main.tf":                 "# modules/vpc/aws/main.tf",
+		"modules/vpc/aws/variables.tf":            "# modules/vpc/aws/variables.tf",
+		"modules/dns/aws/main.tf":                 "# modules/dns/aws/main.tf",
+		"modules/dns/aws/examples/simple/main.tf": "# modules/dns/aws/examples/simple/main.tf",
+	})
+
+	results := e.POST("/v1/bulk/namespace1").WithQuery("version", "1.0.0").WithBytes(monorepo).
+		Expect().Status(http.StatusCreated).JSON().Object().Value("modules").Array()
+	results.Length().Equal(2)
+	results.Element(0).Object().ValueEqual("name", "dns").ValueEqual("status", models.BulkPublished)
+	results.Element(1).Object().ValueEqual("name", "vpc").ValueEqual("status", models.BulkPublished)
+
+	data := e.GET("/v1/modules/namespace1/vpc/aws/1.0.0/data.tgz").Expect().Status(http.StatusOK).Body().Raw()
+	if files := archiveFiles(t, data); strings.Join(files, ",") != "main.tf,variables.tf" {
+		t.Errorf("unexpected files in the vpc archive: %v", files)
+	}
+
+	manifest := `{"version": "1.1.0", "modules": [
+		{"path": "modules/vpc/aws", "name": "vpc", "provider": "aws", "description": "A VPC"},
+		{"path": "modules/dns/aws", "name": "route53", "provider": "aws", "version": "0.1.0"}
+	]}`
+	e.POST("/v1/bulk/namespace1").WithMultipart().
+		WithFileBytes("archive", "monorepo.tgz", monorepo).
+		WithFormField("manifest", manifest).
+		Expect().Status(http.StatusCreated)
+
+	e.GET("/v1/modules/namespace1/vpc/aws/1.1.0").Expect().Status(http.StatusOK).JSON().Object().ValueEqual("description", "A VPC")
+	e.GET("/v1/modules/namespace1/route53/aws/0.1.0").Expect().Status(http.StatusOK)
+
+	// nothing is published when one of the modules is rejected
+	results = e.POST("/v1/bulk/namespace1").WithMultipart().
+		WithFileBytes("archive", "monorepo.tgz", monorepo).
+		WithFormField("manifest", `{"modules": [
+			{"path": "modules/dns/aws", "name": "dns", "provider": "aws", "version": "2.0.0"},
+			{"path": "modules/vpc/aws", "name": "vpc", "provider": "aws", "version": "1.1.0"},
+			{"path": "modules/missing/aws", "name": "missing", "provider": "aws", "version": "1.0.0"}
+		]}`).
+		Expect().Status(http.StatusBadRequest).JSON().Object().Value("modules").Array()
+	results.Element(0).Object().ValueEqual("status", models.BulkSkipped)
+	results.Element(1).Object().ValueEqual("status", models.BulkFailed).Value("errors").Array().Contains("module version already exists")
+	results.Element(2).Object().ValueEqual("status", models.BulkFailed).Value("errors").Array().Contains("modules/missing/aws does not contain any files")
+
+	e.GET("/v1/modules/namespace1/dns/aws/2.0.0").Expect().Status(http.StatusNotFound)
+
+	e.POST("/v1/bulk/namespace1").WithBytes(monorepo).
+		Expect().Status(http.StatusBadRequest).JSON().Object().Value("modules").Array().First().Object().
+		Value("errors").Array().First().String().Contains("not a valid semantic version")
+	e.POST("/v1/bulk/namespace1").WithQuery("version", "3.0.0").WithBytes(moduleArchive(map[string]string{"main.tf": "# main.tf"})).
+		Expect().Status(http.StatusBadRequest).JSON().Object().Value("errors").Array().First().String().Contains("no modules found")
+}
+
+func TestBulkPublishRollback(t *testing.T) {
+	modules := services.NewModuleService(&failingRegistry{registry.NewFakeRegistry(), "vpc"})
+	server := newServer(serveModules(modules), serveBulk(modules))
+	defer server.Close()
+	e := httpexpect.New(t, server.URL)
+
+	monorepo := moduleArchive(map[string]string{
+		"modules/dns/aws/main.tf":  "# modules/dns/aws/main.tf",
+		"modules/vpc/aws/main.tf":  "# modules/vpc/aws/main.tf",
+		"modules/zone/aws/main.tf": "# modules/zone/aws/main.tf",
+	})
+
+	results := e.POST("/v1/bulk/namespace1").WithQuery("version", "1.0.0").WithBytes(monorepo).
+		Expect().Status(http.StatusBadRequest).JSON().Object().Value("modules").Array()
+	results.Element(0).Object().ValueEqual("status", models.BulkRolledBack)
+	results.Element(1).Object().ValueEqual("status", models.BulkFailed).Value("errors").Array().Contains("storage unavailable")
+	results.Element(2).Object().ValueEqual("status", models.BulkSkipped)
+
+	e.GET("/v1/modules/namespace1/dns/aws/1.0.0").Expect().Status(http.StatusNotFound)
+}
@@ -0,0 +1,150 @@
+package v1_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/erikvanbrakel/anthology/app"
+	"github.com/erikvanbrakel/anthology/services"
+	"github.com/gavv/httpexpect"
+	"github.com/go-ozzo/ozzo-routing"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// newCertificate issues a certificate, self-signed when no parent is given.
+func newCertificate(t *testing.T, template *x509.Certificate, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	signer, signerKey := template, interface{}(key)
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func newClientCertificateServer(t *testing.T, ca tls.Certificate, mode, field string) *httptest.Server {
+	f, err := ioutil.TempFile("", "ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate[0]})
+	f.Close()
+	defer os.Remove(f.Name())
+
+	config, err := app.SSLOptions{ClientCA: f.Name(), ClientAuth: mode}.TLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := newRouter()
+	router.Use(app.Authenticate(services.NewCertificateAuthenticator(field)))
+	router.Get("/whoami", func(c *routing.Context) error {
+		if p := app.GetRequestScope(c).Principal(); p != nil {
+			return c.Write(p)
+		}
+		return c.Write(nil)
+	})
+
+	server := httptest.NewUnstartedServer(router)
+	server.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	server.TLS = config
+	server.StartTLS()
+
+	return server
+}
+
+// newClient returns a client that trusts the server and presents the given
+// certificates.
+func newClient(server *httptest.Server, certs ...tls.Certificate) *http.Client {
+	transport := server.Client().Transport.(*http.Transport).Clone()
+	transport.TLSClientConfig.Certificates = certs
+
+	return &http.Client{Transport: transport}
+}
+
+func clientExpect(t *testing.T, server *httptest.Server, certs ...tls.Certificate) *httpexpect.Expect {
+	return httpexpect.WithConfig(httpexpect.Config{
+		BaseURL:  server.URL,
+		Client:   newClient(server, certs...),
+		Reporter: httpexpect.NewAssertReporter(t),
+	})
+}
+
+func TestClientCertificates(t *testing.T) {
+	ca := newCertificate(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+
+	client := newCertificate(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "deployer", OrganizationalUnit: []string{"platform"}},
+		DNSNames:    []string{"deployer.example.com"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, &ca)
+
+	untrusted := newCertificate(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "intruder"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, nil)
+
+	server := newClientCertificateServer(t, ca, "verify-if-given", "subject")
+	defer server.Close()
+
+	principal := clientExpect(t, server, client).GET("/whoami").Expect().Status(http.StatusOK).JSON().Object()
+	principal.ValueEqual("type", "certificate")
+	principal.ValueEqual("name", "deployer")
+	principal.ValueEqual("groups", []string{"platform"})
+
+	clientExpect(t, server).GET("/whoami").Expect().Status(http.StatusOK).JSON().Null()
+
+	// certificates of other CAs are not accepted by the server, so they are not sent
+	clientExpect(t, server, untrusted).GET("/whoami").Expect().Status(http.StatusOK).JSON().Null()
+
+	dns := newClientCertificateServer(t, ca, "require", "dns")
+	defer dns.Close()
+
+	clientExpect(t, dns, client).GET("/whoami").Expect().Status(http.StatusOK).
+		JSON().Object().ValueEqual("name", "deployer.example.com")
+
+	if _, err := newClient(dns).Get(dns.URL + "/whoami"); err == nil {
+		t.Error("expected requests without a client certificate to be rejected")
+	}
+}
+
+func TestClientCertificateConfiguration(t *testing.T) {
+	if _, err := (app.SSLOptions{ClientAuth: "require"}).TLSConfig(); err == nil {
+		t.Error("expected an error without a CA bundle")
+	}
+
+	config, err := app.SSLOptions{ClientAuth: "none"}.TLSConfig()
+	if err != nil || config.ClientAuth != tls.NoClientCert {
+		t.Errorf("expected client certificates to be ignored, got %v, %v", config, err)
+	}
+}
@@ -0,0 +1,111 @@
+package v1_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"github.com/erikvanbrakel/anthology/registry"
+	"github.com/erikvanbrakel/anthology/services"
+	"github.com/gavv/httpexpect"
+	"net/http"
+	"os"
+	"testing"
+)
+
+func TestCopyModule(t *testing.T) {
+	path := writeTokens(t, "alice:"+tokenHash("alice-token"), "bob:"+tokenHash("bob-token"))
+	defer os.Remove(path)
+
+	modules := services.NewModuleService(registry.NewFakeRegistry())
+	modules.Policy = &services.Policy{Grants: []services.Grant{
+		{Subjects: []string{"*"}, Namespaces: []string{"dev-infra", "prod-infra"}, Role: services.RoleReader},
+		{Subjects: []string{"token:alice"}, Namespaces: []string{"dev-infra"}, Role: services.RolePublisher},
+		{Subjects: []string{"token:bob"}, Namespaces: []string{"dev-infra", "prod-infra"}, Role: services.RolePublisher},
+	}}
+
+	server := newServer(authenticate(t, path), serveModules(modules))
+	defer server.Close()
+	e := httpexpect.New(t, server.URL)
+
+	alice := func(r *httpexpect.Request) *httpexpect.Request {
+		return r.WithHeader("Authorization", "Bearer alice-token")
+	}
+	bob := func(r *httpexpect.Request) *httpexpect.Request {
+		return r.WithHeader("Authorization", "Bearer bob-token")
+	}
+	archive := moduleArchive(map[string]string{
+		"main.tf":   "# main.tf",
+		"README.md": "# README.md",
+	})
+	checksum := fmt.Sprintf("sha256:%x", sha256.Sum256(archive))
+
+	alice(e.POST("/v1/modules/dev-infra/vpc/aws/1.0.0")).WithMultipart().
+		WithFileBytes("archive", "module.tgz", archive).
+		WithFormField("description", "VPC").
+		Expect().Status(http.StatusNoContent)
+
+	alice(e.POST("/v1/modules/dev-infra/vpc/aws/1.0.0/copy")).WithJSON(map[string]string{"namespace": "prod-infra"}).
+		Expect().Status(http.StatusForbidden)
+	bob(e.POST("/v1/modules/dev-infra/vpc/aws/1.0.0/copy")).WithJSON(map[string]string{}).
+		Expect().Status(http.StatusBadRequest)
+	bob(e.POST("/v1/modules/dev-infra/vpc/aws/2.0.0/copy")).WithJSON(map[string]string{"namespace": "prod-infra"}).
+		Expect().Status(http.StatusNotFound)
+
+	copied := bob(e.POST("/v1/modules/dev-infra/vpc/aws/1.0.0/copy")).WithJSON(map[string]string{"namespace": "prod-infra"}).
+		Expect().Status(http.StatusCreated).JSON().Object()
+	copied.ValueEqual("namespace", "prod-infra").ValueEqual("version", "1.0.0").ValueEqual("description", "VPC")
+	copied.Value("provenance").Object().ValueEqual("namespace", "dev-infra").ValueEqual("checksum", checksum).
+		ValueEqual("copied_by", "token:bob")
+
+	// copies are immutable like any other version
+	bob(e.POST("/v1/modules/dev-infra/vpc/aws/1.0.0/copy")).WithJSON(map[string]string{"namespace": "prod-infra"}).
+		Expect().Status(http.StatusConflict)
+	bob(e.POST("/v1/modules/dev-infra/vpc/aws/1.0.0/copy")).WithJSON(map[string]string{"namespace": "dev-infra"}).
+		Expect().Status(http.StatusBadRequest)
+
+	e.GET("/v1/modules/prod-infra/vpc/aws/1.0.0").Expect().Status(http.StatusOK).JSON().Object().
+		Value("provenance").Object().ValueEqual("version", "1.0.0").ValueEqual("checksum", checksum)
+	e.GET("/v1/modules/prod-infra/vpc/aws/1.0.0/data.tgz").Expect().Status(http.StatusOK).Body().Equal(string(archive))
+	e.GET("/v1/modules/dev-infra/vpc/aws/1.0.0").Expect().Status(http.StatusOK).JSON().Object().
+		ValueEqual("checksum", checksum).NotContainsKey("provenance")
+}
+
+// copyingRegistry copies archives itself, like a backend with a native copy,
+// and counts the archives read through it.
+type copyingRegistry struct {
+	registry.Registry
+	reads int
+}
+
+func (r *copyingRegistry) GetModuleData(namespace, name, provider, version string) (*bytes.Buffer, error) {
+	r.reads++
+	return r.Registry.GetModuleData(namespace, name, provider, version)
+}
+
+func (r *copyingRegistry) CopyModule(namespace, name, provider, version, target string) error {
+	data, err := r.Registry.GetModuleData(namespace, name, provider, version)
+	if err != nil {
+		return err
+	}
+	return r.Registry.PublishModule(target, name, provider, version, data)
+}
+
+func TestCopyModuleWithoutReadingTheArchive(t *testing.T) {
+	r := &copyingRegistry{Registry: registry.NewFakeRegistry()}
+
+	server := newServer(serveModules(services.NewModuleService(r)))
+	defer server.Close()
+	e := httpexpect.New(t, server.URL)
+
+	archive := moduleArchive(map[string]string{"main.tf": "# main.tf"})
+	checksum := fmt.Sprintf("sha256:%x", sha256.Sum256(archive))
+
+	e.POST("/v1/modules/dev-infra/vpc/aws/1.0.0").WithBytes(archive).Expect().Status(http.StatusNoContent)
+	e.POST("/v1/modules/dev-infra/vpc/aws/1.0.0/copy").WithJSON(map[string]string{"namespace": "prod-infra"}).
+		Expect().Status(http.StatusCreated).JSON().Path("$.provenance.checksum").Equal(checksum)
+
+	if r.reads != 0 {
+		t.Errorf("expected the recorded checksum to be used, but the archive was read %d times", r.reads)
+	}
+	e.GET("/v1/modules/prod-infra/vpc/aws/1.0.0/data.tgz").Expect().Status(http.StatusOK).Body().Equal(string(archive))
+}
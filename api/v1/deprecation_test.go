@@ -0,0 +1,118 @@
+package v1_test
+
+import (
+	"bytes"
+	"github.com/erikvanbrakel/anthology/app"
+	"github.com/erikvanbrakel/anthology/registry"
+	"github.com/erikvanbrakel/anthology/services"
+	"github.com/gavv/httpexpect"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeprecateVersion(t *testing.T) {
+	path := writeTokens(t, "alice:"+tokenHash("alice-token"))
+	defer os.Remove(path)
+
+	backend := registry.NewFakeRegistry()
+	backend.PublishModule("team-a", "module1", "aws", "1.0.0", bytes.NewReader(moduleArchive(map[string]string{"main.tf": "# main.tf"})))
+	backend.PublishModule("team-a", "module1", "aws", "1.1.0", bytes.NewReader(moduleArchive(map[string]string{"main.tf": "# main.tf"})))
+
+	// listings are shared between requests by the cache
+	r, err := registry.NewCachingRegistry(backend, app.CacheOptions{ListingTTL: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer receiver.Close()
+
+	webhooks, err := services.NewWebhookService(backend, []services.WebhookSubscription{
+		{ID: "deprecations", URL: receiver.URL, Secret: "secret"},
+	}, 1, time.Millisecond, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer webhooks.Close()
+
+	modules := services.NewModuleService(r)
+	modules.Webhooks = webhooks
+	modules.Policy = &services.Policy{Grants: []services.Grant{
+		{Subjects: []string{"*"}, Namespaces: []string{"team-a"}, Role: services.RoleReader},
+		{Subjects: []string{"token:alice"}, Namespaces: []string{"team-a"}, Role: services.RolePublisher},
+	}}
+
+	server := newServer(authenticate(t, path), serveModules(modules))
+	defer server.Close()
+	e := newExpect(t, server)
+
+	alice := func(r *httpexpect.Request) *httpexpect.Request {
+		return r.WithHeader("Authorization", "Bearer alice-token")
+	}
+	deprecation := map[string]string{"message": "Leaks security group rules", "link": "https://example.com/advisories/12"}
+
+	e.PUT("/v1/modules/team-a/module1/aws/1.1.0/deprecation").WithJSON(deprecation).Expect().Status(http.StatusUnauthorized)
+	alice(e.PUT("/v1/modules/team-a/module1/aws/1.1.0/deprecation")).WithJSON(map[string]string{}).
+		Expect().Status(http.StatusBadRequest)
+	alice(e.PUT("/v1/modules/team-a/module1/aws/1.1.0/deprecation")).WithJSON(map[string]string{"message": "Broken", "link": "advisories/12"}).
+		Expect().Status(http.StatusBadRequest)
+	alice(e.PUT("/v1/modules/team-a/module1/aws/2.0.0/deprecation")).WithJSON(deprecation).Expect().Status(http.StatusNotFound)
+
+	alice(e.PUT("/v1/modules/team-a/module1/aws/1.1.0/deprecation")).WithJSON(deprecation).
+		Expect().Status(http.StatusOK).JSON().Object().Value("deprecation").Object().
+		ValueEqual("message", "Leaks security group rules").ValueEqual("deprecated_by", "token:alice")
+
+	versions := e.GET("/v1/modules/team-a/module1/aws/versions").Expect().Status(http.StatusOK).
+		JSON().Path("$.modules[0].versions").Array()
+	for _, v := range versions.Iter() {
+		if v.Object().Value("version").String().Raw() == "1.1.0" {
+			v.Object().Value("deprecation").Object().ValueEqual("link", "https://example.com/advisories/12")
+		} else {
+			v.Object().NotContainsKey("deprecation")
+		}
+	}
+	cached, _, _ := r.ListModules("team-a", "module1", "aws", 0, 10000)
+	for _, m := range cached {
+		if m.Deprecation != nil {
+			t.Errorf("listing the versions changed the cached listing of %s", m.Version)
+		}
+	}
+	e.GET("/v1/modules/team-a/module1/aws/1.1.0").Expect().Status(http.StatusOK).JSON().Object().ContainsKey("deprecation")
+
+	// the latest version skips deprecated versions
+	e.GET("/v1/modules/team-a/module1/aws").Expect().Status(http.StatusOK).JSON().Object().ValueEqual("version", "1.0.0")
+	e.GET("/v1/modules/team-a/module1/aws/download").Expect().Status(http.StatusFound).
+		Header("Location").Equal("/v1/modules/team-a/module1/aws/1.0.0/download")
+
+	download := e.GET("/v1/modules/team-a/module1/aws/1.1.0/download").Expect().Status(http.StatusNoContent)
+	download.Header("Warning").Equal(`299 - "team-a/module1/aws 1.1.0 is deprecated: Leaks security group rules (https://example.com/advisories/12)"`)
+	e.GET("/v1/modules/team-a/module1/aws/1.0.0/download").Expect().Status(http.StatusNoContent).Header("Warning").Empty()
+
+	// unless there is no alternative
+	alice(e.PUT("/v1/modules/team-a/module1/aws/1.0.0/deprecation")).WithJSON(deprecation).Expect().Status(http.StatusOK)
+	e.GET("/v1/modules/team-a/module1/aws").Expect().Status(http.StatusOK).JSON().Object().ValueEqual("version", "1.1.0")
+	e.GET("/v1/modules/team-a/module1/aws/download").Expect().Status(http.StatusFound).
+		Header("Location").Equal("/v1/modules/team-a/module1/aws/1.1.0/download")
+
+	alice(e.DELETE("/v1/modules/team-a/module1/aws/1.1.0/deprecation")).Expect().Status(http.StatusNoContent)
+	alice(e.DELETE("/v1/modules/team-a/module1/aws/1.1.0/deprecation")).Expect().Status(http.StatusNotFound)
+	e.GET("/v1/modules/team-a/module1/aws/1.1.0").Expect().Status(http.StatusOK).JSON().Object().NotContainsKey("deprecation")
+	e.GET("/v1/modules/team-a/module1/aws/1.1.0/download").Expect().Status(http.StatusNoContent).Header("Warning").Empty()
+
+	waitForDeliveries(t, webhooks)
+	deliveries, _, err := webhooks.Deliveries(nil, "", "", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []string
+	for _, d := range deliveries {
+		events = append(events, d.Event.Type+" "+d.Event.Version)
+	}
+	if strings.Join(events, ",") != "module.deprecated 1.1.0,module.deprecated 1.0.0,module.undeprecated 1.1.0" {
+		t.Errorf("unexpected events %v", events)
+	}
+}
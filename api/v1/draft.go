@@ -0,0 +1,144 @@
+package v1
+
+import (
+	"github.com/erikvanbrakel/anthology/app"
+	"github.com/erikvanbrakel/anthology/models"
+	"github.com/go-ozzo/ozzo-routing"
+	"io"
+	"net/http"
+)
+
+type (
+	draftService interface {
+		Create(rs app.RequestScope, namespace, name, provider, version string, data io.Reader, metadata *models.ModuleMetadata) (*models.Draft, error)
+		Query(rs app.RequestScope, namespace, name, provider string) ([]models.Draft, error)
+		Get(rs app.RequestScope, namespace, name, provider, version string) (*models.Draft, error)
+		GetData(rs app.RequestScope, namespace, name, provider, version string) (io.ReadCloser, error)
+		Promote(rs app.RequestScope, namespace, name, provider, version string) (*models.Module, error)
+		Discard(rs app.RequestScope, namespace, name, provider, version string) error
+	}
+
+	draftResource struct {
+		service draftService
+	}
+)
+
+func ServeDraftResource(rg *routing.RouteGroup, service draftService) {
+	r := &draftResource{service}
+
+	// List the drafts of a namespace or of a single module
+	rg.Get("/<namespace>", r.query)
+	rg.Get("/<namespace>/<name>/<provider>", r.query)
+
+	// Store a draft, either as a raw archive or as a form with metadata
+	rg.Post("/<namespace>/<name>/<provider>/<version>", r.create)
+
+	// Get a specific draft
+	rg.Get("/<namespace>/<name>/<provider>/<version>", r.get)
+
+	// Download the archive of a draft
+	rg.Get("/<namespace>/<name>/<provider>/<version>/download", r.getDownloadUrl)
+	rg.Get("/<namespace>/<name>/<provider>/<version>/data.tgz", r.getData).Name("GetDraftData")
+
+	// Release a draft
+	rg.Post("/<namespace>/<name>/<provider>/<version>/promote", r.promote)
+
+	// Throw a draft away
+	rg.Delete("/<namespace>/<name>/<provider>/<version>", r.discard)
+}
+
+func (r *draftResource) query(c *routing.Context) error {
+	rs := app.GetRequestScope(c)
+
+	drafts, err := r.service.Query(rs, c.Param("namespace"), c.Param("name"), c.Param("provider"))
+	if err != nil {
+		return writeServiceError(c, err)
+	}
+
+	return c.Write(struct {
+		Drafts []models.Draft `json:"drafts"`
+	}{drafts})
+}
+
+func (r *draftResource) create(c *routing.Context) error {
+	rs := app.GetRequestScope(c)
+
+	data, metadata, problem := readPublish(c)
+	if problem != "" {
+		c.Response.WriteHeader(http.StatusBadRequest)
+		return c.Write(apiError{[]string{problem}})
+	}
+	defer data.Close()
+
+	draft, err := r.service.Create(rs, c.Param("namespace"), c.Param("name"), c.Param("provider"), c.Param("version"), data, metadata)
+	if err != nil {
+		return writeServiceError(c, err)
+	}
+
+	c.Response.WriteHeader(http.StatusCreated)
+	return c.Write(draft)
+}
+
+func (r *draftResource) get(c *routing.Context) error {
+	rs := app.GetRequestScope(c)
+
+	draft, err := r.service.Get(rs, c.Param("namespace"), c.Param("name"), c.Param("provider"), c.Param("version"))
+	if err != nil {
+		return writeServiceError(c, err)
+	}
+
+	return c.Write(draft)
+}
+
+func (r *draftResource) getDownloadUrl(c *routing.Context) error {
+	rs := app.GetRequestScope(c)
+	namespace, name, provider, version := c.Param("namespace"), c.Param("name"), c.Param("provider"), c.Param("version")
+
+	if _, err := r.service.Get(rs, namespace, name, provider, version); err != nil {
+		return writeServiceError(c, err)
+	}
+
+	c.Response.Header().Set("X-Terraform-Get", c.URL("GetDraftData",
+		"namespace", namespace,
+		"name", name,
+		"provider", provider,
+		"version", version,
+	))
+	c.Response.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (r *draftResource) getData(c *routing.Context) error {
+	rs := app.GetRequestScope(c)
+
+	data, err := r.service.GetData(rs, c.Param("namespace"), c.Param("name"), c.Param("provider"), c.Param("version"))
+	if err != nil {
+		return writeServiceError(c, err)
+	}
+	defer data.Close()
+
+	_, err = io.Copy(c.Response, data)
+	return err
+}
+
+func (r *draftResource) promote(c *routing.Context) error {
+	rs := app.GetRequestScope(c)
+
+	module, err := r.service.Promote(rs, c.Param("namespace"), c.Param("name"), c.Param("provider"), c.Param("version"))
+	if err != nil {
+		return writeServiceError(c, err)
+	}
+
+	return c.Write(module)
+}
+
+func (r *draftResource) discard(c *routing.Context) error {
+	rs := app.GetRequestScope(c)
+
+	if err := r.service.Discard(rs, c.Param("namespace"), c.Param("name"), c.Param("provider"), c.Param("version")); err != nil {
+		return writeServiceError(c, err)
+	}
+
+	c.Response.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,83 @@
+package v1_test
+
+import (
+	"bytes"
+	"github.com/erikvanbrakel/anthology/api/v1"
+	"github.com/erikvanbrakel/anthology/registry"
+	"github.com/erikvanbrakel/anthology/services"
+	"github.com/gavv/httpexpect"
+	"github.com/go-ozzo/ozzo-routing"
+	"net/http"
+	"os"
+	"testing"
+)
+
+func TestDrafts(t *testing.T) {
+	path := writeTokens(t, "alice:"+tokenHash("alice-token"))
+	defer os.Remove(path)
+
+	r := registry.NewFakeRegistry()
+	r.PublishModule("team-a", "module1", "aws", "1.0.0", bytes.NewReader(moduleArchive(map[string]string{"main.tf": "# main.tf"})))
+
+	modules := services.NewModuleService(r)
+	modules.Policy = &services.Policy{Grants: []services.Grant{
+		{Subjects: []string{"*"}, Namespaces: []string{"team-a"}, Role: services.RoleReader},
+		{Subjects: []string{"token:alice"}, Namespaces: []string{"team-a"}, Role: services.RolePublisher},
+	}}
+
+	server := newServer(authenticate(t, path), serveModules(modules), func(router *routing.Router) {
+		v1.ServeDraftResource(router.Group("/v1/drafts"), services.NewDraftService(modules))
+	})
+	defer server.Close()
+	e := httpexpect.New(t, server.URL)
+
+	alice := func(r *httpexpect.Request) *httpexpect.Request {
+		return r.WithHeader("Authorization", "Bearer alice-token")
+	}
+	archive := moduleArchive(map[string]string{
+		"main.tf":   "# main.tf",
+		"README.md": "# README.md",
+	})
+
+	alice(e.POST("/v1/drafts/team-a/module1/aws/2.0.0")).WithMultipart().
+		WithFileBytes("archive", "module.tgz", archive).
+		WithFormField("description", "Next major").
+		Expect().Status(http.StatusCreated).JSON().Object().
+		ValueEqual("version", "2.0.0").ValueEqual("created_by", "token:alice").ValueEqual("description", "Next major")
+	alice(e.POST("/v1/drafts/team-a/module1/aws/1.1.0")).WithBytes(archive).
+		Expect().Status(http.StatusCreated)
+
+	alice(e.POST("/v1/drafts/team-a/module1/aws/2.0.0")).WithBytes(archive).Expect().Status(http.StatusConflict)
+	alice(e.POST("/v1/drafts/team-a/module1/aws/1.0.0")).WithBytes(archive).Expect().Status(http.StatusConflict)
+	alice(e.POST("/v1/drafts/team-a/module1/aws/3.0.0")).WithBytes([]byte("not an archive")).Expect().Status(http.StatusBadRequest)
+	e.POST("/v1/drafts/team-a/module1/aws/3.0.0").WithBytes(archive).Expect().Status(http.StatusUnauthorized)
+
+	// drafts are invisible to consumers
+	e.GET("/v1/modules/team-a/module1/aws/versions").Expect().Status(http.StatusOK).
+		JSON().Path("$.modules[0].versions").Array().Length().Equal(1)
+	e.GET("/v1/modules/team-a/module1/aws").Expect().Status(http.StatusOK).JSON().Object().ValueEqual("version", "1.0.0")
+	e.GET("/v1/modules/team-a/module1/aws/2.0.0").Expect().Status(http.StatusNotFound)
+	e.GET("/v1/modules/team-a").Expect().Status(http.StatusOK).JSON().Object().Value("modules").Array().Length().Equal(1)
+	e.GET("/v1/drafts/team-a").Expect().Status(http.StatusUnauthorized)
+	e.GET("/v1/drafts/team-a/module1/aws/2.0.0/data.tgz").Expect().Status(http.StatusUnauthorized)
+
+	// but available to publishers
+	alice(e.GET("/v1/drafts/team-a")).Expect().Status(http.StatusOK).JSON().Object().Value("drafts").Array().Length().Equal(2)
+	alice(e.GET("/v1/drafts/team-a/module1/aws")).Expect().Status(http.StatusOK).JSON().Object().Value("drafts").Array().Length().Equal(2)
+	download := alice(e.GET("/v1/drafts/team-a/module1/aws/2.0.0/download")).Expect().Status(http.StatusNoContent).
+		Header("X-Terraform-Get").Equal("/v1/drafts/team-a/module1/aws/2.0.0/data.tgz")
+	alice(e.GET(download.Raw())).Expect().Status(http.StatusOK).Body().Equal(string(archive))
+
+	alice(e.POST("/v1/drafts/team-a/module1/aws/2.0.0/promote")).Expect().Status(http.StatusOK).JSON().Object().
+		ValueEqual("version", "2.0.0").ValueEqual("description", "Next major")
+	alice(e.DELETE("/v1/drafts/team-a/module1/aws/1.1.0")).Expect().Status(http.StatusNoContent)
+
+	alice(e.GET("/v1/drafts/team-a")).Expect().Status(http.StatusOK).JSON().Object().Value("drafts").Array().Empty()
+	alice(e.POST("/v1/drafts/team-a/module1/aws/2.0.0/promote")).Expect().Status(http.StatusNotFound)
+	alice(e.DELETE("/v1/drafts/team-a/module1/aws/1.1.0")).Expect().Status(http.StatusNotFound)
+
+	e.GET("/v1/modules/team-a/module1/aws/versions").Expect().Status(http.StatusOK).
+		JSON().Path("$.modules[0].versions").Array().Length().Equal(2)
+	e.GET("/v1/modules/team-a/module1/aws/1.1.0").Expect().Status(http.StatusNotFound)
+	e.GET("/v1/modules/team-a/module1/aws/2.0.0/data.tgz").Expect().Status(http.StatusOK).Body().Equal(string(archive))
+}
@@ -0,0 +1,36 @@
+package v1
+
+import (
+	"github.com/erikvanbrakel/anthology/app"
+	"github.com/erikvanbrakel/anthology/services"
+	"github.com/go-ozzo/ozzo-routing"
+	"net/http"
+)
+
+// writeServiceError renders the well-known service errors as API errors and
+// passes anything else on to the error handler.
+func writeServiceError(c *routing.Context, err error) error {
+	if validationErr, ok := err.(*services.ValidationError); ok {
+		c.Response.WriteHeader(http.StatusBadRequest)
+		return c.Write(apiError{validationErr.Errors})
+	}
+
+	switch err {
+	case services.ErrNotFound:
+		c.Response.WriteHeader(http.StatusNotFound)
+		return c.Write(apiError{[]string{"not found"}})
+	case services.ErrForbidden:
+		if app.GetRequestScope(c).Principal() == nil {
+			c.Response.Header().Set("WWW-Authenticate", `Bearer realm="anthology"`)
+			c.Response.WriteHeader(http.StatusUnauthorized)
+			return c.Write(apiError{[]string{"authentication required"}})
+		}
+		c.Response.WriteHeader(http.StatusForbidden)
+		return c.Write(apiError{[]string{err.Error()}})
+	case services.ErrConflict, services.ErrOffsetMismatch:
+		c.Response.WriteHeader(http.StatusConflict)
+		return c.Write(apiError{[]string{err.Error()}})
+	}
+
+	return err
+}
@@ -0,0 +1,43 @@
+package v1
+
+import (
+	"github.com/erikvanbrakel/anthology/app"
+	"github.com/erikvanbrakel/anthology/models"
+	"github.com/go-ozzo/ozzo-routing"
+	"net/http"
+)
+
+type (
+	gitService interface {
+		Publish(rs app.RequestScope, namespace, name, provider string, source models.GitSource) (*models.GitRelease, error)
+	}
+
+	gitResource struct {
+		service gitService
+	}
+)
+
+func ServeGitResource(rg *routing.RouteGroup, service gitService) {
+	r := &gitResource{service}
+
+	// Publish the module at a tag of a git repository
+	rg.Post("/<namespace>/<name>/<provider>", r.publish)
+}
+
+func (r *gitResource) publish(c *routing.Context) error {
+	rs := app.GetRequestScope(c)
+
+	var source models.GitSource
+	if err := c.Read(&source); err != nil || source.Repository == "" || source.Tag == "" {
+		c.Response.WriteHeader(http.StatusBadRequest)
+		return c.Write(apiError{[]string{"repository and tag are required"}})
+	}
+
+	release, err := r.service.Publish(rs, c.Param("namespace"), c.Param("name"), c.Param("provider"), source)
+	if err != nil {
+		return writeServiceError(c, err)
+	}
+
+	c.Response.WriteHeader(http.StatusCreated)
+	return c.Write(release)
+}
@@ -0,0 +1,139 @@
+package v1_test
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"github.com/erikvanbrakel/anthology/api/v1"
+	"github.com/erikvanbrakel/anthology/registry"
+	"github.com/erikvanbrakel/anthology/services"
+	"github.com/gavv/httpexpect"
+	"github.com/go-ozzo/ozzo-routing"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGitPublish(t *testing.T) {
+	repo, git := newRepo(t)
+	defer os.RemoveAll(repo)
+
+	os.MkdirAll(filepath.Join(repo, "modules", "vpc"), 0755)
+	ioutil.WriteFile(filepath.Join(repo, "main.tf"), []byte("# root"), 0644)
+	ioutil.WriteFile(filepath.Join(repo, "modules", "vpc", "main.tf"), []byte("# vpc"), 0644)
+
+	git("init", "--quiet")
+	git("add", ".")
+	git("commit", "--quiet", "-m", "initial")
+	git("tag", "v1.0.0")
+	git("tag", "-a", "-m", "vpc", "modules/vpc/v2.1.0")
+	git("tag", "latest")
+
+	cache, err := ioutil.TempDir("", "git-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cache)
+
+	modules := services.NewModuleService(registry.NewFakeRegistry())
+	service, err := services.NewGitService(modules, cache, time.Minute, []string{"file"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := newServer(serveModules(modules), func(router *routing.Router) {
+		v1.ServeGitResource(router.Group("/v1/git"), service)
+	})
+	defer server.Close()
+	e := httpexpect.New(t, server.URL)
+
+	remote := "file://" + filepath.ToSlash(repo)
+
+	release := e.POST("/v1/git/namespace1/root/aws").
+		WithJSON(map[string]string{"repository": remote, "tag": "v1.0.0"}).
+		Expect().Status(http.StatusCreated).JSON().Object()
+	release.ValueEqual("version", "1.0.0")
+	release.Value("commit").String().Length().Equal(40)
+
+	e.POST("/v1/git/namespace1/vpc/aws").
+		WithJSON(map[string]string{"repository": remote, "tag": "modules/vpc/v2.1.0", "path": "modules/vpc"}).
+		Expect().Status(http.StatusCreated).JSON().Object().ValueEqual("version", "2.1.0")
+
+	data := e.GET("/v1/modules/namespace1/vpc/aws/2.1.0/data.tgz").Expect().Status(http.StatusOK).Body().Raw()
+	if files := archiveFiles(t, data); strings.Join(files, ",") != "main.tf" {
+		t.Errorf("expected only main.tf in the archive, got %v", files)
+	}
+
+	e.POST("/v1/git/namespace1/root/aws").
+		WithJSON(map[string]string{"repository": remote, "tag": "v1.0.0"}).
+		Expect().Status(http.StatusConflict)
+
+	e.POST("/v1/git/namespace1/root/aws").
+		WithJSON(map[string]string{"repository": remote, "tag": "latest"}).
+		Expect().Status(http.StatusBadRequest)
+
+	e.POST("/v1/git/namespace1/root/aws").
+		WithJSON(map[string]string{"repository": remote, "tag": "v9.0.0"}).
+		Expect().Status(http.StatusBadRequest).JSON().Object().Value("errors").Array().First().String().Contains("unable to fetch")
+
+	e.POST("/v1/git/namespace1/root/aws").
+		WithJSON(map[string]string{"repository": "https://example.com/repo.git", "tag": "v1.0.0"}).
+		Expect().Status(http.StatusBadRequest).JSON().Object().Value("errors").Array().First().String().Contains("not allowed")
+
+	e.POST("/v1/git/namespace1/root/aws").
+		WithJSON(map[string]string{"repository": "ext::sh -c touch% /tmp/pwned", "tag": "v1.0.0"}).
+		Expect().Status(http.StatusBadRequest)
+
+	service.Remotes = []string{"https://github.com/example/"}
+	e.POST("/v1/git/namespace1/other/aws").
+		WithJSON(map[string]string{"repository": remote, "tag": "v1.0.0"}).
+		Expect().Status(http.StatusBadRequest).JSON().Object().Value("errors").Array().First().String().Contains("allowed remotes")
+}
+
+// newRepo creates an empty git repository and returns a function running git
+// in it.
+func newRepo(t *testing.T) (string, func(args ...string)) {
+	repo, err := ioutil.TempDir("", "repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return repo, func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		cmd.Dir = repo
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %s: %s", args[0], out)
+		}
+	}
+}
+
+func archiveFiles(t *testing.T, data string) []string {
+	gz, err := gzip.NewReader(strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var files []string
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header.Typeflag == tar.TypeReg {
+			files = append(files, header.Name)
+		}
+	}
+
+	sort.Strings(files)
+	return files
+}
@@ -0,0 +1,79 @@
+package v1
+
+import (
+	"github.com/erikvanbrakel/anthology/app"
+	"github.com/erikvanbrakel/anthology/models"
+	"github.com/go-ozzo/ozzo-routing"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// maxHookPayload is the largest payload git hosts send, GitHub caps theirs at
+// 25MB.
+const maxHookPayload = 25 << 20
+
+type (
+	hookService interface {
+		Receive(rs app.RequestScope, source string, header http.Header, body []byte) ([]models.HookEvent, error)
+		Events(rs app.RequestScope, repository, status string) ([]models.HookEvent, error)
+	}
+
+	hookResource struct {
+		service hookService
+	}
+)
+
+// ServeHookReceiver serves the endpoints git hosts send push webhooks to. They
+// authenticate with the secret of the webhook instead of the usual
+// credentials.
+func ServeHookReceiver(rg *routing.RouteGroup, service hookService) {
+	r := &hookResource{service}
+
+	// Receive a push webhook from GitHub, GitLab or Gitea
+	rg.Post("/<source>", r.receive)
+}
+
+func ServeHookResource(rg *routing.RouteGroup, service hookService) {
+	r := &hookResource{service}
+
+	// List the publishes triggered by webhooks, newest first
+	rg.Get("", r.events)
+}
+
+func (r *hookResource) receive(c *routing.Context) error {
+	rs := app.GetRequestScope(c)
+
+	body, err := ioutil.ReadAll(io.LimitReader(c.Request.Body, maxHookPayload))
+	if err != nil {
+		return err
+	}
+
+	events, err := r.service.Receive(rs, c.Param("source"), c.Request.Header, body)
+	if err != nil {
+		return writeServiceError(c, err)
+	}
+
+	status := http.StatusOK
+	if len(events) > 0 {
+		status = http.StatusAccepted
+	}
+
+	c.Response.WriteHeader(status)
+	return c.Write(struct {
+		Events []models.HookEvent `json:"events"`
+	}{events})
+}
+
+func (r *hookResource) events(c *routing.Context) error {
+	rs := app.GetRequestScope(c)
+
+	events, err := r.service.Events(rs, c.Query("repository"), c.Query("status"))
+	if err != nil {
+		return err
+	}
+
+	return c.Write(struct {
+		Events []models.HookEvent `json:"events"`
+	}{events})
+}
@@ -0,0 +1,173 @@
+package v1_test
+
+import (
+	"github.com/erikvanbrakel/anthology/api/v1"
+	"github.com/erikvanbrakel/anthology/models"
+	"github.com/erikvanbrakel/anthology/registry"
+	"github.com/erikvanbrakel/anthology/services"
+	"github.com/gavv/httpexpect"
+	"github.com/go-ozzo/ozzo-routing"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Payloads as sent by the git hosts, trimmed to the fields that matter.
+const (
+	githubTagPush = `{
+  "ref": "refs/tags/v1.0.0",
+  "before": "0000000000000000000000000000000000000000",
+  "after": "6113728f27ae82c7b1a177c8d03f9e96e0adf246",
+  "created": true,
+  "deleted": false,
+  "repository": {
+    "id": 186853002,
+    "full_name": "example/terraform-aws-vpc",
+    "clone_url": "https://github.com/example/terraform-aws-vpc.git",
+    "ssh_url": "git@github.com:example/terraform-aws-vpc.git"
+  },
+  "pusher": {"name": "octocat"}
+}`
+
+	githubBranchPush = `{
+  "ref": "refs/heads/main",
+  "deleted": false,
+  "repository": {"full_name": "example/terraform-aws-vpc"}
+}`
+
+	gitlabTagPush = `{
+  "object_kind": "tag_push",
+  "ref": "refs/tags/modules/dns/v2.0.0",
+  "checkout_sha": "82b3d5ae55f7080f1e6022629cdb57bfae7cccc7",
+  "project": {
+    "id": 1,
+    "path_with_namespace": "infra/monorepo",
+    "git_http_url": "https://gitlab.example.com/infra/monorepo.git"
+  }
+}`
+
+	giteaTagPush = `{
+  "ref": "refs/tags/v3.0.0",
+  "before": "0000000000000000000000000000000000000000",
+  "after": "28e1879d029cb852e4844d9c718537df08844e03",
+  "repository": {
+    "id": 1,
+    "full_name": "example/terraform-aws-vpc",
+    "clone_url": "https://gitea.example.com/example/terraform-aws-vpc.git"
+  }
+}`
+)
+
+func TestHooks(t *testing.T) {
+	repo, git := newRepo(t)
+	defer os.RemoveAll(repo)
+
+	os.MkdirAll(filepath.Join(repo, "modules", "dns"), 0755)
+	ioutil.WriteFile(filepath.Join(repo, "main.tf"), []byte("# vpc"), 0644)
+	ioutil.WriteFile(filepath.Join(repo, "modules", "dns", "main.tf"), []byte("# dns"), 0644)
+
+	git("init", "--quiet")
+	git("add", ".")
+	git("commit", "--quiet", "-m", "initial")
+	git("tag", "v1.0.0")
+	git("tag", "modules/dns/v2.0.0")
+
+	bare := repo + ".git"
+	git("clone", "--quiet", "--bare", repo, bare)
+	defer os.RemoveAll(bare)
+	remote := "file://" + filepath.ToSlash(bare)
+
+	r := registry.NewFakeRegistry()
+	modules := services.NewModuleService(r)
+	gitService, err := services.NewGitService(modules, "", time.Minute, []string{"file"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hooks, err := services.NewHookService(r, gitService, []services.HookRepository{
+		{Source: "github", Repository: "example/terraform-aws-vpc", Secret: "github-secret", URL: remote, Namespace: "namespace1", Name: "vpc", Provider: "aws"},
+		{Source: "gitlab", Repository: "infra/monorepo", Secret: "gitlab-secret", URL: remote, Path: "modules/dns", TagPrefix: "modules/dns/", Namespace: "namespace1", Name: "dns", Provider: "aws"},
+		{Source: "gitea", Repository: "example/terraform-aws-vpc", Secret: "gitea-secret", URL: remote, Namespace: "namespace1", Name: "vpc", Provider: "aws"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := newServer(serveModules(modules), func(router *routing.Router) {
+		v1.ServeHookResource(router.Group("/v1/hooks"), hooks)
+		v1.ServeHookReceiver(router.Group("/hooks"), hooks)
+	})
+	defer server.Close()
+	e := httpexpect.New(t, server.URL)
+
+	e.POST("/hooks/github").WithText(githubTagPush).
+		WithHeader("X-GitHub-Event", "push").
+		WithHeader("X-Hub-Signature-256", services.SignWebhook("github-secret", []byte(githubTagPush))).
+		Expect().Status(http.StatusAccepted).JSON().Object().Value("events").Array().Length().Equal(1)
+
+	e.POST("/hooks/gitlab").WithText(gitlabTagPush).
+		WithHeader("X-Gitlab-Event", "Tag Push Hook").
+		WithHeader("X-Gitlab-Token", "gitlab-secret").
+		Expect().Status(http.StatusAccepted)
+
+	// v3.0.0 does not exist in the repository
+	giteaSignature := services.SignWebhook("gitea-secret", []byte(giteaTagPush))[len("sha256="):]
+	e.POST("/hooks/gitea").WithText(giteaTagPush).
+		WithHeader("X-Gitea-Event", "push").
+		WithHeader("X-Gitea-Signature", giteaSignature).
+		Expect().Status(http.StatusAccepted)
+
+	e.POST("/hooks/github").WithText(githubBranchPush).
+		WithHeader("X-GitHub-Event", "push").
+		WithHeader("X-Hub-Signature-256", services.SignWebhook("github-secret", []byte(githubBranchPush))).
+		Expect().Status(http.StatusOK).JSON().Object().Value("events").Array().Empty()
+
+	e.POST("/hooks/github").WithText(githubTagPush).
+		WithHeader("X-GitHub-Event", "push").
+		WithHeader("X-Hub-Signature-256", services.SignWebhook("wrong-secret", []byte(githubTagPush))).
+		Expect().Status(http.StatusUnauthorized)
+	e.POST("/hooks/gitlab").WithText(gitlabTagPush).
+		WithHeader("X-Gitlab-Event", "Tag Push Hook").
+		Expect().Status(http.StatusUnauthorized)
+	e.POST("/hooks/bitbucket").WithText(githubTagPush).
+		Expect().Status(http.StatusNotFound)
+
+	waitForHooks(t, hooks)
+
+	e.GET("/v1/modules/namespace1/vpc/aws/1.0.0/download").Expect().Status(http.StatusNoContent)
+	e.GET("/v1/modules/namespace1/dns/aws/2.0.0/download").Expect().Status(http.StatusNoContent)
+
+	events := e.GET("/v1/hooks").Expect().Status(http.StatusOK).JSON().Object().Value("events").Array()
+	events.Length().Equal(3)
+
+	failed := e.GET("/v1/hooks").WithQuery("status", models.HookFailed).
+		Expect().Status(http.StatusOK).JSON().Object().Value("events").Array()
+	failed.Length().Equal(1)
+	failed.First().Object().ValueEqual("source", "gitea")
+	failed.First().Object().ValueEqual("tag", "v3.0.0")
+	failed.First().Object().Value("error").String().Contains("unable to fetch")
+
+	published := e.GET("/v1/hooks").WithQuery("repository", "infra/monorepo").
+		Expect().Status(http.StatusOK).JSON().Object().Value("events").Array()
+	published.Length().Equal(1)
+	published.First().Object().ValueEqual("status", models.HookPublished)
+	published.First().Object().ValueEqual("version", "2.0.0")
+	published.First().Object().Value("commit").String().Length().Equal(40)
+}
+
+func waitForHooks(t *testing.T, hooks *services.HookService) {
+	for i := 0; i < 500; i++ {
+		pending, err := hooks.Events(nil, "", models.HookPending)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pending) == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("hook events are still pending")
+}
@@ -0,0 +1,216 @@
+package v1
+
+import (
+	"github.com/erikvanbrakel/anthology/app"
+	"github.com/erikvanbrakel/anthology/services"
+	"github.com/go-ozzo/ozzo-routing"
+	"html/template"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+type (
+	loginService interface {
+		ValidateClient(clientID, redirectURI string) error
+		Authorize(rs app.RequestScope, clientID, redirectURI, codeChallenge, username, password string) (string, error)
+		Exchange(rs app.RequestScope, clientID, code, redirectURI, codeVerifier string) (string, time.Time, error)
+	}
+
+	loginResource struct {
+		service loginService
+	}
+
+	// authorizationRequest holds the parameters of an authorization request,
+	// which are carried through the login form as hidden fields.
+	authorizationRequest struct {
+		ClientID            string
+		RedirectURI         string
+		State               string
+		CodeChallenge       string
+		CodeChallengeMethod string
+		ResponseType        string
+		Error               string
+	}
+)
+
+var loginForm = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Anthology login</title></head>
+<body>
+<h1>Log in to Anthology</h1>
+{{if .Error}}<p><strong>{{.Error}}</strong></p>{{end}}
+{{if .ClientID}}<form method="post">
+<input type="hidden" name="response_type" value="{{.ResponseType}}">
+<input type="hidden" name="client_id" value="{{.ClientID}}">
+<input type="hidden" name="redirect_uri" value="{{.RedirectURI}}">
+<input type="hidden" name="state" value="{{.State}}">
+<input type="hidden" name="code_challenge" value="{{.CodeChallenge}}">
+<input type="hidden" name="code_challenge_method" value="{{.CodeChallengeMethod}}">
+<p><label>Username <input type="text" name="username" autofocus></label></p>
+<p><label>Password <input type="password" name="password"></label></p>
+<p><input type="submit" value="Log in"></p>
+</form>{{end}}
+</body>
+</html>
+`))
+
+// ServeLoginResource serves the OAuth2 endpoints advertised as login.v1, used
+// by `terraform login`.
+func ServeLoginResource(rg *routing.RouteGroup, service loginService) {
+	r := &loginResource{service}
+
+	// Show the login form
+	rg.Get("/authorization", r.authorizationForm)
+
+	// Log in and redirect back to the client with an authorization code
+	rg.Post("/authorization", r.authorize)
+
+	// Exchange an authorization code for a token
+	rg.Post("/token", r.token)
+}
+
+func (r *loginResource) authorizationForm(c *routing.Context) error {
+	req := readAuthorizationRequest(c.Request.URL.Query())
+
+	if err := r.validate(req); err != nil {
+		return r.fail(c, req, err)
+	}
+
+	return writeLoginForm(c, http.StatusOK, req)
+}
+
+func (r *loginResource) authorize(c *routing.Context) error {
+	rs := app.GetRequestScope(c)
+
+	if err := c.Request.ParseForm(); err != nil {
+		c.Response.WriteHeader(http.StatusBadRequest)
+		return c.Write(apiError{[]string{err.Error()}})
+	}
+	req := readAuthorizationRequest(c.Request.PostForm)
+
+	if err := r.validate(req); err != nil {
+		return r.fail(c, req, err)
+	}
+
+	code, err := r.service.Authorize(rs, req.ClientID, req.RedirectURI, req.CodeChallenge, c.Request.PostFormValue("username"), c.Request.PostFormValue("password"))
+	if err == app.ErrInvalidCredentials {
+		req.Error = "Invalid username or password."
+		return writeLoginForm(c, http.StatusUnauthorized, req)
+	}
+	if err != nil {
+		return r.fail(c, req, err)
+	}
+
+	return redirect(c, req.RedirectURI, url.Values{"code": {code}, "state": {req.State}})
+}
+
+func (r *loginResource) token(c *routing.Context) error {
+	rs := app.GetRequestScope(c)
+
+	if err := c.Request.ParseForm(); err != nil {
+		return writeOAuthError(c, &services.OAuthError{Code: "invalid_request", Description: err.Error()})
+	}
+	form := c.Request.PostForm
+
+	if grantType := form.Get("grant_type"); grantType != "authorization_code" {
+		return writeOAuthError(c, &services.OAuthError{Code: "unsupported_grant_type", Description: "unsupported grant type " + grantType})
+	}
+
+	// public clients may send their ID with HTTP basic authentication
+	clientID := form.Get("client_id")
+	if user, _, ok := c.Request.BasicAuth(); ok && clientID == "" {
+		clientID = user
+	}
+
+	token, expiresAt, err := r.service.Exchange(rs, clientID, form.Get("code"), form.Get("redirect_uri"), form.Get("code_verifier"))
+	if err != nil {
+		return writeOAuthError(c, err)
+	}
+
+	c.Response.Header().Set("Cache-Control", "no-store")
+	return c.Write(struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}{token, "bearer", int64(expiresAt.Sub(rs.Now()).Seconds())})
+}
+
+// validate checks an authorization request. Client errors are returned as is,
+// errors in the remaining parameters are reported to the client.
+func (r *loginResource) validate(req *authorizationRequest) error {
+	if err := r.service.ValidateClient(req.ClientID, req.RedirectURI); err != nil {
+		return err
+	}
+
+	switch {
+	case req.ResponseType != "code":
+		return &services.OAuthError{Code: "unsupported_response_type", Description: "only the code response type is supported"}
+	case req.CodeChallenge == "" || req.CodeChallengeMethod != "S256":
+		return &services.OAuthError{Code: "invalid_request", Description: "a S256 code_challenge is required"}
+	}
+
+	return nil
+}
+
+// fail redirects errors back to the client once its redirect URI has been
+// verified, and shows them to the user otherwise.
+func (r *loginResource) fail(c *routing.Context, req *authorizationRequest, err error) error {
+	oauthErr, ok := err.(*services.OAuthError)
+	if !ok {
+		return err
+	}
+
+	if r.service.ValidateClient(req.ClientID, req.RedirectURI) != nil {
+		return writeLoginForm(c, http.StatusBadRequest, &authorizationRequest{Error: oauthErr.Description})
+	}
+
+	return redirect(c, req.RedirectURI, url.Values{
+		"error":             {oauthErr.Code},
+		"error_description": {oauthErr.Description},
+		"state":             {req.State},
+	})
+}
+
+func readAuthorizationRequest(values url.Values) *authorizationRequest {
+	return &authorizationRequest{
+		ClientID:            values.Get("client_id"),
+		RedirectURI:         values.Get("redirect_uri"),
+		State:               values.Get("state"),
+		CodeChallenge:       values.Get("code_challenge"),
+		CodeChallengeMethod: values.Get("code_challenge_method"),
+		ResponseType:        values.Get("response_type"),
+	}
+}
+
+func writeLoginForm(c *routing.Context, status int, req *authorizationRequest) error {
+	c.Response.Header().Set("Content-Type", "text/html; charset=utf-8")
+	c.Response.WriteHeader(status)
+	return loginForm.Execute(c.Response, req)
+}
+
+func writeOAuthError(c *routing.Context, err error) error {
+	oauthErr, ok := err.(*services.OAuthError)
+	if !ok {
+		return err
+	}
+
+	c.Response.WriteHeader(http.StatusBadRequest)
+	return c.Write(oauthErr)
+}
+
+func redirect(c *routing.Context, target string, query url.Values) error {
+	u, err := url.Parse(target)
+	if err != nil {
+		return err
+	}
+
+	values := u.Query()
+	for k, v := range query {
+		values[k] = v
+	}
+	u.RawQuery = values.Encode()
+
+	http.Redirect(c.Response, c.Request, u.String(), http.StatusFound)
+	return nil
+}
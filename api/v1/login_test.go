@@ -0,0 +1,220 @@
+package v1_test
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"github.com/erikvanbrakel/anthology/api/v1"
+	"github.com/erikvanbrakel/anthology/app"
+	"github.com/erikvanbrakel/anthology/registry"
+	"github.com/erikvanbrakel/anthology/services"
+	"github.com/gavv/httpexpect"
+	"github.com/go-ozzo/ozzo-routing"
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+)
+
+const (
+	testRedirectURI  = "http://localhost:10000/login"
+	testCodeVerifier = "0123456789abcdef0123456789abcdef0123456789abcdef"
+)
+
+func writeUsers(t *testing.T, users map[string]string) string {
+	f, err := ioutil.TempFile("", "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for name, password := range users {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteString(name + ":" + string(hash) + "\n")
+	}
+
+	return f.Name()
+}
+
+func newLoginServer(t *testing.T) (*httptest.Server, *httpexpect.Expect) {
+	path := writeUsers(t, map[string]string{"alice": "secret"})
+	defer os.Remove(path)
+
+	users, err := services.LoadUserStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	login := services.NewLoginService(registry.NewFakeRegistry(), users, "terraform-cli", time.Hour)
+
+	router := newRouter()
+	router.Use(app.Authenticate(login))
+	v1.ServeLoginResource(router.Group("/oauth"), login)
+	router.Get("/whoami", func(c *routing.Context) error {
+		if p := app.GetRequestScope(c).Principal(); p != nil {
+			return c.Write(p.Name)
+		}
+		return c.Write("anonymous")
+	})
+
+	server := httptest.NewServer(router)
+	return server, newExpect(t, server)
+}
+
+func codeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func authorizationForm(password string) map[string]interface{} {
+	return map[string]interface{}{
+		"response_type":         "code",
+		"client_id":             "terraform-cli",
+		"redirect_uri":          testRedirectURI,
+		"state":                 "xyz",
+		"code_challenge":        codeChallenge(testCodeVerifier),
+		"code_challenge_method": "S256",
+		"username":              "alice",
+		"password":              password,
+	}
+}
+
+func authorize(t *testing.T, e *httpexpect.Expect) string {
+	location := e.POST("/oauth/authorization").WithForm(authorizationForm("secret")).
+		Expect().Status(http.StatusFound).Header("Location").Raw()
+
+	u, err := url.Parse(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Query().Get("state") != "xyz" {
+		t.Errorf("expected state to be passed back, got %q", u.Query().Get("state"))
+	}
+
+	return u.Query().Get("code")
+}
+
+func TestLogin(t *testing.T) {
+	server, e := newLoginServer(t)
+	defer server.Close()
+
+	e.GET("/oauth/authorization").
+		WithQuery("response_type", "code").
+		WithQuery("client_id", "terraform-cli").
+		WithQuery("redirect_uri", testRedirectURI).
+		WithQuery("state", "xyz").
+		WithQuery("code_challenge", codeChallenge(testCodeVerifier)).
+		WithQuery("code_challenge_method", "S256").
+		Expect().Status(http.StatusOK).ContentType("text/html").Body().Contains(`name="password"`)
+
+	e.POST("/oauth/authorization").WithForm(authorizationForm("wrong")).
+		Expect().Status(http.StatusUnauthorized).Body().Contains("Invalid username or password")
+
+	code := authorize(t, e)
+
+	e.POST("/oauth/token").WithForm(map[string]string{
+		"grant_type":    "authorization_code",
+		"client_id":     "terraform-cli",
+		"code":          code,
+		"redirect_uri":  testRedirectURI,
+		"code_verifier": "not the verifier",
+	}).Expect().Status(http.StatusBadRequest).JSON().Object().ValueEqual("error", "invalid_grant")
+
+	// a code can not be used again after a failed exchange
+	e.POST("/oauth/token").WithForm(map[string]string{
+		"grant_type":    "authorization_code",
+		"client_id":     "terraform-cli",
+		"code":          code,
+		"redirect_uri":  testRedirectURI,
+		"code_verifier": testCodeVerifier,
+	}).Expect().Status(http.StatusBadRequest).JSON().Object().ValueEqual("error", "invalid_grant")
+
+	code = authorize(t, e)
+
+	response := e.POST("/oauth/token").WithForm(map[string]string{
+		"grant_type":    "authorization_code",
+		"client_id":     "terraform-cli",
+		"code":          code,
+		"redirect_uri":  testRedirectURI,
+		"code_verifier": testCodeVerifier,
+	}).Expect().Status(http.StatusOK).JSON().Object()
+
+	response.ValueEqual("token_type", "bearer")
+	token := response.Value("access_token").String().NotEmpty().Raw()
+
+	e.GET("/whoami").Expect().Status(http.StatusOK).JSON().Equal("anonymous")
+	e.GET("/whoami").WithHeader("Authorization", "Bearer "+token).
+		Expect().Status(http.StatusOK).JSON().Equal("alice")
+	e.GET("/whoami").WithHeader("Authorization", "Bearer "+token+"0").
+		Expect().Status(http.StatusUnauthorized)
+}
+
+func TestLoginCodeIsRedeemedOnce(t *testing.T) {
+	server, e := newLoginServer(t)
+	defer server.Close()
+
+	code := authorize(t, e)
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {"terraform-cli"},
+		"code":          {code},
+		"redirect_uri":  {testRedirectURI},
+		"code_verifier": {testCodeVerifier},
+	}
+
+	statuses := make(chan int, 5)
+	for i := 0; i < cap(statuses); i++ {
+		go func() {
+			resp, err := http.PostForm(server.URL+"/oauth/token", form)
+			if err != nil {
+				statuses <- 0
+				return
+			}
+			resp.Body.Close()
+			statuses <- resp.StatusCode
+		}()
+	}
+
+	got := map[int]int{}
+	for i := 0; i < cap(statuses); i++ {
+		got[<-statuses]++
+	}
+	if got[http.StatusOK] != 1 || got[http.StatusBadRequest] != cap(statuses)-1 {
+		t.Errorf("expected the code to be redeemed exactly once, got %v", got)
+	}
+}
+
+func TestLoginRejectsInvalidClients(t *testing.T) {
+	server, e := newLoginServer(t)
+	defer server.Close()
+
+	// errors for unverified redirect URIs are shown instead of redirected
+	form := authorizationForm("secret")
+	form["redirect_uri"] = "https://attacker.example.com/login"
+	e.POST("/oauth/authorization").WithForm(form).
+		Expect().Status(http.StatusBadRequest).Body().Contains("redirect_uri must be a local http URL")
+
+	form = authorizationForm("secret")
+	form["client_id"] = "other"
+	e.POST("/oauth/authorization").WithForm(form).
+		Expect().Status(http.StatusBadRequest).Body().Contains("unknown client")
+
+	form = authorizationForm("secret")
+	form["code_challenge_method"] = "plain"
+	location := e.POST("/oauth/authorization").WithForm(form).
+		Expect().Status(http.StatusFound).Header("Location").Raw()
+
+	u, _ := url.Parse(location)
+	if u.Query().Get("error") != "invalid_request" || u.Query().Get("code") != "" {
+		t.Errorf("expected an invalid_request error redirect, got %s", location)
+	}
+
+	e.POST("/oauth/token").WithForm(map[string]string{"grant_type": "password"}).
+		Expect().Status(http.StatusBadRequest).JSON().Object().ValueEqual("error", "unsupported_grant_type")
+}
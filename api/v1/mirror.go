@@ -0,0 +1,98 @@
+package v1
+
+import (
+	"github.com/erikvanbrakel/anthology/app"
+	"github.com/erikvanbrakel/anthology/models"
+	"github.com/go-ozzo/ozzo-routing"
+	"io"
+	"net/http"
+	"strings"
+)
+
+type (
+	mirrorService interface {
+		Versions(rs app.RequestScope, hostname, namespace, providerType string) ([]string, error)
+		Archives(rs app.RequestScope, hostname, namespace, providerType, version string) (map[string]models.MirrorArchive, error)
+		GetArchive(rs app.RequestScope, hostname, namespace, providerType, filename string) (io.ReadCloser, error)
+	}
+
+	mirrorResource struct {
+		service mirrorService
+	}
+)
+
+// ServeMirrorResource implements the provider network mirror protocol. The
+// archive URLs in a version document are relative, so the packages are served
+// next to it.
+func ServeMirrorResource(rg *routing.RouteGroup, service mirrorService) {
+	r := &mirrorResource{service}
+
+	// index.json, <version>.json or a provider package
+	rg.Get("/<hostname>/<namespace>/<type>/<file>", r.get)
+}
+
+func (r *mirrorResource) get(c *routing.Context) error {
+	file := c.Param("file")
+
+	switch {
+	case file == "index.json":
+		return r.index(c)
+	case strings.HasSuffix(file, ".json"):
+		return r.version(c, strings.TrimSuffix(file, ".json"))
+	case strings.HasSuffix(file, ".zip"):
+		return r.archive(c, file)
+	}
+
+	c.Response.WriteHeader(http.StatusNotFound)
+	return c.Write(apiError{[]string{"not found"}})
+}
+
+func (r *mirrorResource) index(c *routing.Context) error {
+	rs := app.GetRequestScope(c)
+
+	versions, err := r.service.Versions(rs, c.Param("hostname"), c.Param("namespace"), c.Param("type"))
+	if err != nil {
+		return err
+	}
+
+	if len(versions) == 0 {
+		c.Response.WriteHeader(http.StatusNotFound)
+		return c.Write(apiError{[]string{"not found"}})
+	}
+
+	index := map[string]struct{}{}
+	for _, v := range versions {
+		index[v] = struct{}{}
+	}
+
+	return c.Write(struct {
+		Versions map[string]struct{} `json:"versions"`
+	}{index})
+}
+
+func (r *mirrorResource) version(c *routing.Context, version string) error {
+	rs := app.GetRequestScope(c)
+
+	archives, err := r.service.Archives(rs, c.Param("hostname"), c.Param("namespace"), c.Param("type"), version)
+	if err != nil {
+		return writeServiceError(c, err)
+	}
+
+	return c.Write(struct {
+		Archives map[string]models.MirrorArchive `json:"archives"`
+	}{archives})
+}
+
+func (r *mirrorResource) archive(c *routing.Context, filename string) error {
+	rs := app.GetRequestScope(c)
+
+	data, err := r.service.GetArchive(rs, c.Param("hostname"), c.Param("namespace"), c.Param("type"), filename)
+	if err != nil {
+		return writeServiceError(c, err)
+	}
+	defer data.Close()
+
+	c.Response.Header().Set("Content-Type", "application/zip")
+	_, err = io.Copy(c.Response, data)
+	return err
+}
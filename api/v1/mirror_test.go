@@ -0,0 +1,111 @@
+package v1_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"github.com/erikvanbrakel/anthology/registry"
+	"github.com/erikvanbrakel/anthology/services"
+	"github.com/gavv/httpexpect"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func providerZip(t *testing.T, files map[string]string) []byte {
+	buf := new(bytes.Buffer)
+	w := zip.NewWriter(buf)
+	for name, content := range files {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(content))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestProviderMirror(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	linux := providerZip(t, map[string]string{"terraform-provider-example_v1.0.0": "binary"})
+	darwin := providerZip(t, map[string]string{"terraform-provider-example_v1.0.0": "other binary"})
+
+	files := map[string][]byte{
+		"registry.terraform.io/namespace1/example/terraform-provider-example_1.0.0_linux_amd64.zip":  linux,
+		"registry.terraform.io/namespace1/example/terraform-provider-example_1.0.0_darwin_arm64.zip": darwin,
+		"registry.terraform.io/namespace1/example/terraform-provider-example_2.0.0_linux_amd64.zip":  linux,
+		"registry.terraform.io/namespace1/example/index.json":                                        []byte(`{"versions":{}}`),
+	}
+	for name, data := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(p), 0755)
+		if err := ioutil.WriteFile(p, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mirror := services.NewMirrorService(registry.NewFakeRegistry())
+
+	imported, err := mirror.Import(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported != 3 {
+		t.Errorf("expected 3 imported packages, got %d", imported)
+	}
+
+	server := newServer(serveMirror(mirror))
+	defer server.Close()
+	e := httpexpect.New(t, server.URL)
+
+	versions := e.GET("/v1/mirror/registry.terraform.io/namespace1/example/index.json").
+		Expect().Status(http.StatusOK).JSON().Object().Value("versions").Object()
+	versions.Keys().ContainsOnly("1.0.0", "2.0.0")
+	versions.Value("1.0.0").Object().Empty()
+
+	archives := e.GET("/v1/mirror/registry.terraform.io/namespace1/example/1.0.0.json").
+		Expect().Status(http.StatusOK).JSON().Object().Value("archives").Object()
+	archives.Keys().ContainsOnly("linux_amd64", "darwin_arm64")
+
+	archive := archives.Value("linux_amd64").Object()
+	archive.ValueEqual("url", "terraform-provider-example_1.0.0_linux_amd64.zip")
+	archive.ValueEqual("hashes", []string{
+		"h1:+jpfKUbIEzDeDw3F1D/yiX57JwlhoDQSfbIz6rgJLUY=",
+		fmt.Sprintf("zh:%x", sha256.Sum256(linux)),
+	})
+
+	e.GET("/v1/mirror/registry.terraform.io/namespace1/example/terraform-provider-example_1.0.0_darwin_arm64.zip").
+		Expect().Status(http.StatusOK).Body().Equal(string(darwin))
+
+	e.GET("/v1/mirror/registry.terraform.io/namespace1/example/3.0.0.json").
+		Expect().Status(http.StatusNotFound)
+	e.GET("/v1/mirror/registry.terraform.io/namespace1/absent/index.json").
+		Expect().Status(http.StatusNotFound)
+	e.GET("/v1/mirror/registry.terraform.io/namespace1/example/terraform-provider-other_1.0.0_linux_amd64.zip").
+		Expect().Status(http.StatusNotFound)
+}
+
+func TestProviderMirrorRejectsInvalidPackages(t *testing.T) {
+	mirror := services.NewMirrorService(registry.NewFakeRegistry())
+
+	err := mirror.Add("registry.terraform.io", "namespace1", "example", "terraform-provider-example_1.0.0_linux_amd64.zip", []byte("not a zip"))
+	if _, ok := err.(*services.ValidationError); !ok {
+		t.Errorf("expected a validation error for an invalid zip, got %v", err)
+	}
+
+	err = mirror.Add("registry.terraform.io", "namespace1", "example", "terraform-provider-example_latest_linux_amd64.zip", providerZip(t, nil))
+	if _, ok := err.(*services.ValidationError); !ok {
+		t.Errorf("expected a validation error for an invalid version, got %v", err)
+	}
+}
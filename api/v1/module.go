@@ -5,10 +5,14 @@ import (
 	"github.com/blang/semver"
 	"github.com/erikvanbrakel/anthology/app"
 	"github.com/erikvanbrakel/anthology/models"
+	"github.com/erikvanbrakel/anthology/services"
 	"github.com/go-ozzo/ozzo-routing"
 	"io"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"strconv"
+	"strings"
 )
 
 type (
@@ -18,7 +22,20 @@ type (
 		Exists(rs app.RequestScope, namespace, name, provider, version string) (bool, error)
 		Get(rs app.RequestScope, namespace, name, provider, version string) (*models.Module, error)
 		GetData(rs app.RequestScope, namespace, name, provider, version string) (io.Reader, error)
+		GetDataURL(rs app.RequestScope, namespace, name, provider, version string) (string, error)
 		Publish(rs app.RequestScope, namespace, name, provider, version string, data io.Reader) error
+		PublishWithMetadata(rs app.RequestScope, namespace, name, provider, version string, data io.Reader, metadata *models.ModuleMetadata) error
+		Validate(rs app.RequestScope, namespace, name, provider, version string, data io.Reader, metadata *models.ModuleMetadata) (*models.ValidationReport, error)
+		Tags(rs app.RequestScope, namespace, name, provider string) (*models.ModuleTags, error)
+		ResolveTag(rs app.RequestScope, namespace, name, provider, tag string) (string, error)
+		SetTag(rs app.RequestScope, namespace, name, provider, tag, version string) (*models.ModuleTags, error)
+		DeleteTag(rs app.RequestScope, namespace, name, provider, tag string) error
+		Copy(rs app.RequestScope, namespace, name, provider, version, target string) (*models.Module, error)
+		ResolveAlias(rs app.RequestScope, namespace, name, provider string) (*models.ModuleAlias, error)
+		Deprecations(rs app.RequestScope, namespace, name, provider string) (map[string]*models.Deprecation, error)
+		Deprecate(rs app.RequestScope, namespace, name, provider, version, message, link string) (*models.Module, error)
+		Undeprecate(rs app.RequestScope, namespace, name, provider, version string) error
+		Delete(rs app.RequestScope, namespace, name, provider, version string) error
 	}
 
 	moduleResource struct {
@@ -43,9 +60,15 @@ func ServeModuleResource(rg *routing.RouteGroup, service moduleService) {
 	// List available versions for a specific module
 	rg.Get("/<namespace>/<name>/<provider>/versions", r.queryVersions)
 
-	// Download source code for a specific module version
+	// Download source code for a specific module version, or for the version
+	// a tag points to
 	rg.Get("/<namespace>/<name>/<provider>/<version>/download", r.getDownloadUrl).Name("GetDownloadUrl")
 
+	// Manage the tags of a module, like stable or beta
+	rg.Get("/<namespace>/<name>/<provider>/tags", r.getTags)
+	rg.Put("/<namespace>/<name>/<provider>/tags/<tag>", r.setTag)
+	rg.Delete("/<namespace>/<name>/<provider>/tags/<tag>", r.deleteTag)
+
 	// Download the latest version of a module
 	rg.Get("/<namespace>/<name>/<provider>/download", r.getLatestDownloadUrl)
 
@@ -58,12 +81,65 @@ func ServeModuleResource(rg *routing.RouteGroup, service moduleService) {
 	// Get a specific module
 	rg.Get("/<namespace>/<name>/<provider>/<version>", r.get)
 
-	// Publish a specific module
+	// Publish a specific module, or only validate it with ?dry_run=true
 	rg.Post("/<namespace>/<name>/<provider>/<version>", r.publish)
 
+	// Validate a module without publishing it
+	rg.Post("/<namespace>/<name>/<provider>/<version>/validate", r.validate)
+
+	// Copy a specific module version to another namespace
+	rg.Post("/<namespace>/<name>/<provider>/<version>/copy", r.copy)
+
+	// Deprecate a specific module version, or lift its deprecation
+	rg.Put("/<namespace>/<name>/<provider>/<version>/deprecation", r.deprecate)
+	rg.Delete("/<namespace>/<name>/<provider>/<version>/deprecation", r.undeprecate)
+
+	// Delete a specific module version
+	rg.Delete("/<namespace>/<name>/<provider>/<version>", r.delete)
+
 	rg.Get("/<namespace>/<name>/<provider>/<version>/data.tgz", r.getModuleData).Name("GetModuleData")
 }
 
+// serveMoved serves a read of a module without versions from the
+// coordinates it moved to, with a notice that the old ones are deprecated. It
+// reports false when the module did not move. Handlers that did not list the
+// versions of the module pass listed=false, so that it is checked that none
+// are left. An alias is followed once, never from the new coordinates.
+func (r *moduleResource) serveMoved(c *routing.Context, handler routing.Handler, listed bool) (bool, error) {
+	rs := app.GetRequestScope(c)
+	namespace, name, provider := c.Param("namespace"), c.Param("name"), c.Param("provider")
+
+	if c.Get("alias") != nil {
+		return false, nil
+	}
+	if !listed {
+		versions, err := r.service.QueryVersions(rs, namespace, name, provider)
+		if err != nil || len(versions) > 0 {
+			return false, err
+		}
+	}
+
+	alias, err := r.service.ResolveAlias(rs, namespace, name, provider)
+	if err != nil || alias == nil {
+		return false, err
+	}
+
+	c.Set("alias", alias)
+	c.SetParam("namespace", alias.Target.Namespace)
+	c.SetParam("name", alias.Target.Name)
+	c.SetParam("provider", alias.Target.Provider)
+
+	warnDeprecated(c, alias.Message)
+	return true, handler(c)
+}
+
+// warnDeprecated marks a response as deprecated, with a message for the
+// caller in a Warning header.
+func warnDeprecated(c *routing.Context, message string) {
+	c.Response.Header().Set("Deprecation", "true")
+	c.Response.Header().Add("Warning", "299 - "+strconv.Quote(message))
+}
+
 func (r *moduleResource) getModuleData(c *routing.Context) error {
 	rs := app.GetRequestScope(c)
 
@@ -75,7 +151,7 @@ func (r *moduleResource) getModuleData(c *routing.Context) error {
 	data, err := r.service.GetData(rs, namespace, name, provider, version)
 
 	if err != nil {
-		return err
+		return writeServiceError(c, err)
 	}
 
 	_, err = io.Copy(c.Response, data)
@@ -83,17 +159,124 @@ func (r *moduleResource) getModuleData(c *routing.Context) error {
 }
 
 func (r *moduleResource) publish(c *routing.Context) error {
+	if dryRun, _ := strconv.ParseBool(c.Query("dry_run", "false")); dryRun {
+		return r.validate(c)
+	}
+
 	rs := app.GetRequestScope(c)
 	namespace, name, provider, version := c.Param("namespace"), c.Param("name"), c.Param("provider"), c.Param("version")
 
-	err := r.service.Publish(rs, namespace, name, provider, version, c.Request.Body)
+	data, metadata, problem := readPublish(c)
+	if problem != "" {
+		c.Response.WriteHeader(http.StatusBadRequest)
+		return c.Write(apiError{[]string{problem}})
+	}
+	defer data.Close()
+
+	var err error
+	if metadata != nil {
+		err = r.service.PublishWithMetadata(rs, namespace, name, provider, version, data, metadata)
+	} else {
+		err = r.service.Publish(rs, namespace, name, provider, version, data)
+	}
 	if err != nil {
-		return err
+		return writeServiceError(c, err)
 	}
 
 	return r.getDownloadUrl(c)
 }
 
+func (r *moduleResource) validate(c *routing.Context) error {
+	rs := app.GetRequestScope(c)
+	namespace, name, provider, version := c.Param("namespace"), c.Param("name"), c.Param("provider"), c.Param("version")
+
+	data, metadata, problem := readPublish(c)
+	if problem != "" {
+		c.Response.WriteHeader(http.StatusBadRequest)
+		return c.Write(apiError{[]string{problem}})
+	}
+	defer data.Close()
+
+	report, err := r.service.Validate(rs, namespace, name, provider, version, data, metadata)
+	if err != nil {
+		return writeServiceError(c, err)
+	}
+
+	if !report.Valid {
+		c.Response.WriteHeader(http.StatusBadRequest)
+	}
+	return c.Write(report)
+}
+
+// readPublish returns the archive of a publish, sent either as the request
+// body or as the "archive" field of a multipart form, together with the
+// metadata in the other fields of the form. A problem with the request is
+// described in the returned string.
+func readPublish(c *routing.Context) (io.ReadCloser, *models.ModuleMetadata, string) {
+	if mediaType, _, _ := mime.ParseMediaType(c.Request.Header.Get("Content-Type")); mediaType != "multipart/form-data" {
+		return c.Request.Body, nil, ""
+	}
+
+	if err := c.Request.ParseMultipartForm(maxMemory); err != nil {
+		return nil, nil, "invalid multipart form: " + err.Error()
+	}
+
+	archive, _, err := c.Request.FormFile("archive")
+	if err != nil {
+		c.Request.MultipartForm.RemoveAll()
+		return nil, nil, "the form has no archive file"
+	}
+
+	return formArchive{archive, c.Request.MultipartForm}, formMetadata(c.Request), ""
+}
+
+// formArchive removes the temporary files of a form once its archive is
+// closed.
+type formArchive struct {
+	multipart.File
+	form *multipart.Form
+}
+
+func (a formArchive) Close() error {
+	a.File.Close()
+	return a.form.RemoveAll()
+}
+
+// formMetadata reads the description of a module version from the fields of
+// a multipart publish.
+func formMetadata(req *http.Request) *models.ModuleMetadata {
+	metadata := &models.ModuleMetadata{
+		Owner:        req.FormValue("owner"),
+		Description:  req.FormValue("description"),
+		Source:       req.FormValue("source"),
+		Readme:       req.FormValue("readme"),
+		ReleaseNotes: req.FormValue("release_notes"),
+	}
+
+	// labels can be repeated and comma separated
+	for _, value := range req.MultipartForm.Value["labels"] {
+		for _, label := range strings.Split(value, ",") {
+			if label = strings.TrimSpace(label); label != "" {
+				metadata.Labels = append(metadata.Labels, label)
+			}
+		}
+	}
+
+	return metadata
+}
+
+func (r *moduleResource) delete(c *routing.Context) error {
+	rs := app.GetRequestScope(c)
+	namespace, name, provider, version := c.Param("namespace"), c.Param("name"), c.Param("provider"), c.Param("version")
+
+	if err := r.service.Delete(rs, namespace, name, provider, version); err != nil {
+		return writeServiceError(c, err)
+	}
+
+	c.Response.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
 func (r *moduleResource) query(c *routing.Context) error {
 	rs := app.GetRequestScope(c)
 
@@ -137,10 +320,31 @@ func (r *moduleResource) queryVersions(c *routing.Context) error {
 	}
 
 	if len(versionsByModule) == 0 {
+		if moved, err := r.serveMoved(c, r.queryVersions, true); moved || err != nil {
+			return err
+		}
 		c.Response.WriteHeader(http.StatusNotFound)
 		return c.Write(apiError{[]string{"not found"}})
 	}
 
+	tags, err := r.service.Tags(rs, namespace, name, provider)
+	if err != nil {
+		return err
+	}
+
+	deprecations, err := r.service.Deprecations(rs, namespace, name, provider)
+	if err != nil {
+		return err
+	}
+
+	// the listing can be shared with other requests by the cache, so the
+	// deprecations go on a copy
+	versions := make([]models.Module, len(versionsByModule))
+	for i, m := range versionsByModule {
+		m.Deprecation = deprecations[m.Version]
+		versions[i] = m
+	}
+
 	return c.Write(struct {
 		Modules VersionsList `json:"modules"`
 	}{
@@ -148,28 +352,52 @@ func (r *moduleResource) queryVersions(c *routing.Context) error {
 
 			{
 				Source:   fmt.Sprintf("%s/%s/%s", namespace, name, provider),
-				Versions: versionsByModule,
+				Versions: versions,
+				Tags:     tags.Tags,
 			},
 		},
 	})
 }
 
 func (r *moduleResource) getDownloadUrl(c *routing.Context) error {
+	rs := app.GetRequestScope(c)
 	namespace, name, provider, version := c.Param("namespace"), c.Param("name"), c.Param("provider"), c.Param("version")
 
-	if exists, _ := r.service.Exists(app.GetRequestScope(c), namespace, name, provider, version); exists {
+	if _, err := semver.Parse(version); err != nil {
+		return r.getTagDownloadUrl(c)
+	}
+
+	if exists, _ := r.service.Exists(rs, namespace, name, provider, version); exists {
+
+		url, err := r.service.GetDataURL(rs, namespace, name, provider, version)
+		if err != nil {
+			return err
+		}
+
+		deprecations, err := r.service.Deprecations(rs, namespace, name, provider)
+		if err != nil {
+			return err
+		}
+		if deprecation := deprecations[version]; deprecation != nil {
+			warnDeprecated(c, deprecationWarning(namespace, name, provider, version, deprecation))
+		}
 
-		url := c.URL("GetModuleData",
-			"namespace", namespace,
-			"name", name,
-			"provider", provider,
-			"version", version,
-		)
+		if url == "" {
+			url = c.URL("GetModuleData",
+				"namespace", namespace,
+				"name", name,
+				"provider", provider,
+				"version", version,
+			)
+		}
 		c.Response.Header().Set("X-Terraform-Get", url)
 		c.Response.WriteHeader(http.StatusNoContent)
 		return nil
 	}
 
+	if moved, err := r.serveMoved(c, r.getDownloadUrl, false); moved || err != nil {
+		return err
+	}
 	c.Response.WriteHeader(http.StatusNotFound)
 	return c.Write(apiError{[]string{"not found"}})
 }
@@ -188,24 +416,23 @@ func (r *moduleResource) getLatestDownloadUrl(c *routing.Context) error {
 	}
 
 	if count == 0 {
+		if moved, err := r.serveMoved(c, r.getLatestDownloadUrl, true); moved || err != nil {
+			return err
+		}
 		c.Response.WriteHeader(http.StatusNotFound)
 		return c.Write(apiError{[]string{"not found"}})
 	}
 
-	var latestVersion semver.Version
-
-	for _, m := range modules {
-		moduleVersion, _ := semver.Make(m.Version)
-		if moduleVersion.Compare(latestVersion) > 0 {
-			latestVersion = moduleVersion
-		}
+	deprecations, err := r.service.Deprecations(rs, namespace, name, provider)
+	if err != nil {
+		return err
 	}
 
 	url := c.URL("GetDownloadUrl",
 		"namespace", c.Param("namespace"),
 		"name", c.Param("name"),
 		"provider", c.Param("provider"),
-		"version", latestVersion.String(),
+		"version", latestVersion(modules, deprecations).Version,
 	)
 
 	c.Response.Header().Set("Location", url)
@@ -213,6 +440,135 @@ func (r *moduleResource) getLatestDownloadUrl(c *routing.Context) error {
 	return nil
 }
 
+func (r *moduleResource) copy(c *routing.Context) error {
+	rs := app.GetRequestScope(c)
+
+	var request struct {
+		Namespace string `json:"namespace"`
+	}
+	if err := c.Read(&request); err != nil || request.Namespace == "" {
+		c.Response.WriteHeader(http.StatusBadRequest)
+		return c.Write(apiError{[]string{"namespace is required"}})
+	}
+
+	module, err := r.service.Copy(rs, c.Param("namespace"), c.Param("name"), c.Param("provider"), c.Param("version"), request.Namespace)
+	if err != nil {
+		return writeServiceError(c, err)
+	}
+
+	c.Response.WriteHeader(http.StatusCreated)
+	return c.Write(module)
+}
+
+// getTagDownloadUrl redirects to the download of the version a tag points
+// to, the way getLatestDownloadUrl redirects to the latest version.
+func (r *moduleResource) getTagDownloadUrl(c *routing.Context) error {
+	rs := app.GetRequestScope(c)
+	namespace, name, provider := c.Param("namespace"), c.Param("name"), c.Param("provider")
+
+	version, err := r.service.ResolveTag(rs, namespace, name, provider, c.Param("version"))
+	if err == services.ErrNotFound {
+		if moved, err := r.serveMoved(c, r.getTagDownloadUrl, false); moved || err != nil {
+			return err
+		}
+	}
+	if err != nil {
+		return writeServiceError(c, err)
+	}
+
+	url := c.URL("GetDownloadUrl",
+		"namespace", namespace,
+		"name", name,
+		"provider", provider,
+		"version", version,
+	)
+
+	c.Response.Header().Set("Location", url)
+	c.Response.WriteHeader(http.StatusFound)
+	return nil
+}
+
+func (r *moduleResource) getTags(c *routing.Context) error {
+	rs := app.GetRequestScope(c)
+
+	tags, err := r.service.Tags(rs, c.Param("namespace"), c.Param("name"), c.Param("provider"))
+	if err != nil {
+		return writeServiceError(c, err)
+	}
+
+	return c.Write(tags)
+}
+
+func (r *moduleResource) setTag(c *routing.Context) error {
+	rs := app.GetRequestScope(c)
+
+	var request struct {
+		Version string `json:"version"`
+	}
+	if err := c.Read(&request); err != nil || request.Version == "" {
+		c.Response.WriteHeader(http.StatusBadRequest)
+		return c.Write(apiError{[]string{"version is required"}})
+	}
+
+	tags, err := r.service.SetTag(rs, c.Param("namespace"), c.Param("name"), c.Param("provider"), c.Param("tag"), request.Version)
+	if err != nil {
+		return writeServiceError(c, err)
+	}
+
+	return c.Write(tags)
+}
+
+func (r *moduleResource) deleteTag(c *routing.Context) error {
+	rs := app.GetRequestScope(c)
+
+	if err := r.service.DeleteTag(rs, c.Param("namespace"), c.Param("name"), c.Param("provider"), c.Param("tag")); err != nil {
+		return writeServiceError(c, err)
+	}
+
+	c.Response.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (r *moduleResource) deprecate(c *routing.Context) error {
+	rs := app.GetRequestScope(c)
+
+	var request struct {
+		Message string `json:"message"`
+		Link    string `json:"link"`
+	}
+	if err := c.Read(&request); err != nil || request.Message == "" {
+		c.Response.WriteHeader(http.StatusBadRequest)
+		return c.Write(apiError{[]string{"message is required"}})
+	}
+
+	module, err := r.service.Deprecate(rs, c.Param("namespace"), c.Param("name"), c.Param("provider"), c.Param("version"), request.Message, request.Link)
+	if err != nil {
+		return writeServiceError(c, err)
+	}
+
+	return c.Write(module)
+}
+
+func (r *moduleResource) undeprecate(c *routing.Context) error {
+	rs := app.GetRequestScope(c)
+
+	if err := r.service.Undeprecate(rs, c.Param("namespace"), c.Param("name"), c.Param("provider"), c.Param("version")); err != nil {
+		return writeServiceError(c, err)
+	}
+
+	c.Response.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// deprecationWarning describes a deprecated version for a Warning header.
+func deprecationWarning(namespace, name, provider, version string, deprecation *models.Deprecation) string {
+	warning := fmt.Sprintf("%s/%s/%s %s is deprecated: %s", namespace, name, provider, version, deprecation.Message)
+	if deprecation.Link != "" {
+		warning += " (" + deprecation.Link + ")"
+	}
+	return warning
+}
+
 func (r *moduleResource) get(c *routing.Context) error {
 	rs := app.GetRequestScope(c)
 
@@ -228,6 +584,9 @@ func (r *moduleResource) get(c *routing.Context) error {
 	}
 
 	if module == nil {
+		if moved, err := r.serveMoved(c, r.get, false); moved || err != nil {
+			return err
+		}
 		c.Response.WriteHeader(http.StatusNotFound)
 		return c.Write(apiError{[]string{"not found"}})
 	}
@@ -249,24 +608,53 @@ func (r *moduleResource) getLatest(c *routing.Context) error {
 	}
 
 	if len(modules) == 0 {
+		if moved, err := r.serveMoved(c, r.getLatest, true); moved || err != nil {
+			return err
+		}
 		c.Response.WriteHeader(http.StatusNotFound)
 		return c.Write(apiError{[]string{"not found"}})
 	}
 
-	var module = models.Module{
-		Version: "0.0.0",
+	deprecations, err := r.service.Deprecations(rs, namespace, name, provider)
+	if err != nil {
+		return err
 	}
 
-	for _, m := range modules {
+	module := latestVersion(modules, deprecations)
+
+	latest, err := r.service.Get(rs, namespace, name, provider, module.Version)
+	if err != nil {
+		return err
+	}
+	if latest != nil {
+		module = *latest
+	}
+
+	return c.Write(module)
+}
+
+// latestVersion picks the highest version of a module that is not
+// deprecated, or the highest version when all of them are.
+func latestVersion(modules []models.Module, deprecations map[string]*models.Deprecation) models.Module {
+	var latest, latestDeprecated *models.Module
+	var latestVersion, latestDeprecatedVersion semver.Version
+
+	for i, m := range modules {
 		moduleVersion, _ := semver.Make(m.Version)
-		latestVersion, _ := semver.Make(module.Version)
 
-		if moduleVersion.Compare(latestVersion) > 0 {
-			module = m
+		if deprecations[m.Version] != nil {
+			if latestDeprecated == nil || moduleVersion.Compare(latestDeprecatedVersion) > 0 {
+				latestDeprecated, latestDeprecatedVersion = &modules[i], moduleVersion
+			}
+		} else if latest == nil || moduleVersion.Compare(latestVersion) > 0 {
+			latest, latestVersion = &modules[i], moduleVersion
 		}
 	}
 
-	return c.Write(module)
+	if latest == nil {
+		return *latestDeprecated
+	}
+	return *latest
 }
 
 func (r *moduleResource) queryLatest(c *routing.Context) error {
@@ -311,8 +699,9 @@ func (r *moduleResource) queryLatest(c *routing.Context) error {
 }
 
 type VersionsList []struct {
-	Source   string          `json:"source"`
-	Versions []models.Module `json:"versions"`
+	Source   string            `json:"source"`
+	Versions []models.Module   `json:"versions"`
+	Tags     map[string]string `json:"tags,omitempty"`
 }
 
 func getPaginationInfo(c *routing.Context, count int) PaginationInfo {
@@ -1,9 +1,13 @@
 package v1_test
 
 import (
+	"github.com/erikvanbrakel/anthology/api/v1"
+	"github.com/erikvanbrakel/anthology/registry"
+	"github.com/erikvanbrakel/anthology/services"
 	"github.com/gavv/httpexpect"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 )
 
@@ -115,6 +119,12 @@ func TestGetDownloadUrl(t *testing.T) {
 			http.StatusNotFound,
 			assertError("not found"),
 		},
+		{
+			"download the archive of a module version (not-exist)",
+			"GET", "/namespace1/module1/aws/4.0.0/data.tgz", "",
+			http.StatusNotFound,
+			assertError("not found"),
+		},
 		{
 			"download the latest version of a module",
 			"GET", "/namespace1/module1/aws/download", "",
@@ -132,6 +142,41 @@ func TestGetDownloadUrl(t *testing.T) {
 	})
 }
 
+type presigningRegistry struct {
+	registry.Registry
+}
+
+func (r *presigningRegistry) GetModuleDataURL(namespace, name, provider, version string) (string, error) {
+	return "https://storage.example.com/" + strings.Join([]string{namespace, name, provider, version}, "/") + ".tgz?signature=abc", nil
+}
+
+func TestGetPresignedDownloadUrl(t *testing.T) {
+	dataset := []testModule{
+		{"namespace1", "module1", "aws", "1.0.0", nil},
+	}
+
+	newRegistry := func() registry.Registry {
+		return &presigningRegistry{registry.NewFakeRegistry()}
+	}
+
+	runAPITestsWithRegistry(t, newRegistry, dataset, []apiTestCase{
+		{
+			"download source code from a presigned url",
+			"GET", "/namespace1/module1/aws/1.0.0/download", "",
+			http.StatusNoContent,
+			func(t *testing.T, r *httpexpect.Response, server *httptest.Server) {
+				r.Header("X-Terraform-Get").Equal("https://storage.example.com/namespace1/module1/aws/1.0.0.tgz?signature=abc")
+			},
+		},
+		{
+			"download source code from a presigned url (not-exist)",
+			"GET", "/namespace1/module1/aws/2.0.0/download", "",
+			http.StatusNotFound,
+			assertError(errorNotFound),
+		},
+	})
+}
+
 func TestListLatestVersions(t *testing.T) {
 	dataset := []testModule{
 		{"namespace1", "module1", "aws", "1.0.0", nil},
@@ -217,7 +262,7 @@ func TestGetModule(t *testing.T) {
 func TestPublishModule(t *testing.T) {
 	dataset := []testModule{}
 
-	moduleData := "some data"
+	moduleData := string(moduleArchive(map[string]string{"main.tf": "# main.tf"}))
 
 	runAPITests(t, dataset, []apiTestCase{
 		{
@@ -233,6 +278,151 @@ func TestPublishModule(t *testing.T) {
 				response.Body().Equal(moduleData)
 			},
 		},
+		{
+			"publish a new module (invalid archive)",
+			"POST", "/namespace1/module1/gcp/3.0.0", "some data",
+			http.StatusBadRequest,
+			assertError("archive is not gzip compressed"),
+		},
+	})
+}
+
+func TestPublishModuleWithMetadata(t *testing.T) {
+	router := newRouter()
+	v1.ServeModuleResource(&router.RouteGroup, services.NewModuleService(registry.NewFakeRegistry()))
+	server := httptest.NewServer(router)
+	defer server.Close()
+	e := httpexpect.New(t, server.URL)
+
+	e.POST("/namespace1/module1/aws/1.0.0").WithMultipart().
+		WithFileBytes("archive", "module.tgz", moduleArchive(map[string]string{"main.tf": "# main.tf"})).
+		WithFormField("description", "A VPC with public and private subnets").
+		WithFormField("source", "https://github.com/example/terraform-aws-vpc").
+		WithFormField("owner", "network-team").
+		WithFormField("labels", "network, VPC").
+		WithFormField("labels", "aws").
+		WithFormField("release_notes", "Initial release").
+		Expect().Status(http.StatusNoContent).Header("X-Terraform-Get").NotEmpty()
+
+	// existing scripts keep sending the raw archive
+	e.POST("/namespace1/module1/aws/0.9.0").WithBytes(moduleArchive(map[string]string{"main.tf": "# main.tf"})).
+		Expect().Status(http.StatusNoContent)
+
+	module := e.GET("/namespace1/module1/aws/1.0.0").Expect().Status(http.StatusOK).JSON().Object()
+	module.ValueEqual("version", "1.0.0")
+	module.ValueEqual("description", "A VPC with public and private subnets")
+	module.ValueEqual("source", "https://github.com/example/terraform-aws-vpc")
+	module.ValueEqual("owner", "network-team")
+	module.ValueEqual("labels", []string{"network", "vpc", "aws"})
+	module.ValueEqual("release_notes", "Initial release")
+	module.NotContainsKey("readme")
+
+	e.GET("/namespace1/module1/aws").Expect().Status(http.StatusOK).JSON().Object().
+		ValueEqual("owner", "network-team")
+	e.GET("/namespace1/module1/aws/0.9.0").Expect().Status(http.StatusOK).JSON().Object().
+		NotContainsKey("description")
+	e.GET("/namespace1/module1/aws/versions").Expect().Status(http.StatusOK).
+		JSON().Path("$.modules[0].versions[0]").Object().NotContainsKey("description")
+
+	e.POST("/namespace1/module1/aws/2.0.0").WithMultipart().
+		WithFormField("description", "no archive").
+		Expect().Status(http.StatusBadRequest)
+
+	e.POST("/namespace1/module1/aws/2.0.0").WithMultipart().
+		WithFileBytes("archive", "module.tgz", moduleArchive(map[string]string{"main.tf": "# main.tf"})).
+		WithFormField("source", "not a url").
+		WithFormField("labels", "in valid").
+		Expect().Status(http.StatusBadRequest).JSON().Object().Value("errors").Array().Length().Equal(2)
+	e.GET("/namespace1/module1/aws/2.0.0").Expect().Status(http.StatusNotFound)
+}
+
+func TestValidateModule(t *testing.T) {
+	router := newRouter()
+	v1.ServeModuleResource(&router.RouteGroup, services.NewModuleService(registry.NewFakeRegistry()))
+	server := httptest.NewServer(router)
+	defer server.Close()
+	e := httpexpect.New(t, server.URL)
+
+	e.POST("/namespace1/module1/aws/1.0.0").WithBytes(moduleArchive(map[string]string{
+		"main.tf":   "# main.tf",
+		"README.md": "# README.md",
+	})).
+		Expect().Status(http.StatusNoContent)
+
+	archive := moduleArchive(map[string]string{
+		"main.tf":                `resource "aws_vpc" "this" {}`,
+		"variables.tf":           "variable \"cidr\" {}\nvariable \"name\" {\n  default = \"vpc\"\n}",
+		"outputs.tf":             `output "vpc_id" {}`,
+		"modules/subnet/vars.tf": `variable "ignored" {}`,
+	})
+
+	report := e.POST("/namespace1/module1/aws/1.1.0").WithQuery("dry_run", "true").WithBytes(archive).
+		Expect().Status(http.StatusOK).JSON().Object()
+	report.ValueEqual("valid", true)
+	report.ValueEqual("errors", []string{})
+	report.ValueEqual("warnings", []string{"the module has no README"})
+	report.ValueEqual("files", []string{"main.tf", "modules/subnet/vars.tf", "outputs.tf", "variables.tf"})
+	report.ValueEqual("variables", []string{"cidr", "name"})
+	report.ValueEqual("outputs", []string{"vpc_id"})
+	report.Value("checksum").String().Contains("sha256:")
+
+	// nothing was published
+	e.GET("/namespace1/module1/aws/1.1.0").Expect().Status(http.StatusNotFound)
+
+	e.POST("/namespace1/module1/aws/1.0.0/validate").WithBytes(archive).
+		Expect().Status(http.StatusBadRequest).JSON().Object().
+		ValueEqual("valid", false).Value("errors").Array().Contains("module version already exists")
+
+	e.POST("/namespace1/module1/aws/3.0.0/validate").WithMultipart().
+		WithFileBytes("archive", "module.tgz", archive).
+		WithFormField("readme", "# Module").
+		WithFormField("description", "A VPC").
+		Expect().Status(http.StatusOK).JSON().Object().
+		ValueEqual("warnings", []string{"3.0.0 skips versions after the latest version 1.0.0"}).
+		Path("$.metadata.description").Equal("A VPC")
+
+	e.POST("/namespace1/module1/aws/0.5.0-beta.1/validate").WithBytes(moduleArchive(map[string]string{
+		"main.tf":   "# main.tf",
+		"README.md": "# README.md",
+	})).
+		Expect().Status(http.StatusOK).JSON().Object().
+		ValueEqual("warnings", []string{"0.5.0-beta.1 is a pre-release", "0.5.0-beta.1 is older than the latest version 1.0.0"})
+
+	errors := e.POST("/namespace1/module.1/AWS/latest/validate").WithBytes([]byte("not an archive")).
+		Expect().Status(http.StatusBadRequest).JSON().Object().Value("errors").Array()
+	errors.Length().Equal(4)
+	errors.Contains("archive is not gzip compressed", "version is not a valid semantic version: latest")
+
+	// a real publish applies the same rules
+	e.POST("/namespace1/module.1/aws/1.0.0").WithBytes(moduleArchive(map[string]string{"main.tf": "# main.tf"})).
+		Expect().Status(http.StatusBadRequest)
+}
+
+func TestDeleteModule(t *testing.T) {
+	dataset := []testModule{
+		{"namespace1", "module1", "aws", "1.0.0", nil},
+		{"namespace1", "module1", "aws", "2.0.0", nil},
+	}
+
+	runAPITests(t, dataset, []apiTestCase{
+		{
+			"delete a specific module version",
+			"DELETE", "/namespace1/module1/aws/1.0.0", "",
+			http.StatusNoContent,
+			func(t *testing.T, r *httpexpect.Response, server *httptest.Server) {
+				e := httpexpect.New(t, server.URL)
+
+				e.GET("/namespace1/module1/aws/1.0.0").Expect().Status(http.StatusNotFound)
+				e.GET("/namespace1/module1/aws/versions").Expect().Status(http.StatusOK).
+					JSON().Path("$.modules[0].versions").Array().Length().Equal(1)
+			},
+		},
+		{
+			"delete a specific module version (not-exist)",
+			"DELETE", "/namespace1/module1/aws/3.0.0", "",
+			http.StatusNotFound,
+			assertError(errorNotFound),
+		},
 	})
 }
 
@@ -0,0 +1,190 @@
+package v1_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/erikvanbrakel/anthology/app"
+	"github.com/erikvanbrakel/anthology/registry"
+	"github.com/erikvanbrakel/anthology/services"
+	"github.com/gavv/httpexpect"
+	"github.com/go-ozzo/ozzo-routing"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func encodeSegment(v interface{}) string {
+	data, _ := json.Marshal(v)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func signJWT(t *testing.T, key crypto.Signer, kid string, claims map[string]interface{}) string {
+	alg := "RS256"
+	if _, ok := key.(*ecdsa.PrivateKey); ok {
+		alg = "ES256"
+	}
+
+	signed := encodeSegment(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"}) + "." + encodeSegment(claims)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func jwks(rsaKey *rsa.PrivateKey, ecKey *ecdsa.PrivateKey) []byte {
+	data, _ := json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{
+			{
+				"kid": "rsa",
+				"kty": "RSA",
+				"n":   base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes()),
+			},
+			{
+				"kid": "ec",
+				"kty": "EC",
+				"crv": "P-256",
+				"x":   base64.RawURLEncoding.EncodeToString(ecKey.X.Bytes()),
+				"y":   base64.RawURLEncoding.EncodeToString(ecKey.Y.Bytes()),
+			},
+		},
+	})
+	return data
+}
+
+func ciClaims(issuer, project string, expires time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":            issuer,
+		"sub":            "project_path:" + project + ":ref_type:branch:ref:main",
+		"aud":            "anthology",
+		"exp":            expires.Unix(),
+		"project_path":   project,
+		"namespace_path": "team-a",
+		"ref":            "main",
+	}
+}
+
+func TestOIDCAuthentication(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := ioutil.TempFile("", "jwks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(jwks(rsaKey, ecKey))
+	f.Close()
+	defer os.Remove(f.Name())
+
+	jwksServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(jwks(rsaKey, ecKey))
+	}))
+	defer jwksServer.Close()
+
+	rules := []services.ClaimRule{
+		{Claims: map[string]string{"project_path": "team-a/*", "ref": "main"}, Namespaces: []string{"{namespace_path}"}},
+	}
+	oidc, err := services.NewOIDCAuthenticator(services.OIDCConfig{Issuers: []services.OIDCIssuer{
+		{Issuer: "https://gitlab.example.com", Audience: "anthology", JWKSFile: f.Name(), Rules: rules},
+		{Issuer: "https://ci.example.com", Audience: "anthology", JWKSURL: jwksServer.URL, Rules: rules},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	modules := services.NewModuleService(registry.NewFakeRegistry())
+	modules.Policy = &services.Policy{}
+
+	server := newServer(func(router *routing.Router) { router.Use(app.Authenticate(oidc)) }, serveModules(modules))
+	defer server.Close()
+	e := httpexpect.New(t, server.URL)
+
+	publish := func(namespace, token string) *httpexpect.Response {
+		return e.POST("/v1/modules/"+namespace+"/module1/aws/1.0.0").
+			WithHeader("Authorization", "Bearer "+token).
+			WithBytes(moduleArchive(map[string]string{"main.tf": "# main.tf"})).
+			Expect()
+	}
+
+	valid := time.Now().Add(time.Hour)
+
+	publish("team-a", signJWT(t, rsaKey, "rsa", ciClaims("https://gitlab.example.com", "team-a/app", valid))).
+		Status(http.StatusNoContent)
+	publish("team-b", signJWT(t, rsaKey, "rsa", ciClaims("https://gitlab.example.com", "team-a/app", valid))).
+		Status(http.StatusForbidden)
+	// authorized, so the publish only fails because the version exists
+	publish("team-a", signJWT(t, ecKey, "ec", ciClaims("https://ci.example.com", "team-a/infra", valid))).
+		Status(http.StatusConflict)
+
+	// the claims do not match the rule
+	publish("team-a", signJWT(t, rsaKey, "rsa", ciClaims("https://gitlab.example.com", "team-b/app", valid))).
+		Status(http.StatusForbidden)
+
+	// claims can not widen the namespace pattern
+	wildcard := ciClaims("https://gitlab.example.com", "team-a/app", valid)
+	wildcard["namespace_path"] = "*"
+	publish("team-a", signJWT(t, rsaKey, "rsa", wildcard)).Status(http.StatusForbidden)
+
+	expired := ciClaims("https://gitlab.example.com", "team-a/app", time.Now().Add(-time.Hour))
+	publish("team-a", signJWT(t, rsaKey, "rsa", expired)).Status(http.StatusUnauthorized)
+
+	audience := ciClaims("https://gitlab.example.com", "team-a/app", valid)
+	audience["aud"] = []string{"other"}
+	publish("team-a", signJWT(t, rsaKey, "rsa", audience)).Status(http.StatusUnauthorized)
+
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	publish("team-a", signJWT(t, otherKey, "rsa", ciClaims("https://gitlab.example.com", "team-a/app", valid))).
+		Status(http.StatusUnauthorized)
+
+	// tokens of unknown issuers are not recognized
+	publish("team-a", signJWT(t, rsaKey, "rsa", ciClaims("https://other.example.com", "team-a/app", valid))).
+		Status(http.StatusUnauthorized)
+}
+
+func TestOIDCConfiguration(t *testing.T) {
+	tests := map[string]services.OIDCIssuer{
+		"missing audience": {Issuer: "https://ci.example.com", JWKSURL: "https://ci.example.com/jwks"},
+		"missing keys":     {Issuer: "https://ci.example.com", Audience: "anthology"},
+		"unknown role": {Issuer: "https://ci.example.com", Audience: "anthology", JWKSURL: "https://ci.example.com/jwks",
+			Rules: []services.ClaimRule{{Role: "owner"}}},
+		"unreadable file": {Issuer: "https://ci.example.com", Audience: "anthology", JWKSFile: "/does/not/exist"},
+	}
+
+	for name, issuer := range tests {
+		if _, err := services.NewOIDCAuthenticator(services.OIDCConfig{Issuers: []services.OIDCIssuer{issuer}}); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
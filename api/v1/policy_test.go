@@ -0,0 +1,153 @@
+package v1_test
+
+import (
+	"github.com/erikvanbrakel/anthology/registry"
+	"github.com/erikvanbrakel/anthology/services"
+	"github.com/gavv/httpexpect"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+var testPolicy = &services.Policy{
+	Groups: map[string][]string{
+		"team-a": {"token:alice"},
+	},
+	Grants: []services.Grant{
+		{Subjects: []string{"*"}, Namespaces: []string{"public"}, Role: services.RoleReader},
+		{Subjects: []string{"group:team-a"}, Namespaces: []string{"team-a*"}, Role: services.RolePublisher},
+		{Subjects: []string{"token:admin"}, Namespaces: []string{"*"}, Role: services.RoleAdmin},
+	},
+}
+
+var policyDataset = []testModule{
+	{"public", "module1", "aws", "1.0.0", moduleArchive(map[string]string{"main.tf": "# main.tf"})},
+	{"team-a", "module1", "aws", "1.0.0", moduleArchive(map[string]string{"main.tf": "# main.tf"})},
+	{"team-b", "module1", "aws", "1.0.0", moduleArchive(map[string]string{"main.tf": "# main.tf"})},
+}
+
+func TestPolicy(t *testing.T) {
+	path := writeTokens(t,
+		"alice:"+tokenHash("alice-token"),
+		"admin:"+tokenHash("admin-token"),
+	)
+	defer os.Remove(path)
+
+	modules := services.NewModuleService(newTestRegistry(policyDataset))
+	modules.Policy = testPolicy
+
+	server := newServer(authenticate(t, path), serveModules(modules), serveUploads(services.NewUploadService(modules, 0)))
+	defer server.Close()
+	e := httpexpect.New(t, server.URL)
+
+	alice := func(r *httpexpect.Request) *httpexpect.Request {
+		return r.WithHeader("Authorization", "Bearer alice-token")
+	}
+
+	// listings only contain readable namespaces
+	listing := e.GET("/v1/modules/").Expect().Status(http.StatusOK).JSON().Object().Value("modules").Array()
+	listing.Length().Equal(1)
+	listing.Element(0).Object().ValueEqual("namespace", "public")
+
+	listing = alice(e.GET("/v1/modules/")).Expect().Status(http.StatusOK).JSON().Object().Value("modules").Array()
+	listing.Length().Equal(2)
+	alice(e.GET("/v1/modules/")).WithQuery("offset", -1).Expect().Status(http.StatusOK).JSON().Object().
+		Value("modules").Array().Length().Equal(2)
+
+	// private namespaces look like they do not exist
+	e.GET("/v1/modules/team-a/module1/aws/1.0.0").Expect().Status(http.StatusNotFound)
+	e.GET("/v1/modules/team-a/module1/aws/versions").Expect().Status(http.StatusNotFound)
+	e.GET("/v1/modules/team-a/module1/aws/1.0.0/download").Expect().Status(http.StatusNotFound)
+	e.GET("/v1/modules/team-a/module1/aws/1.0.0/data.tgz").Expect().Status(http.StatusNotFound)
+	alice(e.GET("/v1/modules/team-a/module1/aws/1.0.0/download")).Expect().Status(http.StatusNoContent)
+	alice(e.GET("/v1/modules/team-b/module1/aws/1.0.0")).Expect().Status(http.StatusNotFound)
+
+	// publishing needs the publisher role on the namespace
+	e.POST("/v1/modules/team-a/module1/aws/2.0.0").WithBytes(moduleArchive(map[string]string{"main.tf": "# main.tf"})).
+		Expect().Status(http.StatusUnauthorized)
+	alice(e.POST("/v1/modules/team-b/module1/aws/2.0.0")).WithBytes(moduleArchive(map[string]string{"main.tf": "# main.tf"})).
+		Expect().Status(http.StatusForbidden)
+	alice(e.POST("/v1/uploads/team-b/module1/aws/2.0.0")).
+		Expect().Status(http.StatusForbidden)
+	alice(e.POST("/v1/modules/team-a-infra/module1/aws/1.0.0")).WithBytes(moduleArchive(map[string]string{"main.tf": "# main.tf"})).
+		Expect().Status(http.StatusNoContent)
+
+	// deleting needs the admin role
+	alice(e.DELETE("/v1/modules/team-a/module1/aws/1.0.0")).Expect().Status(http.StatusForbidden)
+	e.DELETE("/v1/modules/team-b/module1/aws/1.0.0").WithHeader("Authorization", "Bearer admin-token").
+		Expect().Status(http.StatusNoContent)
+}
+
+func TestProviderPolicy(t *testing.T) {
+	path := writeTokens(t,
+		"alice:"+tokenHash("alice-token"),
+		"admin:"+tokenHash("admin-token"),
+	)
+	defer os.Remove(path)
+
+	objects := map[string]string{}
+	for key, data := range providerRelease() {
+		objects[strings.Replace(key, "namespace1", "team-a", 1)] = data
+	}
+	r := putObjects(registry.NewFakeRegistry(), objects)
+
+	providers := services.NewProviderService(r)
+	providers.Policy = testPolicy
+	mirror := services.NewMirrorService(r)
+	mirror.Policy = testPolicy
+
+	archive := providerZip(t, map[string]string{"terraform-provider-example_v1.0.0": "binary"})
+	if err := mirror.Add("registry.terraform.io", "team-a", "example", "terraform-provider-example_1.0.0_linux_amd64.zip", archive); err != nil {
+		t.Fatal(err)
+	}
+
+	server := newServer(authenticate(t, path), serveProviders(providers), serveMirror(mirror))
+	defer server.Close()
+	e := httpexpect.New(t, server.URL)
+
+	alice := func(r *httpexpect.Request) *httpexpect.Request {
+		return r.WithHeader("Authorization", "Bearer alice-token")
+	}
+	admin := func(r *httpexpect.Request) *httpexpect.Request {
+		return r.WithHeader("Authorization", "Bearer admin-token")
+	}
+
+	// private providers and mirrors look like they do not exist
+	e.GET("/v1/providers/team-a/example/versions").Expect().Status(http.StatusNotFound)
+	e.GET("/v1/providers/team-a/example/1.0.0/download/linux/amd64").Expect().Status(http.StatusNotFound)
+	e.GET("/v1/providers/team-a/example/1.0.0/files/terraform-provider-example_1.0.0_linux_amd64.zip").
+		Expect().Status(http.StatusNotFound)
+	e.GET("/v1/signing-keys/team-a").Expect().Status(http.StatusOK).JSON().Path("$.gpg_public_keys").Array().Empty()
+	e.GET("/v1/mirror/registry.terraform.io/team-a/example/index.json").Expect().Status(http.StatusNotFound)
+	e.GET("/v1/mirror/registry.terraform.io/team-a/example/1.0.0.json").Expect().Status(http.StatusNotFound)
+	e.GET("/v1/mirror/registry.terraform.io/team-a/example/terraform-provider-example_1.0.0_linux_amd64.zip").
+		Expect().Status(http.StatusNotFound)
+
+	alice(e.GET("/v1/providers/team-a/example/versions")).Expect().Status(http.StatusOK)
+	alice(e.GET("/v1/providers/team-a/example/1.0.0/download/linux/amd64")).Expect().Status(http.StatusOK)
+	alice(e.GET("/v1/mirror/registry.terraform.io/team-a/example/index.json")).Expect().Status(http.StatusOK)
+	alice(e.GET("/v1/mirror/registry.terraform.io/team-a/example/terraform-provider-example_1.0.0_linux_amd64.zip")).
+		Expect().Status(http.StatusOK)
+
+	// managing signing keys needs the admin role
+	signer, publicKey := newSigningKey(t)
+	e.POST("/v1/signing-keys/team-a").WithJSON(map[string]string{"ascii_armor": publicKey}).
+		Expect().Status(http.StatusUnauthorized)
+	alice(e.POST("/v1/signing-keys/team-a")).WithJSON(map[string]string{"ascii_armor": publicKey}).
+		Expect().Status(http.StatusForbidden)
+	for _, namespace := range []string{"team-a", "team-b"} {
+		admin(e.POST("/v1/signing-keys/" + namespace)).WithJSON(map[string]string{"ascii_armor": publicKey}).
+			Expect().Status(http.StatusCreated)
+	}
+	alice(e.DELETE("/v1/signing-keys/team-a/" + signer.PrimaryKey.KeyIdString())).Expect().Status(http.StatusForbidden)
+
+	// publishing needs the publisher role on the namespace
+	release := signedRelease(t, signer, "3.0.0", map[string]string{"linux_amd64": "linux"})
+	asAlice := e.Builder(func(r *httpexpect.Request) { r.WithHeader("Authorization", "Bearer alice-token") })
+	publishRelease(e, "/v1/providers/team-a/example/3.0.0", release).Status(http.StatusUnauthorized)
+	publishRelease(asAlice, "/v1/providers/team-b/example/3.0.0", release).Status(http.StatusForbidden)
+	publishRelease(asAlice, "/v1/providers/team-a/example/3.0.0", release).Status(http.StatusCreated)
+
+	admin(e.DELETE("/v1/signing-keys/team-b/" + signer.PrimaryKey.KeyIdString())).Expect().Status(http.StatusNoContent)
+}
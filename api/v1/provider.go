@@ -0,0 +1,135 @@
+package v1
+
+import (
+	"github.com/erikvanbrakel/anthology/app"
+	"github.com/erikvanbrakel/anthology/models"
+	"github.com/go-ozzo/ozzo-routing"
+	"io"
+	"net/http"
+)
+
+type (
+	providerService interface {
+		QueryVersions(rs app.RequestScope, namespace, providerType string) ([]models.ProviderVersion, error)
+		GetPackage(rs app.RequestScope, namespace, providerType, version, os, arch string) (*models.ProviderPackage, error)
+		GetFile(rs app.RequestScope, namespace, providerType, version, filename string) (io.ReadCloser, error)
+		SHASumsFilename(providerType, version string) string
+		SHASumsSignatureFilename(providerType, version string) string
+		Publish(rs app.RequestScope, namespace, providerType, version string, files map[string]io.ReadSeeker) error
+	}
+
+	providerResource struct {
+		service providerService
+	}
+)
+
+func ServeProviderResource(rg *routing.RouteGroup, service providerService) {
+	r := &providerResource{service}
+
+	// List available versions for a specific provider
+	rg.Get("/<namespace>/<type>/versions", r.queryVersions)
+
+	// Find a provider package for a specific platform
+	rg.Get("/<namespace>/<type>/<version>/download/<os>/<arch>", r.getPackage)
+
+	// Publish a provider release
+	rg.Post("/<namespace>/<type>/<version>", r.publish)
+
+	// Download one of the files of a provider release
+	rg.Get("/<namespace>/<type>/<version>/files/<filename>", r.getFile).Name("GetProviderFile")
+}
+
+func (r *providerResource) queryVersions(c *routing.Context) error {
+	rs := app.GetRequestScope(c)
+
+	versions, err := r.service.QueryVersions(rs, c.Param("namespace"), c.Param("type"))
+	if err != nil {
+		return err
+	}
+
+	if len(versions) == 0 {
+		c.Response.WriteHeader(http.StatusNotFound)
+		return c.Write(apiError{[]string{"not found"}})
+	}
+
+	return c.Write(struct {
+		Versions []models.ProviderVersion `json:"versions"`
+	}{versions})
+}
+
+func (r *providerResource) getPackage(c *routing.Context) error {
+	rs := app.GetRequestScope(c)
+	namespace, providerType, version := c.Param("namespace"), c.Param("type"), c.Param("version")
+
+	pkg, err := r.service.GetPackage(rs, namespace, providerType, version, c.Param("os"), c.Param("arch"))
+	if err != nil {
+		return writeServiceError(c, err)
+	}
+
+	fileURL := func(filename string) string {
+		return c.URL("GetProviderFile",
+			"namespace", namespace,
+			"type", providerType,
+			"version", version,
+			"filename", filename,
+		)
+	}
+
+	pkg.DownloadURL = fileURL(pkg.Filename)
+	pkg.SHASumsURL = fileURL(r.service.SHASumsFilename(providerType, version))
+	pkg.SHASumsSignatureURL = fileURL(r.service.SHASumsSignatureFilename(providerType, version))
+
+	return c.Write(pkg)
+}
+
+// maxMemory is the part of a multipart upload kept in memory, the remainder is
+// buffered in temporary files.
+const maxMemory = 32 << 20
+
+func (r *providerResource) publish(c *routing.Context) error {
+	rs := app.GetRequestScope(c)
+	namespace, providerType, version := c.Param("namespace"), c.Param("type"), c.Param("version")
+
+	if err := c.Request.ParseMultipartForm(maxMemory); err != nil {
+		c.Response.WriteHeader(http.StatusBadRequest)
+		return c.Write(apiError{[]string{"a release must be uploaded as multipart/form-data: " + err.Error()}})
+	}
+	defer c.Request.MultipartForm.RemoveAll()
+
+	files := map[string]io.ReadSeeker{}
+	for _, headers := range c.Request.MultipartForm.File {
+		for _, header := range headers {
+			f, err := header.Open()
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			files[header.Filename] = f
+		}
+	}
+
+	if err := r.service.Publish(rs, namespace, providerType, version, files); err != nil {
+		return writeServiceError(c, err)
+	}
+
+	c.Response.WriteHeader(http.StatusCreated)
+	return c.Write(struct {
+		Namespace string `json:"namespace"`
+		Type      string `json:"type"`
+		Version   string `json:"version"`
+	}{namespace, providerType, version})
+}
+
+func (r *providerResource) getFile(c *routing.Context) error {
+	rs := app.GetRequestScope(c)
+
+	data, err := r.service.GetFile(rs, c.Param("namespace"), c.Param("type"), c.Param("version"), c.Param("filename"))
+	if err != nil {
+		return writeServiceError(c, err)
+	}
+	defer data.Close()
+
+	c.Response.Header().Set("Content-Type", "application/octet-stream")
+	_, err = io.Copy(c.Response, data)
+	return err
+}
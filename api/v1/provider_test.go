@@ -0,0 +1,194 @@
+package v1_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"github.com/erikvanbrakel/anthology/registry"
+	"github.com/erikvanbrakel/anthology/services"
+	"github.com/gavv/httpexpect"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const testSigningKey = "-----BEGIN PGP PUBLIC KEY BLOCK-----\n\ntest\n-----END PGP PUBLIC KEY BLOCK-----\n"
+
+// putObjects stores objects, keyed by their path, in a registry.
+func putObjects(r registry.Registry, objects map[string]string) registry.Registry {
+	for key, data := range objects {
+		r.PutObject(key, strings.NewReader(data))
+	}
+	return r
+}
+
+func providerRelease() map[string]string {
+	return map[string]string{
+		"providers/namespace1/example/1.0.0/terraform-provider-example_1.0.0_linux_amd64.zip":  "linux",
+		"providers/namespace1/example/1.0.0/terraform-provider-example_1.0.0_darwin_arm64.zip": "darwin",
+		"providers/namespace1/example/1.0.0/terraform-provider-example_1.0.0_SHA256SUMS": "" +
+			"aaaa  terraform-provider-example_1.0.0_linux_amd64.zip\n" +
+			"bbbb  terraform-provider-example_1.0.0_darwin_arm64.zip\n",
+		"providers/namespace1/example/1.0.0/terraform-provider-example_1.0.0_SHA256SUMS.sig":  "signature",
+		"providers/namespace1/example/2.0.0/terraform-provider-example_2.0.0_linux_amd64.zip": "linux",
+		"providers/namespace1/example/2.0.0/terraform-provider-example_2.0.0_manifest.json":   `{"version":1,"metadata":{"protocol_versions":["6.0"]}}`,
+		"providers/namespace1/example/2.0.0/terraform-provider-example_2.0.0_SHA256SUMS":      "cccc  terraform-provider-example_2.0.0_linux_amd64.zip\n",
+		"providers/namespace1/example/2.0.0/terraform-provider-example_2.0.0_SHA256SUMS.sig":  "signature",
+		"signing-keys/namespace1/ABCDEF0123456789.asc":                                        testSigningKey,
+	}
+}
+
+func TestListProviderVersions(t *testing.T) {
+	server := newServer(serveProviders(services.NewProviderService(putObjects(registry.NewFakeRegistry(), providerRelease()))))
+	defer server.Close()
+	e := httpexpect.New(t, server.URL)
+
+	versions := e.GET("/v1/providers/namespace1/example/versions").
+		Expect().Status(http.StatusOK).JSON().Object().Value("versions").Array()
+
+	versions.Length().Equal(2)
+
+	first := versions.Element(0).Object()
+	first.ValueEqual("version", "1.0.0")
+	first.ValueEqual("protocols", []string{"5.0"})
+	first.Value("platforms").Array().Length().Equal(2)
+
+	second := versions.Element(1).Object()
+	second.ValueEqual("version", "2.0.0")
+	second.ValueEqual("protocols", []string{"6.0"})
+	second.Value("platforms").Array().Element(0).Object().ValueEqual("os", "linux").ValueEqual("arch", "amd64")
+
+	e.GET("/v1/providers/namespace1/absent/versions").
+		Expect().Status(http.StatusNotFound).JSON().Object().Value("errors").Array().Contains(errorNotFound)
+}
+
+func TestGetProviderPackage(t *testing.T) {
+	server := newServer(serveProviders(services.NewProviderService(putObjects(registry.NewFakeRegistry(), providerRelease()))))
+	defer server.Close()
+	e := httpexpect.New(t, server.URL)
+
+	pkg := e.GET("/v1/providers/namespace1/example/1.0.0/download/darwin/arm64").
+		Expect().Status(http.StatusOK).JSON().Object()
+
+	pkg.ValueEqual("os", "darwin")
+	pkg.ValueEqual("arch", "arm64")
+	pkg.ValueEqual("filename", "terraform-provider-example_1.0.0_darwin_arm64.zip")
+	pkg.ValueEqual("shasum", "bbbb")
+	pkg.ValueEqual("protocols", []string{"5.0"})
+
+	key := pkg.Path("$.signing_keys.gpg_public_keys").Array().Element(0).Object()
+	key.ValueEqual("key_id", "ABCDEF0123456789")
+	key.ValueEqual("ascii_armor", testSigningKey)
+
+	e.GET(pkg.Value("download_url").String().Raw()).Expect().Status(http.StatusOK).Body().Equal("darwin")
+	e.GET(pkg.Value("shasums_url").String().Raw()).Expect().Status(http.StatusOK).Body().Contains("bbbb")
+	e.GET(pkg.Value("shasums_signature_url").String().Raw()).Expect().Status(http.StatusOK).Body().Equal("signature")
+
+	e.GET("/v1/providers/namespace1/example/1.0.0/download/windows/amd64").Expect().Status(http.StatusNotFound)
+	e.GET("/v1/providers/namespace1/example/3.0.0/download/linux/amd64").Expect().Status(http.StatusNotFound)
+}
+
+func newSigningKey(t *testing.T) (*openpgp.Entity, string) {
+	entity, err := openpgp.NewEntity("Anthology Test", "", "test@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range entity.Identities {
+		if err := id.SelfSignature.SignUserId(id.UserId.Id, entity.PrimaryKey, entity.PrivateKey, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, subkey := range entity.Subkeys {
+		if err := subkey.Sig.SignKey(subkey.PublicKey, entity.PrivateKey, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	w, _ := armor.Encode(buf, openpgp.PublicKeyType, nil)
+	if err := entity.Serialize(w); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	return entity, buf.String()
+}
+
+func signedRelease(t *testing.T, signer *openpgp.Entity, version string, packages map[string]string) map[string]string {
+	files := map[string]string{}
+	sums := &bytes.Buffer{}
+
+	for platform, content := range packages {
+		filename := "terraform-provider-example_" + version + "_" + platform + ".zip"
+		files[filename] = content
+		fmt.Fprintf(sums, "%x  %s\n", sha256.Sum256([]byte(content)), filename)
+	}
+
+	signature := &bytes.Buffer{}
+	if err := openpgp.DetachSign(signature, signer, bytes.NewReader(sums.Bytes()), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	files["terraform-provider-example_"+version+"_SHA256SUMS"] = sums.String()
+	files["terraform-provider-example_"+version+"_SHA256SUMS.sig"] = signature.String()
+	return files
+}
+
+func publishRelease(e *httpexpect.Expect, path string, files map[string]string) *httpexpect.Response {
+	request := e.POST(path).WithMultipart()
+	for filename, content := range files {
+		request = request.WithFile("files", filename, strings.NewReader(content))
+	}
+	return request.Expect()
+}
+
+func TestPublishProvider(t *testing.T) {
+	signer, publicKey := newSigningKey(t)
+	other, _ := newSigningKey(t)
+
+	server := newServer(serveProviders(services.NewProviderService(registry.NewFakeRegistry())))
+	defer server.Close()
+	e := httpexpect.New(t, server.URL)
+
+	e.POST("/v1/signing-keys/namespace1").WithJSON(map[string]string{"ascii_armor": "not a key"}).
+		Expect().Status(http.StatusBadRequest)
+
+	e.POST("/v1/signing-keys/namespace1").WithJSON(map[string]string{"ascii_armor": publicKey}).
+		Expect().Status(http.StatusCreated).JSON().Object().ValueEqual("key_id", signer.PrimaryKey.KeyIdString())
+
+	e.GET("/v1/signing-keys/namespace1").Expect().Status(http.StatusOK).
+		JSON().Path("$.gpg_public_keys").Array().Length().Equal(1)
+
+	release := signedRelease(t, signer, "1.0.0", map[string]string{"linux_amd64": "linux", "darwin_arm64": "darwin"})
+
+	publishRelease(e, "/v1/providers/namespace1/example/1.0.0", release).Status(http.StatusCreated)
+	publishRelease(e, "/v1/providers/namespace1/example/1.0.0", release).Status(http.StatusConflict)
+
+	e.GET("/v1/providers/namespace1/example/versions").Expect().Status(http.StatusOK).
+		JSON().Path("$.versions[0].platforms").Array().Length().Equal(2)
+
+	pkg := e.GET("/v1/providers/namespace1/example/1.0.0/download/linux/amd64").Expect().Status(http.StatusOK).JSON().Object()
+	pkg.Path("$.signing_keys.gpg_public_keys[0].key_id").Equal(signer.PrimaryKey.KeyIdString())
+	e.GET(pkg.Value("download_url").String().Raw()).Expect().Status(http.StatusOK).Body().Equal("linux")
+
+	tampered := signedRelease(t, signer, "2.0.0", map[string]string{"linux_amd64": "linux"})
+	tampered["terraform-provider-example_2.0.0_linux_amd64.zip"] = "tampered"
+	publishRelease(e, "/v1/providers/namespace1/example/2.0.0", tampered).Status(http.StatusBadRequest).
+		JSON().Object().Value("errors").Array().Element(0).String().Contains("checksum mismatch")
+
+	unknownSigner := signedRelease(t, other, "2.0.0", map[string]string{"linux_amd64": "linux"})
+	publishRelease(e, "/v1/providers/namespace1/example/2.0.0", unknownSigner).Status(http.StatusBadRequest).
+		JSON().Object().Value("errors").Array().Element(0).String().Contains("signature")
+
+	unsigned := signedRelease(t, signer, "2.0.0", map[string]string{"linux_amd64": "linux"})
+	delete(unsigned, "terraform-provider-example_2.0.0_SHA256SUMS.sig")
+	publishRelease(e, "/v1/providers/namespace1/example/2.0.0", unsigned).Status(http.StatusBadRequest)
+
+	e.GET("/v1/providers/namespace1/example/2.0.0/download/linux/amd64").Expect().Status(http.StatusNotFound)
+
+	e.DELETE("/v1/signing-keys/namespace1/" + signer.PrimaryKey.KeyIdString()).Expect().Status(http.StatusNoContent)
+	e.DELETE("/v1/signing-keys/namespace1/" + signer.PrimaryKey.KeyIdString()).Expect().Status(http.StatusNotFound)
+}
@@ -0,0 +1,75 @@
+package v1
+
+import (
+	"github.com/erikvanbrakel/anthology/app"
+	"github.com/erikvanbrakel/anthology/models"
+	"github.com/go-ozzo/ozzo-routing"
+	"net/http"
+)
+
+type (
+	signingKeyService interface {
+		SigningKeys(rs app.RequestScope, namespace string) ([]models.GPGPublicKey, error)
+		AddSigningKey(rs app.RequestScope, namespace, armor string) (*models.GPGPublicKey, error)
+		DeleteSigningKey(rs app.RequestScope, namespace, keyID string) error
+	}
+
+	signingKeyResource struct {
+		service signingKeyService
+	}
+)
+
+func ServeSigningKeyResource(rg *routing.RouteGroup, service signingKeyService) {
+	r := &signingKeyResource{service}
+
+	// List the public keys provider releases of a namespace are signed with
+	rg.Get("/<namespace>", r.query)
+
+	// Register a public key for a namespace
+	rg.Post("/<namespace>", r.add)
+
+	// Remove a public key from a namespace
+	rg.Delete("/<namespace>/<key_id>", r.delete)
+}
+
+func (r *signingKeyResource) query(c *routing.Context) error {
+	rs := app.GetRequestScope(c)
+
+	keys, err := r.service.SigningKeys(rs, c.Param("namespace"))
+	if err != nil {
+		return err
+	}
+
+	return c.Write(models.SigningKeys{GPGPublicKeys: keys})
+}
+
+func (r *signingKeyResource) add(c *routing.Context) error {
+	rs := app.GetRequestScope(c)
+
+	var request struct {
+		ASCIIArmor string `json:"ascii_armor"`
+	}
+	if err := c.Read(&request); err != nil || request.ASCIIArmor == "" {
+		c.Response.WriteHeader(http.StatusBadRequest)
+		return c.Write(apiError{[]string{"ascii_armor is required"}})
+	}
+
+	key, err := r.service.AddSigningKey(rs, c.Param("namespace"), request.ASCIIArmor)
+	if err != nil {
+		return writeServiceError(c, err)
+	}
+
+	c.Response.WriteHeader(http.StatusCreated)
+	return c.Write(key)
+}
+
+func (r *signingKeyResource) delete(c *routing.Context) error {
+	rs := app.GetRequestScope(c)
+
+	if err := r.service.DeleteSigningKey(rs, c.Param("namespace"), c.Param("key_id")); err != nil {
+		return writeServiceError(c, err)
+	}
+
+	c.Response.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,116 @@
+package v1_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/erikvanbrakel/anthology/models"
+	"github.com/erikvanbrakel/anthology/registry"
+	"github.com/erikvanbrakel/anthology/services"
+	"github.com/gavv/httpexpect"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestModuleTags(t *testing.T) {
+	path := writeTokens(t, "alice:"+tokenHash("alice-token"), "admin:"+tokenHash("admin-token"))
+	defer os.Remove(path)
+
+	r := registry.NewFakeRegistry()
+	r.PublishModule("team-a", "module1", "aws", "1.0.0", bytes.NewReader(moduleArchive(map[string]string{"main.tf": "# main.tf"})))
+	r.PublishModule("team-a", "module1", "aws", "1.1.0", bytes.NewReader(moduleArchive(map[string]string{"main.tf": "# main.tf"})))
+	r.PublishModule("team-a", "module1", "aws", "2.0.0-beta.1", bytes.NewReader(moduleArchive(map[string]string{"main.tf": "# main.tf"})))
+
+	modules := services.NewModuleService(r)
+	modules.Policy = &services.Policy{Grants: []services.Grant{
+		{Subjects: []string{"*"}, Namespaces: []string{"team-a"}, Role: services.RoleReader},
+		{Subjects: []string{"token:alice"}, Namespaces: []string{"team-a"}, Role: services.RolePublisher},
+		{Subjects: []string{"token:admin"}, Namespaces: []string{"team-a"}, Role: services.RoleAdmin},
+	}}
+
+	var mu sync.Mutex
+	var untagged []string
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event models.Event
+		json.NewDecoder(r.Body).Decode(&event)
+
+		mu.Lock()
+		defer mu.Unlock()
+		untagged = append(untagged, event.Tag+"@"+event.Version)
+	}))
+	defer receiver.Close()
+
+	webhooks, err := services.NewWebhookService(r, []services.WebhookSubscription{
+		{ID: "untagged", URL: receiver.URL, Secret: "secret", Events: []string{services.EventModuleUntagged}},
+	}, 1, time.Millisecond, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer webhooks.Close()
+	modules.Webhooks = webhooks
+
+	server := newServer(authenticate(t, path), serveModules(modules))
+	defer server.Close()
+	e := newExpect(t, server)
+
+	alice := func(r *httpexpect.Request) *httpexpect.Request {
+		return r.WithHeader("Authorization", "Bearer alice-token")
+	}
+
+	e.GET("/v1/modules/team-a/module1/aws/tags").Expect().Status(http.StatusOK).JSON().Object().Value("tags").Object().Empty()
+	e.GET("/v1/modules/team-a/module1/aws/stable/download").Expect().Status(http.StatusNotFound)
+
+	e.PUT("/v1/modules/team-a/module1/aws/tags/stable").WithJSON(map[string]string{"version": "1.0.0"}).
+		Expect().Status(http.StatusUnauthorized)
+	alice(e.PUT("/v1/modules/team-a/module1/aws/tags/stable")).WithJSON(map[string]string{"version": "1.0.0"}).
+		Expect().Status(http.StatusOK).JSON().Path("$.tags.stable").Equal("1.0.0")
+	alice(e.PUT("/v1/modules/team-a/module1/aws/tags/beta")).WithJSON(map[string]string{"version": "2.0.0-beta.1"}).
+		Expect().Status(http.StatusOK)
+	alice(e.PUT("/v1/modules/team-a/module1/aws/tags/stable")).WithJSON(map[string]string{"version": "1.1.0"}).
+		Expect().Status(http.StatusOK)
+
+	alice(e.PUT("/v1/modules/team-a/module1/aws/tags/1.0.0")).WithJSON(map[string]string{"version": "1.0.0"}).
+		Expect().Status(http.StatusBadRequest)
+	alice(e.PUT("/v1/modules/team-a/module1/aws/tags/Stable")).WithJSON(map[string]string{"version": "1.0.0"}).
+		Expect().Status(http.StatusBadRequest)
+	alice(e.PUT("/v1/modules/team-a/module1/aws/tags/stable")).WithJSON(map[string]string{"version": "3.0.0"}).
+		Expect().Status(http.StatusBadRequest)
+	alice(e.PUT("/v1/modules/team-a/module1/aws/tags/stable")).WithJSON(map[string]string{}).
+		Expect().Status(http.StatusBadRequest)
+
+	e.GET("/v1/modules/team-a/module1/aws/stable/download").Expect().Status(http.StatusFound).
+		Header("Location").Equal("/v1/modules/team-a/module1/aws/1.1.0/download")
+	e.GET("/v1/modules/team-a/module1/aws/versions").Expect().Status(http.StatusOK).
+		JSON().Path("$.modules[0].tags").Object().Equal(map[string]string{"stable": "1.1.0", "beta": "2.0.0-beta.1"})
+
+	history := e.GET("/v1/modules/team-a/module1/aws/tags").Expect().Status(http.StatusOK).JSON().Object().Value("history").Array()
+	history.Length().Equal(3)
+	history.Last().Object().ValueEqual("tag", "stable").ValueEqual("version", "1.1.0").
+		ValueEqual("previous", "1.0.0").ValueEqual("principal", "token:alice")
+
+	alice(e.DELETE("/v1/modules/team-a/module1/aws/tags/beta")).Expect().Status(http.StatusNoContent)
+	alice(e.DELETE("/v1/modules/team-a/module1/aws/tags/beta")).Expect().Status(http.StatusNotFound)
+	e.GET("/v1/modules/team-a/module1/aws/beta/download").Expect().Status(http.StatusNotFound)
+	e.GET("/v1/modules/team-a/module1/aws/tags").Expect().Status(http.StatusOK).JSON().Object().Value("history").Array().Length().Equal(4)
+
+	// deleting a version removes the tags pointing to it
+	e.DELETE("/v1/modules/team-a/module1/aws/1.1.0").WithHeader("Authorization", "Bearer admin-token").
+		Expect().Status(http.StatusNoContent)
+	tags := e.GET("/v1/modules/team-a/module1/aws/tags").Expect().Status(http.StatusOK).JSON().Object()
+	tags.Value("tags").Object().Empty()
+	tags.Value("history").Array().Last().Object().ValueEqual("tag", "stable").NotContainsKey("version").
+		ValueEqual("previous", "1.1.0").ValueEqual("principal", "token:admin")
+	e.GET("/v1/modules/team-a/module1/aws/stable/download").Expect().Status(http.StatusNotFound)
+
+	waitForDeliveries(t, webhooks)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(untagged, ",") != "beta@2.0.0-beta.1,stable@1.1.0" {
+		t.Errorf("expected module.untagged events for beta and stable, got %v", untagged)
+	}
+}
@@ -0,0 +1,155 @@
+package v1
+
+import (
+	"github.com/erikvanbrakel/anthology/app"
+	"github.com/erikvanbrakel/anthology/models"
+	"github.com/erikvanbrakel/anthology/services"
+	"github.com/go-ozzo/ozzo-routing"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const tusVersion = "1.0.0"
+
+type (
+	uploadService interface {
+		Create(rs app.RequestScope, namespace, name, provider, version string) (*models.UploadSession, *services.DirectUpload, error)
+		Receive(rs app.RequestScope, id string, data io.Reader) error
+		Offset(rs app.RequestScope, id string) (int64, error)
+		Append(rs app.RequestScope, id string, offset int64, data io.Reader) (int64, error)
+		Finalize(rs app.RequestScope, id string) (*models.Module, error)
+	}
+
+	uploadResource struct {
+		service uploadService
+	}
+
+	// uploadSession tells the client where to send the archive. The upload
+	// url always points to Anthology and accepts the archive in one PUT or in
+	// resumable PATCH requests; the direct upload url is a presigned link to
+	// PUT the archive straight to storage, when the backend has one, and has
+	// to be sent the direct upload headers.
+	uploadSession struct {
+		ID                  string            `json:"id"`
+		UploadURL           string            `json:"upload_url"`
+		UploadMethod        string            `json:"upload_method"`
+		DirectUploadURL     string            `json:"direct_upload_url,omitempty"`
+		DirectUploadHeaders map[string]string `json:"direct_upload_headers,omitempty"`
+		FinalizeURL         string            `json:"finalize_url"`
+		ExpiresAt           time.Time         `json:"expires_at"`
+	}
+)
+
+func ServeUploadResource(rg *routing.RouteGroup, service uploadService) {
+	r := &uploadResource{service}
+
+	// Open an upload session for a specific module version
+	rg.Post("/<namespace>/<name>/<provider>/<version>", r.create)
+
+	// Upload the archive for a session when the backend has no direct upload
+	rg.Put("/<id>", r.receive).Name("ReceiveUpload")
+
+	// Query and continue a resumable upload, following the tus protocol
+	rg.Head("/<id>", r.offset)
+	rg.Patch("/<id>", r.append)
+
+	// Publish the uploaded archive
+	rg.Post("/<id>/finalize", r.finalize).Name("FinalizeUpload")
+}
+
+func (r *uploadResource) create(c *routing.Context) error {
+	rs := app.GetRequestScope(c)
+	namespace, name, provider, version := c.Param("namespace"), c.Param("name"), c.Param("provider"), c.Param("version")
+
+	session, direct, err := r.service.Create(rs, namespace, name, provider, version)
+	if err != nil {
+		return writeServiceError(c, err)
+	}
+
+	response := uploadSession{
+		ID:           session.ID,
+		UploadURL:    c.URL("ReceiveUpload", "id", session.ID),
+		UploadMethod: http.MethodPut,
+		FinalizeURL:  c.URL("FinalizeUpload", "id", session.ID),
+		ExpiresAt:    session.ExpiresAt,
+	}
+	if direct != nil {
+		response.DirectUploadURL = direct.URL
+		if len(direct.Headers) > 0 {
+			response.DirectUploadHeaders = map[string]string{}
+			for name := range direct.Headers {
+				response.DirectUploadHeaders[name] = direct.Headers.Get(name)
+			}
+		}
+	}
+
+	c.Response.WriteHeader(http.StatusCreated)
+	return c.Write(response)
+}
+
+func (r *uploadResource) receive(c *routing.Context) error {
+	rs := app.GetRequestScope(c)
+
+	if err := r.service.Receive(rs, c.Param("id"), c.Request.Body); err != nil {
+		return writeServiceError(c, err)
+	}
+
+	c.Response.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (r *uploadResource) offset(c *routing.Context) error {
+	rs := app.GetRequestScope(c)
+
+	offset, err := r.service.Offset(rs, c.Param("id"))
+	if err != nil {
+		return writeServiceError(c, err)
+	}
+
+	c.Response.Header().Set("Tus-Resumable", tusVersion)
+	c.Response.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	c.Response.Header().Set("Cache-Control", "no-store")
+	c.Response.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (r *uploadResource) append(c *routing.Context) error {
+	rs := app.GetRequestScope(c)
+
+	if c.Request.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		c.Response.WriteHeader(http.StatusUnsupportedMediaType)
+		return c.Write(apiError{[]string{"chunks must be sent as application/offset+octet-stream"}})
+	}
+
+	offset, err := strconv.ParseInt(c.Request.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		c.Response.WriteHeader(http.StatusBadRequest)
+		return c.Write(apiError{[]string{"missing or invalid Upload-Offset header"}})
+	}
+
+	offset, err = r.service.Append(rs, c.Param("id"), offset, c.Request.Body)
+
+	c.Response.Header().Set("Tus-Resumable", tusVersion)
+	if err != services.ErrNotFound {
+		c.Response.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	}
+	if err != nil {
+		return writeServiceError(c, err)
+	}
+
+	c.Response.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (r *uploadResource) finalize(c *routing.Context) error {
+	rs := app.GetRequestScope(c)
+
+	module, err := r.service.Finalize(rs, c.Param("id"))
+	if err != nil {
+		return writeServiceError(c, err)
+	}
+
+	return c.Write(module)
+}
@@ -0,0 +1,269 @@
+package v1_test
+
+import (
+	"bytes"
+	"github.com/erikvanbrakel/anthology/registry"
+	"github.com/erikvanbrakel/anthology/services"
+	"github.com/gavv/httpexpect"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// encryptingRegistry hands out direct upload URLs that require headers, like
+// S3 with server-side encryption.
+type encryptingRegistry struct {
+	registry.Registry
+}
+
+func (r encryptingRegistry) GetObjectUploadURL(key string, ttl time.Duration) (string, http.Header, error) {
+	return "https://storage.example.com/" + key, http.Header{"X-Amz-Server-Side-Encryption": {"aws:kms"}}, nil
+}
+
+func TestUploadSession(t *testing.T) {
+	dataset := []testModule{
+		{"namespace1", "module1", "aws", "1.0.0", nil},
+	}
+	archive := moduleArchive(map[string]string{
+		"main.tf":      "# main.tf",
+		"variables.tf": "# variables.tf",
+	})
+
+	t.Run("upload and finalize a module", func(t *testing.T) {
+		modules := services.NewModuleService(newTestRegistry(dataset))
+		server := newServer(serveModules(modules), serveUploads(services.NewUploadService(modules, time.Hour)))
+		defer server.Close()
+		e := httpexpect.New(t, server.URL)
+
+		session := e.POST("/v1/uploads/namespace1/module1/aws/2.0.0").
+			Expect().Status(http.StatusCreated).JSON().Object()
+
+		session.ValueEqual("upload_method", "PUT")
+		uploadURL := session.Value("upload_url").String().NotEmpty().Raw()
+		finalizeURL := session.Value("finalize_url").String().NotEmpty().Raw()
+
+		e.PUT(uploadURL).WithBytes(archive).Expect().Status(http.StatusNoContent)
+
+		module := e.POST(finalizeURL).Expect().Status(http.StatusOK).JSON().Object()
+		module.ValueEqual("version", "2.0.0")
+
+		e.GET("/v1/modules/namespace1/module1/aws/2.0.0/data.tgz").
+			Expect().Status(http.StatusOK).Body().Equal(string(archive))
+
+		e.POST(finalizeURL).Expect().Status(http.StatusNotFound)
+	})
+
+	t.Run("direct uploads with required headers", func(t *testing.T) {
+		modules := services.NewModuleService(encryptingRegistry{newTestRegistry(dataset)})
+		server := newServer(serveModules(modules), serveUploads(services.NewUploadService(modules, time.Hour)))
+		defer server.Close()
+		e := httpexpect.New(t, server.URL)
+
+		session := e.POST("/v1/uploads/namespace1/module1/aws/2.0.0").
+			Expect().Status(http.StatusCreated).JSON().Object()
+		session.Value("direct_upload_url").String().Match("^https://storage.example.com/")
+		session.Value("direct_upload_headers").Object().Equal(map[string]string{"X-Amz-Server-Side-Encryption": "aws:kms"})
+
+		modules = services.NewModuleService(newTestRegistry(dataset))
+		server = newServer(serveModules(modules), serveUploads(services.NewUploadService(modules, time.Hour)))
+		defer server.Close()
+		httpexpect.New(t, server.URL).POST("/v1/uploads/namespace1/module1/aws/2.0.0").
+			Expect().Status(http.StatusCreated).JSON().Object().
+			NotContainsKey("direct_upload_url").NotContainsKey("direct_upload_headers")
+	})
+
+	t.Run("upload an existing version", func(t *testing.T) {
+		modules := services.NewModuleService(newTestRegistry(dataset))
+		server := newServer(serveModules(modules), serveUploads(services.NewUploadService(modules, time.Hour)))
+		defer server.Close()
+		e := httpexpect.New(t, server.URL)
+
+		e.POST("/v1/uploads/namespace1/module1/aws/1.0.0").
+			Expect().Status(http.StatusConflict)
+	})
+
+	t.Run("finalize the same version twice at once", func(t *testing.T) {
+		modules := services.NewModuleService(newTestRegistry(dataset))
+		server := newServer(serveModules(modules), serveUploads(services.NewUploadService(modules, time.Hour)))
+		defer server.Close()
+		e := httpexpect.New(t, server.URL)
+
+		var finalizeURLs []string
+		for i := 0; i < 2; i++ {
+			session := e.POST("/v1/uploads/namespace1/module1/aws/2.0.0").
+				Expect().Status(http.StatusCreated).JSON().Object()
+			e.PUT(session.Value("upload_url").String().Raw()).WithBytes(archive).Expect().Status(http.StatusNoContent)
+			finalizeURLs = append(finalizeURLs, session.Value("finalize_url").String().Raw())
+		}
+
+		statuses := make(chan int, len(finalizeURLs))
+		for _, url := range finalizeURLs {
+			go func(url string) {
+				resp, err := http.Post(server.URL+url, "", nil)
+				if err != nil {
+					statuses <- 0
+					return
+				}
+				resp.Body.Close()
+				statuses <- resp.StatusCode
+			}(url)
+		}
+
+		got := map[int]int{}
+		for range finalizeURLs {
+			got[<-statuses]++
+		}
+		if got[http.StatusOK] != 1 || got[http.StatusConflict] != 1 {
+			t.Fatalf("expected one finalize to succeed and one to conflict, got %v", got)
+		}
+	})
+
+	t.Run("finalize without an archive", func(t *testing.T) {
+		modules := services.NewModuleService(newTestRegistry(dataset))
+		server := newServer(serveModules(modules), serveUploads(services.NewUploadService(modules, time.Hour)))
+		defer server.Close()
+		e := httpexpect.New(t, server.URL)
+
+		finalizeURL := e.POST("/v1/uploads/namespace1/module1/aws/2.0.0").
+			Expect().Status(http.StatusCreated).JSON().Object().Value("finalize_url").String().Raw()
+
+		e.POST(finalizeURL).Expect().Status(http.StatusBadRequest)
+	})
+
+	t.Run("finalize an invalid archive", func(t *testing.T) {
+		modules := services.NewModuleService(newTestRegistry(dataset))
+		server := newServer(serveModules(modules), serveUploads(services.NewUploadService(modules, time.Hour)))
+		defer server.Close()
+		e := httpexpect.New(t, server.URL)
+
+		session := e.POST("/v1/uploads/namespace1/module1/aws/2.0.0").
+			Expect().Status(http.StatusCreated).JSON().Object()
+
+		e.PUT(session.Value("upload_url").String().Raw()).WithText("not an archive").Expect().Status(http.StatusNoContent)
+		e.POST(session.Value("finalize_url").String().Raw()).Expect().Status(http.StatusBadRequest).
+			JSON().Object().Value("errors").Array().Contains("archive is not gzip compressed")
+	})
+
+	t.Run("expired sessions are cleaned up", func(t *testing.T) {
+		r := registry.NewFakeRegistry()
+		uploads := services.NewUploadService(services.NewModuleService(r), time.Hour)
+
+		server := newServer(serveUploads(uploads))
+		defer server.Close()
+		e := httpexpect.New(t, server.URL)
+
+		session := e.POST("/v1/uploads/namespace1/module1/aws/2.0.0").
+			Expect().Status(http.StatusCreated).JSON().Object()
+		e.PUT(session.Value("upload_url").String().Raw()).WithBytes(archive).Expect().Status(http.StatusNoContent)
+
+		if removed, _ := uploads.Cleanup(time.Now()); removed != 0 {
+			t.Errorf("expected no sessions to be removed, removed %d", removed)
+		}
+		if removed, _ := uploads.Cleanup(time.Now().Add(2 * time.Hour)); removed != 1 {
+			t.Errorf("expected 1 session to be removed, removed %d", removed)
+		}
+		if keys, _ := r.ListObjects("uploads/"); len(keys) != 0 {
+			t.Errorf("expected staged data to be removed, found %v", keys)
+		}
+
+		e.POST(session.Value("finalize_url").String().Raw()).Expect().Status(http.StatusNotFound)
+	})
+
+	t.Run("resume a chunked upload", func(t *testing.T) {
+		modules := services.NewModuleService(newTestRegistry(dataset))
+		server := newServer(serveModules(modules), serveUploads(services.NewUploadService(modules, time.Hour)))
+		defer server.Close()
+		e := httpexpect.New(t, server.URL)
+
+		session := e.POST("/v1/uploads/namespace1/module1/aws/2.0.0").
+			Expect().Status(http.StatusCreated).JSON().Object()
+		uploadURL := session.Value("upload_url").String().Raw()
+
+		e.HEAD(uploadURL).Expect().Status(http.StatusOK).Header("Upload-Offset").Equal("0")
+
+		half := len(archive) / 2
+		e.PATCH(uploadURL).
+			WithHeader("Content-Type", "application/offset+octet-stream").
+			WithHeader("Upload-Offset", "0").
+			WithBytes(archive[:half]).
+			Expect().Status(http.StatusNoContent).Header("Upload-Offset").Equal(strconv.Itoa(half))
+
+		e.PATCH(uploadURL).
+			WithHeader("Content-Type", "application/offset+octet-stream").
+			WithHeader("Upload-Offset", "0").
+			WithBytes(archive[:half]).
+			Expect().Status(http.StatusConflict).Header("Upload-Offset").Equal(strconv.Itoa(half))
+
+		offset := e.HEAD(uploadURL).Expect().Status(http.StatusOK).Header("Upload-Offset").Raw()
+
+		e.PATCH(uploadURL).
+			WithHeader("Content-Type", "application/offset+octet-stream").
+			WithHeader("Upload-Offset", offset).
+			WithBytes(archive[half:]).
+			Expect().Status(http.StatusNoContent).Header("Upload-Offset").Equal(strconv.Itoa(len(archive)))
+
+		e.POST(session.Value("finalize_url").String().Raw()).Expect().Status(http.StatusOK)
+
+		e.GET("/v1/modules/namespace1/module1/aws/2.0.0/data.tgz").
+			Expect().Status(http.StatusOK).Body().Equal(string(archive))
+	})
+
+	t.Run("concurrent chunks at the same offset", func(t *testing.T) {
+		modules := services.NewModuleService(newTestRegistry(dataset))
+		server := newServer(serveModules(modules), serveUploads(services.NewUploadService(modules, time.Hour)))
+		defer server.Close()
+		e := httpexpect.New(t, server.URL)
+
+		session := e.POST("/v1/uploads/namespace1/module1/aws/2.0.0").
+			Expect().Status(http.StatusCreated).JSON().Object()
+		uploadURL := session.Value("upload_url").String().Raw()
+
+		half := len(archive) / 2
+		statuses := make(chan int, 4)
+		for i := 0; i < cap(statuses); i++ {
+			go func() {
+				req, _ := http.NewRequest(http.MethodPatch, server.URL+uploadURL, bytes.NewReader(archive[:half]))
+				req.Header.Set("Content-Type", "application/offset+octet-stream")
+				req.Header.Set("Upload-Offset", "0")
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					statuses <- 0
+					return
+				}
+				resp.Body.Close()
+				statuses <- resp.StatusCode
+			}()
+		}
+
+		got := map[int]int{}
+		for i := 0; i < cap(statuses); i++ {
+			got[<-statuses]++
+		}
+		if got[http.StatusNoContent] != 1 || got[http.StatusConflict] != cap(statuses)-1 {
+			t.Fatalf("expected one chunk to be stored and the others to conflict, got %v", got)
+		}
+
+		e.PATCH(uploadURL).
+			WithHeader("Content-Type", "application/offset+octet-stream").
+			WithHeader("Upload-Offset", strconv.Itoa(half)).
+			WithBytes(archive[half:]).
+			Expect().Status(http.StatusNoContent)
+		e.POST(session.Value("finalize_url").String().Raw()).Expect().Status(http.StatusOK)
+	})
+
+	t.Run("chunk without offset", func(t *testing.T) {
+		modules := services.NewModuleService(newTestRegistry(dataset))
+		server := newServer(serveModules(modules), serveUploads(services.NewUploadService(modules, time.Hour)))
+		defer server.Close()
+		e := httpexpect.New(t, server.URL)
+
+		uploadURL := e.POST("/v1/uploads/namespace1/module1/aws/2.0.0").
+			Expect().Status(http.StatusCreated).JSON().Object().Value("upload_url").String().Raw()
+
+		e.PATCH(uploadURL).
+			WithHeader("Content-Type", "application/offset+octet-stream").
+			WithBytes(archive).
+			Expect().Status(http.StatusBadRequest)
+	})
+}
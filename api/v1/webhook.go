@@ -0,0 +1,49 @@
+package v1
+
+import (
+	"github.com/erikvanbrakel/anthology/app"
+	"github.com/erikvanbrakel/anthology/models"
+	"github.com/go-ozzo/ozzo-routing"
+	"strconv"
+)
+
+type (
+	webhookService interface {
+		Deliveries(rs app.RequestScope, subscription, status string, offset, limit int) ([]models.WebhookDelivery, int, error)
+	}
+
+	webhookResource struct {
+		service webhookService
+	}
+)
+
+func ServeWebhookResource(rg *routing.RouteGroup, service webhookService) {
+	r := &webhookResource{service}
+
+	// List the delivery log, only deliveries of events in namespaces the
+	// caller administers are returned. Without a policy any authenticated
+	// caller may list it.
+	rg.Get("/deliveries", r.deliveries)
+}
+
+func (r *webhookResource) deliveries(c *routing.Context) error {
+	rs := app.GetRequestScope(c)
+
+	offset, _ := strconv.Atoi(c.Query("offset", "0"))
+	limit, _ := strconv.Atoi(c.Query("limit", "100"))
+
+	deliveries, count, err := r.service.Deliveries(rs, c.Query("subscription"), c.Query("status"), offset, limit)
+	if err != nil {
+		return writeServiceError(c, err)
+	}
+
+	meta := PaginationInfo{CurrentOffset: offset, Limit: limit}
+	if offset+len(deliveries) < count {
+		meta.NextOffset = offset + len(deliveries)
+	}
+
+	return c.Write(struct {
+		PaginationInfo PaginationInfo           `json:"meta"`
+		Deliveries     []models.WebhookDelivery `json:"deliveries"`
+	}{meta, deliveries})
+}
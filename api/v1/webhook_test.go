@@ -0,0 +1,152 @@
+package v1_test
+
+import (
+	"encoding/json"
+	"github.com/erikvanbrakel/anthology/api/v1"
+	"github.com/erikvanbrakel/anthology/models"
+	"github.com/erikvanbrakel/anthology/registry"
+	"github.com/erikvanbrakel/anthology/services"
+	"github.com/gavv/httpexpect"
+	"github.com/go-ozzo/ozzo-routing"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhooks(t *testing.T) {
+	var mu sync.Mutex
+	var received []models.Event
+	attempts := 0
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get("X-Anthology-Signature") != services.SignWebhook("secret", body) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		// the first delivery fails, so it has to be retried
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		var event models.Event
+		json.Unmarshal(body, &event)
+		received = append(received, event)
+	}))
+	defer receiver.Close()
+
+	tokens := writeTokens(t, "ci:"+tokenHash("ci-token"))
+	defer os.Remove(tokens)
+
+	r := registry.NewFakeRegistry()
+	webhooks, err := services.NewWebhookService(r, []services.WebhookSubscription{
+		{ID: "ci", URL: receiver.URL, Secret: "secret", Namespaces: []string{"namespace1"}, Events: []string{services.EventModulePublished}},
+		{ID: "unreachable", URL: receiver.URL, Secret: "wrong", Namespaces: []string{"namespace2"}},
+	}, 3, 10*time.Millisecond, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer webhooks.Close()
+
+	modules := services.NewModuleService(r)
+	modules.Webhooks = webhooks
+
+	server := newServer(authenticate(t, tokens), serveModules(modules), func(router *routing.Router) {
+		v1.ServeWebhookResource(router.Group("/v1/webhooks"), webhooks)
+	})
+	defer server.Close()
+	e := httpexpect.New(t, server.URL)
+
+	e.POST("/v1/modules/namespace1/module1/aws/1.0.0").WithBytes(moduleArchive(map[string]string{"main.tf": "# main.tf"})).
+		Expect().Status(http.StatusNoContent)
+	e.DELETE("/v1/modules/namespace1/module1/aws/1.0.0").
+		Expect().Status(http.StatusNoContent)
+	e.POST("/v1/modules/namespace2/module1/aws/1.0.0").WithBytes(moduleArchive(map[string]string{"main.tf": "# main.tf"})).
+		Expect().Status(http.StatusNoContent)
+
+	waitForDeliveries(t, webhooks)
+
+	// without a policy the log is only available to authenticated callers
+	e.GET("/v1/webhooks/deliveries").Expect().Status(http.StatusUnauthorized)
+
+	ci := func(r *httpexpect.Request) *httpexpect.Request {
+		return r.WithHeader("Authorization", "Bearer ci-token")
+	}
+
+	deliveries := ci(e.GET("/v1/webhooks/deliveries")).Expect().Status(http.StatusOK).JSON().Object().Value("deliveries").Array()
+	deliveries.Length().Equal(2)
+
+	delivered := deliveries.Element(0).Object()
+	delivered.ValueEqual("subscription", "ci")
+	delivered.ValueEqual("status", models.DeliveryDelivered)
+	delivered.ValueEqual("attempts", 2)
+	delivered.Value("event").Object().ValueEqual("type", services.EventModulePublished)
+
+	failed := deliveries.Element(1).Object()
+	failed.ValueEqual("subscription", "unreachable")
+	failed.ValueEqual("status", models.DeliveryFailed)
+	failed.ValueEqual("attempts", 3)
+	failed.ValueEqual("last_status_code", http.StatusUnauthorized)
+
+	ci(e.GET("/v1/webhooks/deliveries")).WithQuery("status", models.DeliveryFailed).
+		Expect().Status(http.StatusOK).JSON().Object().Value("deliveries").Array().Length().Equal(1)
+
+	page := ci(e.GET("/v1/webhooks/deliveries")).WithQuery("limit", 1).Expect().Status(http.StatusOK).JSON().Object()
+	page.Value("deliveries").Array().Length().Equal(1)
+	page.Path("$.meta.next_offset").Equal(1)
+	ci(e.GET("/v1/webhooks/deliveries")).WithQuery("offset", 1).Expect().Status(http.StatusOK).JSON().Object().
+		Value("deliveries").Array().Element(0).Object().ValueEqual("subscription", "unreachable")
+	ci(e.GET("/v1/webhooks/deliveries")).WithQuery("offset", -1).Expect().Status(http.StatusOK).JSON().Object().
+		Value("deliveries").Array().Length().Equal(2)
+
+	// delivered entries expire, failed ones are kept
+	webhooks.Retention = time.Hour
+	if removed, err := webhooks.Cleanup(time.Now().Add(2 * time.Hour)); err != nil || removed != 1 {
+		t.Fatalf("expected 1 expired delivery, got %d, %v", removed, err)
+	}
+	ci(e.GET("/v1/webhooks/deliveries")).Expect().Status(http.StatusOK).JSON().Object().
+		Value("deliveries").Array().Element(0).Object().ValueEqual("status", models.DeliveryFailed)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(received) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(received))
+	}
+	if event := received[0]; event.Namespace != "namespace1" || event.Version != "1.0.0" || event.Principal != "anonymous" {
+		t.Errorf("unexpected event %+v", event)
+	}
+}
+
+func waitForDeliveries(t *testing.T, webhooks *services.WebhookService) {
+	for i := 0; i < 100; i++ {
+		pending, _, err := webhooks.Deliveries(nil, "", models.DeliveryPending, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pending) == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("webhook deliveries are still pending")
+}
+
+func TestWebhookSubscriptionsNeedASecret(t *testing.T) {
+	_, err := services.NewWebhookService(registry.NewFakeRegistry(), []services.WebhookSubscription{
+		{ID: "ci", URL: "https://ci.example.com/hooks/anthology"},
+	}, 3, time.Second, 1)
+	if err == nil {
+		t.Error("expected a subscription without a secret to be rejected")
+	}
+}
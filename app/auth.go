@@ -0,0 +1,86 @@
+package app
+
+import (
+	"errors"
+	"github.com/erikvanbrakel/anthology/models"
+	"github.com/go-ozzo/ozzo-routing"
+	"net/http"
+	"strings"
+)
+
+// ErrInvalidCredentials is returned by an Authenticator for credentials that
+// are meant for it but are not valid.
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// Authenticator resolves the credentials of a request to a principal. It
+// returns nil without an error when the request carries no credentials it
+// recognizes.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*models.Principal, error)
+}
+
+// Authenticate attaches the principal found by the first matching
+// authenticator to the request scope. Requests without credentials continue
+// anonymously, requests with invalid or unrecognized credentials are rejected.
+func Authenticate(authenticators ...Authenticator) routing.Handler {
+	return func(c *routing.Context) error {
+		rs := GetRequestScope(c)
+
+		for _, a := range authenticators {
+			p, err := a.Authenticate(c.Request)
+			if err == ErrInvalidCredentials {
+				rs.Infof("rejected request with invalid credentials")
+				return unauthorized(c, err.Error())
+			}
+			if err != nil {
+				return err
+			}
+			if p != nil {
+				rs.SetPrincipal(p)
+				return nil
+			}
+		}
+
+		// a token nobody recognizes is as invalid as an expired one
+		if BearerToken(c.Request) != "" {
+			rs.Infof("rejected request with an unknown token")
+			return unauthorized(c, ErrInvalidCredentials.Error())
+		}
+
+		return nil
+	}
+}
+
+func unauthorized(c *routing.Context, message string) error {
+	c.Abort()
+	c.Response.Header().Set("WWW-Authenticate", `Bearer realm="anthology"`)
+	c.Response.WriteHeader(http.StatusUnauthorized)
+	return c.Write(map[string][]string{"errors": {message}})
+}
+
+// BearerToken returns the token of an "Authorization: Bearer" header, or an
+// empty string when there is none.
+func BearerToken(r *http.Request) string {
+	parts := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(parts[1])
+}
+
+// RequireAuthentication rejects anonymous reads (GET and HEAD requests)
+// and/or anonymous writes (all other requests).
+func RequireAuthentication(read, write bool) routing.Handler {
+	return func(c *routing.Context) error {
+		required := write
+		if c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead {
+			required = read
+		}
+
+		if !required || GetRequestScope(c).Principal() != nil {
+			return nil
+		}
+
+		return unauthorized(c, "authentication required")
+	}
+}
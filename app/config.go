@@ -1,9 +1,15 @@
 package app
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
 	"github.com/jessevdk/go-flags"
 	"github.com/sirupsen/logrus"
+	"io/ioutil"
 	"os"
+	"time"
 )
 
 var Config = &CommonOptions{}
@@ -14,16 +20,118 @@ type CommonOptions struct {
 	S3         S3Options         `group:"S3 configuration" namespace:"s3"`
 	FileSystem FileSystemOptions `group:"Filesystem configuration" namespace:"filesystem"`
 	SSLConfig  SSLOptions        `group:"SSL Configuration" namespace:"ssl"`
+	Uploads    UploadOptions     `group:"Upload configuration" namespace:"uploads"`
+	Cache      CacheOptions      `group:"Cache configuration" namespace:"cache"`
+	Auth       AuthOptions       `group:"Authentication" namespace:"auth"`
+	Audit      AuditOptions      `group:"Audit configuration" namespace:"audit"`
+	Webhooks   WebhookOptions    `group:"Webhook configuration" namespace:"webhooks"`
+	Git        GitOptions        `group:"Git configuration" namespace:"git"`
+
+	Mirror      MirrorCommand      `command:"mirror" description:"Populate the provider network mirror from a directory written by terraform providers mirror, then exit"`
+	VerifyAudit VerifyAuditCommand `command:"verify-audit" description:"Verify the hash chain of the audit log, then exit"`
+
+	// Command is the name of the command given on the command line, empty
+	// when the server should be started.
+	Command string `no-flag:"true"`
+}
+
+type MirrorCommand struct {
+	Args struct {
+		Directory string `positional-arg-name:"directory"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+type CacheOptions struct {
+	Directory  string        `long:"directory" description:"Directory for cached module archives, archives are not cached when empty"`
+	MaxSize    int64         `long:"max-size" description:"Maximum size of the archive cache in bytes" default:"1073741824"`
+	ListingTTL time.Duration `long:"listing-ttl" description:"Time module listings are cached in memory, listings are not cached when 0"`
+}
+
+func (o CacheOptions) IsEnabled() bool {
+	return o.Directory != "" || o.ListingTTL > 0
+}
+
+type VerifyAuditCommand struct{}
+
+type AuditOptions struct {
+	File    string `long:"file" description:"Append audit entries as JSON lines to this file"`
+	Backend bool   `long:"backend" description:"Store audit entries in the configured backend"`
+}
+
+func (o AuditOptions) Validate() error {
+	if o.File != "" && o.Backend {
+		return errors.New("--audit.file and --audit.backend are mutually exclusive")
+	}
+	return nil
+}
+
+type WebhookOptions struct {
+	Config      string        `long:"config" description:"JSON file with the webhook subscriptions, no webhooks are sent when empty"`
+	MaxAttempts int           `long:"max-attempts" description:"Number of times a delivery is attempted before it is marked as failed" default:"8"`
+	RetryDelay  time.Duration `long:"retry-delay" description:"Delay before the first retry of a failed delivery, doubled after every attempt" default:"10s"`
+	Workers     int           `long:"workers" description:"Number of deliveries attempted at the same time" default:"4"`
+	Retention   time.Duration `long:"retention" description:"How long delivered entries are kept in the delivery log, forever when 0" default:"168h"`
+}
+
+type GitOptions struct {
+	Enabled   bool          `long:"enabled" description:"Allow publishing modules from tags in git repositories"`
+	Directory string        `long:"directory" description:"Directory to keep fetched repositories in, repositories are fetched into a temporary directory when empty"`
+	Timeout   time.Duration `long:"timeout" description:"Time git may take to fetch and archive a tag" default:"5m"`
+	Hooks     string        `long:"hooks" description:"JSON file mapping repositories that publish on tag pushes to modules"`
+	Schemes   []string      `long:"scheme" description:"URL scheme remotes may use, can be repeated" choice:"file" choice:"http" choice:"https" choice:"ssh" default:"https"`
+	Remotes   []string      `long:"remote" description:"Prefix remotes have to start with, e.g. https://github.com/example/, can be repeated; any remote is allowed when not set"`
+}
+
+type AuthOptions struct {
+	Users        string        `long:"users" description:"htpasswd file with bcrypt hashed passwords of the users that can log in with terraform login"`
+	ClientID     string        `long:"client-id" description:"OAuth client ID used by terraform login" default:"terraform-cli"`
+	TokenTTL     time.Duration `long:"token-ttl" description:"Lifetime of the tokens issued by terraform login" default:"720h"`
+	Tokens       string        `long:"tokens" description:"File with the names and SHA256 hashes of accepted bearer tokens"`
+	RequireRead  bool          `long:"require-read" description:"Reject anonymous reads"`
+	RequireWrite bool          `long:"require-write" description:"Reject anonymous writes, like publishing and deleting"`
+	Policy       string        `long:"policy" description:"JSON file granting roles on namespaces, all namespaces are open when empty"`
+	OIDC         string        `long:"oidc" description:"JSON file with the OIDC issuers whose tokens are accepted"`
+}
+
+// Validate refuses OIDC authentication without a policy. Without one every
+// namespace is open, so any token of a trusted issuer could publish anywhere.
+func (o AuthOptions) Validate() error {
+	if o.OIDC != "" && o.Policy == "" {
+		return errors.New("--auth.oidc requires --auth.policy")
+	}
+	return nil
+}
+
+// IsLoginEnabled reports whether terraform login is offered.
+func (o AuthOptions) IsLoginEnabled() bool {
+	return o.Users != ""
+}
+
+type UploadOptions struct {
+	TTL time.Duration `long:"ttl" description:"Time an upload session stays open before it is cleaned up" default:"1h"`
 }
 
 type SSLOptions struct {
-	Certificate string `long:"certificate" description:"Path to the SSL certificate"`
-	Key         string `long:"key" description:"Path to the SSL certificate key"`
+	Certificate     string `long:"certificate" description:"Path to the SSL certificate"`
+	Key             string `long:"key" description:"Path to the SSL certificate key"`
+	ClientCA        string `long:"client-ca" description:"Bundle of CA certificates client certificates are verified against"`
+	ClientAuth      string `long:"client-auth" description:"Whether clients have to present a certificate" choice:"none" choice:"require" choice:"verify-if-given" default:"none"`
+	ClientPrincipal string `long:"client-principal" description:"Part of a client certificate used as principal name" choice:"subject" choice:"dns" choice:"email" choice:"uri" default:"subject"`
 }
 
 type S3Options struct {
-	Bucket   string `long:"bucket" description:"S3 bucket to use as backing storage"`
-	Endpoint string `long:"endpoint" description:"S3 endpoint"`
+	Bucket             string        `long:"bucket" description:"S3 bucket to use as backing storage"`
+	Endpoint           string        `long:"endpoint" description:"S3 endpoint"`
+	Region             string        `long:"region" description:"AWS region of the bucket" default:"us-east-1"`
+	Prefix             string        `long:"prefix" description:"Key prefix under which modules are stored"`
+	VirtualHostedStyle bool          `long:"virtual-hosted-style" description:"Use virtual-hosted-style instead of path-style addressing"`
+	Profile            string        `long:"profile" description:"Named profile from the shared AWS configuration"`
+	RoleArn            string        `long:"role-arn" description:"ARN of a role to assume for bucket access"`
+	RoleSessionName    string        `long:"role-session-name" description:"Session name used when assuming the role" default:"anthology"`
+	SSE                string        `long:"sse" description:"Server-side encryption for stored objects" choice:"AES256" choice:"aws:kms"`
+	KMSKeyID           string        `long:"kms-key-id" description:"KMS key ID used with --s3.sse=aws:kms"`
+	ACL                string        `long:"acl" description:"Canned ACL applied to stored objects"`
+	PresignTTL         time.Duration `long:"presign-ttl" description:"Let clients download archives straight from S3 through presigned URLs valid for this long (0 disables)"`
 }
 
 type FileSystemOptions struct {
@@ -32,6 +140,7 @@ type FileSystemOptions struct {
 
 func LoadConfig() error {
 	p := flags.NewParser(Config, flags.Default)
+	p.SubcommandsOptional = true
 
 	if _, err := p.Parse(); err != nil {
 		if flagsErr, ok := err.(*flags.Error); ok && flagsErr.Type == flags.ErrHelp {
@@ -41,9 +150,71 @@ func LoadConfig() error {
 		}
 	}
 
+	if p.Active != nil {
+		Config.Command = p.Active.Name
+	}
+
 	return nil
 }
 
+func (o S3Options) Validate() error {
+	if o.Bucket == "" {
+		return errors.New("s3 backend requires --s3.bucket")
+	}
+
+	if o.KMSKeyID != "" && o.SSE != "aws:kms" {
+		return errors.New("--s3.kms-key-id requires --s3.sse=aws:kms")
+	}
+
+	return nil
+}
+
+// Validate refuses client certificate authentication without TLS, since
+// there would be no client certificates to check.
+func (o SSLOptions) Validate() error {
+	if o.ClientAuth == "" || o.ClientAuth == "none" {
+		return nil
+	}
+
+	if !o.IsValid() {
+		return errors.New("--ssl.client-auth requires --ssl.certificate and --ssl.key")
+	}
+	if o.ClientCA == "" {
+		return errors.New("--ssl.client-auth requires --ssl.client-ca")
+	}
+
+	return nil
+}
+
+// TLSConfig returns the server TLS configuration for client certificate
+// verification.
+func (o SSLOptions) TLSConfig() (*tls.Config, error) {
+	if o.ClientAuth == "" || o.ClientAuth == "none" {
+		return &tls.Config{}, nil
+	}
+
+	if o.ClientCA == "" {
+		return nil, errors.New("--ssl.client-auth requires --ssl.client-ca")
+	}
+
+	bundle, err := ioutil.ReadFile(o.ClientCA)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bundle) {
+		return nil, fmt.Errorf("no certificates found in %s", o.ClientCA)
+	}
+
+	config := &tls.Config{ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven}
+	if o.ClientAuth == "require" {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
+
 func (o SSLOptions) IsValid() bool {
 	if o.Certificate == "" && o.Key == "" {
 		return false
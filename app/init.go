@@ -13,14 +13,14 @@ import (
 func Init(logger *logrus.Logger) routing.Handler {
 	return func(rc *routing.Context) error {
 		now := time.Now()
-		rc.Response = &access.LogResponseWriter{rc.Response, http.StatusOK, 0}
+		rc.Response = &access.LogResponseWriter{ResponseWriter: rc.Response, Status: http.StatusOK}
 
 		ac := newRequestScope(now, logger, rc.Request)
 
 		rc.Set("Context", ac)
 
 		fault.Recovery(ac.Errorf, convertError)(rc)
-		logAccess(rc, ac.Infof, ac.Now())
+		logAccess(rc, ac, ac.Now())
 
 		return nil
 	}
@@ -31,11 +31,19 @@ func GetRequestScope(c *routing.Context) RequestScope {
 	return c.Get("Context").(RequestScope)
 }
 
-func logAccess(c *routing.Context, logFunc access.LogFunc, start time.Time) {
+// logAccess logs a request with the name of the authenticated principal, or
+// "-" for anonymous requests.
+func logAccess(c *routing.Context, rs RequestScope, start time.Time) {
 	rw := c.Response.(*access.LogResponseWriter)
 	elapsed := float64(time.Now().Sub(start).Nanoseconds()) / 1e6
 	requestLine := fmt.Sprintf("%s %s %s", c.Request.Method, c.Request.URL.Path, c.Request.Proto)
-	logFunc(`[%.3fms] %s %d %d`, elapsed, requestLine, rw.Status, rw.BytesWritten)
+
+	principal := "-"
+	if p := rs.Principal(); p != nil {
+		principal = p.Type + ":" + p.Name
+	}
+
+	rs.Infof(`[%.3fms] %s %s %d %d`, elapsed, principal, requestLine, rw.Status, rw.BytesWritten)
 }
 
 func convertError(c *routing.Context, err error) error {
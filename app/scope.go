@@ -1,6 +1,9 @@
 package app
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/erikvanbrakel/anthology/models"
 	"github.com/sirupsen/logrus"
 	"net/http"
 	"time"
@@ -9,20 +12,28 @@ import (
 type RequestScope interface {
 	Logger
 	Now() time.Time
+	// RequestID identifies the request, it is taken from the X-Request-Id
+	// header when the client sends one.
+	RequestID() string
+	// Principal returns the authenticated caller, nil for anonymous requests.
+	Principal() *models.Principal
+	SetPrincipal(p *models.Principal)
 }
 
 type requestScope struct {
 	Logger
 	now       time.Time
 	requestID string
+	principal *models.Principal
 }
 
 func newRequestScope(now time.Time, logger *logrus.Logger, request *http.Request) RequestScope {
 	log := NewLogger(logger, logrus.Fields{})
 	requestID := request.Header.Get("X-Request-Id")
-	if requestID != "" {
-		log.SetField("RequestID", requestID)
+	if requestID == "" {
+		requestID = newRequestID()
 	}
+	log.SetField("RequestID", requestID)
 	return &requestScope{
 		Logger:    log,
 		now:       now,
@@ -33,3 +44,24 @@ func newRequestScope(now time.Time, logger *logrus.Logger, request *http.Request
 func (rs *requestScope) Now() time.Time {
 	return rs.now
 }
+
+func (rs *requestScope) RequestID() string {
+	return rs.requestID
+}
+
+func (rs *requestScope) Principal() *models.Principal {
+	return rs.principal
+}
+
+func (rs *requestScope) SetPrincipal(p *models.Principal) {
+	rs.principal = p
+	if p != nil {
+		rs.SetField("Principal", p.Name)
+	}
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
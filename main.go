@@ -10,12 +10,22 @@ import (
 	"github.com/go-ozzo/ozzo-routing/content"
 	"github.com/sirupsen/logrus"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func main() {
 	if err := app.LoadConfig(); err != nil {
 		panic(fmt.Errorf("invalid configuration: %s", err))
 	}
+	if err := app.Config.SSLConfig.Validate(); err != nil {
+		panic(fmt.Errorf("invalid SSL configuration: %s", err))
+	}
+	if err := app.Config.Auth.Validate(); err != nil {
+		panic(fmt.Errorf("invalid authentication configuration: %s", err))
+	}
 
 	logger := logrus.New()
 
@@ -23,25 +33,159 @@ func main() {
 
 	switch app.Config.Backend {
 	case "s3":
-		r = registry.NewS3Registry(app.Config.S3)
+		var err error
+		if r, err = registry.NewS3Registry(app.Config.S3); err != nil {
+			panic(fmt.Errorf("invalid s3 configuration: %s", err))
+		}
 		break
 	case "filesystem":
 		r = registry.NewFilesystemRegistry(app.Config.FileSystem)
 		break
 	}
-	http.Handle("/", buildRouter(logger, r))
+	if app.Config.Cache.IsEnabled() {
+		var err error
+		if r, err = registry.NewCachingRegistry(r, app.Config.Cache); err != nil {
+			panic(fmt.Errorf("invalid cache configuration: %s", err))
+		}
+	}
+
+	audit, err := newAuditLog(r)
+	if err != nil {
+		panic(fmt.Errorf("invalid audit configuration: %s", err))
+	}
+
+	modules := services.NewModuleService(r)
+	if app.Config.Auth.Policy != "" {
+		if modules.Policy, err = services.LoadPolicy(app.Config.Auth.Policy); err != nil {
+			panic(fmt.Errorf("invalid policy: %s", err))
+		}
+	}
+	modules.Audit = audit
+	if audit != nil {
+		audit.Policy = modules.Policy
+	}
+
+	uploads := services.NewUploadService(modules, app.Config.Uploads.TTL)
+	bulk := services.NewBulkService(modules)
+	drafts := services.NewDraftService(modules)
+	providers := services.NewProviderService(r)
+	providers.Policy = modules.Policy
+	providers.Audit = audit
+	mirror := services.NewMirrorService(r)
+	mirror.Policy = modules.Policy
+
+	var webhooks *services.WebhookService
+	if app.Config.Webhooks.Config != "" {
+		if webhooks, err = services.LoadWebhookService(r, app.Config.Webhooks.Config, app.Config.Webhooks.MaxAttempts, app.Config.Webhooks.RetryDelay, app.Config.Webhooks.Workers); err != nil {
+			panic(fmt.Errorf("invalid webhook configuration: %s", err))
+		}
+		webhooks.Retention = app.Config.Webhooks.Retention
+		webhooks.Policy = modules.Policy
+		modules.Webhooks = webhooks
+		providers.Webhooks = webhooks
+	}
+
+	if app.Config.Command == "verify-audit" {
+		if audit == nil {
+			logger.Fatal("no audit log is configured")
+		}
+		verified, err := audit.Verify()
+		if err != nil {
+			logger.Fatalf("audit log verification failed after %d entries: %s", verified, err)
+		}
+		logger.Infof("verified %d audit entries", verified)
+		return
+	}
+
+	if app.Config.Command == "mirror" {
+		imported, err := mirror.Import(app.Config.Mirror.Args.Directory)
+		if err != nil {
+			logger.Fatalf("unable to populate the provider mirror: %s", err)
+		}
+		logger.Infof("imported %d provider packages into the mirror", imported)
+		return
+	}
+
+	var git *services.GitService
+	if app.Config.Git.Enabled {
+		if git, err = services.NewGitService(modules, app.Config.Git.Directory, app.Config.Git.Timeout, app.Config.Git.Schemes, app.Config.Git.Remotes); err != nil {
+			panic(fmt.Errorf("invalid git configuration: %s", err))
+		}
+	}
+
+	var hooks *services.HookService
+	if app.Config.Git.Hooks != "" {
+		if git == nil {
+			panic(fmt.Errorf("invalid git configuration: --git.hooks requires --git.enabled"))
+		}
+		if hooks, err = services.LoadHookService(r, git, app.Config.Git.Hooks); err != nil {
+			panic(fmt.Errorf("invalid git hook configuration: %s", err))
+		}
+		hooks.Policy = modules.Policy
+	}
+
+	var login *services.LoginService
+	if app.Config.Auth.IsLoginEnabled() {
+		users, err := services.LoadUserStore(app.Config.Auth.Users)
+		if err != nil {
+			panic(fmt.Errorf("invalid user store: %s", err))
+		}
+		login = services.NewLoginService(r, users, app.Config.Auth.ClientID, app.Config.Auth.TokenTTL)
+
+		go cleanup(logger, "login codes and tokens", login.Cleanup)
+	}
+
+	var authenticators []app.Authenticator
+	if login != nil {
+		authenticators = append(authenticators, login)
+	}
+	if app.Config.Auth.Tokens != "" {
+		tokens, err := services.NewFileTokenStore(app.Config.Auth.Tokens)
+		if err != nil {
+			panic(fmt.Errorf("invalid token store: %s", err))
+		}
+		authenticators = append(authenticators, services.NewTokenAuthenticator(tokens))
+	}
+	if app.Config.Auth.OIDC != "" {
+		oidc, err := services.LoadOIDCAuthenticator(app.Config.Auth.OIDC)
+		if err != nil {
+			panic(fmt.Errorf("invalid OIDC configuration: %s", err))
+		}
+		authenticators = append(authenticators, oidc)
+	}
+
+	if app.Config.SSLConfig.ClientAuth != "none" {
+		authenticators = append(authenticators, services.NewCertificateAuthenticator(app.Config.SSLConfig.ClientPrincipal))
+	}
+
+	go cleanup(logger, "upload sessions", uploads.Cleanup)
+
+	if webhooks != nil {
+		if err := webhooks.Resume(); err != nil {
+			logger.Errorf("unable to resume pending webhook deliveries: %s", err)
+		}
+		go cleanup(logger, "webhook deliveries", webhooks.Cleanup)
+		go closeOnSignal(logger, webhooks)
+	}
+
+	http.Handle("/", buildRouter(logger, authenticators, modules, uploads, bulk, drafts, providers, mirror, git, hooks, login, audit, webhooks))
 
 	address := fmt.Sprintf(":%v", app.Config.Port)
 	logger.Infof("server %v is started at %v", app.Version, address)
 
 	if app.Config.SSLConfig.IsValid() {
-		panic(http.ListenAndServeTLS(address, app.Config.SSLConfig.Certificate, app.Config.SSLConfig.Key, nil))
+		tlsConfig, err := app.Config.SSLConfig.TLSConfig()
+		if err != nil {
+			panic(fmt.Errorf("invalid client certificate configuration: %s", err))
+		}
+		server := &http.Server{Addr: address, TLSConfig: tlsConfig}
+		panic(server.ListenAndServeTLS(app.Config.SSLConfig.Certificate, app.Config.SSLConfig.Key))
 	} else {
 		panic(http.ListenAndServe(address, nil))
 	}
 }
 
-func buildRouter(logger *logrus.Logger, reg registry.Registry) *routing.Router {
+func buildRouter(logger *logrus.Logger, authenticators []app.Authenticator, modules *services.ModuleService, uploads *services.UploadService, bulk *services.BulkService, drafts *services.DraftService, providers *services.ProviderService, mirror *services.MirrorService, git *services.GitService, hooks *services.HookService, login *services.LoginService, audit *services.AuditLog, webhooks *services.WebhookService) *routing.Router {
 	router := routing.New()
 
 	router.To("GET,HEAD", "/ping", func(c *routing.Context) error {
@@ -52,17 +196,99 @@ func buildRouter(logger *logrus.Logger, reg registry.Registry) *routing.Router {
 	router.Use(
 		app.Init(logger),
 		content.TypeNegotiator(content.JSON),
+		app.Authenticate(authenticators...),
 	)
 
 	router.To("GET", "/.well-known/terraform.json", func(c *routing.Context) error {
 		c.Abort()
-		return c.Write(map[string]string{
-			"modules.v1": "/v1/modules/",
-		})
+
+		discovery := map[string]interface{}{
+			"modules.v1":   "/v1/modules/",
+			"providers.v1": "/v1/providers/",
+		}
+		if login != nil {
+			discovery["login.v1"] = map[string]interface{}{
+				"client":      login.ClientID,
+				"grant_types": []string{"authz_code"},
+				"authz":       "/oauth/authorization",
+				"token":       "/oauth/token",
+				"ports":       services.LoginPorts,
+			}
+		}
+
+		return c.Write(discovery)
 	})
 
-	rg := router.Group("/v1/modules")
+	api := router.Group("/v1")
+	api.Use(app.RequireAuthentication(app.Config.Auth.RequireRead, app.Config.Auth.RequireWrite))
 
-	v1.ServeModuleResource(rg, services.NewModuleService(reg))
+	v1.ServeModuleResource(api.Group("/modules"), modules)
+	v1.ServeAliasResource(api.Group("/aliases"), modules)
+	v1.ServeUploadResource(api.Group("/uploads"), uploads)
+	v1.ServeBulkResource(api.Group("/bulk"), bulk)
+	v1.ServeDraftResource(api.Group("/drafts"), drafts)
+	v1.ServeProviderResource(api.Group("/providers"), providers)
+	v1.ServeSigningKeyResource(api.Group("/signing-keys"), providers)
+	v1.ServeMirrorResource(api.Group("/mirror"), mirror)
+	if git != nil {
+		v1.ServeGitResource(api.Group("/git"), git)
+	}
+	if hooks != nil {
+		v1.ServeHookResource(api.Group("/hooks"), hooks)
+		v1.ServeHookReceiver(router.Group("/hooks"), hooks)
+	}
+	if audit != nil {
+		v1.ServeAuditResource(api.Group("/audit"), audit)
+	}
+	if webhooks != nil {
+		v1.ServeWebhookResource(api.Group("/webhooks"), webhooks)
+	}
+	if login != nil {
+		v1.ServeLoginResource(router.Group("/oauth"), login)
+	}
 	return router
 }
+
+// newAuditLog opens the configured audit log, or returns nil when auditing is
+// disabled.
+func newAuditLog(r registry.Registry) (*services.AuditLog, error) {
+	if err := app.Config.Audit.Validate(); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case app.Config.Audit.File != "":
+		return services.NewFileAuditLog(app.Config.Audit.File)
+	case app.Config.Audit.Backend:
+		return services.NewStorageAuditLog(r)
+	}
+	return nil, nil
+}
+
+// closeOnSignal lets the webhook deliveries in progress finish before the
+// process exits on SIGINT or SIGTERM. Deliveries waiting for a retry are
+// resumed on the next start.
+func closeOnSignal(logger *logrus.Logger, webhooks *services.WebhookService) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	received := <-signals
+	logger.Infof("received %s, waiting for webhook deliveries in progress", received)
+	webhooks.Close()
+	os.Exit(0)
+}
+
+// cleanup periodically removes expired entries, like upload sessions that were
+// never finalized.
+func cleanup(logger *logrus.Logger, what string, fn func(now time.Time) (int, error)) {
+	for now := range time.Tick(time.Minute) {
+		removed, err := fn(now)
+		if err != nil {
+			logger.Errorf("unable to clean up %s: %s", what, err)
+			continue
+		}
+		if removed > 0 {
+			logger.Infof("removed %d expired %s", removed, what)
+		}
+	}
+}
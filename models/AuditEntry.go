@@ -0,0 +1,31 @@
+package models
+
+import "time"
+
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+)
+
+// AuditEntry records one mutating operation. Entries form a hash chain: the
+// hash of an entry covers all of its other fields, including the hash of the
+// entry before it.
+type AuditEntry struct {
+	Sequence     int64     `json:"sequence"`
+	Time         time.Time `json:"time"`
+	Principal    string    `json:"principal"`
+	RequestID    string    `json:"request_id,omitempty"`
+	Operation    string    `json:"operation"`
+	Namespace    string    `json:"namespace"`
+	Name         string    `json:"name,omitempty"`
+	Provider     string    `json:"provider,omitempty"`
+	Version      string    `json:"version,omitempty"`
+	Tag          string    `json:"tag,omitempty"`
+	Source       string    `json:"source,omitempty"`
+	Target       string    `json:"target,omitempty"`
+	Checksum     string    `json:"checksum,omitempty"`
+	Outcome      string    `json:"outcome"`
+	Error        string    `json:"error,omitempty"`
+	PreviousHash string    `json:"previous_hash"`
+	Hash         string    `json:"hash"`
+}
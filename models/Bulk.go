@@ -0,0 +1,37 @@
+package models
+
+const (
+	BulkPublished  = "published"
+	BulkFailed     = "failed"
+	BulkSkipped    = "skipped"
+	BulkRolledBack = "rolled_back"
+)
+
+// BulkManifest lists the modules to publish from a monorepo archive. Version
+// applies to every module that does not name its own.
+type BulkManifest struct {
+	Version string       `json:"version"`
+	Modules []BulkModule `json:"modules"`
+}
+
+// BulkModule is a module in a monorepo archive, rooted at Path.
+type BulkModule struct {
+	Path     string `json:"path"`
+	Name     string `json:"name"`
+	Provider string `json:"provider"`
+	Version  string `json:"version"`
+
+	*ModuleMetadata
+}
+
+// BulkResult is the outcome of publishing one module of a bulk publish.
+type BulkResult struct {
+	Path      string   `json:"path"`
+	Namespace string   `json:"namespace"`
+	Name      string   `json:"name"`
+	Provider  string   `json:"provider"`
+	Version   string   `json:"version"`
+	Status    string   `json:"status"`
+	Errors    []string `json:"errors,omitempty"`
+	Warnings  []string `json:"warnings,omitempty"`
+}
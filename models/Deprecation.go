@@ -0,0 +1,12 @@
+package models
+
+import "time"
+
+// Deprecation marks a module version that should no longer be used, with a
+// reason and optionally a link to more information.
+type Deprecation struct {
+	Message      string    `json:"message"`
+	Link         string    `json:"link,omitempty"`
+	DeprecatedBy string    `json:"deprecated_by"`
+	DeprecatedAt time.Time `json:"deprecated_at"`
+}
@@ -0,0 +1,16 @@
+package models
+
+import "time"
+
+// Draft is a module version that is stored but not released yet.
+type Draft struct {
+	Namespace string    `json:"namespace"`
+	Name      string    `json:"name"`
+	Provider  string    `json:"provider"`
+	Version   string    `json:"version"`
+	Checksum  string    `json:"checksum"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+
+	*ModuleMetadata
+}
@@ -0,0 +1,35 @@
+package models
+
+import "time"
+
+// Event describes a change in the registry, as sent to webhooks.
+type Event struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	Principal string    `json:"principal"`
+	Namespace string    `json:"namespace"`
+	Name      string    `json:"name,omitempty"`
+	Provider  string    `json:"provider,omitempty"`
+	Version   string    `json:"version,omitempty"`
+	Tag       string    `json:"tag,omitempty"`
+}
+
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// WebhookDelivery tracks the delivery of an event to one subscription.
+type WebhookDelivery struct {
+	ID             string    `json:"id"`
+	Subscription   string    `json:"subscription"`
+	Event          Event     `json:"event"`
+	Status         string    `json:"status"`
+	Attempts       int       `json:"attempts"`
+	LastStatusCode int       `json:"last_status_code,omitempty"`
+	LastError      string    `json:"last_error,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
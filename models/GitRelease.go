@@ -0,0 +1,18 @@
+package models
+
+// GitSource points at a module in a git repository.
+type GitSource struct {
+	Repository string `json:"repository"`
+	Tag        string `json:"tag"`
+	Path       string `json:"path,omitempty"`
+}
+
+// GitRelease is a module version published from a git tag.
+type GitRelease struct {
+	GitSource
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Provider  string `json:"provider"`
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+}
@@ -0,0 +1,26 @@
+package models
+
+import "time"
+
+const (
+	HookPending   = "pending"
+	HookPublished = "published"
+	HookFailed    = "failed"
+)
+
+// HookEvent tracks the publish triggered by a tag pushed to a repository.
+type HookEvent struct {
+	ID         string    `json:"id"`
+	Source     string    `json:"source"`
+	Repository string    `json:"repository"`
+	Tag        string    `json:"tag"`
+	Namespace  string    `json:"namespace"`
+	Name       string    `json:"name"`
+	Provider   string    `json:"provider"`
+	Version    string    `json:"version,omitempty"`
+	Commit     string    `json:"commit,omitempty"`
+	Status     string    `json:"status"`
+	Error      string    `json:"error,omitempty"`
+	ReceivedAt time.Time `json:"received_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
@@ -0,0 +1,6 @@
+package models
+
+type MirrorArchive struct {
+	URL    string   `json:"url"`
+	Hashes []string `json:"hashes"`
+}
@@ -5,4 +5,29 @@ type Module struct {
 	Name      string `json:"name"`
 	Provider  string `json:"provider"`
 	Version   string `json:"version"`
+
+	// Deprecation is set when the version should no longer be used.
+	Deprecation *Deprecation `json:"deprecation,omitempty"`
+
+	// ModuleMetadata is only filled in for a single module version.
+	*ModuleMetadata
+}
+
+// ModuleMetadata describes a module version beyond its coordinates, as given
+// when it was published.
+type ModuleMetadata struct {
+	Owner        string   `json:"owner,omitempty"`
+	Description  string   `json:"description,omitempty"`
+	Source       string   `json:"source,omitempty"`
+	Labels       []string `json:"labels,omitempty"`
+	Readme       string   `json:"readme,omitempty"`
+	ReleaseNotes string   `json:"release_notes,omitempty"`
+
+	// Checksum is the SHA256 checksum of the archive, recorded by the
+	// registry when the version is published.
+	Checksum string `json:"checksum,omitempty"`
+
+	// Provenance is set by the registry when the version was copied from
+	// another namespace.
+	Provenance *Provenance `json:"provenance,omitempty"`
 }
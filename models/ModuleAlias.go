@@ -0,0 +1,24 @@
+package models
+
+import "time"
+
+// ModuleAddress identifies a module, without a version.
+type ModuleAddress struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Provider  string `json:"provider"`
+}
+
+func (a ModuleAddress) String() string {
+	return a.Namespace + "/" + a.Name + "/" + a.Provider
+}
+
+// ModuleAlias sends requests for a module that was renamed, or moved to
+// another namespace, to the module it became.
+type ModuleAlias struct {
+	ModuleAddress
+	Target    ModuleAddress `json:"target"`
+	Message   string        `json:"message"`
+	CreatedBy string        `json:"created_by"`
+	CreatedAt time.Time     `json:"created_at"`
+}
@@ -0,0 +1,20 @@
+package models
+
+import "time"
+
+// ModuleTags are the movable tags of a module, like stable or beta, each
+// pointing to a version, together with how they moved.
+type ModuleTags struct {
+	Tags    map[string]string `json:"tags"`
+	History []TagChange       `json:"history"`
+}
+
+// TagChange records a tag being moved or removed. Version is empty when the
+// tag was removed, Previous when it was created.
+type TagChange struct {
+	Tag       string    `json:"tag"`
+	Version   string    `json:"version,omitempty"`
+	Previous  string    `json:"previous,omitempty"`
+	Principal string    `json:"principal"`
+	Time      time.Time `json:"time"`
+}
@@ -0,0 +1,27 @@
+package models
+
+const (
+	PrincipalUser  = "user"
+	PrincipalToken = "token"
+	PrincipalOIDC  = "oidc"
+
+	PrincipalCertificate = "certificate"
+	PrincipalWebhook     = "webhook"
+)
+
+// Principal is the authenticated identity behind a request.
+type Principal struct {
+	Type   string   `json:"type"`
+	Name   string   `json:"name"`
+	Groups []string `json:"groups,omitempty"`
+
+	// Roles are granted by the credentials themselves, like the claims of an
+	// OIDC token, on top of what the access policy grants.
+	Roles []NamespaceRole `json:"roles,omitempty"`
+}
+
+// NamespaceRole is a role on all namespaces matching a pattern.
+type NamespaceRole struct {
+	Namespace string `json:"namespace"`
+	Role      string `json:"role"`
+}
@@ -0,0 +1,14 @@
+package models
+
+import "time"
+
+// Provenance records where a module version was copied from.
+type Provenance struct {
+	Namespace string    `json:"namespace"`
+	Name      string    `json:"name"`
+	Provider  string    `json:"provider"`
+	Version   string    `json:"version"`
+	Checksum  string    `json:"checksum"`
+	CopiedBy  string    `json:"copied_by"`
+	CopiedAt  time.Time `json:"copied_at"`
+}
@@ -0,0 +1,36 @@
+package models
+
+type ProviderVersion struct {
+	Version   string             `json:"version"`
+	Protocols []string           `json:"protocols"`
+	Platforms []ProviderPlatform `json:"platforms"`
+}
+
+type ProviderPlatform struct {
+	OS   string `json:"os"`
+	Arch string `json:"arch"`
+}
+
+type ProviderPackage struct {
+	Protocols           []string    `json:"protocols"`
+	OS                  string      `json:"os"`
+	Arch                string      `json:"arch"`
+	Filename            string      `json:"filename"`
+	DownloadURL         string      `json:"download_url"`
+	SHASumsURL          string      `json:"shasums_url"`
+	SHASumsSignatureURL string      `json:"shasums_signature_url"`
+	SHASum              string      `json:"shasum"`
+	SigningKeys         SigningKeys `json:"signing_keys"`
+}
+
+type SigningKeys struct {
+	GPGPublicKeys []GPGPublicKey `json:"gpg_public_keys"`
+}
+
+type GPGPublicKey struct {
+	KeyID          string `json:"key_id"`
+	ASCIIArmor     string `json:"ascii_armor"`
+	TrustSignature string `json:"trust_signature"`
+	Source         string `json:"source"`
+	SourceURL      string `json:"source_url"`
+}
@@ -0,0 +1,12 @@
+package models
+
+import "time"
+
+type UploadSession struct {
+	ID        string    `json:"id"`
+	Namespace string    `json:"namespace"`
+	Name      string    `json:"name"`
+	Provider  string    `json:"provider"`
+	Version   string    `json:"version"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
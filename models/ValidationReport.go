@@ -0,0 +1,20 @@
+package models
+
+// ValidationReport is the outcome of checking a module version without
+// publishing it.
+type ValidationReport struct {
+	Namespace string   `json:"namespace"`
+	Name      string   `json:"name"`
+	Provider  string   `json:"provider"`
+	Version   string   `json:"version"`
+	Valid     bool     `json:"valid"`
+	Errors    []string `json:"errors"`
+	Warnings  []string `json:"warnings"`
+
+	Checksum  string          `json:"checksum,omitempty"`
+	Size      int             `json:"size"`
+	Files     []string        `json:"files"`
+	Variables []string        `json:"variables"`
+	Outputs   []string        `json:"outputs"`
+	Metadata  *ModuleMetadata `json:"metadata,omitempty"`
+}
@@ -0,0 +1,380 @@
+package registry
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"github.com/erikvanbrakel/anthology/app"
+	"github.com/erikvanbrakel/anthology/models"
+	"github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CachingRegistry sits in front of another registry. Module archives are kept
+// in a size-bounded LRU cache on local disk and module listings are kept in
+// memory for a short time. Concurrent misses for the same key result in a
+// single call to the backend.
+type CachingRegistry struct {
+	Registry
+
+	directory  string
+	maxSize    int64
+	listingTTL time.Duration
+
+	mu         sync.Mutex
+	size       int64
+	lru        *list.List
+	archives   map[string]*list.Element
+	listings   map[string]cachedListing
+	generation int
+
+	calls callGroup
+}
+
+type cachedArchive struct {
+	key  string
+	size int64
+}
+
+type cachedListing struct {
+	modules []models.Module
+	total   int
+	expires time.Time
+}
+
+func NewCachingRegistry(backend Registry, options app.CacheOptions) (Registry, error) {
+	r := &CachingRegistry{
+		Registry:   backend,
+		directory:  options.Directory,
+		maxSize:    options.MaxSize,
+		listingTTL: options.ListingTTL,
+		lru:        list.New(),
+		archives:   map[string]*list.Element{},
+		listings:   map[string]cachedListing{},
+	}
+
+	if r.directory != "" {
+		if err := os.MkdirAll(r.directory, 0755); err != nil {
+			return nil, fmt.Errorf("unable to create cache directory: %s", err)
+		}
+		if err := r.load(); err != nil {
+			return nil, fmt.Errorf("unable to read cache directory: %s", err)
+		}
+	}
+
+	logrus.Infof("Caching archives in %q (max %d bytes), listings for %s", r.directory, r.maxSize, r.listingTTL)
+
+	return r, nil
+}
+
+func (r *CachingRegistry) ListModules(namespace, name, provider string, offset, limit int) (modules []models.Module, total int, err error) {
+	if r.listingTTL <= 0 {
+		return r.Registry.ListModules(namespace, name, provider, offset, limit)
+	}
+
+	key := fmt.Sprintf("%s/%s/%s?%d,%d", namespace, name, provider, offset, limit)
+
+	r.mu.Lock()
+	cached, ok := r.listings[key]
+	generation := r.generation
+	r.mu.Unlock()
+
+	if ok && time.Now().Before(cached.expires) {
+		return cached.modules, cached.total, nil
+	}
+
+	result, err := r.calls.Do("list:"+key, func() (interface{}, error) {
+		modules, total, err := r.Registry.ListModules(namespace, name, provider, offset, limit)
+		if err != nil {
+			return nil, err
+		}
+
+		listing := cachedListing{modules, total, time.Now().Add(r.listingTTL)}
+
+		// a publish or delete during the call may have made the result stale
+		r.mu.Lock()
+		if r.generation == generation {
+			r.listings[key] = listing
+		}
+		r.mu.Unlock()
+
+		return listing, nil
+	})
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	listing := result.(cachedListing)
+	return listing.modules, listing.total, nil
+}
+
+func (r *CachingRegistry) GetModuleData(namespace, name, provider, version string) (reader *bytes.Buffer, err error) {
+	key := strings.Join([]string{namespace, name, provider, version}, "/")
+
+	if r.directory == "" || strings.Contains(key, "..") {
+		return r.Registry.GetModuleData(namespace, name, provider, version)
+	}
+
+	if data, ok := r.readArchive(key); ok {
+		return bytes.NewBuffer(data), nil
+	}
+
+	r.mu.Lock()
+	generation := r.generation
+	r.mu.Unlock()
+
+	result, err := r.calls.Do("data:"+key, func() (interface{}, error) {
+		data, err := r.Registry.GetModuleData(namespace, name, provider, version)
+		if err != nil {
+			return nil, err
+		}
+
+		// a publish or delete during the call may have replaced or removed
+		// the archive
+		if err := r.writeArchive(key, data.Bytes(), generation); err != nil {
+			logrus.Warnf("unable to cache %s: %s", key, err)
+		}
+
+		return data.Bytes(), nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.NewBuffer(result.([]byte)), nil
+}
+
+func (r *CachingRegistry) PublishModule(namespace, name, provider, version string, data io.Reader) (err error) {
+	err = r.Registry.PublishModule(namespace, name, provider, version, data)
+	r.invalidate(namespace, name, provider, version)
+	return err
+}
+
+func (r *CachingRegistry) DeleteModule(namespace, name, provider, version string) (err error) {
+	err = r.Registry.DeleteModule(namespace, name, provider, version)
+	r.invalidate(namespace, name, provider, version)
+	return err
+}
+
+// CopyModule uses the copy of the backend when it has one, and otherwise
+// copies the archive through the cache.
+func (r *CachingRegistry) CopyModule(namespace, name, provider, version, target string) error {
+	c, ok := r.Registry.(ModuleCopier)
+	if !ok {
+		data, err := r.GetModuleData(namespace, name, provider, version)
+		if err != nil {
+			return err
+		}
+		return r.PublishModule(target, name, provider, version, data)
+	}
+
+	err := c.CopyModule(namespace, name, provider, version, target)
+	r.invalidate(target, name, provider, version)
+	return err
+}
+
+func (r *CachingRegistry) GetModuleDataURL(namespace, name, provider, version string) (url string, err error) {
+	if p, ok := r.Registry.(DownloadURLProvider); ok {
+		return p.GetModuleDataURL(namespace, name, provider, version)
+	}
+	return "", nil
+}
+
+func (r *CachingRegistry) GetObjectUploadURL(key string, ttl time.Duration) (url string, headers http.Header, err error) {
+	if p, ok := r.Registry.(UploadURLProvider); ok {
+		return p.GetObjectUploadURL(key, ttl)
+	}
+	return "", nil, nil
+}
+
+// invalidate drops the cached archive of a module version and every cached
+// listing, since a listing for any prefix of the module may include it.
+func (r *CachingRegistry) invalidate(namespace, name, provider, version string) {
+	key := strings.Join([]string{namespace, name, provider, version}, "/")
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.listings = map[string]cachedListing{}
+	r.generation++
+
+	if e, ok := r.archives[key]; ok {
+		r.removeArchive(e)
+	}
+}
+
+func (r *CachingRegistry) readArchive(key string) ([]byte, bool) {
+	r.mu.Lock()
+	e, ok := r.archives[key]
+	if ok {
+		r.lru.MoveToFront(e)
+	}
+	r.mu.Unlock()
+
+	if !ok {
+		return nil, false
+	}
+
+	data, err := ioutil.ReadFile(r.archivePath(key))
+	if err != nil {
+		r.mu.Lock()
+		if e, ok := r.archives[key]; ok {
+			r.removeArchive(e)
+		}
+		r.mu.Unlock()
+		return nil, false
+	}
+
+	return data, true
+}
+
+// writeArchive caches an archive read from the backend, unless the cache was
+// invalidated since the given generation.
+func (r *CachingRegistry) writeArchive(key string, data []byte, generation int) error {
+	size := int64(len(data))
+	if size > r.maxSize {
+		return nil
+	}
+
+	// the file is written under the lock, so that invalidate can not remove
+	// it between the check and the write
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.generation != generation {
+		return nil
+	}
+
+	target := r.archivePath(key)
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(target, data, 0644); err != nil {
+		return err
+	}
+
+	if e, ok := r.archives[key]; ok {
+		r.size -= e.Value.(*cachedArchive).size
+		r.lru.Remove(e)
+	}
+
+	r.archives[key] = r.lru.PushFront(&cachedArchive{key, size})
+	r.size += size
+
+	r.evict()
+	return nil
+}
+
+// evict removes the least recently used archives until the cache fits in its
+// maximum size again. It must be called with the lock held.
+func (r *CachingRegistry) evict() {
+	for r.size > r.maxSize {
+		e := r.lru.Back()
+		if e == nil {
+			return
+		}
+		r.removeArchive(e)
+	}
+}
+
+// removeArchive must be called with the lock held.
+func (r *CachingRegistry) removeArchive(e *list.Element) {
+	archive := e.Value.(*cachedArchive)
+
+	r.lru.Remove(e)
+	delete(r.archives, archive.key)
+	r.size -= archive.size
+
+	os.Remove(r.archivePath(archive.key))
+}
+
+// load indexes archives left in the cache directory by a previous run, using
+// their modification time as the last access time.
+func (r *CachingRegistry) load() error {
+	var found []os.FileInfo
+	keys := map[os.FileInfo]string{}
+
+	err := filepath.Walk(r.directory, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !strings.HasSuffix(p, ".tgz") {
+			return err
+		}
+
+		key := strings.TrimSuffix(filepath.ToSlash(strings.TrimPrefix(p, filepath.Clean(r.directory)+string(os.PathSeparator))), ".tgz")
+		if len(strings.Split(key, "/")) != 4 {
+			return nil
+		}
+
+		found = append(found, info)
+		keys[info] = key
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].ModTime().After(found[j].ModTime())
+	})
+
+	for _, info := range found {
+		r.archives[keys[info]] = r.lru.PushBack(&cachedArchive{keys[info], info.Size()})
+		r.size += info.Size()
+	}
+
+	r.evict()
+	return nil
+}
+
+func (r *CachingRegistry) archivePath(key string) string {
+	return filepath.Join(r.directory, filepath.FromSlash(key)+".tgz")
+}
+
+// callGroup collapses concurrent calls with the same key into a single call
+// whose result is shared by all callers.
+type callGroup struct {
+	mu    sync.Mutex
+	calls map[string]*call
+}
+
+type call struct {
+	wg    sync.WaitGroup
+	value interface{}
+	err   error
+}
+
+func (g *callGroup) Do(key string, fn func() (interface{}, error)) (interface{}, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = map[string]*call{}
+	}
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		c.wg.Wait()
+		return c.value, c.err
+	}
+
+	c := &call{}
+	c.wg.Add(1)
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	c.value, c.err = fn()
+	c.wg.Done()
+
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+
+	return c.value, c.err
+}
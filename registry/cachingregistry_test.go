@@ -0,0 +1,201 @@
+package registry_test
+
+import (
+	"bytes"
+	"github.com/erikvanbrakel/anthology/app"
+	"github.com/erikvanbrakel/anthology/models"
+	"github.com/erikvanbrakel/anthology/registry"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type countingRegistry struct {
+	registry.Registry
+	lists int32
+	reads int32
+	delay time.Duration
+}
+
+func (r *countingRegistry) ListModules(namespace, name, provider string, offset, limit int) ([]models.Module, int, error) {
+	atomic.AddInt32(&r.lists, 1)
+	return r.Registry.ListModules(namespace, name, provider, offset, limit)
+}
+
+func (r *countingRegistry) GetModuleData(namespace, name, provider, version string) (*bytes.Buffer, error) {
+	atomic.AddInt32(&r.reads, 1)
+	time.Sleep(r.delay)
+	return r.Registry.GetModuleData(namespace, name, provider, version)
+}
+
+func newCachingRegistry(t *testing.T, maxSize int64) (registry.Registry, *countingRegistry, func()) {
+	dir, err := ioutil.TempDir("", "anthology-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend := &countingRegistry{Registry: registry.NewFakeRegistry()}
+	r, err := registry.NewCachingRegistry(backend, app.CacheOptions{
+		Directory:  dir,
+		MaxSize:    maxSize,
+		ListingTTL: time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return r, backend, func() { os.RemoveAll(dir) }
+}
+
+func TestCachingRegistryListings(t *testing.T) {
+	r, backend, cleanup := newCachingRegistry(t, 1024)
+	defer cleanup()
+
+	r.PublishModule("namespace1", "module1", "aws", "1.0.0", bytes.NewBufferString("v1"))
+
+	for i := 0; i < 3; i++ {
+		if _, total, _ := r.ListModules("namespace1", "", "", 0, 10); total != 1 {
+			t.Fatalf("expected 1 module, got %d", total)
+		}
+	}
+	if backend.lists != 1 {
+		t.Errorf("expected 1 backend listing, got %d", backend.lists)
+	}
+
+	r.PublishModule("namespace1", "module1", "aws", "2.0.0", bytes.NewBufferString("v2"))
+
+	if _, total, _ := r.ListModules("namespace1", "", "", 0, 10); total != 2 {
+		t.Errorf("expected listing to be invalidated after publish, got %d modules", total)
+	}
+
+	r.DeleteModule("namespace1", "module1", "aws", "1.0.0")
+
+	if _, total, _ := r.ListModules("namespace1", "", "", 0, 10); total != 1 {
+		t.Errorf("expected listing to be invalidated after delete, got %d modules", total)
+	}
+}
+
+func TestCachingRegistryArchives(t *testing.T) {
+	r, backend, cleanup := newCachingRegistry(t, 1024)
+	defer cleanup()
+	backend.delay = 50 * time.Millisecond
+
+	r.PublishModule("namespace1", "module1", "aws", "1.0.0", bytes.NewBufferString("v1"))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data, err := r.GetModuleData("namespace1", "module1", "aws", "1.0.0")
+			if err != nil || data.String() != "v1" {
+				t.Errorf("unexpected result %q, %v", data, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if backend.reads != 1 {
+		t.Errorf("expected concurrent misses to result in 1 backend read, got %d", backend.reads)
+	}
+
+	r.GetModuleData("namespace1", "module1", "aws", "1.0.0")
+	if backend.reads != 1 {
+		t.Errorf("expected archive to be served from disk, got %d backend reads", backend.reads)
+	}
+
+	r.DeleteModule("namespace1", "module1", "aws", "1.0.0")
+	if _, err := r.GetModuleData("namespace1", "module1", "aws", "1.0.0"); err == nil {
+		t.Errorf("expected deleted archive to be evicted from the cache")
+	}
+}
+
+// slowResponseRegistry reads archives right away, but takes a while to
+// return them.
+type slowResponseRegistry struct {
+	registry.Registry
+	delay time.Duration
+}
+
+func (r *slowResponseRegistry) GetModuleData(namespace, name, provider, version string) (*bytes.Buffer, error) {
+	data, err := r.Registry.GetModuleData(namespace, name, provider, version)
+	time.Sleep(r.delay)
+	return data, err
+}
+
+func TestCachingRegistryDeleteDuringRead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "anthology-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	backend := &slowResponseRegistry{registry.NewFakeRegistry(), 50 * time.Millisecond}
+	r, err := registry.NewCachingRegistry(backend, app.CacheOptions{Directory: dir, MaxSize: 1024, ListingTTL: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.PublishModule("namespace1", "module1", "aws", "1.0.0", bytes.NewBufferString("v1"))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.GetModuleData("namespace1", "module1", "aws", "1.0.0")
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	r.DeleteModule("namespace1", "module1", "aws", "1.0.0")
+	<-done
+
+	if _, err := r.GetModuleData("namespace1", "module1", "aws", "1.0.0"); err == nil {
+		t.Errorf("expected an archive deleted during a read not to be cached")
+	}
+}
+
+func TestCachingRegistryEviction(t *testing.T) {
+	r, backend, cleanup := newCachingRegistry(t, 10)
+	defer cleanup()
+
+	r.PublishModule("namespace1", "module1", "aws", "1.0.0", bytes.NewBufferString("123456"))
+	r.PublishModule("namespace1", "module1", "aws", "2.0.0", bytes.NewBufferString("123456"))
+
+	r.GetModuleData("namespace1", "module1", "aws", "1.0.0")
+	r.GetModuleData("namespace1", "module1", "aws", "2.0.0")
+	r.GetModuleData("namespace1", "module1", "aws", "2.0.0")
+
+	if backend.reads != 2 {
+		t.Errorf("expected 2 backend reads, got %d", backend.reads)
+	}
+
+	r.GetModuleData("namespace1", "module1", "aws", "1.0.0")
+
+	if backend.reads != 3 {
+		t.Errorf("expected least recently used archive to be evicted, got %d backend reads", backend.reads)
+	}
+}
+
+func TestCachingRegistryCopy(t *testing.T) {
+	r, _, cleanup := newCachingRegistry(t, 1024)
+	defer cleanup()
+
+	r.PublishModule("dev", "module1", "aws", "1.0.0", bytes.NewBufferString("v1"))
+
+	if _, total, _ := r.ListModules("prod", "", "", 0, 10); total != 0 {
+		t.Fatalf("expected no modules in prod, got %d", total)
+	}
+
+	if err := r.(registry.ModuleCopier).CopyModule("dev", "module1", "aws", "1.0.0", "prod"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, total, _ := r.ListModules("prod", "", "", 0, 10); total != 1 {
+		t.Fatalf("expected the copy to be listed, got %d modules", total)
+	}
+	if data, _ := r.GetModuleData("prod", "module1", "aws", "1.0.0"); data.String() != "v1" {
+		t.Fatalf("expected the copied archive, got %q", data.String())
+	}
+}
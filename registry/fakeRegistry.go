@@ -5,15 +5,23 @@ import (
 	"errors"
 	"github.com/erikvanbrakel/anthology/models"
 	"io"
+	"io/ioutil"
+	"sort"
 	"strings"
+	"sync"
 )
 
 type InMemoryRegistry struct {
+	mu      sync.RWMutex
 	modules []models.Module
 	data    map[string][]byte
+	objects map[string][]byte
 }
 
 func (r *InMemoryRegistry) ListModules(namespace, name, provider string, offset, limit int) (modules []models.Module, total int, err error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
 	var result []models.Module
 
 	for _, m := range r.modules {
@@ -32,11 +40,14 @@ func (r *InMemoryRegistry) ListModules(namespace, name, provider string, offset,
 }
 
 func (r *InMemoryRegistry) PublishModule(namespace, name, provider, version string, data io.Reader) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	r.modules = append(r.modules, models.Module{
-		namespace,
-		name,
-		provider,
-		version,
+		Namespace: namespace,
+		Name:      name,
+		Provider:  provider,
+		Version:   version,
 	})
 
 	id := strings.Join([]string{namespace, name, provider, version}, "/")
@@ -49,16 +60,83 @@ func (r *InMemoryRegistry) PublishModule(namespace, name, provider, version stri
 	return nil
 }
 
+func (r *InMemoryRegistry) DeleteModule(namespace, name, provider, version string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, m := range r.modules {
+		if m.Namespace == namespace && m.Name == name && m.Provider == provider && m.Version == version {
+			r.modules = append(r.modules[:i], r.modules[i+1:]...)
+			delete(r.data, strings.Join([]string{namespace, name, provider, version}, "/"))
+			return nil
+		}
+	}
+
+	return errors.New("module does not exist")
+}
+
 func (r *InMemoryRegistry) GetModuleData(namespace, name, provider, version string) (reader *bytes.Buffer, err error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
 	id := strings.Join([]string{namespace, name, provider, version}, "/")
 	moduleData, exists := r.data[id]
 	if !exists {
-		return nil, errors.New("module does not exist")
+		return nil, ErrNotFound
 	}
 
 	return bytes.NewBuffer(moduleData), nil
 }
 
+func (r *InMemoryRegistry) GetObject(key string) (io.ReadCloser, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	data, exists := r.objects[key]
+	if !exists {
+		return nil, ErrNotFound
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (r *InMemoryRegistry) PutObject(key string, data io.Reader) error {
+	buf := new(bytes.Buffer)
+	if _, err := buf.ReadFrom(data); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.objects[key] = buf.Bytes()
+	return nil
+}
+
+func (r *InMemoryRegistry) DeleteObject(key string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.objects, key)
+	return nil
+}
+
+func (r *InMemoryRegistry) ListObjects(prefix string) (keys []string, err error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for key := range r.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
 func NewFakeRegistry() Registry {
-	return &InMemoryRegistry{data: map[string][]byte{}}
+	return &InMemoryRegistry{
+		data:    map[string][]byte{},
+		objects: map[string][]byte{},
+	}
 }
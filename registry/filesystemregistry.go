@@ -7,9 +7,11 @@ import (
 	"github.com/erikvanbrakel/anthology/models"
 	"github.com/sirupsen/logrus"
 	"io"
+	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 )
 
@@ -41,11 +43,68 @@ func (r *FilesystemRegistry) ListModules(namespace, name, provider string, offse
 }
 
 func (r *FilesystemRegistry) PublishModule(namespace, name, provider, version string, data io.Reader) (err error) {
-	panic("implement me")
+	return r.writeFile(path.Join(r.basePath, namespace, name, provider, version+".tgz"), data)
+}
+
+func (r *FilesystemRegistry) DeleteModule(namespace, name, provider, version string) (err error) {
+	return os.Remove(path.Join(r.basePath, namespace, name, provider, version+".tgz"))
 }
 
 func (r *FilesystemRegistry) GetModuleData(namespace, name, provider, version string) (reader *bytes.Buffer, err error) {
-	panic("implement me")
+	f, err := os.Open(path.Join(r.basePath, namespace, name, provider, version+".tgz"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	buffer := &bytes.Buffer{}
+	_, err = io.Copy(buffer, f)
+	return buffer, err
+}
+
+func (r *FilesystemRegistry) GetObject(key string) (io.ReadCloser, error) {
+	f, err := os.Open(r.objectPath(key))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+func (r *FilesystemRegistry) PutObject(key string, data io.Reader) error {
+	return r.writeFile(r.objectPath(key), data)
+}
+
+func (r *FilesystemRegistry) DeleteObject(key string) error {
+	err := os.Remove(r.objectPath(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (r *FilesystemRegistry) ListObjects(prefix string) (keys []string, err error) {
+	root := r.objectPath("")
+
+	err = filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".tmp-") {
+			return nil
+		}
+
+		key := filepath.ToSlash(strings.TrimPrefix(p, root+string(os.PathSeparator)))
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+
+	sort.Strings(keys)
+	return keys, err
 }
 
 func NewFilesystemRegistry(options app.FileSystemOptions) Registry {
@@ -61,6 +120,36 @@ func NewFilesystemRegistry(options app.FileSystemOptions) Registry {
 	return &registry
 }
 
+func (r *FilesystemRegistry) objectPath(key string) string {
+	return filepath.Join(r.basePath, storagePrefix, filepath.FromSlash(key))
+}
+
+// writeFile stores data in a temporary file next to the target and renames it
+// into place, so readers never observe a partially written file.
+func (r *FilesystemRegistry) writeFile(target string, data io.Reader) error {
+	dir := filepath.Dir(target)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), target)
+}
+
 func (r *FilesystemRegistry) getModules(namespace, name, provider string) ([]models.Module, error) {
 
 	glob := r.basePath
@@ -96,7 +185,7 @@ func (r *FilesystemRegistry) getModules(namespace, name, provider string) ([]mod
 	for _, f := range dirs {
 		parts := strings.Split(strings.TrimPrefix(f, r.basePath), string(os.PathSeparator))
 
-		if len(parts) != 4 {
+		if len(parts) != 4 || strings.HasPrefix(parts[0], ".") || strings.HasPrefix(parts[3], ".") {
 			continue
 		}
 
@@ -104,7 +193,7 @@ func (r *FilesystemRegistry) getModules(namespace, name, provider string) ([]mod
 			Namespace: parts[0],
 			Name:      parts[1],
 			Provider:  parts[2],
-			Version:   strings.TrimRight(parts[3], ".tgz"),
+			Version:   strings.TrimSuffix(parts[3], ".tgz"),
 		})
 	}
 
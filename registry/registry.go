@@ -2,15 +2,57 @@ package registry
 
 import (
 	"bytes"
+	"errors"
 	"github.com/erikvanbrakel/anthology/models"
 	"io"
+	"net/http"
+	"time"
 )
 
+// ErrNotFound is returned by Storage when an object does not exist.
+var ErrNotFound = errors.New("object does not exist")
+
 type Registry interface {
 	/*	ListModules(namespace, name, provider string, offset, limit int) (modules []Module, total int, err error)
 		ListVersions(namespace, name, provider string) (versions []ModuleVersions, err error)
 		GetModule(namespace, name, provider, version string) (module *Module, err error) */
+	Storage
 	GetModuleData(namespace, name, provider, version string) (reader *bytes.Buffer, err error)
 	ListModules(namespace, name, provider string, offset, limit int) (modules []models.Module, total int, err error)
 	PublishModule(namespace, name, provider, version string, data io.Reader) (err error)
+	DeleteModule(namespace, name, provider, version string) (err error)
+}
+
+// Storage gives access to raw objects kept next to the module archives, such
+// as staged uploads. Keys are slash separated and live in an area of the
+// backend that never shows up in module listings.
+type Storage interface {
+	GetObject(key string) (io.ReadCloser, error)
+	PutObject(key string, data io.Reader) error
+	DeleteObject(key string) error
+	ListObjects(prefix string) (keys []string, err error)
+}
+
+// DownloadURLProvider is implemented by backends that can hand out direct,
+// time-limited links to module archives. An empty url means the archive has
+// to be served by Anthology itself.
+type DownloadURLProvider interface {
+	GetModuleDataURL(namespace, name, provider, version string) (url string, err error)
 }
+
+// UploadURLProvider is implemented by backends that let clients write a
+// Storage object directly, without streaming it through Anthology. An empty
+// url means the object has to be uploaded through Anthology. The headers are
+// part of the signature, clients have to send them with the PUT.
+type UploadURLProvider interface {
+	GetObjectUploadURL(key string, ttl time.Duration) (url string, headers http.Header, err error)
+}
+
+// ModuleCopier is implemented by backends that can copy a module archive to
+// another namespace without it passing through Anthology.
+type ModuleCopier interface {
+	CopyModule(namespace, name, provider, version, target string) error
+}
+
+// storagePrefix is where Storage objects are kept, relative to the module root.
+const storagePrefix = ".anthology/"
@@ -2,20 +2,27 @@ package registry
 
 import (
 	"bytes"
+	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/erikvanbrakel/anthology/app"
 	"github.com/erikvanbrakel/anthology/models"
 	"github.com/sirupsen/logrus"
 	"io"
+	"net/http"
+	"net/url"
 	"strings"
+	"time"
 )
 
 type S3Registry struct {
-	bucket   string
-	endpoint string
+	bucket  string
+	prefix  string
+	options app.S3Options
+	client  *s3.S3
 }
 
 func (r *S3Registry) ListModules(namespace, name, provider string, offset, limit int) (modules []models.Module, total int, err error) {
@@ -28,25 +35,134 @@ func (r *S3Registry) ListModules(namespace, name, provider string, offset, limit
 	return modules, len(modules), nil
 }
 
-func (S3Registry) PublishModule(namepsace, name, provider, version string, data io.Reader) (err error) {
-	panic("implement me")
+func (r *S3Registry) PublishModule(namespace, name, provider, version string, data io.Reader) (err error) {
+	return r.putObject(r.moduleKey(namespace, name, provider, version), data)
 }
 
-func (r *S3Registry) GetModuleData(namespace, name, provider, version string) (reader *bytes.Buffer, err error) {
-	s3client := s3.New(r.getSession())
+// CopyModule copies a module archive to another namespace with CopyObject,
+// applying the configured encryption and ACL to the copy.
+func (r *S3Registry) CopyModule(namespace, name, provider, version, target string) error {
+	input := &s3.CopyObjectInput{
+		Bucket:     aws.String(r.bucket),
+		Key:        aws.String(r.moduleKey(target, name, provider, version)),
+		CopySource: aws.String(copySource(r.bucket, r.moduleKey(namespace, name, provider, version))),
+	}
 
-	obj, err := s3client.GetObject(&s3.GetObjectInput{
-		Key:    aws.String(strings.Join([]string{namespace, name, provider, version}, "/") + ".tgz"),
+	if r.options.SSE != "" {
+		input.ServerSideEncryption = aws.String(r.options.SSE)
+	}
+	if r.options.KMSKeyID != "" {
+		input.SSEKMSKeyId = aws.String(r.options.KMSKeyID)
+	}
+	if r.options.ACL != "" {
+		input.ACL = aws.String(r.options.ACL)
+	}
+
+	_, err := r.client.CopyObject(input)
+	return err
+}
+
+func (r *S3Registry) GetObject(key string) (io.ReadCloser, error) {
+	obj, err := r.client.GetObject(&s3.GetObjectInput{
+		Key:    aws.String(r.objectKey(key)),
 		Bucket: aws.String(r.bucket),
 	})
 
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == s3.ErrCodeNoSuchKey {
+		return nil, ErrNotFound
+	}
 	if err != nil {
 		return nil, err
 	}
 
+	return obj.Body, nil
+}
+
+func (r *S3Registry) PutObject(key string, data io.Reader) error {
+	return r.putObject(r.objectKey(key), data)
+}
+
+func (r *S3Registry) DeleteObject(key string) error {
+	_, err := r.client.DeleteObject(&s3.DeleteObjectInput{
+		Key:    aws.String(r.objectKey(key)),
+		Bucket: aws.String(r.bucket),
+	})
+	return err
+}
+
+func (r *S3Registry) ListObjects(prefix string) (keys []string, err error) {
+	loi := s3.ListObjectsInput{
+		Bucket: aws.String(r.bucket),
+		Prefix: aws.String(r.objectKey(prefix)),
+	}
+
+	err = r.client.ListObjectsPages(&loi, func(result *s3.ListObjectsOutput, lastPage bool) bool {
+		for _, o := range result.Contents {
+			keys = append(keys, strings.TrimPrefix(*o.Key, r.objectKey("")))
+		}
+		return true
+	})
+
+	return keys, err
+}
+
+// GetObjectUploadURL presigns a PUT of an object. The encryption and ACL
+// headers stay signed headers instead of query parameters, so they are
+// returned for the client to send along.
+func (r *S3Registry) GetObjectUploadURL(key string, ttl time.Duration) (url string, headers http.Header, err error) {
+	req, _ := r.client.PutObjectRequest(r.putObjectInput(r.objectKey(key), nil))
+	url, signed, err := req.PresignRequest(ttl)
+	if err != nil {
+		return "", nil, err
+	}
+
+	headers = http.Header{}
+	for name, values := range signed {
+		if name = http.CanonicalHeaderKey(name); name != "Host" {
+			headers[name] = values
+		}
+	}
+	return url, headers, nil
+}
+
+func (r *S3Registry) DeleteModule(namespace, name, provider, version string) (err error) {
+	_, err = r.client.DeleteObject(&s3.DeleteObjectInput{
+		Key:    aws.String(r.moduleKey(namespace, name, provider, version)),
+		Bucket: aws.String(r.bucket),
+	})
+	return err
+}
+
+func (r *S3Registry) GetModuleData(namespace, name, provider, version string) (reader *bytes.Buffer, err error) {
+	obj, err := r.client.GetObject(&s3.GetObjectInput{
+		Key:    aws.String(r.moduleKey(namespace, name, provider, version)),
+		Bucket: aws.String(r.bucket),
+	})
+
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == s3.ErrCodeNoSuchKey {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Body.Close()
+
 	buffer := &bytes.Buffer{}
-	io.Copy(buffer, obj.Body)
-	return buffer, nil
+	_, err = io.Copy(buffer, obj.Body)
+	return buffer, err
+}
+
+func (r *S3Registry) GetModuleDataURL(namespace, name, provider, version string) (url string, err error) {
+	if r.options.PresignTTL <= 0 {
+		return "", nil
+	}
+
+	req, _ := r.client.GetObjectRequest(&s3.GetObjectInput{
+		Key:    aws.String(r.moduleKey(namespace, name, provider, version)),
+		Bucket: aws.String(r.bucket),
+	})
+
+	return req.Presign(r.options.PresignTTL)
 }
 
 func (r *S3Registry) getModules(namespace, name, provider string) (modules []models.Module, err error) {
@@ -66,56 +182,143 @@ func (r *S3Registry) getModules(namespace, name, provider string) (modules []mod
 		prefix += "/"
 	}
 
-	s3client := s3.New(r.getSession())
-
 	loi := s3.ListObjectsInput{
 		Bucket: aws.String(r.bucket),
-		Prefix: aws.String(prefix),
+		Prefix: aws.String(r.prefix + prefix),
 	}
-	result, err := s3client.ListObjects(&loi)
+
+	err = r.client.ListObjectsPages(&loi, func(result *s3.ListObjectsOutput, lastPage bool) bool {
+		for _, o := range result.Contents {
+			parts := strings.Split(strings.TrimPrefix(*o.Key, r.prefix), "/")
+
+			if len(parts) == 4 && !strings.HasPrefix(parts[0], ".") && strings.HasSuffix(parts[3], ".tgz") {
+				modules = append(modules, models.Module{
+					Namespace: parts[0],
+					Name:      parts[1],
+					Provider:  parts[2],
+					Version:   strings.TrimSuffix(parts[3], ".tgz"),
+				})
+			}
+		}
+		return true
+	})
 
 	if err != nil {
-		logrus.Errorf("error: %s", err.(awserr.Error))
+		if awsErr, ok := err.(awserr.Error); ok {
+			logrus.Errorf("error: %s", awsErr)
+		}
 		return nil, err
 	}
 
-	for _, o := range result.Contents {
-		parts := strings.Split(*o.Key, "/")
+	return modules, nil
+}
 
-		if len(parts) == 4 {
-			modules = append(modules, models.Module{
-				Namespace: parts[0],
-				Name:      parts[1],
-				Provider:  parts[2],
-				Version:   strings.TrimRight(parts[3], ".tgz"),
-			})
-		}
+func (r *S3Registry) putObject(key string, data io.Reader) error {
+	buffer := &bytes.Buffer{}
+	if _, err := io.Copy(buffer, data); err != nil {
+		return err
 	}
 
-	return modules, nil
+	_, err := r.client.PutObject(r.putObjectInput(key, bytes.NewReader(buffer.Bytes())))
+	return err
 }
 
-func (r *S3Registry) getSession() *session.Session {
+// putObjectInput applies the configured encryption and ACL to every write.
+func (r *S3Registry) putObjectInput(key string, body io.ReadSeeker) *s3.PutObjectInput {
+	input := &s3.PutObjectInput{
+		Key:    aws.String(key),
+		Bucket: aws.String(r.bucket),
+		Body:   body,
+	}
+
+	if r.options.SSE != "" {
+		input.ServerSideEncryption = aws.String(r.options.SSE)
+	}
+	if r.options.KMSKeyID != "" {
+		input.SSEKMSKeyId = aws.String(r.options.KMSKeyID)
+	}
+	if r.options.ACL != "" {
+		input.ACL = aws.String(r.options.ACL)
+	}
+
+	return input
+}
+
+func (r *S3Registry) objectKey(key string) string {
+	return r.prefix + storagePrefix + key
+}
+
+func (r *S3Registry) moduleKey(namespace, name, provider, version string) string {
+	return r.prefix + strings.Join([]string{namespace, name, provider, version}, "/") + ".tgz"
+}
+
+// copySource is the URL encoded bucket and key CopyObject copies from.
+func copySource(bucket, key string) string {
+	parts := strings.Split(bucket+"/"+key, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return strings.Join(parts, "/")
+}
+
+func newS3Session(options app.S3Options) (*session.Session, error) {
 	config := &aws.Config{
-		S3ForcePathStyle: aws.Bool(true),
-		Region:           aws.String("us-east-1"),
+		S3ForcePathStyle: aws.Bool(!options.VirtualHostedStyle),
+		Region:           aws.String(options.Region),
 	}
-	if r.endpoint != "" {
-		if !strings.HasPrefix(r.endpoint, "https") {
+	if options.Endpoint != "" {
+		if !strings.HasPrefix(options.Endpoint, "https") {
 			config.DisableSSL = aws.Bool(true)
 		}
-		config.Endpoint = aws.String(r.endpoint)
+		config.Endpoint = aws.String(options.Endpoint)
 	}
-	config.CredentialsChainVerboseErrors = aws.Bool(true)
 
-	s, _ := session.NewSession(config)
+	s, err := session.NewSessionWithOptions(session.Options{
+		Config:            *config,
+		Profile:           options.Profile,
+		SharedConfigState: session.SharedConfigEnable,
+	})
 
-	return s
+	if err != nil {
+		return nil, err
+	}
+
+	if options.RoleArn != "" {
+		s = s.Copy(&aws.Config{
+			Credentials: stscreds.NewCredentials(s, options.RoleArn, func(p *stscreds.AssumeRoleProvider) {
+				p.RoleSessionName = options.RoleSessionName
+			}),
+		})
+	}
+
+	return s, nil
 }
 
-func NewS3Registry(options app.S3Options) Registry {
-	return &S3Registry{
-		options.Bucket,
-		options.Endpoint,
+func NewS3Registry(options app.S3Options) (Registry, error) {
+	if err := options.Validate(); err != nil {
+		return nil, err
 	}
+
+	s, err := newS3Session(options)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create AWS session: %s", err)
+	}
+
+	if _, err := s.Config.Credentials.Get(); err != nil {
+		return nil, fmt.Errorf("unable to resolve AWS credentials: %s", err)
+	}
+
+	prefix := strings.Trim(options.Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	logrus.Infof("Using S3 Registry with bucket %s in %s", options.Bucket, options.Region)
+
+	return &S3Registry{
+		bucket:  options.Bucket,
+		prefix:  prefix,
+		options: options,
+		client:  s3.New(s),
+	}, nil
 }
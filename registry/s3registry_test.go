@@ -0,0 +1,97 @@
+package registry_test
+
+import (
+	"github.com/erikvanbrakel/anthology/app"
+	"github.com/erikvanbrakel/anthology/registry"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestS3Registry(t *testing.T, options app.S3Options) registry.Registry {
+	os.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+
+	options.Bucket = "modules"
+	options.Region = "eu-west-1"
+	r, err := registry.NewS3Registry(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestS3UploadURLHeaders(t *testing.T) {
+	r := newTestS3Registry(t, app.S3Options{SSE: "aws:kms", KMSKeyID: "key-1", ACL: "bucket-owner-full-control"})
+
+	presigned, headers, err := r.(registry.UploadURLProvider).GetObjectUploadURL("uploads/session.tgz", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := url.Parse(presigned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := strings.Split(u.Query().Get("X-Amz-SignedHeaders"), ";")
+
+	expected := map[string]string{
+		"X-Amz-Server-Side-Encryption":                "aws:kms",
+		"X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id": "key-1",
+		"X-Amz-Acl": "bucket-owner-full-control",
+	}
+	for name, value := range expected {
+		if actual := headers.Get(name); actual != value {
+			t.Errorf("expected header %s to be %q, got %q", name, value, actual)
+		}
+		if !contains(signed, strings.ToLower(name)) {
+			t.Errorf("expected %s to be a signed header, got %v", name, signed)
+		}
+	}
+}
+
+func TestS3UploadURLWithoutHeaders(t *testing.T) {
+	r := newTestS3Registry(t, app.S3Options{})
+
+	_, headers, err := r.(registry.UploadURLProvider).GetObjectUploadURL("uploads/session.tgz", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(headers) != 0 {
+		t.Errorf("expected no headers to be required, got %v", headers)
+	}
+}
+
+func TestS3GetModuleDataNotFound(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(http.StatusNotFound)
+		io.WriteString(w, `<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>`)
+	}))
+	defer server.Close()
+
+	r := newTestS3Registry(t, app.S3Options{Endpoint: server.URL})
+
+	if _, err := r.GetModuleData("namespace1", "module1", "aws", "1.0.0"); err != registry.ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	if _, err := r.GetObject("login/tokens/unknown.json"); err != registry.ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
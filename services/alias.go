@@ -0,0 +1,149 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/erikvanbrakel/anthology/app"
+	"github.com/erikvanbrakel/anthology/models"
+	"github.com/erikvanbrakel/anthology/registry"
+	"strings"
+)
+
+// Aliases lists the aliases of the modules in a namespace that moved
+// elsewhere.
+func (s *ModuleService) Aliases(rs app.RequestScope, namespace string) ([]models.ModuleAlias, error) {
+	if err := s.Authorize(rs, namespace, RoleAdmin); err != nil {
+		return nil, err
+	}
+
+	keys, err := s.Registry.ListObjects("aliases/" + namespace + "/")
+	if err != nil {
+		return nil, err
+	}
+
+	aliases := []models.ModuleAlias{}
+	for _, key := range keys {
+		parts := strings.Split(strings.TrimSuffix(key, ".json"), "/")
+		if len(parts) != 4 {
+			continue
+		}
+
+		alias, err := s.loadAlias(namespace, parts[2], parts[3])
+		if err != nil {
+			rs.Warnf("ignoring unreadable alias %s: %s", key, err)
+			continue
+		}
+		aliases = append(aliases, *alias)
+	}
+
+	return aliases, nil
+}
+
+// ResolveAlias returns where a module has moved to, or nil when it has not
+// moved. An alias only applies once no versions are left at its own
+// coordinates, so versions published there again take precedence; callers
+// check that first, with the listing they already have.
+func (s *ModuleService) ResolveAlias(rs app.RequestScope, namespace, name, provider string) (*models.ModuleAlias, error) {
+	if s.Authorize(rs, namespace, RoleReader) != nil {
+		return nil, nil
+	}
+
+	alias, err := s.loadAlias(namespace, name, provider)
+	if err == registry.ErrNotFound {
+		return nil, nil
+	}
+	return alias, err
+}
+
+// SetAlias sends requests for a module to another module, for example after
+// it was renamed or moved to another namespace.
+func (s *ModuleService) SetAlias(rs app.RequestScope, namespace, name, provider string, target models.ModuleAddress, message string) (alias *models.ModuleAlias, err error) {
+	entry := models.AuditEntry{Operation: AuditModuleAlias, Namespace: namespace, Name: name, Provider: provider, Target: target.String()}
+	defer func() { s.Audit.Record(rs, entry, err) }()
+
+	if err := s.Authorize(rs, namespace, RoleAdmin); err != nil {
+		return nil, err
+	}
+
+	var errors []string
+	if !namePattern.MatchString(name) {
+		errors = append(errors, "name must be alphanumeric with dashes or underscores, up to 64 characters: "+name)
+	}
+	if !providerPattern.MatchString(provider) {
+		errors = append(errors, "provider must be lower case alphanumeric: "+provider)
+	}
+	if target == (models.ModuleAddress{Namespace: namespace, Name: name, Provider: provider}) {
+		errors = append(errors, "a module can not be an alias of itself")
+	} else if versions, err := s.QueryVersions(rs, target.Namespace, target.Name, target.Provider); err != nil {
+		return nil, err
+	} else if len(versions) == 0 {
+		errors = append(errors, fmt.Sprintf("module %s does not exist", target))
+	} else if _, err := s.loadAlias(target.Namespace, target.Name, target.Provider); err == nil {
+		errors = append(errors, fmt.Sprintf("module %s is an alias itself", target))
+	} else if err != registry.ErrNotFound {
+		return nil, err
+	}
+	if len(errors) > 0 {
+		return nil, &ValidationError{errors}
+	}
+
+	if message == "" {
+		message = fmt.Sprintf("%s/%s/%s has moved to %s", namespace, name, provider, target)
+	}
+
+	alias = &models.ModuleAlias{
+		ModuleAddress: models.ModuleAddress{Namespace: namespace, Name: name, Provider: provider},
+		Target:        target,
+		Message:       message,
+		CreatedBy:     principalName(rs),
+		CreatedAt:     rs.Now().UTC(),
+	}
+
+	data, _ := json.Marshal(alias)
+	if err := s.Registry.PutObject(aliasKey(namespace, name, provider), bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+
+	rs.Infof("aliased %s/%s/%s to %s", namespace, name, provider, target)
+	return alias, nil
+}
+
+// DeleteAlias removes the alias of a module.
+func (s *ModuleService) DeleteAlias(rs app.RequestScope, namespace, name, provider string) (err error) {
+	entry := models.AuditEntry{Operation: AuditModuleUnalias, Namespace: namespace, Name: name, Provider: provider}
+	defer func() { s.Audit.Record(rs, entry, err) }()
+
+	if err := s.Authorize(rs, namespace, RoleAdmin); err != nil {
+		return err
+	}
+
+	alias, err := s.loadAlias(namespace, name, provider)
+	if err == registry.ErrNotFound {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	entry.Target = alias.Target.String()
+
+	return s.Registry.DeleteObject(aliasKey(namespace, name, provider))
+}
+
+func (s *ModuleService) loadAlias(namespace, name, provider string) (*models.ModuleAlias, error) {
+	r, err := s.Registry.GetObject(aliasKey(namespace, name, provider))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	alias := &models.ModuleAlias{}
+	if err := json.NewDecoder(r).Decode(alias); err != nil {
+		return nil, fmt.Errorf("invalid alias for %s/%s/%s: %s", namespace, name, provider, err)
+	}
+	return alias, nil
+}
+
+func aliasKey(namespace, name, provider string) string {
+	return "aliases/" + namespace + "/" + name + "/" + provider + ".json"
+}
@@ -0,0 +1,140 @@
+package services
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+)
+
+// validateArchive checks that data is a gzip compressed tarball containing at
+// least one regular file, which is what Terraform expects to download.
+func validateArchive(data []byte) error {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return &ValidationError{[]string{"archive is not gzip compressed"}}
+	}
+	defer gz.Close()
+
+	files := 0
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return &ValidationError{[]string{"archive is not a valid tarball: " + err.Error()}}
+		}
+		if header.FileInfo().Mode().IsRegular() {
+			files++
+		}
+		if _, err := io.Copy(ioutil.Discard, tr); err != nil {
+			return &ValidationError{[]string{"archive is truncated: " + err.Error()}}
+		}
+	}
+
+	if files == 0 {
+		return &ValidationError{[]string{"archive does not contain any files"}}
+	}
+
+	return nil
+}
+
+// splitArchive extracts the subtrees rooted at the given directories of a
+// gzipped tarball into tarballs of their own. Entries outside of all
+// directories are dropped.
+func splitArchive(data []byte, dirs []string) (map[string][]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, &ValidationError{[]string{"archive is not gzip compressed"}}
+	}
+	defer gz.Close()
+
+	type part struct {
+		buf *bytes.Buffer
+		gz  *gzip.Writer
+		tw  *tar.Writer
+	}
+	parts := map[string]*part{}
+	for _, dir := range dirs {
+		buf := &bytes.Buffer{}
+		w := gzip.NewWriter(buf)
+		parts[dir] = &part{buf, w, tar.NewWriter(w)}
+	}
+
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, &ValidationError{[]string{"archive is not a valid tarball: " + err.Error()}}
+		}
+
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, &ValidationError{[]string{"archive is truncated: " + err.Error()}}
+		}
+
+		// nested directories each get a copy of the entry
+		name := strings.TrimPrefix(path.Clean("/"+header.Name), "/")
+		for dir, p := range parts {
+			if !strings.HasPrefix(name, dir+"/") {
+				continue
+			}
+
+			entry := *header
+			entry.Name = strings.TrimPrefix(name, dir+"/")
+			if entry.Typeflag == tar.TypeDir {
+				entry.Name += "/"
+			}
+			if err := p.tw.WriteHeader(&entry); err != nil {
+				return nil, err
+			}
+			if _, err := p.tw.Write(content); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	archives := map[string][]byte{}
+	for dir, p := range parts {
+		if err := p.tw.Close(); err != nil {
+			return nil, err
+		}
+		if err := p.gz.Close(); err != nil {
+			return nil, err
+		}
+		archives[dir] = p.buf.Bytes()
+	}
+	return archives, nil
+}
+
+// archiveFiles lists the regular files in a gzipped tarball.
+func archiveFiles(data []byte) ([]string, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, &ValidationError{[]string{"archive is not gzip compressed"}}
+	}
+	defer gz.Close()
+
+	var names []string
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return names, nil
+		}
+		if err != nil {
+			return nil, &ValidationError{[]string{"archive is not a valid tarball: " + err.Error()}}
+		}
+		if header.FileInfo().Mode().IsRegular() {
+			names = append(names, strings.TrimPrefix(path.Clean("/"+header.Name), "/"))
+		}
+	}
+}
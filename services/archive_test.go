@@ -0,0 +1,108 @@
+package services
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+// testArchive builds a gzipped tarball from file contents by name. Names
+// ending in a slash are added as directories.
+func testArchive(files ...string) []byte {
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+
+	for _, name := range files {
+		if name[len(name)-1] == '/' {
+			tw.WriteHeader(&tar.Header{Name: name, Mode: 0755, Typeflag: tar.TypeDir})
+			continue
+		}
+		content := []byte("# " + name)
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content))})
+		tw.Write(content)
+	}
+
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+// archiveContents reads a gzipped tarball into file contents by name.
+func archiveContents(t *testing.T, data []byte) map[string]string {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+
+	files := map[string]string{}
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			break
+		}
+		content, _ := ioutil.ReadAll(tr)
+		files[header.Name] = string(content)
+	}
+	return files
+}
+
+func TestSplitArchive(t *testing.T) {
+	archive := testArchive(
+		"README.md",
+		"modules/",
+		"modules/vpc/aws/",
+		"modules/vpc/aws/main.tf",
+		"./modules/vpc/aws/outputs.tf",
+		"modules/vpc/aws/examples/simple/main.tf",
+		"modules/vpc/aws-extra/main.tf",
+		"modules/dns/aws/main.tf",
+		"modules/dns/aws/../../vpc/aws/variables.tf",
+	)
+
+	archives, err := splitArchive(archive, []string{"modules/vpc/aws", "modules/vpc/aws/examples/simple", "modules/dns/aws"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]map[string]string{
+		"modules/vpc/aws": {
+			"main.tf":                 "# modules/vpc/aws/main.tf",
+			"outputs.tf":              "# ./modules/vpc/aws/outputs.tf",
+			"variables.tf":            "# modules/dns/aws/../../vpc/aws/variables.tf",
+			"examples/simple/main.tf": "# modules/vpc/aws/examples/simple/main.tf",
+		},
+		"modules/vpc/aws/examples/simple": {
+			"main.tf": "# modules/vpc/aws/examples/simple/main.tf",
+		},
+		"modules/dns/aws": {
+			"main.tf": "# modules/dns/aws/main.tf",
+		},
+	}
+
+	if len(archives) != len(expected) {
+		t.Fatalf("expected %d archives, got %d", len(expected), len(archives))
+	}
+	for dir, files := range expected {
+		if actual := archiveContents(t, archives[dir]); !reflect.DeepEqual(actual, files) {
+			t.Errorf("%s: expected %v, got %v", dir, files, actual)
+		}
+	}
+}
+
+func TestSplitArchiveRejectsInvalidArchives(t *testing.T) {
+	if _, err := splitArchive([]byte("not an archive"), []string{"modules/vpc"}); err == nil {
+		t.Error("expected an archive that is not gzip compressed to be rejected")
+	} else if _, ok := err.(*ValidationError); !ok {
+		t.Errorf("expected a validation error, got %v", err)
+	}
+
+	archive := testArchive("modules/vpc/main.tf")
+	if _, err := splitArchive(archive[:len(archive)/2], []string{"modules/vpc"}); err == nil {
+		t.Error("expected a truncated archive to be rejected")
+	}
+}
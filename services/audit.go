@@ -0,0 +1,404 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/erikvanbrakel/anthology/app"
+	"github.com/erikvanbrakel/anthology/models"
+	"github.com/erikvanbrakel/anthology/registry"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Audited operations.
+const (
+	AuditModulePublish     = "module.publish"
+	AuditModuleDelete      = "module.delete"
+	AuditModuleCopy        = "module.copy"
+	AuditModuleAlias       = "module.alias"
+	AuditModuleUnalias     = "module.unalias"
+	AuditModuleDeprecate   = "module.deprecate"
+	AuditModuleUndeprecate = "module.undeprecate"
+	AuditModuleDraft       = "module.draft"
+	AuditModuleDiscard     = "module.discard"
+	AuditModuleTag         = "module.tag"
+	AuditModuleUntag       = "module.untag"
+	AuditProviderPublish   = "provider.publish"
+	AuditSigningKeyAdd     = "signing-key.add"
+	AuditSigningKeyDelete  = "signing-key.delete"
+)
+
+// AuditLog records mutating operations in an append-only log. Every entry
+// carries the hash of the entry before it, so changing or removing an entry
+// breaks the chain. A log must have a single writer.
+type AuditLog struct {
+	// Policy limits queries to namespaces the caller administers.
+	Policy *Policy
+
+	store auditStore
+
+	mu   sync.Mutex
+	last *models.AuditEntry
+}
+
+// AuditQuery filters audit entries, empty fields match everything.
+type AuditQuery struct {
+	Namespace string
+	Operation string
+	Principal string
+	After     int64
+	Limit     int
+}
+
+// auditStore persists encoded entries in order.
+type auditStore interface {
+	append(sequence int64, entry []byte) error
+
+	// entries returns the stored entries in order. Entries up to and
+	// including after may be left out.
+	entries(after int64) ([][]byte, error)
+
+	// last returns the most recent entry, or nil for an empty log.
+	last() ([]byte, error)
+}
+
+// auditSegmentSize is the number of entries the storage backend keeps in
+// one object.
+const auditSegmentSize = 1000
+
+// NewFileAuditLog writes the log as JSON lines to a file.
+func NewFileAuditLog(path string) (*AuditLog, error) {
+	return newAuditLog(&fileAuditStore{path})
+}
+
+// NewStorageAuditLog writes the log to the registry backend, as JSON lines in
+// segments of up to 1000 entries named after their first sequence number:
+//
+//	audit/<sequence>.jsonl
+func NewStorageAuditLog(s registry.Storage) (*AuditLog, error) {
+	return newAuditLog(&storageAuditStore{storage: s})
+}
+
+func newAuditLog(store auditStore) (*AuditLog, error) {
+	l := &AuditLog{store: store}
+
+	data, err := store.last()
+	if err != nil {
+		return nil, err
+	}
+	if data != nil {
+		l.last = &models.AuditEntry{}
+		if err := json.Unmarshal(data, l.last); err != nil {
+			return nil, fmt.Errorf("last audit entry is not readable: %s", err)
+		}
+	}
+
+	return l, nil
+}
+
+// Record appends an entry for an operation. The principal, request ID and
+// time are taken from the request scope, the outcome from err. Recording on
+// a nil log does nothing, so services can leave auditing unconfigured.
+// Rejected attempts of anonymous callers are not recorded, otherwise any
+// client could grow the log without limit.
+func (l *AuditLog) Record(rs app.RequestScope, entry models.AuditEntry, err error) {
+	if l == nil || err == ErrForbidden && rs.Principal() == nil {
+		return
+	}
+
+	entry.Time = rs.Now().UTC()
+	entry.RequestID = rs.RequestID()
+	entry.Principal = principalName(rs)
+
+	entry.Outcome = models.AuditSuccess
+	if err != nil {
+		entry.Outcome = models.AuditFailure
+		entry.Error = err.Error()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry.Sequence = 1
+	if l.last != nil {
+		entry.Sequence = l.last.Sequence + 1
+		entry.PreviousHash = l.last.Hash
+	}
+	entry.Hash = hashAuditEntry(entry)
+
+	data, _ := json.Marshal(entry)
+	if err := l.store.append(entry.Sequence, data); err != nil {
+		rs.Errorf("unable to write audit entry for %s on %s: %s", entry.Operation, entry.Namespace, err)
+		return
+	}
+
+	l.last = &entry
+}
+
+// Query returns the entries matching q that the caller may see, oldest
+// first. With a limit only the most recent matching entries are returned.
+// Without a policy the log is only available to authenticated callers.
+func (l *AuditLog) Query(rs app.RequestScope, q AuditQuery) ([]models.AuditEntry, error) {
+	if l.Policy == nil && rs.Principal() == nil {
+		return nil, ErrForbidden
+	}
+
+	entries, err := l.entries(q.After)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []models.AuditEntry{}
+	for _, e := range entries {
+		switch {
+		case e.Sequence <= q.After,
+			q.Namespace != "" && e.Namespace != q.Namespace,
+			q.Operation != "" && e.Operation != q.Operation,
+			q.Principal != "" && e.Principal != q.Principal,
+			l.Policy != nil && !l.Policy.Allows(rs.Principal(), e.Namespace, RoleAdmin):
+			continue
+		}
+		result = append(result, e)
+	}
+
+	if q.Limit > 0 && len(result) > q.Limit {
+		result = result[len(result)-q.Limit:]
+	}
+
+	return result, nil
+}
+
+// Entries reads the whole log.
+func (l *AuditLog) Entries() ([]models.AuditEntry, error) {
+	return l.entries(0)
+}
+
+func (l *AuditLog) entries(after int64) ([]models.AuditEntry, error) {
+	raw, err := l.store.entries(after)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]models.AuditEntry, len(raw))
+	for i, data := range raw {
+		if err := json.Unmarshal(data, &entries[i]); err != nil {
+			return nil, fmt.Errorf("audit entry %d is not readable: %s", i+1, err)
+		}
+	}
+
+	return entries, nil
+}
+
+// Verify walks the hash chain and reports the first entry that was changed,
+// removed or inserted. It returns the number of verified entries.
+func (l *AuditLog) Verify() (int, error) {
+	entries, err := l.Entries()
+	if err != nil {
+		return 0, err
+	}
+
+	previous := ""
+	for i, e := range entries {
+		switch {
+		case e.Sequence != int64(i+1):
+			return i, fmt.Errorf("entry %d has sequence number %d, entries were removed or inserted", i+1, e.Sequence)
+		case e.PreviousHash != previous:
+			return i, fmt.Errorf("entry %d does not follow entry %d, entries were removed or inserted", i+1, i)
+		case hashAuditEntry(e) != e.Hash:
+			return i, fmt.Errorf("entry %d was modified", i+1)
+		}
+		previous = e.Hash
+	}
+
+	return len(entries), nil
+}
+
+// principalName returns the caller as <type>:<name>, the form used for
+// subjects in policies.
+func principalName(rs app.RequestScope) string {
+	if p := rs.Principal(); p != nil {
+		return p.Type + ":" + p.Name
+	}
+	return "anonymous"
+}
+
+func hashAuditEntry(entry models.AuditEntry) string {
+	entry.Hash = ""
+	data, _ := json.Marshal(entry)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+type fileAuditStore struct {
+	path string
+}
+
+func (s *fileAuditStore) append(sequence int64, entry []byte) error {
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(append(entry, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (s *fileAuditStore) entries(after int64) ([][]byte, error) {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries [][]byte
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if line := bytes.TrimSpace(scanner.Bytes()); len(line) > 0 {
+			entries = append(entries, append([]byte(nil), line...))
+		}
+	}
+
+	return entries, scanner.Err()
+}
+
+func (s *fileAuditStore) last() ([]byte, error) {
+	entries, err := s.entries(0)
+	if err != nil || len(entries) == 0 {
+		return nil, err
+	}
+	return entries[len(entries)-1], nil
+}
+
+// storageAuditStore rewrites the last segment on every append, so it keeps
+// that segment in memory. This relies on the log having a single writer.
+type storageAuditStore struct {
+	storage registry.Storage
+
+	tailKey string
+	tail    []byte
+}
+
+func (s *storageAuditStore) append(sequence int64, entry []byte) error {
+	key := auditSegmentKey(sequence)
+	if key != s.tailKey {
+		s.tailKey, s.tail = key, nil
+	}
+
+	data := make([]byte, 0, len(s.tail)+len(entry)+1)
+	data = append(append(append(data, s.tail...), entry...), '\n')
+	if err := s.storage.PutObject(key, bytes.NewReader(data)); err != nil {
+		return err
+	}
+
+	s.tail = data
+	return nil
+}
+
+func (s *storageAuditStore) entries(after int64) ([][]byte, error) {
+	keys, err := s.segments()
+	if err != nil {
+		return nil, err
+	}
+
+	var entries [][]byte
+	for i, key := range keys {
+		// segments are only skipped when the next one starts early enough
+		if i+1 < len(keys) && auditSegmentSequence(keys[i+1]) <= after+1 {
+			continue
+		}
+
+		data, err := s.readSegment(key)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, splitAuditSegment(data)...)
+	}
+
+	return entries, nil
+}
+
+func (s *storageAuditStore) last() ([]byte, error) {
+	keys, err := s.segments()
+	if err != nil || len(keys) == 0 {
+		return nil, err
+	}
+
+	data, err := s.readSegment(keys[len(keys)-1])
+	if err != nil {
+		return nil, err
+	}
+	s.tailKey, s.tail = keys[len(keys)-1], data
+
+	entries := splitAuditSegment(data)
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	return entries[len(entries)-1], nil
+}
+
+// segments lists the segment keys in order.
+func (s *storageAuditStore) segments() ([]string, error) {
+	keys, err := s.storage.ListObjects("audit/")
+	if err != nil {
+		return nil, err
+	}
+
+	segments := []string{}
+	for _, key := range keys {
+		if strings.HasSuffix(key, ".jsonl") {
+			segments = append(segments, key)
+		}
+	}
+	sort.Strings(segments)
+
+	return segments, nil
+}
+
+func (s *storageAuditStore) readSegment(key string) ([]byte, error) {
+	r, err := s.storage.GetObject(key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+}
+
+func splitAuditSegment(data []byte) [][]byte {
+	var entries [][]byte
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			entries = append(entries, line)
+		}
+	}
+	return entries
+}
+
+func auditSegmentKey(sequence int64) string {
+	return fmt.Sprintf("audit/%020d.jsonl", (sequence-1)/auditSegmentSize*auditSegmentSize+1)
+}
+
+func auditSegmentSequence(key string) int64 {
+	sequence, _ := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(key, "audit/"), ".jsonl"), 10, 64)
+	return sequence
+}
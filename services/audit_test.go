@@ -0,0 +1,170 @@
+package services
+
+import (
+	"bytes"
+	"github.com/erikvanbrakel/anthology/app"
+	"github.com/erikvanbrakel/anthology/models"
+	"github.com/erikvanbrakel/anthology/registry"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testScope is a request scope for calling services outside of a request.
+type testScope struct {
+	app.Logger
+	principal *models.Principal
+}
+
+func newTestScope(principal *models.Principal) app.RequestScope {
+	logger := logrus.New()
+	logger.Level = logrus.PanicLevel
+	return &testScope{Logger: app.NewLogger(logger, logrus.Fields{}), principal: principal}
+}
+
+func (s *testScope) Now() time.Time                   { return time.Now() }
+func (s *testScope) RequestID() string                { return "test" }
+func (s *testScope) Principal() *models.Principal     { return s.principal }
+func (s *testScope) SetPrincipal(p *models.Principal) { s.principal = p }
+
+func recordAuditEntries(t *testing.T, r registry.Registry, namespaces ...string) {
+	log, err := NewStorageAuditLog(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rs := newTestScope(&models.Principal{Type: models.PrincipalToken, Name: "ci"})
+	for _, namespace := range namespaces {
+		log.Record(rs, models.AuditEntry{Operation: AuditModulePublish, Namespace: namespace}, nil)
+	}
+}
+
+func rewriteAuditSegment(t *testing.T, r registry.Registry, rewrite func(lines []string) []string) {
+	key := auditSegmentKey(1)
+	f, err := r.GetObject(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := rewrite(strings.Split(strings.TrimSpace(string(data)), "\n"))
+	if err := r.PutObject(key, bytes.NewReader([]byte(strings.Join(lines, "\n")+"\n"))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAuditHashChain(t *testing.T) {
+	r := registry.NewFakeRegistry()
+	recordAuditEntries(t, r, "team-a", "team-b")
+
+	// a reopened log continues the chain
+	recordAuditEntries(t, r, "team-c")
+
+	log, err := NewStorageAuditLog(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := log.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(entries))
+	}
+	for i, e := range entries {
+		if e.Sequence != int64(i+1) || e.Hash != hashAuditEntry(e) {
+			t.Errorf("entry %d has sequence %d and hash %s", i+1, e.Sequence, e.Hash)
+		}
+		if i > 0 && e.PreviousHash != entries[i-1].Hash {
+			t.Errorf("entry %d does not refer to the hash of entry %d", i+1, i)
+		}
+	}
+	if entries[0].Principal != "token:ci" || entries[0].Outcome != models.AuditSuccess {
+		t.Errorf("unexpected entry %+v", entries[0])
+	}
+
+	if n, err := log.Verify(); err != nil || n != 3 {
+		t.Errorf("expected 3 verified entries, got %d: %v", n, err)
+	}
+}
+
+func TestAuditRejectedAttempts(t *testing.T) {
+	log, err := NewStorageAuditLog(registry.NewFakeRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entry := models.AuditEntry{Operation: AuditModulePublish, Namespace: "team-a"}
+	log.Record(newTestScope(nil), entry, ErrForbidden)
+	log.Record(newTestScope(nil), entry, ErrConflict)
+	log.Record(newTestScope(&models.Principal{Type: models.PrincipalToken, Name: "ci"}), entry, ErrForbidden)
+
+	entries, err := log.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected the anonymous rejection to be left out, got %d entries", len(entries))
+	}
+	if entries[0].Principal != "anonymous" || entries[1].Principal != "token:ci" || entries[1].Error != ErrForbidden.Error() {
+		t.Errorf("unexpected entries %+v", entries)
+	}
+}
+
+func TestAuditHashChainDetectsTampering(t *testing.T) {
+	tests := []struct {
+		tag      string
+		rewrite  func(lines []string) []string
+		verified int
+		err      string
+	}{
+		{
+			"modified",
+			func(lines []string) []string {
+				lines[1] = strings.Replace(lines[1], `"team-b"`, `"team-x"`, 1)
+				return lines
+			},
+			1, "entry 2 was modified",
+		},
+		{
+			"removed",
+			func(lines []string) []string {
+				return append(lines[:1], lines[2:]...)
+			},
+			1, "entry 2 has sequence number 3",
+		},
+		{
+			"reordered",
+			func(lines []string) []string {
+				return []string{lines[1], lines[0], lines[2]}
+			},
+			0, "entry 1 has sequence number 2",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.tag, func(t *testing.T) {
+			r := registry.NewFakeRegistry()
+			recordAuditEntries(t, r, "team-a", "team-b", "team-c")
+			rewriteAuditSegment(t, r, test.rewrite)
+
+			log, err := NewStorageAuditLog(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			n, err := log.Verify()
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("expected %q, got %v", test.err, err)
+			}
+			if n != test.verified {
+				t.Errorf("expected %d verified entries, got %d", test.verified, n)
+			}
+		})
+	}
+}
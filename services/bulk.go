@@ -0,0 +1,188 @@
+package services
+
+import (
+	"bytes"
+	"github.com/erikvanbrakel/anthology/app"
+	"github.com/erikvanbrakel/anthology/models"
+	"io"
+	"path"
+	"sort"
+	"strings"
+)
+
+// BulkService publishes several modules out of one archive of a monorepo.
+// Every module is validated before the first one is published, and the
+// modules that were published are removed again when storing a later one
+// fails, so a bulk publish either publishes everything or nothing.
+type BulkService struct {
+	Modules *ModuleService
+}
+
+func NewBulkService(modules *ModuleService) *BulkService {
+	return &BulkService{modules}
+}
+
+// Publish publishes the modules listed in a manifest. Without a manifest
+// every modules/<name>/<provider> directory in the archive is published as
+// the given version. Problems with individual modules are reported in their
+// results, the error is only set when the request as a whole is rejected.
+func (s *BulkService) Publish(rs app.RequestScope, namespace string, data io.Reader, manifest *models.BulkManifest, version string) ([]models.BulkResult, error) {
+	if err := s.Modules.Authorize(rs, namespace, RolePublisher); err != nil {
+		return nil, err
+	}
+
+	buffer := &bytes.Buffer{}
+	if _, err := buffer.ReadFrom(data); err != nil {
+		return nil, err
+	}
+
+	if manifest == nil {
+		var err error
+		if manifest, err = conventionManifest(buffer.Bytes()); err != nil {
+			return nil, err
+		}
+	}
+	if manifest.Version == "" {
+		manifest.Version = version
+	}
+	if len(manifest.Modules) == 0 {
+		return nil, &ValidationError{[]string{"no modules found, the archive needs a manifest or modules/<name>/<provider> directories"}}
+	}
+
+	dirs := make([]string, len(manifest.Modules))
+	for i := range manifest.Modules {
+		m := &manifest.Modules[i]
+		m.Path = strings.Trim(path.Clean("/"+m.Path), "/")
+		if m.Version == "" {
+			m.Version = manifest.Version
+		}
+		dirs[i] = m.Path
+	}
+
+	archives, err := splitArchive(buffer.Bytes(), dirs)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]models.BulkResult, len(manifest.Modules))
+	failed := false
+	for i, m := range manifest.Modules {
+		results[i] = models.BulkResult{Path: m.Path, Namespace: namespace, Name: m.Name, Provider: m.Provider, Version: m.Version}
+		if err := s.validate(rs, namespace, m, manifest.Modules[:i], archives[m.Path], &results[i]); err != nil {
+			return nil, err
+		}
+		failed = failed || len(results[i].Errors) > 0
+	}
+
+	if failed {
+		for i := range results {
+			results[i].Status = models.BulkSkipped
+			if len(results[i].Errors) > 0 {
+				results[i].Status = models.BulkFailed
+			}
+		}
+		return results, nil
+	}
+
+	for i, m := range manifest.Modules {
+		err := s.Modules.PublishWithMetadata(rs, namespace, m.Name, m.Provider, m.Version, bytes.NewReader(archives[m.Path]), m.ModuleMetadata)
+		if err == nil {
+			results[i].Status = models.BulkPublished
+			continue
+		}
+
+		results[i].Status, results[i].Errors = models.BulkFailed, []string{err.Error()}
+		for j := range results {
+			switch {
+			case j < i:
+				s.rollback(rs, results[j])
+				results[j].Status = models.BulkRolledBack
+			case j > i:
+				results[j].Status = models.BulkSkipped
+			}
+		}
+		break
+	}
+
+	return results, nil
+}
+
+// validate checks a module of a bulk publish the way a publish of it alone
+// would be checked, so that publishing it is unlikely to fail.
+func (s *BulkService) validate(rs app.RequestScope, namespace string, m models.BulkModule, before []models.BulkModule, archive []byte, result *models.BulkResult) error {
+	if m.Path == "" || m.Name == "" || m.Provider == "" {
+		result.Errors = append(result.Errors, "path, name and provider are required")
+	}
+	for _, other := range before {
+		if other.Name == m.Name && other.Provider == m.Provider && other.Version == m.Version {
+			result.Errors = append(result.Errors, "the module is listed more than once")
+		}
+	}
+
+	report, err := s.Modules.inspect(rs, namespace, m.Name, m.Provider, m.Version, archive, m.ModuleMetadata)
+	if err != nil {
+		return err
+	}
+	for _, e := range report.Errors {
+		// name the module rather than its part of the bulk archive
+		if strings.HasPrefix(e, "archive ") {
+			e = m.Path + strings.TrimPrefix(e, "archive")
+		}
+		result.Errors = append(result.Errors, e)
+	}
+	result.Warnings = report.Warnings
+
+	exists, err := s.Modules.Exists(rs, namespace, m.Name, m.Provider, m.Version)
+	if err != nil {
+		return err
+	}
+	if exists {
+		result.Errors = append(result.Errors, ErrConflict.Error())
+	}
+
+	return nil
+}
+
+// rollback removes a module published earlier in a bulk publish that failed.
+// It bypasses the admin role deletes normally require, but is audited and
+// announced like any other delete.
+func (s *BulkService) rollback(rs app.RequestScope, result models.BulkResult) {
+	entry := models.AuditEntry{Operation: AuditModuleDelete, Namespace: result.Namespace, Name: result.Name, Provider: result.Provider, Version: result.Version}
+
+	err := s.Modules.Registry.DeleteModule(result.Namespace, result.Name, result.Provider, result.Version)
+	s.Modules.Audit.Record(rs, entry, err)
+	if err != nil {
+		rs.Errorf("unable to roll back %s/%s/%s %s: %s", result.Namespace, result.Name, result.Provider, result.Version, err)
+		return
+	}
+
+	s.Modules.Registry.DeleteObject(metadataKey(result.Namespace, result.Name, result.Provider, result.Version))
+	s.Modules.Webhooks.Notify(rs, models.Event{Type: EventModuleDeleted, Namespace: result.Namespace, Name: result.Name, Provider: result.Provider, Version: result.Version})
+	rs.Warnf("rolled back %s/%s/%s %s after a failed bulk publish", result.Namespace, result.Name, result.Provider, result.Version)
+}
+
+// conventionManifest finds the modules/<name>/<provider> directories in a
+// gzipped tarball.
+func conventionManifest(data []byte) (*models.BulkManifest, error) {
+	names, err := archiveFiles(data)
+	if err != nil {
+		return nil, err
+	}
+
+	found := map[string]models.BulkModule{}
+	for _, name := range names {
+		parts := strings.Split(name, "/")
+		if len(parts) < 4 || parts[0] != "modules" {
+			continue
+		}
+		dir := strings.Join(parts[:3], "/")
+		found[dir] = models.BulkModule{Path: dir, Name: parts[1], Provider: parts[2]}
+	}
+
+	manifest := &models.BulkManifest{}
+	for _, m := range found {
+		manifest.Modules = append(manifest.Modules, m)
+	}
+	sort.Slice(manifest.Modules, func(i, j int) bool { return manifest.Modules[i].Path < manifest.Modules[j].Path })
+	return manifest, nil
+}
@@ -0,0 +1,57 @@
+package services
+
+import (
+	"github.com/erikvanbrakel/anthology/models"
+	"net/http"
+)
+
+// CertificateAuthenticator implements app.Authenticator for verified TLS
+// client certificates. The principal is named after the subject common name
+// or the first subject alternative name of the configured kind, the
+// organizational units of the subject become its groups.
+type CertificateAuthenticator struct {
+	// Field is one of "subject", "dns", "email" or "uri".
+	Field string
+}
+
+func NewCertificateAuthenticator(field string) *CertificateAuthenticator {
+	return &CertificateAuthenticator{
+		field,
+	}
+}
+
+func (a *CertificateAuthenticator) Authenticate(r *http.Request) (*models.Principal, error) {
+	// only chains verified against the configured CA bundle count
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, nil
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+
+	var name string
+	switch a.Field {
+	case "dns":
+		if len(cert.DNSNames) > 0 {
+			name = cert.DNSNames[0]
+		}
+	case "email":
+		if len(cert.EmailAddresses) > 0 {
+			name = cert.EmailAddresses[0]
+		}
+	case "uri":
+		if len(cert.URIs) > 0 {
+			name = cert.URIs[0].String()
+		}
+	default:
+		name = cert.Subject.CommonName
+	}
+
+	if name == "" {
+		return nil, nil
+	}
+
+	return &models.Principal{
+		Type:   models.PrincipalCertificate,
+		Name:   name,
+		Groups: cert.Subject.OrganizationalUnit,
+	}, nil
+}
@@ -0,0 +1,94 @@
+package services
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"github.com/erikvanbrakel/anthology/app"
+	"github.com/erikvanbrakel/anthology/models"
+	"github.com/erikvanbrakel/anthology/registry"
+)
+
+// Copy copies a published module version, with its metadata, to another
+// namespace, for example to promote it from a development to a production
+// namespace once it is approved. The copy records the coordinates and
+// checksum of the version it was copied from. Backends that can copy
+// archives themselves do so without the archive being read or uploaded
+// again.
+func (s *ModuleService) Copy(rs app.RequestScope, namespace, name, provider, version, target string) (module *models.Module, err error) {
+	source := fmt.Sprintf("%s/%s/%s/%s", namespace, name, provider, version)
+	entry := models.AuditEntry{Operation: AuditModuleCopy, Namespace: target, Name: name, Provider: provider, Version: version, Source: source}
+	defer func() { s.Audit.Record(rs, entry, err) }()
+
+	exists, err := s.Exists(rs, namespace, name, provider, version)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrNotFound
+	}
+
+	if err := s.Authorize(rs, target, RolePublisher); err != nil {
+		return nil, err
+	}
+	if !namePattern.MatchString(target) {
+		return nil, &ValidationError{[]string{"namespace must be alphanumeric with dashes or underscores, up to 64 characters: " + target}}
+	}
+	if target == namespace {
+		return nil, &ValidationError{[]string{"a module can not be copied to its own namespace"}}
+	}
+
+	defer s.lockVersion(target, name, provider, version)()
+
+	exists, err = s.Exists(rs, target, name, provider, version)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, ErrConflict
+	}
+
+	metadata, err := s.metadata(namespace, name, provider, version)
+	if err != nil {
+		return nil, err
+	}
+	if metadata == nil {
+		metadata = &models.ModuleMetadata{}
+	}
+
+	// the archive is only read when the backend can't copy it, or for
+	// versions published before checksums were recorded
+	copier, native := s.Registry.(registry.ModuleCopier)
+	var data *bytes.Buffer
+	if !native || metadata.Checksum == "" {
+		if data, err = s.Registry.GetModuleData(namespace, name, provider, version); err != nil {
+			return nil, err
+		}
+		metadata.Checksum = fmt.Sprintf("sha256:%x", sha256.Sum256(data.Bytes()))
+	}
+	entry.Checksum = metadata.Checksum
+
+	metadata.Provenance = &models.Provenance{
+		Namespace: namespace,
+		Name:      name,
+		Provider:  provider,
+		Version:   version,
+		Checksum:  metadata.Checksum,
+		CopiedBy:  principalName(rs),
+		CopiedAt:  rs.Now().UTC(),
+	}
+
+	err = s.storeVersion(target, name, provider, version, metadata, func() error {
+		if native {
+			return copier.CopyModule(namespace, name, provider, version, target)
+		}
+		return s.Registry.PublishModule(target, name, provider, version, data)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.Webhooks.Notify(rs, models.Event{Type: EventModulePublished, Namespace: target, Name: name, Provider: provider, Version: version})
+
+	return &models.Module{Namespace: target, Name: name, Provider: provider, Version: version, ModuleMetadata: metadata}, nil
+}
@@ -0,0 +1,137 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/erikvanbrakel/anthology/app"
+	"github.com/erikvanbrakel/anthology/models"
+	"github.com/erikvanbrakel/anthology/registry"
+	"net/url"
+)
+
+const maxDeprecationMessageSize = 500
+
+// Deprecations returns the deprecated versions of a module, stored as
+// deprecations/<namespace>/<name>/<provider>.json.
+func (s *ModuleService) Deprecations(rs app.RequestScope, namespace, name, provider string) (map[string]*models.Deprecation, error) {
+	if s.Authorize(rs, namespace, RoleReader) != nil {
+		return map[string]*models.Deprecation{}, nil
+	}
+	return s.loadDeprecations(namespace, name, provider)
+}
+
+// Deprecate marks a version as one that should no longer be used. It stays
+// available, but is no longer the latest version while there are others.
+func (s *ModuleService) Deprecate(rs app.RequestScope, namespace, name, provider, version, message, link string) (module *models.Module, err error) {
+	entry := models.AuditEntry{Operation: AuditModuleDeprecate, Namespace: namespace, Name: name, Provider: provider, Version: version}
+	defer func() { s.Audit.Record(rs, entry, err) }()
+
+	if err := s.Authorize(rs, namespace, RolePublisher); err != nil {
+		return nil, err
+	}
+
+	var errors []string
+	if message == "" {
+		errors = append(errors, "message is required")
+	}
+	if len(message) > maxDeprecationMessageSize {
+		errors = append(errors, fmt.Sprintf("message is longer than %d characters", maxDeprecationMessageSize))
+	}
+	if link != "" {
+		if u, err := url.Parse(link); err != nil || !u.IsAbs() || u.Host == "" {
+			errors = append(errors, "link must be an absolute URL: "+link)
+		}
+	}
+	if len(errors) > 0 {
+		return nil, &ValidationError{errors}
+	}
+
+	deprecation := &models.Deprecation{
+		Message:      message,
+		Link:         link,
+		DeprecatedBy: principalName(rs),
+		DeprecatedAt: rs.Now().UTC(),
+	}
+
+	exists, err := s.Exists(rs, namespace, name, provider, version)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrNotFound
+	}
+
+	if err := s.updateDeprecations(namespace, name, provider, version, deprecation); err != nil {
+		return nil, err
+	}
+
+	rs.Infof("deprecated %s/%s/%s %s: %s", namespace, name, provider, version, message)
+	s.Webhooks.Notify(rs, models.Event{Type: EventModuleDeprecated, Namespace: namespace, Name: name, Provider: provider, Version: version})
+
+	return s.Get(rs, namespace, name, provider, version)
+}
+
+// Undeprecate lifts the deprecation of a version.
+func (s *ModuleService) Undeprecate(rs app.RequestScope, namespace, name, provider, version string) (err error) {
+	entry := models.AuditEntry{Operation: AuditModuleUndeprecate, Namespace: namespace, Name: name, Provider: provider, Version: version}
+	defer func() { s.Audit.Record(rs, entry, err) }()
+
+	if err := s.Authorize(rs, namespace, RolePublisher); err != nil {
+		return err
+	}
+
+	if err := s.updateDeprecations(namespace, name, provider, version, nil); err != nil {
+		return err
+	}
+
+	rs.Infof("lifted the deprecation of %s/%s/%s %s", namespace, name, provider, version)
+	s.Webhooks.Notify(rs, models.Event{Type: EventModuleUndeprecated, Namespace: namespace, Name: name, Provider: provider, Version: version})
+
+	return nil
+}
+
+// updateDeprecations sets the deprecation of a version, or removes it when
+// deprecation is nil.
+func (s *ModuleService) updateDeprecations(namespace, name, provider, version string, deprecation *models.Deprecation) error {
+	s.deprecationsMu.Lock()
+	defer s.deprecationsMu.Unlock()
+
+	deprecations, err := s.loadDeprecations(namespace, name, provider)
+	if err != nil {
+		return err
+	}
+
+	if deprecation != nil {
+		deprecations[version] = deprecation
+	} else if _, ok := deprecations[version]; ok {
+		delete(deprecations, version)
+	} else {
+		return ErrNotFound
+	}
+
+	data, _ := json.Marshal(deprecations)
+	return s.Registry.PutObject(deprecationsKey(namespace, name, provider), bytes.NewReader(data))
+}
+
+func (s *ModuleService) loadDeprecations(namespace, name, provider string) (map[string]*models.Deprecation, error) {
+	deprecations := map[string]*models.Deprecation{}
+
+	r, err := s.Registry.GetObject(deprecationsKey(namespace, name, provider))
+	if err == registry.ErrNotFound {
+		return deprecations, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	if err := json.NewDecoder(r).Decode(&deprecations); err != nil {
+		return nil, fmt.Errorf("invalid deprecations for %s/%s/%s: %s", namespace, name, provider, err)
+	}
+	return deprecations, nil
+}
+
+func deprecationsKey(namespace, name, provider string) string {
+	return "deprecations/" + namespace + "/" + name + "/" + provider + ".json"
+}
@@ -0,0 +1,218 @@
+package services
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"github.com/blang/semver"
+	"github.com/erikvanbrakel/anthology/app"
+	"github.com/erikvanbrakel/anthology/models"
+	"github.com/erikvanbrakel/anthology/registry"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// DraftService keeps module versions that are not released yet. Drafts are
+// stored next to the modules, so they never show up in listings, and only
+// publishers of their namespace can see them:
+//
+//	drafts/<namespace>/<name>/<provider>/<version>.tgz
+//	drafts/<namespace>/<name>/<provider>/<version>.json
+//
+// A draft is released by promoting it, which publishes it like any other
+// version, or thrown away by discarding it.
+type DraftService struct {
+	Modules *ModuleService
+}
+
+func NewDraftService(modules *ModuleService) *DraftService {
+	return &DraftService{modules}
+}
+
+// Create stores a draft after running the checks a publish would run.
+func (s *DraftService) Create(rs app.RequestScope, namespace, name, provider, version string, data io.Reader, metadata *models.ModuleMetadata) (draft *models.Draft, err error) {
+	entry := models.AuditEntry{Operation: AuditModuleDraft, Namespace: namespace, Name: name, Provider: provider, Version: version}
+	defer func() { s.Modules.Audit.Record(rs, entry, err) }()
+
+	if err := s.Modules.Authorize(rs, namespace, RolePublisher); err != nil {
+		return nil, err
+	}
+
+	archive, err := ioutil.ReadAll(data)
+	if err != nil {
+		return nil, err
+	}
+	entry.Checksum = fmt.Sprintf("sha256:%x", sha256.Sum256(archive))
+
+	exists, err := s.Modules.Exists(rs, namespace, name, provider, version)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.load(namespace, name, provider, version); exists || err == nil {
+		return nil, ErrConflict
+	} else if err != ErrNotFound {
+		return nil, err
+	}
+
+	report, err := s.Modules.inspect(rs, namespace, name, provider, version, archive, metadata)
+	if err != nil {
+		return nil, err
+	}
+	if len(report.Errors) > 0 {
+		return nil, &ValidationError{report.Errors}
+	}
+
+	draft = &models.Draft{
+		Namespace:      namespace,
+		Name:           name,
+		Provider:       provider,
+		Version:        version,
+		Checksum:       entry.Checksum,
+		CreatedBy:      principalName(rs),
+		CreatedAt:      rs.Now().UTC(),
+		ModuleMetadata: metadata,
+	}
+
+	// the description goes last, a draft only exists once it is stored
+	key := draftKey(namespace, name, provider, version)
+	if err := s.Modules.Registry.PutObject(key+".tgz", bytes.NewReader(archive)); err != nil {
+		return nil, err
+	}
+	encoded, _ := json.Marshal(draft)
+	if err := s.Modules.Registry.PutObject(key+".json", bytes.NewReader(encoded)); err != nil {
+		return nil, err
+	}
+
+	rs.Infof("stored draft %s/%s/%s %s", namespace, name, provider, version)
+	return draft, nil
+}
+
+// Query lists the drafts of a namespace, optionally of a single module.
+func (s *DraftService) Query(rs app.RequestScope, namespace, name, provider string) ([]models.Draft, error) {
+	if err := s.Modules.Authorize(rs, namespace, RolePublisher); err != nil {
+		return nil, err
+	}
+
+	prefix := "drafts/" + namespace + "/"
+	if name != "" && provider != "" {
+		prefix += name + "/" + provider + "/"
+	}
+
+	keys, err := s.Modules.Registry.ListObjects(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	drafts := []models.Draft{}
+	for _, key := range keys {
+		parts := strings.Split(strings.TrimSuffix(key, ".json"), "/")
+		if !strings.HasSuffix(key, ".json") || len(parts) != 5 {
+			continue
+		}
+
+		draft, err := s.load(parts[1], parts[2], parts[3], parts[4])
+		if err != nil {
+			return nil, err
+		}
+		drafts = append(drafts, *draft)
+	}
+
+	return drafts, nil
+}
+
+func (s *DraftService) Get(rs app.RequestScope, namespace, name, provider, version string) (*models.Draft, error) {
+	if err := s.Modules.Authorize(rs, namespace, RolePublisher); err != nil {
+		return nil, err
+	}
+	return s.load(namespace, name, provider, version)
+}
+
+// GetData opens the archive of a draft.
+func (s *DraftService) GetData(rs app.RequestScope, namespace, name, provider, version string) (io.ReadCloser, error) {
+	if _, err := s.Get(rs, namespace, name, provider, version); err != nil {
+		return nil, err
+	}
+
+	r, err := s.Modules.Registry.GetObject(draftKey(namespace, name, provider, version) + ".tgz")
+	if err == registry.ErrNotFound {
+		return nil, ErrNotFound
+	}
+	return r, err
+}
+
+// Promote publishes a draft as a released version and removes the draft.
+func (s *DraftService) Promote(rs app.RequestScope, namespace, name, provider, version string) (*models.Module, error) {
+	draft, err := s.Get(rs, namespace, name, provider, version)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := s.GetData(rs, namespace, name, provider, version)
+	if err != nil {
+		return nil, err
+	}
+	defer data.Close()
+
+	if err := s.Modules.PublishWithMetadata(rs, namespace, name, provider, version, data, draft.ModuleMetadata); err != nil {
+		return nil, err
+	}
+
+	if err := s.remove(namespace, name, provider, version); err != nil {
+		rs.Warnf("unable to remove promoted draft %s/%s/%s %s: %s", namespace, name, provider, version, err)
+	}
+
+	rs.Infof("promoted draft %s/%s/%s %s", namespace, name, provider, version)
+	return s.Modules.Get(rs, namespace, name, provider, version)
+}
+
+// Discard removes a draft without releasing it.
+func (s *DraftService) Discard(rs app.RequestScope, namespace, name, provider, version string) (err error) {
+	entry := models.AuditEntry{Operation: AuditModuleDiscard, Namespace: namespace, Name: name, Provider: provider, Version: version}
+	defer func() { s.Modules.Audit.Record(rs, entry, err) }()
+
+	draft, err := s.Get(rs, namespace, name, provider, version)
+	if err != nil {
+		return err
+	}
+	entry.Checksum = draft.Checksum
+
+	return s.remove(namespace, name, provider, version)
+}
+
+func (s *DraftService) load(namespace, name, provider, version string) (*models.Draft, error) {
+	// coordinates end up in storage keys, odd ones can not belong to a draft
+	if _, err := semver.Parse(version); err != nil || !namePattern.MatchString(namespace) || !namePattern.MatchString(name) || !providerPattern.MatchString(provider) {
+		return nil, ErrNotFound
+	}
+
+	r, err := s.Modules.Registry.GetObject(draftKey(namespace, name, provider, version) + ".json")
+	if err == registry.ErrNotFound {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	draft := &models.Draft{}
+	if err := json.NewDecoder(r).Decode(draft); err != nil {
+		return nil, fmt.Errorf("invalid draft %s/%s/%s %s: %s", namespace, name, provider, version, err)
+	}
+	return draft, nil
+}
+
+// remove deletes the description of a draft before its archive, so a draft
+// is never left without an archive.
+func (s *DraftService) remove(namespace, name, provider, version string) error {
+	key := draftKey(namespace, name, provider, version)
+	if err := s.Modules.Registry.DeleteObject(key + ".json"); err != nil {
+		return err
+	}
+	return s.Modules.Registry.DeleteObject(key + ".tgz")
+}
+
+func draftKey(namespace, name, provider, version string) string {
+	return "drafts/" + namespace + "/" + name + "/" + provider + "/" + version
+}
@@ -0,0 +1,32 @@
+package services
+
+import (
+	"errors"
+	"strings"
+)
+
+var (
+	// ErrNotFound is returned when the requested resource does not exist.
+	ErrNotFound = errors.New("not found")
+
+	// ErrConflict is returned when a module version has already been published.
+	ErrConflict = errors.New("module version already exists")
+
+	// ErrOffsetMismatch is returned when a chunk does not continue a resumable
+	// upload where the previous chunk ended.
+	ErrOffsetMismatch = errors.New("upload offset does not match")
+
+	// ErrForbidden is returned when the caller lacks the role an operation
+	// requires on a namespace.
+	ErrForbidden = errors.New("forbidden")
+)
+
+// ValidationError is returned when submitted data is rejected. It carries
+// every problem that was found, not just the first one.
+type ValidationError struct {
+	Errors []string
+}
+
+func (e *ValidationError) Error() string {
+	return strings.Join(e.Errors, "; ")
+}
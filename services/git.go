@@ -0,0 +1,279 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"github.com/blang/semver"
+	"github.com/erikvanbrakel/anthology/app"
+	"github.com/erikvanbrakel/anthology/models"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// scpLikeURL matches the user@host:path form git accepts for SSH remotes.
+var scpLikeURL = regexp.MustCompile(`^[\w.-]+@[\w.-]+:[^/]`)
+
+// GitService publishes modules straight from tags in git repositories by
+// shelling out to git. Only the tagged commit is fetched, into a bare
+// repository that is kept per remote in Directory, or thrown away when
+// Directory is empty.
+type GitService struct {
+	Modules   *ModuleService
+	Directory string
+	Timeout   time.Duration
+
+	// Schemes are the URL schemes remotes may use, file has to be enabled
+	// explicitly since it exposes repositories on the server.
+	Schemes []string
+
+	// Remotes restricts the remotes to ones starting with any of these
+	// prefixes, e.g. https://github.com/example/, when not empty.
+	Remotes []string
+
+	mu sync.Mutex
+}
+
+func NewGitService(modules *ModuleService, directory string, timeout time.Duration, schemes, remotes []string) (*GitService, error) {
+	if _, err := exec.LookPath("git"); err != nil {
+		return nil, fmt.Errorf("git is not available: %s", err)
+	}
+
+	for _, scheme := range schemes {
+		switch scheme {
+		case "file", "http", "https", "ssh":
+		default:
+			return nil, fmt.Errorf("unsupported git scheme %s", scheme)
+		}
+	}
+
+	if directory != "" {
+		if err := os.MkdirAll(directory, 0755); err != nil {
+			return nil, fmt.Errorf("unable to create git directory: %s", err)
+		}
+	}
+
+	return &GitService{
+		Modules:   modules,
+		Directory: directory,
+		Timeout:   timeout,
+		Schemes:   schemes,
+		Remotes:   remotes,
+	}, nil
+}
+
+// Publish archives the tree of a tag, or of a subdirectory of it, and
+// publishes it as the version named by the tag: v1.2.3, 1.2.3 and
+// prefixed tags like modules/vpc/v1.2.3 are all published as 1.2.3.
+func (s *GitService) Publish(rs app.RequestScope, namespace, name, provider string, source models.GitSource) (*models.GitRelease, error) {
+	if err := s.Modules.Authorize(rs, namespace, RolePublisher); err != nil {
+		return nil, err
+	}
+
+	version, err := s.validate(&source)
+	if err != nil {
+		return nil, err
+	}
+
+	exists, err := s.Modules.Exists(rs, namespace, name, provider, version)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, ErrConflict
+	}
+
+	commit, archive, err := s.archive(source)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.Modules.Publish(rs, namespace, name, provider, version, bytes.NewReader(archive)); err != nil {
+		return nil, err
+	}
+
+	rs.Infof("published %s/%s/%s %s from %s at %s", namespace, name, provider, version, source.Repository, commit)
+
+	return &models.GitRelease{
+		GitSource: source,
+		Namespace: namespace,
+		Name:      name,
+		Provider:  provider,
+		Version:   version,
+		Commit:    commit,
+	}, nil
+}
+
+// validate checks a source before it is handed to git and returns the
+// version named by its tag. The path is cleaned in place.
+func (s *GitService) validate(source *models.GitSource) (string, error) {
+	var errors []string
+
+	if scheme := remoteScheme(source.Repository); scheme == "" {
+		errors = append(errors, "repository must be a file://, http(s):// or ssh:// URL or an scp-like SSH address")
+	} else if !s.allows(scheme) {
+		errors = append(errors, scheme+" repositories are not allowed")
+	} else if !s.allowsRemote(source.Repository) {
+		errors = append(errors, "repository is not one of the allowed remotes: "+source.Repository)
+	}
+
+	version, err := tagVersion(source.Tag)
+	if err != nil {
+		errors = append(errors, err.Error())
+	}
+
+	source.Path = strings.Trim(path.Clean("/"+source.Path), "/")
+	if strings.HasPrefix(source.Path, "-") || strings.Contains(source.Path, ":") {
+		errors = append(errors, "invalid path "+source.Path)
+	}
+
+	if len(errors) > 0 {
+		return "", &ValidationError{errors}
+	}
+	return version, nil
+}
+
+// archive fetches a tag and returns the commit it points to together with a
+// gzipped tarball of its tree.
+func (s *GitService) archive(source models.GitSource) (string, []byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.Timeout)
+	defer cancel()
+
+	dir := filepath.Join(s.Directory, fmt.Sprintf("%x.git", sha256.Sum256([]byte(source.Repository))))
+	if s.Directory == "" {
+		tmp, err := ioutil.TempDir("", "anthology-git")
+		if err != nil {
+			return "", nil, err
+		}
+		defer os.RemoveAll(tmp)
+		dir = tmp
+	} else {
+		// concurrent fetches into the same repository would trip over git's
+		// lock files
+		s.mu.Lock()
+		defer s.mu.Unlock()
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "HEAD")); os.IsNotExist(err) {
+		if _, err := s.git(ctx, "", "init", "--quiet", "--bare", dir); err != nil {
+			return "", nil, err
+		}
+	}
+
+	ref := "refs/tags/" + source.Tag
+	if _, err := s.git(ctx, dir, "fetch", "--quiet", "--depth=1", "--no-tags", "--force", source.Repository, "+"+ref+":"+ref); err != nil {
+		return "", nil, &ValidationError{[]string{fmt.Sprintf("unable to fetch tag %s from %s: %s", source.Tag, source.Repository, err)}}
+	}
+
+	commit, err := s.git(ctx, dir, "rev-parse", "--verify", "--quiet", ref+"^{commit}")
+	if err != nil {
+		return "", nil, &ValidationError{[]string{"tag " + source.Tag + " does not point to a commit"}}
+	}
+
+	tree := ref
+	if source.Path != "" {
+		tree += ":" + source.Path
+	}
+	archive, err := s.git(ctx, dir, "archive", "--format=tar.gz", tree)
+	if err != nil {
+		return "", nil, &ValidationError{[]string{fmt.Sprintf("unable to archive %s: %s", tree, err)}}
+	}
+
+	return string(bytes.TrimSpace(commit)), archive, nil
+}
+
+// git runs a git command and returns its output. Git is kept from prompting
+// for credentials and from using protocols that are not allowed.
+func (s *GitService) git(ctx context.Context, dir string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_TERMINAL_PROMPT=0",
+		"GIT_PROTOCOL_FROM_USER=0",
+		"GIT_ALLOW_PROTOCOL="+strings.Join(s.Schemes, ":"),
+	)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("git %s timed out", args[0])
+		}
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%s", msg)
+		}
+		return nil, err
+	}
+
+	return stdout.Bytes(), nil
+}
+
+func (s *GitService) allows(scheme string) bool {
+	for _, allowed := range s.Schemes {
+		if allowed == scheme {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *GitService) allowsRemote(remote string) bool {
+	if len(s.Remotes) == 0 {
+		return true
+	}
+	// a prefix says nothing about a remote that climbs out of it
+	if strings.Contains(remote+"/", "/../") {
+		return false
+	}
+	for _, prefix := range s.Remotes {
+		if strings.HasPrefix(remote, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteScheme returns the scheme of a git remote, or an empty string for
+// anything that is not a plain URL, like the ext:: transport or a bare path.
+func remoteScheme(remote string) string {
+	if strings.HasPrefix(remote, "-") || strings.Contains(remote, "::") {
+		return ""
+	}
+	if scpLikeURL.MatchString(remote) {
+		return "ssh"
+	}
+
+	u, err := url.Parse(remote)
+	if err != nil || u.Path == "" {
+		return ""
+	}
+
+	switch u.Scheme {
+	case "file", "http", "https", "ssh":
+		return u.Scheme
+	}
+	return ""
+}
+
+// tagVersion parses the semantic version at the end of a tag.
+func tagVersion(tag string) (string, error) {
+	if tag == "" || strings.HasPrefix(tag, "-") || strings.Contains(tag, "..") || strings.ContainsAny(tag, " ~^:?*[\\") {
+		return "", fmt.Errorf("invalid tag %q", tag)
+	}
+
+	v, err := semver.Parse(strings.TrimPrefix(path.Base(tag), "v"))
+	if err != nil {
+		return "", fmt.Errorf("tag %s does not name a semantic version", tag)
+	}
+	return v.String(), nil
+}
@@ -0,0 +1,282 @@
+package services
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"github.com/erikvanbrakel/anthology/app"
+	"github.com/erikvanbrakel/anthology/models"
+	"github.com/erikvanbrakel/anthology/registry"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Sources of push webhooks.
+const (
+	HookGitHub = "github"
+	HookGitLab = "gitlab"
+	HookGitea  = "gitea"
+)
+
+// HookRepository maps a repository on a git host to a module. Tags starting
+// with TagPrefix are published from Path, fetched from URL or, when that is
+// empty, from the clone URL in the payload.
+type HookRepository struct {
+	Source     string `json:"source"`
+	Repository string `json:"repository"`
+	Secret     string `json:"secret"`
+	URL        string `json:"url"`
+	Path       string `json:"path"`
+	TagPrefix  string `json:"tag_prefix"`
+	Namespace  string `json:"namespace"`
+	Name       string `json:"name"`
+	Provider   string `json:"provider"`
+}
+
+// HookService publishes modules when a tag is pushed to a mapped repository.
+// Payloads are authenticated with the secret of the mapping, the publish
+// itself runs in the background and is tracked in storage:
+//
+//	hooks/events/<id>.json
+type HookService struct {
+	Storage      registry.Storage
+	Git          *GitService
+	Repositories []HookRepository
+
+	// Policy limits the event log to namespaces the caller can publish to.
+	Policy *Policy
+}
+
+// hookPush is what is needed from a push payload, whatever host sent it.
+type hookPush struct {
+	repository string
+	ref        string
+	cloneURL   string
+	deleted    bool
+}
+
+func NewHookService(s registry.Storage, git *GitService, repositories []HookRepository) (*HookService, error) {
+	for i, r := range repositories {
+		var errors []string
+		switch r.Source {
+		case HookGitHub, HookGitLab, HookGitea:
+		default:
+			errors = append(errors, "unknown source "+r.Source)
+		}
+		if r.Repository == "" || r.Secret == "" {
+			errors = append(errors, "repository and secret are required")
+		}
+		if r.Namespace == "" || r.Name == "" || r.Provider == "" {
+			errors = append(errors, "namespace, name and provider are required")
+		}
+		if len(errors) > 0 {
+			return nil, fmt.Errorf("repository %d: %s", i, strings.Join(errors, ", "))
+		}
+	}
+
+	return &HookService{
+		Storage:      s,
+		Git:          git,
+		Repositories: repositories,
+	}, nil
+}
+
+func LoadHookService(s registry.Storage, git *GitService, filename string) (*HookService, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var config struct {
+		Repositories []HookRepository `json:"repositories"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+
+	return NewHookService(s, git, config.Repositories)
+}
+
+// Receive handles a webhook from a git host. Payloads that are not tag pushes,
+// like branch pushes and pings, are accepted without publishing anything.
+// Payloads that can not be authenticated are rejected with ErrForbidden.
+func (s *HookService) Receive(rs app.RequestScope, source string, header http.Header, body []byte) ([]models.HookEvent, error) {
+	push, err := parsePush(source, header, body)
+	if err != nil {
+		return nil, err
+	}
+
+	var mappings []HookRepository
+	for _, r := range s.Repositories {
+		if r.Source == source && strings.EqualFold(r.Repository, push.repository) && verifyHook(source, r.Secret, header, body) {
+			mappings = append(mappings, r)
+		}
+	}
+	if len(mappings) == 0 {
+		rs.Warnf("rejected %s webhook for repository %q", source, push.repository)
+		return nil, ErrForbidden
+	}
+
+	events := []models.HookEvent{}
+	if !strings.HasPrefix(push.ref, "refs/tags/") || push.deleted {
+		return events, nil
+	}
+	tag := strings.TrimPrefix(push.ref, "refs/tags/")
+
+	principal := &models.Principal{Type: models.PrincipalWebhook, Name: source + ":" + push.repository}
+	for _, r := range mappings {
+		principal.Roles = append(principal.Roles, models.NamespaceRole{Namespace: r.Namespace, Role: RolePublisher})
+	}
+	rs.SetPrincipal(principal)
+
+	for _, r := range mappings {
+		if !strings.HasPrefix(tag, r.TagPrefix) {
+			continue
+		}
+
+		event := models.HookEvent{
+			ID:         newOrderedID(),
+			Source:     source,
+			Repository: push.repository,
+			Tag:        tag,
+			Namespace:  r.Namespace,
+			Name:       r.Name,
+			Provider:   r.Provider,
+			Status:     models.HookPending,
+			ReceivedAt: rs.Now().UTC(),
+			UpdatedAt:  rs.Now().UTC(),
+		}
+		if err := s.save(&event); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+
+		remote := r.URL
+		if remote == "" {
+			remote = push.cloneURL
+		}
+		go s.publish(rs, event, models.GitSource{Repository: remote, Tag: tag, Path: r.Path})
+	}
+
+	return events, nil
+}
+
+// Events lists the publishes triggered by webhooks, newest first.
+func (s *HookService) Events(rs app.RequestScope, repository, status string) ([]models.HookEvent, error) {
+	keys, err := s.Storage.ListObjects("hooks/events/")
+	if err != nil {
+		return nil, err
+	}
+
+	events := []models.HookEvent{}
+	for _, key := range keys {
+		r, err := s.Storage.GetObject(key)
+		if err != nil {
+			return nil, err
+		}
+
+		var event models.HookEvent
+		err = json.NewDecoder(r).Decode(&event)
+		r.Close()
+		if err != nil {
+			return nil, fmt.Errorf("unreadable hook event %s: %s", key, err)
+		}
+
+		switch {
+		case repository != "" && !strings.EqualFold(event.Repository, repository),
+			status != "" && event.Status != status,
+			rs != nil && s.Policy != nil && !s.Policy.Allows(rs.Principal(), event.Namespace, RolePublisher):
+			continue
+		}
+		events = append(events, event)
+	}
+
+	sort.Slice(events, func(i, j int) bool { return events[i].ID > events[j].ID })
+	return events, nil
+}
+
+func (s *HookService) publish(rs app.RequestScope, event models.HookEvent, source models.GitSource) {
+	release, err := s.Git.Publish(rs, event.Namespace, event.Name, event.Provider, source)
+	if err != nil {
+		rs.Errorf("unable to publish %s/%s/%s from tag %s of %s: %s", event.Namespace, event.Name, event.Provider, event.Tag, event.Repository, err)
+		event.Status, event.Error = models.HookFailed, err.Error()
+	} else {
+		event.Status, event.Version, event.Commit = models.HookPublished, release.Version, release.Commit
+	}
+
+	event.UpdatedAt = time.Now().UTC()
+	if err := s.save(&event); err != nil {
+		rs.Errorf("unable to update hook event %s: %s", event.ID, err)
+	}
+}
+
+func (s *HookService) save(event *models.HookEvent) error {
+	data, _ := json.Marshal(event)
+	return s.Storage.PutObject("hooks/events/"+event.ID+".json", bytes.NewReader(data))
+}
+
+// parsePush reads the repository and ref from a push payload. Event types
+// other than pushes are returned without a ref.
+func parsePush(source string, header http.Header, body []byte) (*hookPush, error) {
+	var payload struct {
+		Ref         string  `json:"ref"`
+		Deleted     bool    `json:"deleted"`
+		CheckoutSHA *string `json:"checkout_sha"`
+		Repository  struct {
+			FullName string `json:"full_name"`
+			CloneURL string `json:"clone_url"`
+		} `json:"repository"`
+		Project struct {
+			PathWithNamespace string `json:"path_with_namespace"`
+			HTTPURL           string `json:"git_http_url"`
+		} `json:"project"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, &ValidationError{[]string{"payload is not valid JSON: " + err.Error()}}
+	}
+
+	push := &hookPush{}
+	switch source {
+	case HookGitHub, HookGitea:
+		push.repository, push.cloneURL = payload.Repository.FullName, payload.Repository.CloneURL
+		event := header.Get("X-GitHub-Event")
+		if source == HookGitea {
+			event = header.Get("X-Gitea-Event")
+		}
+		if event == "push" {
+			push.ref, push.deleted = payload.Ref, payload.Deleted
+		}
+	case HookGitLab:
+		push.repository, push.cloneURL = payload.Project.PathWithNamespace, payload.Project.HTTPURL
+		if header.Get("X-Gitlab-Event") == "Tag Push Hook" {
+			// a deleted tag has no commit to check out
+			push.ref, push.deleted = payload.Ref, payload.CheckoutSHA == nil
+		}
+	default:
+		return nil, ErrNotFound
+	}
+
+	if push.repository == "" {
+		return nil, &ValidationError{[]string{"payload does not name a repository"}}
+	}
+	return push, nil
+}
+
+// verifyHook checks the signature GitHub and Gitea compute over the body, or
+// the plain secret token GitLab sends along.
+func verifyHook(source, secret string, header http.Header, body []byte) bool {
+	switch source {
+	case HookGitHub:
+		return hmac.Equal([]byte(header.Get("X-Hub-Signature-256")), []byte(SignWebhook(secret, body)))
+	case HookGitea:
+		return hmac.Equal([]byte("sha256="+header.Get("X-Gitea-Signature")), []byte(SignWebhook(secret, body)))
+	case HookGitLab:
+		return subtle.ConstantTimeCompare([]byte(header.Get("X-Gitlab-Token")), []byte(secret)) == 1
+	}
+	return false
+}
@@ -0,0 +1,186 @@
+package services
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// jwt is a decoded, not yet verified, JSON web token.
+type jwt struct {
+	Header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	Claims    map[string]interface{}
+	signed    []byte
+	signature []byte
+}
+
+// jsonWebKey is a public key from a JSON web key set (RFC 7517).
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+var jwtHashes = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+	"ES256": crypto.SHA256,
+	"ES384": crypto.SHA384,
+	"ES512": crypto.SHA512,
+}
+
+// parseJWT decodes a token in compact serialization. It fails for anything
+// that does not look like a JWT, so other kinds of bearer tokens can be told
+// apart.
+func parseJWT(token string) (*jwt, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("not a JWT")
+	}
+
+	t := &jwt{signed: []byte(parts[0] + "." + parts[1])}
+
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWT header: %s", err)
+	}
+	if err := json.Unmarshal(header, &t.Header); err != nil {
+		return nil, fmt.Errorf("invalid JWT header: %s", err)
+	}
+
+	claims, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWT claims: %s", err)
+	}
+	d := json.NewDecoder(bytes.NewReader(claims))
+	d.UseNumber()
+	if err := d.Decode(&t.Claims); err != nil {
+		return nil, fmt.Errorf("invalid JWT claims: %s", err)
+	}
+
+	if t.signature, err = base64.RawURLEncoding.DecodeString(parts[2]); err != nil {
+		return nil, fmt.Errorf("invalid JWT signature: %s", err)
+	}
+
+	return t, nil
+}
+
+// verify checks the signature of the token with a public key. Only the
+// asymmetric algorithms are accepted, "none" and HMAC never verify.
+func (t *jwt) verify(key crypto.PublicKey) error {
+	hash, ok := jwtHashes[t.Header.Alg]
+	if !ok {
+		return fmt.Errorf("unsupported JWT algorithm %q", t.Header.Alg)
+	}
+
+	h := hash.New()
+	h.Write(t.signed)
+	digest := h.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(t.Header.Alg, "RS") {
+			return errors.New("JWT algorithm does not match the key")
+		}
+		return rsa.VerifyPKCS1v15(k, hash, digest, t.signature)
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if !strings.HasPrefix(t.Header.Alg, "ES") || len(t.signature) != 2*size {
+			return errors.New("JWT algorithm does not match the key")
+		}
+		r := new(big.Int).SetBytes(t.signature[:size])
+		s := new(big.Int).SetBytes(t.signature[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return errors.New("invalid JWT signature")
+		}
+		return nil
+	}
+
+	return errors.New("unsupported key type")
+}
+
+// parseJWKS reads the keys of a JSON web key set by key ID. Keys of unknown
+// types are skipped.
+func parseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %s", k.Kid, err)
+		}
+		if key != nil {
+			keys[k.Kid] = key
+		}
+	}
+
+	return keys, nil
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+
+	return nil, nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
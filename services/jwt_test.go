@@ -0,0 +1,165 @@
+package services
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+)
+
+func encodeJWTSegment(v interface{}) string {
+	data, _ := json.Marshal(v)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// signJWT signs claims with an RSA or P-256 key, for the given algorithm.
+func signJWT(t *testing.T, alg string, key crypto.Signer, claims map[string]interface{}) string {
+	signed := encodeJWTSegment(map[string]string{"alg": alg, "kid": "test"}) + "." + encodeJWTSegment(claims)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestJWTVerify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := map[string]interface{}{"sub": "ci", "exp": 1700000000}
+	rsaToken := signJWT(t, "RS256", rsaKey, claims)
+	ecToken := signJWT(t, "ES256", ecKey, claims)
+
+	parts := strings.Split(rsaToken, ".")
+	tampered := parts[0] + "." + encodeJWTSegment(map[string]interface{}{"sub": "admin"}) + "." + parts[2]
+	unsigned := encodeJWTSegment(map[string]string{"alg": "none"}) + "." + parts[1] + "."
+	hmac := encodeJWTSegment(map[string]string{"alg": "HS256"}) + "." + parts[1] + "." + parts[2]
+	confused := encodeJWTSegment(map[string]string{"alg": "ES256"}) + "." + parts[1] + "." + parts[2]
+
+	tests := []struct {
+		tag   string
+		token string
+		key   crypto.PublicKey
+		err   string
+	}{
+		{"RS256", rsaToken, &rsaKey.PublicKey, ""},
+		{"ES256", ecToken, &ecKey.PublicKey, ""},
+		{"modified claims", tampered, &rsaKey.PublicKey, "verification error"},
+		{"other key", ecToken, &otherKey.PublicKey, "invalid JWT signature"},
+		{"none", unsigned, &rsaKey.PublicKey, `unsupported JWT algorithm "none"`},
+		{"HMAC", hmac, &rsaKey.PublicKey, `unsupported JWT algorithm "HS256"`},
+		{"RSA signature as ES256", confused, &ecKey.PublicKey, "JWT algorithm does not match the key"},
+		{"ES256 with an RSA key", ecToken, &rsaKey.PublicKey, "JWT algorithm does not match the key"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.tag, func(t *testing.T) {
+			token, err := parseJWT(test.token)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = token.verify(test.key)
+			switch {
+			case test.err == "" && err != nil:
+				t.Errorf("expected the token to verify, got %v", err)
+			case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+				t.Errorf("expected %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestParseJWT(t *testing.T) {
+	for _, token := range []string{"not-a-jwt", "a.b", "!!.e30.", "e30.!!.", encodeJWTSegment(map[string]string{}) + ".e30.!!"} {
+		if _, err := parseJWT(token); err == nil {
+			t.Errorf("expected %q to be rejected", token)
+		}
+	}
+
+	token, err := parseJWT(encodeJWTSegment(map[string]string{"alg": "RS256", "kid": "key-1"}) + "." +
+		encodeJWTSegment(map[string]interface{}{"exp": 1700000000}) + ".c2ln")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Header.Alg != "RS256" || token.Header.Kid != "key-1" || string(token.signature) != "sig" {
+		t.Errorf("unexpected token %+v", token)
+	}
+	if exp, ok := token.Claims["exp"].(json.Number); !ok || exp.String() != "1700000000" {
+		t.Errorf("expected exp to be kept as a number, got %#v", token.Claims["exp"])
+	}
+}
+
+func TestParseJWKS(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encode := func(i *big.Int) string { return base64.RawURLEncoding.EncodeToString(i.Bytes()) }
+	data, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{"kid": "rsa", "kty": "RSA", "n": encode(rsaKey.N), "e": encode(big.NewInt(int64(rsaKey.E)))},
+		{"kid": "ec", "kty": "EC", "crv": "P-256", "x": encode(ecKey.X), "y": encode(ecKey.Y)},
+		{"kid": "symmetric", "kty": "oct"},
+	}})
+
+	keys, err := parseJWKS(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("expected the symmetric key to be skipped, got %d keys", len(keys))
+	}
+
+	claims := map[string]interface{}{"sub": "ci"}
+	for kid, token := range map[string]string{"rsa": signJWT(t, "RS256", rsaKey, claims), "ec": signJWT(t, "ES256", ecKey, claims)} {
+		parsed, err := parseJWT(token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := parsed.verify(keys[kid]); err != nil {
+			t.Errorf("expected the %s key to verify its token, got %v", kid, err)
+		}
+	}
+
+	data, _ = json.Marshal(map[string]interface{}{"keys": []map[string]string{{"kid": "ec", "kty": "EC", "crv": "P-192"}}})
+	if _, err := parseJWKS(data); err == nil {
+		t.Error("expected an unsupported curve to be rejected")
+	}
+}
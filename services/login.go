@@ -0,0 +1,310 @@
+package services
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/erikvanbrakel/anthology/app"
+	"github.com/erikvanbrakel/anthology/models"
+	"github.com/erikvanbrakel/anthology/registry"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LoginPorts is the range of local ports Terraform may listen on for the
+// redirect at the end of `terraform login`.
+var LoginPorts = [2]int{10000, 10010}
+
+// authorizationCodeTTL is the time a client has to exchange an authorization
+// code for a token.
+const authorizationCodeTTL = 5 * time.Minute
+
+// tokenCacheTTL bounds how long a verified token is trusted without reading it
+// from storage again.
+const tokenCacheTTL = time.Minute
+
+// loginTokenPattern matches the tokens issued by Exchange, other bearer tokens
+// are not looked up in storage.
+var loginTokenPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// LoginService is the OAuth2 authorization server behind `terraform login`. It
+// implements the authorization code grant with PKCE for a single public
+// client. Authorization codes and tokens are kept in storage by their SHA256
+// hash only:
+//
+//	login/codes/<sha256 of code>.json
+//	login/tokens/<sha256 of token>.json
+type LoginService struct {
+	Storage  registry.Storage
+	Users    *UserStore
+	ClientID string
+	TokenTTL time.Duration
+
+	mu     sync.Mutex
+	tokens map[string]cachedToken
+
+	// codesMu makes reading and deleting an authorization code one step, so
+	// that concurrent exchanges of the same code can not both redeem it.
+	codesMu sync.Mutex
+}
+
+// OAuthError is an error response as defined by RFC 6749.
+type OAuthError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func (e *OAuthError) Error() string {
+	return e.Code + ": " + e.Description
+}
+
+type authorizationCode struct {
+	ClientID      string            `json:"client_id"`
+	RedirectURI   string            `json:"redirect_uri"`
+	CodeChallenge string            `json:"code_challenge"`
+	Principal     *models.Principal `json:"principal"`
+	ExpiresAt     time.Time         `json:"expires_at"`
+}
+
+type issuedToken struct {
+	Principal *models.Principal `json:"principal"`
+	ExpiresAt time.Time         `json:"expires_at"`
+}
+
+type cachedToken struct {
+	token   *issuedToken
+	expires time.Time
+}
+
+func NewLoginService(s registry.Storage, users *UserStore, clientID string, tokenTTL time.Duration) *LoginService {
+	return &LoginService{
+		Storage:  s,
+		Users:    users,
+		ClientID: clientID,
+		TokenTTL: tokenTTL,
+		tokens:   map[string]cachedToken{},
+	}
+}
+
+// ValidateClient checks the client of an authorization request. Errors are
+// shown to the user instead of being sent to an unverified redirect URI.
+func (s *LoginService) ValidateClient(clientID, redirectURI string) error {
+	if clientID != s.ClientID {
+		return &OAuthError{"unauthorized_client", "unknown client " + clientID}
+	}
+
+	u, err := url.Parse(redirectURI)
+	if err != nil || u.Scheme != "http" {
+		return &OAuthError{"invalid_request", "redirect_uri must be a local http URL"}
+	}
+
+	host, port, err := net.SplitHostPort(u.Host)
+	if err != nil || (host != "localhost" && !net.ParseIP(host).IsLoopback()) {
+		return &OAuthError{"invalid_request", "redirect_uri must be a local http URL"}
+	}
+
+	if p, err := strconv.Atoi(port); err != nil || p < LoginPorts[0] || p > LoginPorts[1] {
+		return &OAuthError{"invalid_request", fmt.Sprintf("redirect_uri must use a port between %d and %d", LoginPorts[0], LoginPorts[1])}
+	}
+
+	return nil
+}
+
+// Authorize authenticates a user and returns an authorization code bound to
+// the client, its redirect URI and the PKCE code challenge.
+func (s *LoginService) Authorize(rs app.RequestScope, clientID, redirectURI, codeChallenge, username, password string) (string, error) {
+	if err := s.ValidateClient(clientID, redirectURI); err != nil {
+		return "", err
+	}
+	if codeChallenge == "" {
+		return "", &OAuthError{"invalid_request", "a S256 code_challenge is required"}
+	}
+
+	principal, err := s.Users.Authenticate(username, password)
+	if err != nil {
+		rs.Infof("failed login for user %s", username)
+		return "", err
+	}
+
+	code, err := newSecret()
+	if err != nil {
+		return "", err
+	}
+
+	data, _ := json.Marshal(&authorizationCode{
+		ClientID:      clientID,
+		RedirectURI:   redirectURI,
+		CodeChallenge: codeChallenge,
+		Principal:     principal,
+		ExpiresAt:     rs.Now().Add(authorizationCodeTTL),
+	})
+	if err := s.Storage.PutObject(codeKey(code), bytes.NewReader(data)); err != nil {
+		return "", err
+	}
+
+	return code, nil
+}
+
+// Exchange redeems an authorization code for an access token. A code can be
+// used only once.
+func (s *LoginService) Exchange(rs app.RequestScope, clientID, code, redirectURI, codeVerifier string) (token string, expiresAt time.Time, err error) {
+	invalid := &OAuthError{"invalid_grant", "the authorization code is invalid or expired"}
+
+	grant, err := s.consumeCode(code)
+	if err == registry.ErrNotFound {
+		return "", time.Time{}, invalid
+	} else if err != nil {
+		return "", time.Time{}, err
+	}
+
+	if rs.Now().After(grant.ExpiresAt) || grant.ClientID != clientID || grant.RedirectURI != redirectURI {
+		return "", time.Time{}, invalid
+	}
+
+	challenge := sha256.Sum256([]byte(codeVerifier))
+	if subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(challenge[:])), []byte(grant.CodeChallenge)) != 1 {
+		return "", time.Time{}, &OAuthError{"invalid_grant", "code_verifier does not match the code challenge"}
+	}
+
+	if token, err = newSecret(); err != nil {
+		return "", time.Time{}, err
+	}
+
+	issued := &issuedToken{Principal: grant.Principal, ExpiresAt: rs.Now().Add(s.TokenTTL)}
+	data, _ := json.Marshal(issued)
+	if err := s.Storage.PutObject(tokenKey(token), bytes.NewReader(data)); err != nil {
+		return "", time.Time{}, err
+	}
+
+	rs.Infof("issued a token for user %s", grant.Principal.Name)
+
+	return token, issued.ExpiresAt, nil
+}
+
+// consumeCode reads an authorization code and removes it, so that it can not
+// be used again.
+func (s *LoginService) consumeCode(code string) (*authorizationCode, error) {
+	s.codesMu.Lock()
+	defer s.codesMu.Unlock()
+
+	var grant authorizationCode
+	if err := s.readJSON(codeKey(code), &grant); err != nil {
+		return nil, err
+	}
+
+	if err := s.Storage.DeleteObject(codeKey(code)); err != nil {
+		return nil, err
+	}
+	return &grant, nil
+}
+
+// Authenticate implements app.Authenticator for tokens issued by Exchange.
+// Tokens that were not issued here are left to other authenticators.
+func (s *LoginService) Authenticate(r *http.Request) (*models.Principal, error) {
+	token := app.BearerToken(r)
+	if !loginTokenPattern.MatchString(token) {
+		return nil, nil
+	}
+
+	issued, err := s.lookup(token)
+	if err != nil || issued == nil {
+		return nil, err
+	}
+
+	if time.Now().After(issued.ExpiresAt) {
+		return nil, app.ErrInvalidCredentials
+	}
+
+	return issued.Principal, nil
+}
+
+// Cleanup removes authorization codes and tokens that expired before now.
+func (s *LoginService) Cleanup(now time.Time) (int, error) {
+	removed := 0
+
+	for _, prefix := range []string{"login/codes/", "login/tokens/"} {
+		keys, err := s.Storage.ListObjects(prefix)
+		if err != nil {
+			return removed, err
+		}
+
+		for _, key := range keys {
+			var entry struct {
+				ExpiresAt time.Time `json:"expires_at"`
+			}
+			if err := s.readJSON(key, &entry); err != nil || now.After(entry.ExpiresAt) {
+				s.Storage.DeleteObject(key)
+				removed++
+			}
+		}
+	}
+
+	return removed, nil
+}
+
+func (s *LoginService) lookup(token string) (*issuedToken, error) {
+	key := tokenKey(token)
+
+	s.mu.Lock()
+	cached, ok := s.tokens[key]
+	s.mu.Unlock()
+
+	if ok && time.Now().Before(cached.expires) {
+		return cached.token, nil
+	}
+
+	issued := &issuedToken{}
+	if err := s.readJSON(key, issued); err == registry.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.tokens[key] = cachedToken{issued, time.Now().Add(tokenCacheTTL)}
+	s.mu.Unlock()
+
+	return issued, nil
+}
+
+func (s *LoginService) readJSON(key string, v interface{}) error {
+	r, err := s.Storage.GetObject(key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	return json.NewDecoder(r).Decode(v)
+}
+
+func newSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func codeKey(code string) string {
+	return "login/codes/" + hashSecret(code) + ".json"
+}
+
+func tokenKey(token string) string {
+	return "login/tokens/" + hashSecret(token) + ".json"
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(strings.TrimSpace(secret)))
+	return hex.EncodeToString(sum[:])
+}
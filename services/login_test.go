@@ -0,0 +1,49 @@
+package services
+
+import (
+	"github.com/erikvanbrakel/anthology/registry"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// countingStorage counts the objects read from storage.
+type countingStorage struct {
+	registry.Storage
+	reads int
+}
+
+func (s *countingStorage) GetObject(key string) (io.ReadCloser, error) {
+	s.reads++
+	return s.Storage.GetObject(key)
+}
+
+func TestLoginAuthenticateLookups(t *testing.T) {
+	storage := &countingStorage{Storage: registry.NewFakeRegistry()}
+	s := NewLoginService(storage, nil, "terraform-cli", 0)
+
+	tests := []struct {
+		token string
+		reads int
+	}{
+		{"static-token", 0},
+		{"eyJhbGciOiJSUzI1NiJ9.e30.c2ln", 0},
+		{strings.Repeat("A", 64), 0},
+		{strings.Repeat("a", 65), 0},
+		{strings.Repeat("a", 64), 1},
+	}
+
+	for _, test := range tests {
+		storage.reads = 0
+
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.Header.Set("Authorization", "Bearer "+test.token)
+		if principal, err := s.Authenticate(r); principal != nil || err != nil {
+			t.Errorf("%s: expected no principal, got %+v, %v", test.token, principal, err)
+		}
+		if storage.reads != test.reads {
+			t.Errorf("%s: expected %d reads, got %d", test.token, test.reads, storage.reads)
+		}
+	}
+}
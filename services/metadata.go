@@ -0,0 +1,100 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/erikvanbrakel/anthology/models"
+	"github.com/erikvanbrakel/anthology/registry"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+const (
+	maxLabels          = 20
+	maxDescriptionSize = 1000
+)
+
+var labelPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,49}$`)
+
+// validateMetadata checks the metadata given with a publish and normalizes
+// the labels to lower case.
+func validateMetadata(metadata *models.ModuleMetadata) error {
+	var errors []string
+
+	if metadata.Checksum != "" {
+		errors = append(errors, "checksum is recorded by the registry and can not be given")
+	}
+	if metadata.Provenance != nil {
+		errors = append(errors, "provenance is recorded by the registry and can not be given")
+	}
+
+	if len(metadata.Description) > maxDescriptionSize {
+		errors = append(errors, fmt.Sprintf("description is longer than %d characters", maxDescriptionSize))
+	}
+
+	if metadata.Source != "" {
+		if u, err := url.Parse(metadata.Source); (err != nil || !u.IsAbs() || u.Host == "") && !scpLikeURL.MatchString(metadata.Source) {
+			errors = append(errors, "source must be an absolute URL: "+metadata.Source)
+		}
+	}
+
+	if len(metadata.Labels) > maxLabels {
+		errors = append(errors, fmt.Sprintf("at most %d labels are allowed", maxLabels))
+	}
+	for i, label := range metadata.Labels {
+		metadata.Labels[i] = strings.ToLower(label)
+		if !labelPattern.MatchString(metadata.Labels[i]) {
+			errors = append(errors, "invalid label "+label)
+		}
+	}
+
+	if len(errors) > 0 {
+		return &ValidationError{errors}
+	}
+	return nil
+}
+
+// metadata reads the metadata of a module version, nil when none was given.
+func (s *ModuleService) metadata(namespace, name, provider, version string) (*models.ModuleMetadata, error) {
+	r, err := s.Registry.GetObject(metadataKey(namespace, name, provider, version))
+	if err == registry.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	metadata := &models.ModuleMetadata{}
+	if err := json.NewDecoder(r).Decode(metadata); err != nil {
+		return nil, fmt.Errorf("invalid metadata for %s/%s/%s %s: %s", namespace, name, provider, version, err)
+	}
+	return metadata, nil
+}
+
+func (s *ModuleService) saveMetadata(namespace, name, provider, version string, metadata *models.ModuleMetadata) error {
+	data, _ := json.Marshal(metadata)
+	return s.Registry.PutObject(metadataKey(namespace, name, provider, version), bytes.NewReader(data))
+}
+
+// storeVersion saves the metadata of a version and then writes its archive
+// with write. The metadata goes first, it is only read once the version
+// exists, and is removed again when the archive can't be written.
+func (s *ModuleService) storeVersion(namespace, name, provider, version string, metadata *models.ModuleMetadata, write func() error) error {
+	if err := s.saveMetadata(namespace, name, provider, version, metadata); err != nil {
+		return err
+	}
+
+	if err := write(); err != nil {
+		s.Registry.DeleteObject(metadataKey(namespace, name, provider, version))
+		return err
+	}
+
+	return nil
+}
+
+func metadataKey(namespace, name, provider, version string) string {
+	return "modules/" + namespace + "/" + name + "/" + provider + "/" + version + ".json"
+}
@@ -0,0 +1,249 @@
+package services
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/blang/semver"
+	"github.com/erikvanbrakel/anthology/app"
+	"github.com/erikvanbrakel/anthology/models"
+	"github.com/erikvanbrakel/anthology/registry"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MirrorService implements the provider network mirror protocol. Archives are
+// stored per origin registry hostname, next to a <version>.json file per
+// release that holds the platforms and hashes Terraform verifies.
+type MirrorService struct {
+	Storage registry.Storage
+
+	// Policy restricts access to namespaces, when set.
+	Policy *Policy
+
+	mu sync.Mutex
+}
+
+func NewMirrorService(s registry.Storage) *MirrorService {
+	return &MirrorService{
+		Storage: s,
+	}
+}
+
+// Authorize checks that the caller has at least the given role on a
+// namespace.
+func (s *MirrorService) Authorize(rs app.RequestScope, namespace, role string) error {
+	if s.Policy == nil || s.Policy.Allows(rs.Principal(), namespace, role) {
+		return nil
+	}
+	return ErrForbidden
+}
+
+// Versions lists the mirrored versions of a provider.
+func (s *MirrorService) Versions(rs app.RequestScope, hostname, namespace, providerType string) ([]string, error) {
+	if s.Authorize(rs, namespace, RoleReader) != nil {
+		return []string{}, nil
+	}
+
+	prefix := mirrorPrefix(hostname, namespace, providerType)
+
+	keys, err := s.Storage.ListObjects(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := []string{}
+	for _, key := range keys {
+		name := strings.TrimPrefix(key, prefix)
+		if strings.Contains(name, "/") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		versions = append(versions, strings.TrimSuffix(name, ".json"))
+	}
+
+	return versions, nil
+}
+
+// Archives returns the mirrored archives of a release by platform.
+func (s *MirrorService) Archives(rs app.RequestScope, hostname, namespace, providerType, version string) (map[string]models.MirrorArchive, error) {
+	if s.Authorize(rs, namespace, RoleReader) != nil {
+		return nil, ErrNotFound
+	}
+	return s.archives(hostname, namespace, providerType, version)
+}
+
+// GetArchive opens a mirrored provider package.
+func (s *MirrorService) GetArchive(rs app.RequestScope, hostname, namespace, providerType, filename string) (io.ReadCloser, error) {
+	if s.Authorize(rs, namespace, RoleReader) != nil {
+		return nil, ErrNotFound
+	}
+	if !strings.HasPrefix(filename, "terraform-provider-"+providerType+"_") || !strings.HasSuffix(filename, ".zip") {
+		return nil, ErrNotFound
+	}
+
+	r, err := s.Storage.GetObject(mirrorPrefix(hostname, namespace, providerType) + filename)
+	if err == registry.ErrNotFound {
+		return nil, ErrNotFound
+	}
+	return r, err
+}
+
+// Add stores a provider package in the mirror and records its hashes.
+func (s *MirrorService) Add(hostname, namespace, providerType, filename string, data []byte) error {
+	version, goos, arch, ok := parseMirrorFilename(providerType, filename)
+	if !ok {
+		return &ValidationError{[]string{"unexpected provider package name " + filename}}
+	}
+
+	h1, err := hashZip(data)
+	if err != nil {
+		return &ValidationError{[]string{fmt.Sprintf("%s is not a valid zip archive: %s", filename, err)}}
+	}
+
+	prefix := mirrorPrefix(hostname, namespace, providerType)
+	if err := s.Storage.PutObject(prefix+filename, bytes.NewReader(data)); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	archives, err := s.archives(hostname, namespace, providerType, version)
+	if err == ErrNotFound {
+		archives = map[string]models.MirrorArchive{}
+	} else if err != nil {
+		return err
+	}
+
+	archives[goos+"_"+arch] = models.MirrorArchive{
+		URL:    filename,
+		Hashes: []string{h1, fmt.Sprintf("zh:%x", sha256.Sum256(data))},
+	}
+
+	encoded, _ := json.Marshal(archives)
+	return s.Storage.PutObject(prefix+version+".json", bytes.NewReader(encoded))
+}
+
+// Import adds every provider package found in a directory laid out like the
+// output of `terraform providers mirror`, i.e.
+// <hostname>/<namespace>/<type>/terraform-provider-<type>_<version>_<os>_<arch>.zip.
+// Other files, like the JSON files written by Terraform, are ignored.
+func (s *MirrorService) Import(dir string) (int, error) {
+	imported := 0
+
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !strings.HasSuffix(p, ".zip") {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+
+		parts := strings.Split(filepath.ToSlash(rel), "/")
+		if len(parts) != 4 {
+			return nil
+		}
+
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+
+		if err := s.Add(parts[0], parts[1], parts[2], parts[3], data); err != nil {
+			return fmt.Errorf("unable to import %s: %s", rel, err)
+		}
+
+		imported++
+		return nil
+	})
+
+	return imported, err
+}
+
+func (s *MirrorService) archives(hostname, namespace, providerType, version string) (map[string]models.MirrorArchive, error) {
+	r, err := s.Storage.GetObject(mirrorPrefix(hostname, namespace, providerType) + version + ".json")
+	if err == registry.ErrNotFound {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	archives := map[string]models.MirrorArchive{}
+	if err := json.NewDecoder(r).Decode(&archives); err != nil {
+		return nil, err
+	}
+
+	return archives, nil
+}
+
+// parseMirrorFilename splits a package name like
+// terraform-provider-aws_1.0.0_linux_amd64.zip into its version and platform.
+func parseMirrorFilename(providerType, filename string) (version, goos, arch string, ok bool) {
+	prefix := "terraform-provider-" + providerType + "_"
+	if !strings.HasPrefix(filename, prefix) || !strings.HasSuffix(filename, ".zip") {
+		return "", "", "", false
+	}
+
+	parts := strings.Split(strings.TrimSuffix(strings.TrimPrefix(filename, prefix), ".zip"), "_")
+	if len(parts) != 3 {
+		return "", "", "", false
+	}
+	if _, err := semver.Make(parts[0]); err != nil {
+		return "", "", "", false
+	}
+
+	return parts[0], parts[1], parts[2], true
+}
+
+// hashZip computes the "h1:" hash Terraform records in dependency lock files:
+// the SHA256 of a sorted list of the SHA256 of every file in the archive.
+func hashZip(data []byte) (string, error) {
+	z, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", err
+	}
+
+	files := make([]*zip.File, 0, len(z.File))
+	for _, f := range z.File {
+		if strings.Contains(f.Name, "\n") {
+			return "", fmt.Errorf("file name %q contains a newline", f.Name)
+		}
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+
+	summary := sha256.New()
+	for _, f := range files {
+		r, err := f.Open()
+		if err != nil {
+			return "", err
+		}
+
+		h := sha256.New()
+		_, err = io.Copy(h, r)
+		r.Close()
+		if err != nil {
+			return "", err
+		}
+
+		fmt.Fprintf(summary, "%x  %s\n", h.Sum(nil), f.Name)
+	}
+
+	return "h1:" + base64.StdEncoding.EncodeToString(summary.Sum(nil)), nil
+}
+
+func mirrorPrefix(hostname, namespace, providerType string) string {
+	return "mirror/" + hostname + "/" + namespace + "/" + providerType + "/"
+}
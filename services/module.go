@@ -1,23 +1,75 @@
 package services
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"github.com/blang/semver"
 	"github.com/erikvanbrakel/anthology/app"
 	"github.com/erikvanbrakel/anthology/models"
 	"github.com/erikvanbrakel/anthology/registry"
+	"hash/fnv"
 	"io"
+	"regexp"
+	"sync"
 )
 
 type ModuleService struct {
 	Registry registry.Registry
+
+	// Policy restricts access to namespaces. Without a policy everyone can do
+	// everything.
+	Policy *Policy
+
+	// Audit records publishes and deletes, when set.
+	Audit *AuditLog
+
+	// Webhooks are notified of publishes and deletes, when set.
+	Webhooks *WebhookService
+
+	// tagsMu serializes tag changes, which rewrite the tags of a module.
+	tagsMu sync.Mutex
+
+	// deprecationsMu serializes deprecations, which rewrite the deprecations
+	// of a module.
+	deprecationsMu sync.Mutex
+
+	// versionLocks are shared by the module versions that hash to the same
+	// stripe, see lockVersion.
+	versionLocks [versionLockStripes]sync.Mutex
 }
 
+// versionLockStripes is the number of locks publishes are spread over.
+const versionLockStripes = 64
+
+// Naming rules of the public registry.
+var (
+	namePattern     = regexp.MustCompile(`^[0-9A-Za-z](?:[0-9A-Za-z-_]{0,62}[0-9A-Za-z])?$`)
+	providerPattern = regexp.MustCompile(`^[0-9a-z]{1,64}$`)
+)
+
 func NewModuleService(r registry.Registry) *ModuleService {
 	return &ModuleService{
-		r,
+		Registry: r,
+	}
+}
+
+// Authorize checks that the caller has at least the given role on a
+// namespace.
+func (s *ModuleService) Authorize(rs app.RequestScope, namespace, role string) error {
+	if s.Policy == nil || s.Policy.Allows(rs.Principal(), namespace, role) {
+		return nil
 	}
+	return ErrForbidden
 }
 
 func (s *ModuleService) Query(rs app.RequestScope, namespace, name, provider string, verified bool, offset, limit int) ([]models.Module, int, error) {
+	if s.Policy != nil && namespace == "" {
+		return s.queryVisible(rs, name, provider, offset, limit)
+	}
+	if s.Authorize(rs, namespace, RoleReader) != nil {
+		return []models.Module{}, 0, nil
+	}
 
 	modules, count, err := s.Registry.ListModules(namespace, name, provider, offset, limit)
 
@@ -28,13 +80,50 @@ func (s *ModuleService) Query(rs app.RequestScope, namespace, name, provider str
 	return modules, count, nil
 }
 
+// queryVisible lists modules across all namespaces the caller may read. The
+// backend can not filter by namespace access, so the page is cut out of the
+// filtered listing here.
+func (s *ModuleService) queryVisible(rs app.RequestScope, name, provider string, offset, limit int) ([]models.Module, int, error) {
+	modules, _, err := s.Registry.ListModules("", name, provider, 0, 10000)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	visible := []models.Module{}
+	for _, m := range modules {
+		if s.Authorize(rs, m.Namespace, RoleReader) == nil {
+			visible = append(visible, m)
+		}
+	}
+
+	total := len(visible)
+	switch {
+	case offset < 0:
+		offset = 0
+	case offset > total:
+		offset = total
+	}
+	if end := offset + limit; limit >= 0 && end < total {
+		visible = visible[:end]
+	}
+
+	return visible[offset:], total, nil
+}
+
 func (s *ModuleService) QueryVersions(rs app.RequestScope, namespace, name, provider string) ([]models.Module, error) {
+	if s.Authorize(rs, namespace, RoleReader) != nil {
+		return []models.Module{}, nil
+	}
 
 	modules, _, err := s.Registry.ListModules(namespace, name, provider, 0, 10000)
 	return modules, err
 }
 
 func (s *ModuleService) Exists(rs app.RequestScope, namespace, name, provider, version string) (bool, error) {
+	if s.Authorize(rs, namespace, RoleReader) != nil {
+		return false, nil
+	}
+
 	modules, _, err := s.Registry.ListModules(namespace, name, provider, 0, 10000)
 
 	if err != nil {
@@ -50,6 +139,10 @@ func (s *ModuleService) Exists(rs app.RequestScope, namespace, name, provider, v
 }
 
 func (s *ModuleService) Get(rs app.RequestScope, namespace, name, provider, version string) (*models.Module, error) {
+	if s.Authorize(rs, namespace, RoleReader) != nil {
+		return nil, nil
+	}
+
 	modules, _, err := s.Registry.ListModules(namespace, name, provider, 0, 10000)
 
 	if err != nil {
@@ -58,6 +151,14 @@ func (s *ModuleService) Get(rs app.RequestScope, namespace, name, provider, vers
 
 	for _, m := range modules {
 		if m.Version == version {
+			if m.ModuleMetadata, err = s.metadata(namespace, name, provider, version); err != nil {
+				return nil, err
+			}
+			deprecations, err := s.loadDeprecations(namespace, name, provider)
+			if err != nil {
+				return nil, err
+			}
+			m.Deprecation = deprecations[version]
 			return &m, nil
 		}
 	}
@@ -66,9 +167,164 @@ func (s *ModuleService) Get(rs app.RequestScope, namespace, name, provider, vers
 }
 
 func (s *ModuleService) Publish(rs app.RequestScope, namespace, name, provider, version string, data io.Reader) error {
-	return s.Registry.PublishModule(namespace, name, provider, version, data)
+	return s.PublishWithMetadata(rs, namespace, name, provider, version, data, nil)
+}
+
+// PublishWithMetadata publishes a module version together with a description
+// of it, which is returned when the version is requested on its own.
+func (s *ModuleService) PublishWithMetadata(rs app.RequestScope, namespace, name, provider, version string, data io.Reader, metadata *models.ModuleMetadata) (err error) {
+	entry := models.AuditEntry{Operation: AuditModulePublish, Namespace: namespace, Name: name, Provider: provider, Version: version}
+	defer func() { s.Audit.Record(rs, entry, err) }()
+
+	if err := s.Authorize(rs, namespace, RolePublisher); err != nil {
+		return err
+	}
+
+	buffer := &bytes.Buffer{}
+	if _, err := buffer.ReadFrom(data); err != nil {
+		return err
+	}
+	entry.Checksum = fmt.Sprintf("sha256:%x", sha256.Sum256(buffer.Bytes()))
+
+	if errors := validateCoordinates(namespace, name, provider, version); len(errors) > 0 {
+		return &ValidationError{errors}
+	}
+
+	defer s.lockVersion(namespace, name, provider, version)()
+
+	// published versions are immutable
+	exists, err := s.Exists(rs, namespace, name, provider, version)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return ErrConflict
+	}
+
+	if metadata != nil {
+		if err := validateMetadata(metadata); err != nil {
+			return err
+		}
+	}
+	if err := validateArchive(buffer.Bytes()); err != nil {
+		return err
+	}
+
+	stored := &models.ModuleMetadata{}
+	if metadata != nil {
+		*stored = *metadata
+	}
+	stored.Checksum = entry.Checksum
+
+	err = s.storeVersion(namespace, name, provider, version, stored, func() error {
+		return s.Registry.PublishModule(namespace, name, provider, version, buffer)
+	})
+	if err != nil {
+		return err
+	}
+
+	s.Webhooks.Notify(rs, models.Event{Type: EventModulePublished, Namespace: namespace, Name: name, Provider: provider, Version: version})
+	return nil
+}
+
+func (s *ModuleService) Delete(rs app.RequestScope, namespace, name, provider, version string) (err error) {
+	entry := models.AuditEntry{Operation: AuditModuleDelete, Namespace: namespace, Name: name, Provider: provider, Version: version}
+	defer func() { s.Audit.Record(rs, entry, err) }()
+
+	if err := s.Authorize(rs, namespace, RoleAdmin); err != nil {
+		return err
+	}
+
+	exists, err := s.Exists(rs, namespace, name, provider, version)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrNotFound
+	}
+
+	if err := s.Registry.DeleteModule(namespace, name, provider, version); err != nil {
+		return err
+	}
+	if err := s.Registry.DeleteObject(metadataKey(namespace, name, provider, version)); err != nil {
+		rs.Warnf("unable to delete the metadata of %s/%s/%s %s: %s", namespace, name, provider, version, err)
+	}
+	if err := s.updateDeprecations(namespace, name, provider, version, nil); err != nil && err != ErrNotFound {
+		rs.Warnf("unable to delete the deprecation of %s/%s/%s %s: %s", namespace, name, provider, version, err)
+	}
+
+	// tags can't point to a version that is gone
+	untagged, err := s.untagVersion(rs, namespace, name, provider, version)
+	if err != nil {
+		rs.Warnf("unable to remove the tags of %s/%s/%s %s: %s", namespace, name, provider, version, err)
+	}
+
+	s.Webhooks.Notify(rs, models.Event{Type: EventModuleDeleted, Namespace: namespace, Name: name, Provider: provider, Version: version})
+	for _, tag := range untagged {
+		s.Webhooks.Notify(rs, models.Event{Type: EventModuleUntagged, Namespace: namespace, Name: name, Provider: provider, Version: version, Tag: tag})
+	}
+	return nil
 }
 
 func (s *ModuleService) GetData(rs app.RequestScope, namespace, name, provider, version string) (io.Reader, error) {
-	return s.Registry.GetModuleData(namespace, name, provider, version)
+	if s.Authorize(rs, namespace, RoleReader) != nil {
+		return nil, ErrNotFound
+	}
+
+	data, err := s.Registry.GetModuleData(namespace, name, provider, version)
+	if err == registry.ErrNotFound {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// GetDataURL returns a direct download link for the module archive when the
+// backend supports it, or an empty string when the archive has to be proxied.
+func (s *ModuleService) GetDataURL(rs app.RequestScope, namespace, name, provider, version string) (string, error) {
+	if s.Authorize(rs, namespace, RoleReader) != nil {
+		return "", ErrNotFound
+	}
+
+	if p, ok := s.Registry.(registry.DownloadURLProvider); ok {
+		return p.GetModuleDataURL(namespace, name, provider, version)
+	}
+	return "", nil
+}
+
+// validateCoordinates checks the namespace, name, provider and version of a
+// module version that is about to be published against the naming rules of
+// the public registry.
+func validateCoordinates(namespace, name, provider, version string) []string {
+	var errors []string
+
+	if !namePattern.MatchString(namespace) {
+		errors = append(errors, "namespace must be alphanumeric with dashes or underscores, up to 64 characters: "+namespace)
+	}
+	if !namePattern.MatchString(name) {
+		errors = append(errors, "name must be alphanumeric with dashes or underscores, up to 64 characters: "+name)
+	}
+	if !providerPattern.MatchString(provider) {
+		errors = append(errors, "provider must be lower case alphanumeric: "+provider)
+	}
+	if _, err := semver.Parse(version); err != nil {
+		errors = append(errors, "version is not a valid semantic version: "+version)
+	}
+
+	return errors
+}
+
+// lockVersion serializes publishes of the same module version, so that two
+// of them can not both pass the check for an existing version. Versions share
+// a fixed set of locks, so unrelated publishes may wait for each other but no
+// lock is kept per version. It returns the function that releases the lock.
+func (s *ModuleService) lockVersion(namespace, name, provider, version string) func() {
+	h := fnv.New32a()
+	io.WriteString(h, namespace+"/"+name+"/"+provider+"/"+version)
+
+	m := &s.versionLocks[h.Sum32()%versionLockStripes]
+	m.Lock()
+	return m.Unlock
 }
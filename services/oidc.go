@@ -0,0 +1,339 @@
+package services
+
+import (
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/erikvanbrakel/anthology/app"
+	"github.com/erikvanbrakel/anthology/models"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// jwtLeeway allows for clock skew between Anthology and the issuer.
+	jwtLeeway = time.Minute
+
+	// jwksTTL is how long keys are used before they are loaded again, keys
+	// are also reloaded when a token refers to an unknown key, but at most
+	// once per jwksMinRefresh.
+	jwksTTL        = time.Hour
+	jwksMinRefresh = time.Minute
+)
+
+// OIDCConfig lists the issuers whose tokens are accepted, e.g. the OIDC
+// providers of CI systems.
+type OIDCConfig struct {
+	Issuers []OIDCIssuer `json:"issuers"`
+}
+
+// OIDCIssuer configures one trusted issuer. Its keys are loaded from either a
+// JWKS URL or a local JWKS file.
+type OIDCIssuer struct {
+	Issuer   string      `json:"issuer"`
+	Audience string      `json:"audience"`
+	JWKSURL  string      `json:"jwks_url"`
+	JWKSFile string      `json:"jwks_file"`
+	Rules    []ClaimRule `json:"rules"`
+}
+
+// ClaimRule grants a role on namespaces to tokens whose claims all match the
+// given patterns, using the syntax of path.Match. Namespaces may refer to
+// claims as {claim}, e.g. {namespace_path}.
+type ClaimRule struct {
+	Claims     map[string]string `json:"claims"`
+	Namespaces []string          `json:"namespaces"`
+	Role       string            `json:"role"`
+}
+
+// OIDCAuthenticator implements app.Authenticator for JWTs of the configured
+// issuers. Tokens of other issuers are left to other authenticators.
+type OIDCAuthenticator struct {
+	issuers map[string]*oidcIssuer
+}
+
+type oidcIssuer struct {
+	OIDCIssuer
+
+	mu       sync.Mutex
+	keys     map[string]crypto.PublicKey
+	loadedAt time.Time
+}
+
+var claimReference = regexp.MustCompile(`\{([^{}]+)\}`)
+
+func LoadOIDCAuthenticator(filename string) (*OIDCAuthenticator, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var config OIDCConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+
+	return NewOIDCAuthenticator(config)
+}
+
+func NewOIDCAuthenticator(config OIDCConfig) (*OIDCAuthenticator, error) {
+	a := &OIDCAuthenticator{issuers: map[string]*oidcIssuer{}}
+
+	for _, c := range config.Issuers {
+		switch {
+		case c.Issuer == "":
+			return nil, errors.New("an issuer needs an issuer URL")
+		case c.Audience == "":
+			return nil, fmt.Errorf("issuer %s: an audience is required", c.Issuer)
+		case (c.JWKSURL == "") == (c.JWKSFile == ""):
+			return nil, fmt.Errorf("issuer %s: exactly one of jwks_url and jwks_file is required", c.Issuer)
+		}
+
+		c.Rules = append([]ClaimRule(nil), c.Rules...)
+		for i, rule := range c.Rules {
+			if rule.Role == "" {
+				c.Rules[i].Role = RolePublisher
+			} else if _, ok := roleLevels[rule.Role]; !ok {
+				return nil, fmt.Errorf("issuer %s: unknown role %q", c.Issuer, rule.Role)
+			}
+		}
+
+		issuer := &oidcIssuer{OIDCIssuer: c}
+		if err := issuer.load(); err != nil {
+			if c.JWKSFile != "" {
+				return nil, fmt.Errorf("issuer %s: %s", c.Issuer, err)
+			}
+			logrus.Warnf("unable to load the keys of issuer %s, retrying on first use: %s", c.Issuer, err)
+		}
+
+		a.issuers[c.Issuer] = issuer
+	}
+
+	return a, nil
+}
+
+func (a *OIDCAuthenticator) Authenticate(r *http.Request) (*models.Principal, error) {
+	token, err := parseJWT(app.BearerToken(r))
+	if err != nil {
+		return nil, nil
+	}
+
+	iss, _ := token.Claims["iss"].(string)
+	issuer, ok := a.issuers[iss]
+	if !ok {
+		return nil, nil
+	}
+
+	if err := issuer.verify(token, time.Now()); err != nil {
+		logrus.Infof("rejected token of issuer %s: %s", iss, err)
+		return nil, app.ErrInvalidCredentials
+	}
+
+	sub, _ := token.Claims["sub"].(string)
+	return &models.Principal{
+		Type:  models.PrincipalOIDC,
+		Name:  sub,
+		Roles: issuer.roles(token.Claims),
+	}, nil
+}
+
+// verify checks the signature, audience and validity period of a token.
+func (i *oidcIssuer) verify(token *jwt, now time.Time) error {
+	key, err := i.key(token.Header.Kid)
+	if err != nil {
+		return err
+	}
+	if err := token.verify(key); err != nil {
+		return err
+	}
+
+	if !claimContains(token.Claims["aud"], i.Audience) {
+		return errors.New("token is not meant for this audience")
+	}
+
+	exp, ok := numericClaim(token.Claims, "exp")
+	if !ok {
+		return errors.New("token does not expire")
+	}
+	if now.After(time.Unix(exp, 0).Add(jwtLeeway)) {
+		return errors.New("token has expired")
+	}
+	if nbf, ok := numericClaim(token.Claims, "nbf"); ok && now.Add(jwtLeeway).Before(time.Unix(nbf, 0)) {
+		return errors.New("token is not valid yet")
+	}
+
+	return nil
+}
+
+// roles evaluates the rules of the issuer against the claims of a token.
+func (i *oidcIssuer) roles(claims map[string]interface{}) []models.NamespaceRole {
+	var roles []models.NamespaceRole
+
+	for _, rule := range i.Rules {
+		if !claimsMatch(rule.Claims, claims) {
+			continue
+		}
+		for _, namespace := range rule.Namespaces {
+			if expanded, ok := expandClaims(namespace, claims); ok {
+				roles = append(roles, models.NamespaceRole{Namespace: expanded, Role: rule.Role})
+			}
+		}
+	}
+
+	return roles
+}
+
+// key returns the public key with the given ID, reloading the key set when
+// the key is unknown or the keys are old.
+func (i *oidcIssuer) key(kid string) (crypto.PublicKey, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	key, ok := i.lookup(kid)
+	stale := time.Since(i.loadedAt) > jwksTTL
+	if (!ok || stale) && time.Since(i.loadedAt) > jwksMinRefresh {
+		if err := i.loadLocked(); err != nil {
+			logrus.Warnf("unable to reload the keys of issuer %s: %s", i.Issuer, err)
+		}
+		key, ok = i.lookup(kid)
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	return key, nil
+}
+
+// lookup finds a key by ID. Tokens without a key ID are accepted when the
+// issuer has a single key.
+func (i *oidcIssuer) lookup(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(i.keys) == 1 {
+		for _, key := range i.keys {
+			return key, true
+		}
+	}
+	key, ok := i.keys[kid]
+	return key, ok
+}
+
+func (i *oidcIssuer) load() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return i.loadLocked()
+}
+
+func (i *oidcIssuer) loadLocked() error {
+	i.loadedAt = time.Now()
+
+	var data []byte
+	var err error
+
+	if i.JWKSFile != "" {
+		data, err = ioutil.ReadFile(i.JWKSFile)
+	} else {
+		data, err = fetchJWKS(i.JWKSURL)
+	}
+	if err != nil {
+		return err
+	}
+
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return err
+	}
+
+	i.keys = keys
+	return nil
+}
+
+var jwksClient = &http.Client{Timeout: 10 * time.Second}
+
+func fetchJWKS(url string) ([]byte, error) {
+	resp, err := jwksClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+func claimsMatch(patterns map[string]string, claims map[string]interface{}) bool {
+	for name, pattern := range patterns {
+		if !claimMatches(claims[name], pattern) {
+			return false
+		}
+	}
+	return true
+}
+
+// claimMatches matches a claim against a pattern. Array claims match when
+// any of their elements does.
+func claimMatches(claim interface{}, pattern string) bool {
+	switch v := claim.(type) {
+	case nil:
+		return false
+	case []interface{}:
+		for _, e := range v {
+			if claimMatches(e, pattern) {
+				return true
+			}
+		}
+		return false
+	default:
+		ok, _ := path.Match(pattern, fmt.Sprint(v))
+		return ok
+	}
+}
+
+func claimContains(claim interface{}, value string) bool {
+	switch v := claim.(type) {
+	case string:
+		return v == value
+	case []interface{}:
+		for _, e := range v {
+			if e == value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func numericClaim(claims map[string]interface{}, name string) (int64, bool) {
+	n, ok := claims[name].(json.Number)
+	if !ok {
+		return 0, false
+	}
+	if i, err := n.Int64(); err == nil {
+		return i, true
+	}
+	f, err := n.Float64()
+	return int64(f), err == nil
+}
+
+// expandClaims replaces claim references in a namespace pattern. Claims that
+// are missing or would change the meaning of the pattern make it unusable.
+func expandClaims(namespace string, claims map[string]interface{}) (string, bool) {
+	ok := true
+	expanded := claimReference.ReplaceAllStringFunc(namespace, func(ref string) string {
+		value, isString := claims[ref[1:len(ref)-1]].(string)
+		if !isString || value == "" || strings.ContainsAny(value, `/*?[]\`) {
+			ok = false
+		}
+		return value
+	})
+	return expanded, ok
+}
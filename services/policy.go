@@ -0,0 +1,138 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/erikvanbrakel/anthology/models"
+	"os"
+	"path"
+)
+
+// Roles that can be granted on namespaces. Every role includes the
+// permissions of the roles before it.
+const (
+	RoleReader    = "reader"
+	RolePublisher = "publisher"
+	RoleAdmin     = "admin"
+)
+
+var roleLevels = map[string]int{
+	RoleReader:    1,
+	RolePublisher: 2,
+	RoleAdmin:     3,
+}
+
+// Subjects that do not name a specific principal.
+const (
+	SubjectEveryone      = "*"
+	SubjectAuthenticated = "authenticated"
+)
+
+// Policy grants roles on namespaces to principals. Namespaces without any
+// grant are not accessible at all. Subjects are written as <type>:<name>,
+// e.g. user:alice, token:ci or group:team-a, or are one of "*" (everyone,
+// including anonymous callers) and "authenticated".
+type Policy struct {
+	// Groups adds principals to groups, on top of the groups a principal
+	// already has, e.g. from its token.
+	Groups map[string][]string `json:"groups"`
+	Grants []Grant             `json:"grants"`
+}
+
+// Grant gives a role on all namespaces matching one of the patterns, which
+// use the syntax of path.Match.
+type Grant struct {
+	Subjects   []string `json:"subjects"`
+	Namespaces []string `json:"namespaces"`
+	Role       string   `json:"role"`
+}
+
+func LoadPolicy(filename string) (*Policy, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	p := &Policy{}
+	if err := json.NewDecoder(f).Decode(p); err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+
+	return p, p.Validate()
+}
+
+func (p *Policy) Validate() error {
+	for i, g := range p.Grants {
+		if _, ok := roleLevels[g.Role]; !ok {
+			return fmt.Errorf("grant %d: unknown role %q", i, g.Role)
+		}
+		for _, pattern := range g.Namespaces {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("grant %d: invalid namespace pattern %q", i, pattern)
+			}
+		}
+	}
+	return nil
+}
+
+// Allows reports whether a principal, nil for anonymous callers, has at least
+// the given role on a namespace.
+func (p *Policy) Allows(principal *models.Principal, namespace, role string) bool {
+	if principal != nil {
+		for _, r := range principal.Roles {
+			if roleLevels[r.Role] >= roleLevels[role] && matchesAny([]string{r.Namespace}, namespace) {
+				return true
+			}
+		}
+	}
+
+	subjects := p.subjects(principal)
+
+	for _, g := range p.Grants {
+		if roleLevels[g.Role] < roleLevels[role] || !matchesAny(g.Namespaces, namespace) {
+			continue
+		}
+		for _, s := range g.Subjects {
+			if subjects[s] {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// subjects returns every subject that applies to a principal.
+func (p *Policy) subjects(principal *models.Principal) map[string]bool {
+	subjects := map[string]bool{SubjectEveryone: true}
+	if principal == nil {
+		return subjects
+	}
+
+	self := principal.Type + ":" + principal.Name
+	subjects[SubjectAuthenticated] = true
+	subjects[self] = true
+
+	for _, g := range principal.Groups {
+		subjects["group:"+g] = true
+	}
+	for group, members := range p.Groups {
+		for _, m := range members {
+			if m == self {
+				subjects["group:"+group] = true
+			}
+		}
+	}
+
+	return subjects
+}
+
+func matchesAny(patterns []string, namespace string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, namespace); ok {
+			return true
+		}
+	}
+	return false
+}
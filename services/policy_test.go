@@ -0,0 +1,76 @@
+package services
+
+import (
+	"github.com/erikvanbrakel/anthology/models"
+	"testing"
+)
+
+func TestPolicyAllows(t *testing.T) {
+	policy := &Policy{
+		Groups: map[string][]string{
+			"team-a": {"token:alice"},
+		},
+		Grants: []Grant{
+			{Subjects: []string{SubjectEveryone}, Namespaces: []string{"public"}, Role: RoleReader},
+			{Subjects: []string{SubjectAuthenticated}, Namespaces: []string{"internal"}, Role: RoleReader},
+			{Subjects: []string{"group:team-a"}, Namespaces: []string{"team-a", "team-a-*"}, Role: RolePublisher},
+			{Subjects: []string{"token:admin"}, Namespaces: []string{"*"}, Role: RoleAdmin},
+		},
+	}
+
+	ci := &models.Principal{Type: models.PrincipalToken, Name: "ci", Groups: []string{"team-a"}}
+	alice := &models.Principal{Type: models.PrincipalToken, Name: "alice"}
+	bob := &models.Principal{Type: models.PrincipalToken, Name: "bob"}
+	deployer := &models.Principal{Type: models.PrincipalToken, Name: "deployer", Roles: []models.NamespaceRole{
+		{Namespace: "team-b-*", Role: RolePublisher},
+	}}
+
+	tests := []struct {
+		principal *models.Principal
+		namespace string
+		role      string
+		allowed   bool
+	}{
+		{nil, "public", RoleReader, true},
+		{nil, "public", RolePublisher, false},
+		{nil, "internal", RoleReader, false},
+		{bob, "internal", RoleReader, true},
+		{bob, "team-a", RoleReader, false},
+
+		// groups come from the principal or from the policy
+		{ci, "team-a", RoleReader, true},
+		{ci, "team-a", RolePublisher, true},
+		{ci, "team-a", RoleAdmin, false},
+		{alice, "team-a", RolePublisher, true},
+
+		// patterns match whole namespaces
+		{alice, "team-a-infra", RolePublisher, true},
+		{alice, "team-ab", RoleReader, false},
+		{alice, "team-b", RoleReader, false},
+
+		{deployer, "team-b-infra", RolePublisher, true},
+		{deployer, "team-b-infra", RoleAdmin, false},
+		{deployer, "team-b", RoleReader, false},
+
+		{&models.Principal{Type: models.PrincipalToken, Name: "admin"}, "team-b", RoleAdmin, true},
+		{&models.Principal{Type: models.PrincipalUser, Name: "admin"}, "team-b", RoleReader, false},
+	}
+
+	for _, test := range tests {
+		if allowed := policy.Allows(test.principal, test.namespace, test.role); allowed != test.allowed {
+			t.Errorf("%+v as %s on %s: expected %v, got %v", test.principal, test.role, test.namespace, test.allowed, allowed)
+		}
+	}
+}
+
+func TestPolicyValidate(t *testing.T) {
+	if err := (&Policy{Grants: []Grant{{Namespaces: []string{"team-*"}, Role: RoleReader}}}).Validate(); err != nil {
+		t.Errorf("expected a valid policy, got %v", err)
+	}
+	if err := (&Policy{Grants: []Grant{{Namespaces: []string{"*"}, Role: "owner"}}}).Validate(); err == nil {
+		t.Error("expected an unknown role to be rejected")
+	}
+	if err := (&Policy{Grants: []Grant{{Namespaces: []string{"team-["}, Role: RoleReader}}}).Validate(); err == nil {
+		t.Error("expected an invalid pattern to be rejected")
+	}
+}
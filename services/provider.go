@@ -0,0 +1,417 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/blang/semver"
+	"github.com/erikvanbrakel/anthology/app"
+	"github.com/erikvanbrakel/anthology/models"
+	"github.com/erikvanbrakel/anthology/registry"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+)
+
+// ProviderService serves Terraform providers stored in a registry backend.
+// Releases use the same layout as the official release tooling:
+//
+//	providers/<namespace>/<type>/<version>/terraform-provider-<type>_<version>_<os>_<arch>.zip
+//	providers/<namespace>/<type>/<version>/terraform-provider-<type>_<version>_SHA256SUMS
+//	providers/<namespace>/<type>/<version>/terraform-provider-<type>_<version>_SHA256SUMS.sig
+//	providers/<namespace>/<type>/<version>/terraform-provider-<type>_<version>_manifest.json
+//
+// Public keys used to sign the checksums are stored per namespace as
+// signing-keys/<namespace>/<key id>.asc.
+type ProviderService struct {
+	Storage registry.Storage
+
+	// Policy restricts access to namespaces, when set.
+	Policy *Policy
+
+	// Audit records publishes and signing key changes, when set.
+	Audit *AuditLog
+
+	// Webhooks are notified of publishes, when set.
+	Webhooks *WebhookService
+}
+
+// defaultProtocols is assumed for releases without a manifest.
+var defaultProtocols = []string{"5.0"}
+
+func NewProviderService(s registry.Storage) *ProviderService {
+	return &ProviderService{
+		Storage: s,
+	}
+}
+
+// Authorize checks that the caller has at least the given role on a
+// namespace.
+func (s *ProviderService) Authorize(rs app.RequestScope, namespace, role string) error {
+	if s.Policy == nil || s.Policy.Allows(rs.Principal(), namespace, role) {
+		return nil
+	}
+	return ErrForbidden
+}
+
+// QueryVersions lists all releases of a provider, oldest first.
+func (s *ProviderService) QueryVersions(rs app.RequestScope, namespace, providerType string) ([]models.ProviderVersion, error) {
+	if s.Authorize(rs, namespace, RoleReader) != nil {
+		return []models.ProviderVersion{}, nil
+	}
+
+	keys, err := s.Storage.ListObjects(providerPrefix(namespace, providerType))
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[string]*models.ProviderVersion{}
+	for _, key := range keys {
+		version, filename := path.Split(strings.TrimPrefix(key, providerPrefix(namespace, providerType)))
+		version = strings.TrimSuffix(version, "/")
+
+		goos, arch, ok := parsePackageFilename(providerType, version, filename)
+		if !ok {
+			continue
+		}
+
+		v, exists := byVersion[version]
+		if !exists {
+			v = &models.ProviderVersion{Version: version, Platforms: []models.ProviderPlatform{}}
+			byVersion[version] = v
+		}
+		v.Platforms = append(v.Platforms, models.ProviderPlatform{OS: goos, Arch: arch})
+	}
+
+	versions := make([]models.ProviderVersion, 0, len(byVersion))
+	for _, v := range byVersion {
+		if v.Protocols, err = s.protocols(namespace, providerType, v.Version); err != nil {
+			return nil, err
+		}
+		versions = append(versions, *v)
+	}
+
+	sort.Slice(versions, func(i, j int) bool {
+		vi, _ := semver.Make(versions[i].Version)
+		vj, _ := semver.Make(versions[j].Version)
+		return vi.LT(vj)
+	})
+
+	return versions, nil
+}
+
+// GetPackage describes the package of a release for one platform. The URLs in
+// the result are left empty, they depend on how the files are served.
+func (s *ProviderService) GetPackage(rs app.RequestScope, namespace, providerType, version, goos, arch string) (*models.ProviderPackage, error) {
+	if s.Authorize(rs, namespace, RoleReader) != nil {
+		return nil, ErrNotFound
+	}
+
+	filename := packageFilename(providerType, version, goos, arch)
+
+	sums, err := s.shasums(namespace, providerType, version)
+	if err != nil {
+		return nil, err
+	}
+
+	shasum, ok := sums[filename]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	protocols, err := s.protocols(namespace, providerType, version)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := s.SigningKeys(rs, namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.ProviderPackage{
+		Protocols:   protocols,
+		OS:          goos,
+		Arch:        arch,
+		Filename:    filename,
+		SHASum:      shasum,
+		SigningKeys: models.SigningKeys{GPGPublicKeys: keys},
+	}, nil
+}
+
+// GetFile opens one of the files of a release.
+func (s *ProviderService) GetFile(rs app.RequestScope, namespace, providerType, version, filename string) (io.ReadCloser, error) {
+	if s.Authorize(rs, namespace, RoleReader) != nil || !strings.HasPrefix(filename, releasePrefix(providerType, version)) {
+		return nil, ErrNotFound
+	}
+
+	r, err := s.Storage.GetObject(providerPrefix(namespace, providerType) + version + "/" + filename)
+	if err == registry.ErrNotFound {
+		return nil, ErrNotFound
+	}
+	return r, err
+}
+
+// Publish stores a provider release. The files are the platform packages, the
+// SHA256SUMS file, its detached signature and optionally a manifest, all named
+// like the official release tooling names them. The signature has to be made
+// by one of the keys registered for the namespace and the checksums have to
+// match the packages.
+func (s *ProviderService) Publish(rs app.RequestScope, namespace, providerType, version string, files map[string]io.ReadSeeker) (err error) {
+	entry := models.AuditEntry{Operation: AuditProviderPublish, Namespace: namespace, Name: providerType, Version: version}
+	defer func() { s.Audit.Record(rs, entry, err) }()
+
+	if err := s.Authorize(rs, namespace, RolePublisher); err != nil {
+		return err
+	}
+
+	if _, err := semver.Make(version); err != nil {
+		return &ValidationError{[]string{"version is not a valid semantic version: " + version}}
+	}
+
+	existing, err := s.Storage.ListObjects(providerPrefix(namespace, providerType) + version + "/")
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		return ErrConflict
+	}
+
+	sumsFile, sigFile := s.SHASumsFilename(providerType, version), s.SHASumsSignatureFilename(providerType, version)
+
+	var errors []string
+	if files[sumsFile] == nil {
+		errors = append(errors, "missing "+sumsFile)
+	}
+	if files[sigFile] == nil {
+		errors = append(errors, "missing "+sigFile)
+	}
+	if len(errors) > 0 {
+		return &ValidationError{errors}
+	}
+
+	signed, err := ioutil.ReadAll(files[sumsFile])
+	if err != nil {
+		return err
+	}
+	signature, err := ioutil.ReadAll(files[sigFile])
+	if err != nil {
+		return err
+	}
+
+	keyID, err := s.verifySignature(rs, namespace, signed, signature)
+	if err != nil {
+		return err
+	}
+
+	sums, err := parseSHASums(bytes.NewReader(signed))
+	if err != nil {
+		return err
+	}
+	entry.Checksum = fmt.Sprintf("sha256:%x", sha256.Sum256(signed))
+
+	packages := 0
+	for filename, data := range files {
+		switch {
+		case filename == sumsFile, filename == sigFile, filename == releasePrefix(providerType, version)+"manifest.json":
+			continue
+		}
+
+		if _, _, ok := parsePackageFilename(providerType, version, filename); !ok {
+			errors = append(errors, "unexpected file "+filename)
+			continue
+		}
+		packages++
+
+		expected, ok := sums[filename]
+		if !ok {
+			errors = append(errors, filename+" is not listed in "+sumsFile)
+			continue
+		}
+
+		h := sha256.New()
+		if _, err := io.Copy(h, data); err != nil {
+			return err
+		}
+		if actual := hex.EncodeToString(h.Sum(nil)); actual != strings.ToLower(expected) {
+			errors = append(errors, fmt.Sprintf("checksum mismatch for %s: expected %s, got %s", filename, expected, actual))
+		}
+	}
+
+	if packages == 0 {
+		errors = append(errors, "a release needs at least one platform package")
+	}
+	if len(errors) > 0 {
+		sort.Strings(errors)
+		return &ValidationError{errors}
+	}
+
+	// the checksum file goes last, a release is only served once it exists
+	names := make([]string, 0, len(files))
+	for filename := range files {
+		if filename != sumsFile {
+			names = append(names, filename)
+		}
+	}
+	sort.Strings(names)
+	names = append(names, sumsFile)
+
+	for _, filename := range names {
+		data := files[filename]
+		if _, err := data.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if err := s.Storage.PutObject(providerPrefix(namespace, providerType)+version+"/"+filename, data); err != nil {
+			return err
+		}
+	}
+
+	rs.Infof("published provider %s/%s %s with %d packages, signed by %s", namespace, providerType, version, packages, keyID)
+
+	s.Webhooks.Notify(rs, models.Event{Type: EventProviderPublished, Namespace: namespace, Name: providerType, Version: version})
+
+	return nil
+}
+
+// SigningKeys returns the public keys registered for a namespace.
+func (s *ProviderService) SigningKeys(rs app.RequestScope, namespace string) ([]models.GPGPublicKey, error) {
+	if s.Authorize(rs, namespace, RoleReader) != nil {
+		return []models.GPGPublicKey{}, nil
+	}
+
+	keys, err := s.Storage.ListObjects(signingKeyPrefix(namespace))
+	if err != nil {
+		return nil, err
+	}
+
+	result := []models.GPGPublicKey{}
+	for _, key := range keys {
+		if !strings.HasSuffix(key, ".asc") {
+			continue
+		}
+
+		armor, err := s.readObject(key)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, models.GPGPublicKey{
+			KeyID:      strings.TrimSuffix(strings.TrimPrefix(key, signingKeyPrefix(namespace)), ".asc"),
+			ASCIIArmor: string(armor),
+		})
+	}
+
+	return result, nil
+}
+
+// SHASumsFilename returns the name of the checksum file of a release.
+func (s *ProviderService) SHASumsFilename(providerType, version string) string {
+	return releasePrefix(providerType, version) + "SHA256SUMS"
+}
+
+// SHASumsSignatureFilename returns the name of the detached signature of the
+// checksum file of a release.
+func (s *ProviderService) SHASumsSignatureFilename(providerType, version string) string {
+	return s.SHASumsFilename(providerType, version) + ".sig"
+}
+
+func (s *ProviderService) protocols(namespace, providerType, version string) ([]string, error) {
+	data, err := s.readObject(providerPrefix(namespace, providerType) + version + "/" + releasePrefix(providerType, version) + "manifest.json")
+	if err == registry.ErrNotFound {
+		return defaultProtocols, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest struct {
+		Metadata struct {
+			ProtocolVersions []string `json:"protocol_versions"`
+		} `json:"metadata"`
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest for %s/%s %s: %s", namespace, providerType, version, err)
+	}
+
+	if len(manifest.Metadata.ProtocolVersions) == 0 {
+		return defaultProtocols, nil
+	}
+	return manifest.Metadata.ProtocolVersions, nil
+}
+
+// shasums parses the checksum file of a release into a map of file name to
+// hex encoded SHA256 checksum.
+func (s *ProviderService) shasums(namespace, providerType, version string) (map[string]string, error) {
+	r, err := s.Storage.GetObject(providerPrefix(namespace, providerType) + version + "/" + s.SHASumsFilename(providerType, version))
+	if err == registry.ErrNotFound {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return parseSHASums(r)
+}
+
+func (s *ProviderService) readObject(key string) ([]byte, error) {
+	r, err := s.Storage.GetObject(key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+}
+
+func parseSHASums(r io.Reader) (map[string]string, error) {
+	sums := map[string]string{}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		sums[strings.TrimPrefix(fields[1], "*")] = fields[0]
+	}
+
+	return sums, scanner.Err()
+}
+
+// parsePackageFilename extracts the platform from the name of a provider
+// package, e.g. terraform-provider-aws_1.0.0_linux_amd64.zip.
+func parsePackageFilename(providerType, version, filename string) (goos, arch string, ok bool) {
+	prefix := releasePrefix(providerType, version)
+	if !strings.HasPrefix(filename, prefix) || !strings.HasSuffix(filename, ".zip") {
+		return "", "", false
+	}
+
+	platform := strings.Split(strings.TrimSuffix(strings.TrimPrefix(filename, prefix), ".zip"), "_")
+	if len(platform) != 2 {
+		return "", "", false
+	}
+
+	return platform[0], platform[1], true
+}
+
+func packageFilename(providerType, version, goos, arch string) string {
+	return fmt.Sprintf("%s%s_%s.zip", releasePrefix(providerType, version), goos, arch)
+}
+
+func releasePrefix(providerType, version string) string {
+	return fmt.Sprintf("terraform-provider-%s_%s_", providerType, version)
+}
+
+func providerPrefix(namespace, providerType string) string {
+	return "providers/" + namespace + "/" + providerType + "/"
+}
+
+func signingKeyPrefix(namespace string) string {
+	return "signing-keys/" + namespace + "/"
+}
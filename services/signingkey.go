@@ -0,0 +1,109 @@
+package services
+
+import (
+	"bytes"
+	"github.com/erikvanbrakel/anthology/app"
+	"github.com/erikvanbrakel/anthology/models"
+	"github.com/erikvanbrakel/anthology/registry"
+	"golang.org/x/crypto/openpgp"
+	"strings"
+)
+
+// AddSigningKey registers an ASCII-armored public key for a namespace. The
+// key ID is taken from the primary key.
+func (s *ProviderService) AddSigningKey(rs app.RequestScope, namespace, armor string) (key *models.GPGPublicKey, err error) {
+	entry := models.AuditEntry{Operation: AuditSigningKeyAdd, Namespace: namespace}
+	defer func() { s.Audit.Record(rs, entry, err) }()
+
+	if err := s.Authorize(rs, namespace, RoleAdmin); err != nil {
+		return nil, err
+	}
+
+	entities, err := openpgp.ReadArmoredKeyRing(strings.NewReader(armor))
+	if err != nil {
+		return nil, &ValidationError{[]string{"invalid ASCII-armored public key: " + err.Error()}}
+	}
+	if len(entities) != 1 {
+		return nil, &ValidationError{[]string{"exactly one public key must be provided"}}
+	}
+	if entities[0].PrivateKey != nil {
+		return nil, &ValidationError{[]string{"refusing to store a private key"}}
+	}
+
+	key = &models.GPGPublicKey{
+		KeyID:      entities[0].PrimaryKey.KeyIdString(),
+		ASCIIArmor: armor,
+	}
+	entry.Name = key.KeyID
+
+	if err := s.Storage.PutObject(signingKeyPrefix(namespace)+key.KeyID+".asc", strings.NewReader(armor)); err != nil {
+		return nil, err
+	}
+
+	rs.Infof("registered signing key %s for namespace %s", key.KeyID, namespace)
+
+	return key, nil
+}
+
+// DeleteSigningKey removes a public key from a namespace. Releases signed with
+// it can no longer be verified by Terraform.
+func (s *ProviderService) DeleteSigningKey(rs app.RequestScope, namespace, keyID string) (err error) {
+	entry := models.AuditEntry{Operation: AuditSigningKeyDelete, Namespace: namespace, Name: strings.ToUpper(keyID)}
+	defer func() { s.Audit.Record(rs, entry, err) }()
+
+	if err := s.Authorize(rs, namespace, RoleAdmin); err != nil {
+		return err
+	}
+
+	key := signingKeyPrefix(namespace) + strings.ToUpper(keyID) + ".asc"
+
+	if _, err := s.readObject(key); err == registry.ErrNotFound {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+
+	return s.Storage.DeleteObject(key)
+}
+
+// keyRing builds a key ring from all keys registered for a namespace.
+func (s *ProviderService) keyRing(rs app.RequestScope, namespace string) (openpgp.EntityList, error) {
+	keys, err := s.SigningKeys(rs, namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	var ring openpgp.EntityList
+	for _, key := range keys {
+		entities, err := openpgp.ReadArmoredKeyRing(strings.NewReader(key.ASCIIArmor))
+		if err != nil {
+			rs.Warnf("ignoring unreadable signing key %s in namespace %s: %s", key.KeyID, namespace, err)
+			continue
+		}
+		ring = append(ring, entities...)
+	}
+
+	return ring, nil
+}
+
+// verifySignature checks a detached signature, either binary or armored,
+// against the keys of a namespace and returns the ID of the signing key.
+func (s *ProviderService) verifySignature(rs app.RequestScope, namespace string, signed, signature []byte) (string, error) {
+	ring, err := s.keyRing(rs, namespace)
+	if err != nil {
+		return "", err
+	}
+	if len(ring) == 0 {
+		return "", &ValidationError{[]string{"no signing keys are registered for namespace " + namespace}}
+	}
+
+	signer, err := openpgp.CheckDetachedSignature(ring, bytes.NewReader(signed), bytes.NewReader(signature))
+	if err != nil {
+		signer, err = openpgp.CheckArmoredDetachedSignature(ring, bytes.NewReader(signed), bytes.NewReader(signature))
+	}
+	if err != nil {
+		return "", &ValidationError{[]string{"SHA256SUMS signature does not match a registered signing key: " + err.Error()}}
+	}
+
+	return signer.PrimaryKey.KeyIdString(), nil
+}
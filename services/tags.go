@@ -0,0 +1,195 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/blang/semver"
+	"github.com/erikvanbrakel/anthology/app"
+	"github.com/erikvanbrakel/anthology/models"
+	"github.com/erikvanbrakel/anthology/registry"
+	"regexp"
+	"sort"
+)
+
+// maxTagHistory is the number of tag changes kept per module.
+const maxTagHistory = 100
+
+var tagPattern = regexp.MustCompile(`^[a-z][a-z0-9._-]{0,31}$`)
+
+// Tags returns the tags of a module, stored as
+// tags/<namespace>/<name>/<provider>.json.
+func (s *ModuleService) Tags(rs app.RequestScope, namespace, name, provider string) (*models.ModuleTags, error) {
+	if s.Authorize(rs, namespace, RoleReader) != nil {
+		return nil, ErrNotFound
+	}
+	return s.loadTags(namespace, name, provider)
+}
+
+// ResolveTag returns the version a tag points to.
+func (s *ModuleService) ResolveTag(rs app.RequestScope, namespace, name, provider, tag string) (string, error) {
+	tags, err := s.Tags(rs, namespace, name, provider)
+	if err != nil {
+		return "", err
+	}
+
+	version, ok := tags.Tags[tag]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return version, nil
+}
+
+// SetTag points a tag to a published version, creating the tag when needed.
+func (s *ModuleService) SetTag(rs app.RequestScope, namespace, name, provider, tag, version string) (tags *models.ModuleTags, err error) {
+	entry := models.AuditEntry{Operation: AuditModuleTag, Namespace: namespace, Name: name, Provider: provider, Version: version, Tag: tag}
+	defer func() { s.Audit.Record(rs, entry, err) }()
+
+	if err := s.Authorize(rs, namespace, RolePublisher); err != nil {
+		return nil, err
+	}
+
+	if _, err := semver.Parse(tag); err == nil || !tagPattern.MatchString(tag) {
+		return nil, &ValidationError{[]string{"a tag must be lower case, start with a letter and not look like a version: " + tag}}
+	}
+
+	exists, err := s.Exists(rs, namespace, name, provider, version)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, &ValidationError{[]string{fmt.Sprintf("version %s of %s/%s/%s does not exist", version, namespace, name, provider)}}
+	}
+
+	tags, _, err = s.updateTags(rs, namespace, name, provider, tag, version)
+	if err != nil {
+		return nil, err
+	}
+
+	s.Webhooks.Notify(rs, models.Event{Type: EventModuleTagged, Namespace: namespace, Name: name, Provider: provider, Version: version, Tag: tag})
+	return tags, nil
+}
+
+// DeleteTag removes a tag from a module.
+func (s *ModuleService) DeleteTag(rs app.RequestScope, namespace, name, provider, tag string) (err error) {
+	entry := models.AuditEntry{Operation: AuditModuleUntag, Namespace: namespace, Name: name, Provider: provider, Tag: tag}
+	defer func() { s.Audit.Record(rs, entry, err) }()
+
+	if err := s.Authorize(rs, namespace, RolePublisher); err != nil {
+		return err
+	}
+
+	_, previous, err := s.updateTags(rs, namespace, name, provider, tag, "")
+	if err != nil {
+		return err
+	}
+	entry.Version = previous
+
+	s.Webhooks.Notify(rs, models.Event{Type: EventModuleUntagged, Namespace: namespace, Name: name, Provider: provider, Version: previous, Tag: tag})
+	return nil
+}
+
+// updateTags moves a tag, or removes it when version is empty, and records
+// the change in the history. It returns the version the tag pointed to
+// before.
+func (s *ModuleService) updateTags(rs app.RequestScope, namespace, name, provider, tag, version string) (*models.ModuleTags, string, error) {
+	s.tagsMu.Lock()
+	defer s.tagsMu.Unlock()
+
+	tags, err := s.loadTags(namespace, name, provider)
+	if err != nil {
+		return nil, "", err
+	}
+
+	previous, ok := tags.Tags[tag]
+	if version == "" && !ok {
+		return nil, "", ErrNotFound
+	}
+	if version == previous {
+		return tags, previous, nil
+	}
+
+	if version == "" {
+		delete(tags.Tags, tag)
+	} else {
+		tags.Tags[tag] = version
+	}
+	addTagChange(rs, tags, tag, version, previous)
+
+	if err := s.saveTags(namespace, name, provider, tags); err != nil {
+		return nil, "", err
+	}
+
+	rs.Infof("tagged %s/%s/%s %s as %s", namespace, name, provider, version, tag)
+	return tags, previous, nil
+}
+
+// untagVersion removes the tags that point to a deleted version and returns
+// their names.
+func (s *ModuleService) untagVersion(rs app.RequestScope, namespace, name, provider, version string) ([]string, error) {
+	s.tagsMu.Lock()
+	defer s.tagsMu.Unlock()
+
+	tags, err := s.loadTags(namespace, name, provider)
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []string
+	for tag, v := range tags.Tags {
+		if v == version {
+			removed = append(removed, tag)
+		}
+	}
+	if len(removed) == 0 {
+		return nil, nil
+	}
+	sort.Strings(removed)
+
+	for _, tag := range removed {
+		delete(tags.Tags, tag)
+		addTagChange(rs, tags, tag, "", version)
+	}
+
+	return removed, s.saveTags(namespace, name, provider, tags)
+}
+
+func addTagChange(rs app.RequestScope, tags *models.ModuleTags, tag, version, previous string) {
+	tags.History = append(tags.History, models.TagChange{
+		Tag:       tag,
+		Version:   version,
+		Previous:  previous,
+		Principal: principalName(rs),
+		Time:      rs.Now().UTC(),
+	})
+	if len(tags.History) > maxTagHistory {
+		tags.History = tags.History[len(tags.History)-maxTagHistory:]
+	}
+}
+
+func (s *ModuleService) saveTags(namespace, name, provider string, tags *models.ModuleTags) error {
+	data, _ := json.Marshal(tags)
+	return s.Registry.PutObject(tagsKey(namespace, name, provider), bytes.NewReader(data))
+}
+
+func (s *ModuleService) loadTags(namespace, name, provider string) (*models.ModuleTags, error) {
+	tags := &models.ModuleTags{Tags: map[string]string{}, History: []models.TagChange{}}
+
+	r, err := s.Registry.GetObject(tagsKey(namespace, name, provider))
+	if err == registry.ErrNotFound {
+		return tags, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	if err := json.NewDecoder(r).Decode(tags); err != nil {
+		return nil, fmt.Errorf("invalid tags for %s/%s/%s: %s", namespace, name, provider, err)
+	}
+	return tags, nil
+}
+
+func tagsKey(namespace, name, provider string) string {
+	return "tags/" + namespace + "/" + name + "/" + provider + ".json"
+}
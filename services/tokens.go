@@ -0,0 +1,153 @@
+package services
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"github.com/erikvanbrakel/anthology/app"
+	"github.com/erikvanbrakel/anthology/models"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TokenStore looks up the principal a bearer token was issued to. Unknown
+// tokens yield nil without an error.
+type TokenStore interface {
+	Lookup(token string) (*models.Principal, error)
+}
+
+// TokenAuthenticator implements app.Authenticator for bearer tokens kept in a
+// TokenStore.
+type TokenAuthenticator struct {
+	Store TokenStore
+}
+
+func NewTokenAuthenticator(store TokenStore) *TokenAuthenticator {
+	return &TokenAuthenticator{
+		store,
+	}
+}
+
+func (a *TokenAuthenticator) Authenticate(r *http.Request) (*models.Principal, error) {
+	token := app.BearerToken(r)
+	if token == "" {
+		return nil, nil
+	}
+
+	return a.Store.Lookup(token)
+}
+
+// FileTokenStore reads tokens from a file with one token per line:
+//
+//	<name>:<hex encoded sha256 of the token>[:<group>,<group>...]
+//
+// Only hashes are stored, so the file does not need to be kept secret. It is
+// read again when it changes.
+type FileTokenStore struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	tokens  []storedToken
+}
+
+type storedToken struct {
+	hash      []byte
+	principal *models.Principal
+}
+
+func NewFileTokenStore(path string) (*FileTokenStore, error) {
+	s := &FileTokenStore{path: path}
+
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *FileTokenStore) Lookup(token string) (*models.Principal, error) {
+	if err := s.reload(); err != nil {
+		logrus.Warnf("unable to reload tokens from %s, using the tokens read before: %s", s.path, err)
+	}
+
+	sum := sha256.Sum256([]byte(token))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, t := range s.tokens {
+		if subtle.ConstantTimeCompare(t.hash, sum[:]) == 1 {
+			return t.principal, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// reload reads the file when it was modified since it was last read. On
+// errors the tokens read before are kept.
+func (s *FileTokenStore) reload() error {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if info.ModTime().Equal(s.modTime) && s.tokens != nil {
+		return nil
+	}
+
+	tokens, err := readTokenFile(s.path)
+	if err != nil {
+		return err
+	}
+
+	s.tokens, s.modTime = tokens, info.ModTime()
+	return nil
+}
+
+func readTokenFile(path string) ([]storedToken, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tokens := []storedToken{}
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		parts := strings.Split(text, ":")
+		if len(parts) < 2 || len(parts) > 3 || parts[0] == "" {
+			return nil, fmt.Errorf("%s:%d: expected <name>:<sha256>[:<groups>]", path, line)
+		}
+
+		hash, err := hex.DecodeString(parts[1])
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("%s:%d: token of %s is not a hex encoded sha256 hash", path, line, parts[0])
+		}
+
+		principal := &models.Principal{Type: models.PrincipalToken, Name: parts[0]}
+		if len(parts) == 3 && parts[2] != "" {
+			principal.Groups = strings.Split(parts[2], ",")
+		}
+
+		tokens = append(tokens, storedToken{hash, principal})
+	}
+
+	return tokens, scanner.Err()
+}
@@ -0,0 +1,371 @@
+package services
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/erikvanbrakel/anthology/app"
+	"github.com/erikvanbrakel/anthology/models"
+	"github.com/erikvanbrakel/anthology/registry"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UploadService manages two-phase uploads: a client first opens a session for
+// a module version, then writes the archive straight to storage and finally
+// asks for the staged archive to be published.
+type UploadService struct {
+	Modules *ModuleService
+	TTL     time.Duration
+
+	// sessionLocks holds a mutex per session, see lockSession.
+	sessionLocks sync.Map
+}
+
+// DirectUpload is a presigned request that writes an archive straight to
+// storage. The client has to send the headers along with the PUT.
+type DirectUpload struct {
+	URL     string
+	Headers http.Header
+}
+
+func NewUploadService(modules *ModuleService, ttl time.Duration) *UploadService {
+	return &UploadService{
+		Modules: modules,
+		TTL:     ttl,
+	}
+}
+
+// Create opens an upload session. The returned direct upload is a presigned
+// request to upload the archive straight to storage when the backend
+// supports it, and nil otherwise.
+func (s *UploadService) Create(rs app.RequestScope, namespace, name, provider, version string) (session *models.UploadSession, direct *DirectUpload, err error) {
+	if err := s.Modules.Authorize(rs, namespace, RolePublisher); err != nil {
+		return nil, nil, err
+	}
+
+	exists, err := s.Modules.Exists(rs, namespace, name, provider, version)
+	if err != nil {
+		return nil, nil, err
+	}
+	if exists {
+		return nil, nil, ErrConflict
+	}
+
+	id, err := newSessionID()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	session = &models.UploadSession{
+		ID:        id,
+		Namespace: namespace,
+		Name:      name,
+		Provider:  provider,
+		Version:   version,
+		ExpiresAt: rs.Now().Add(s.TTL),
+	}
+
+	data, _ := json.Marshal(session)
+	if err := s.storage().PutObject(sessionKey(id), bytes.NewReader(data)); err != nil {
+		return nil, nil, err
+	}
+
+	if p, ok := s.storage().(registry.UploadURLProvider); ok {
+		url, headers, err := p.GetObjectUploadURL(stagedKey(id), s.TTL)
+		if err != nil {
+			return nil, nil, err
+		}
+		if url != "" {
+			direct = &DirectUpload{URL: url, Headers: headers}
+		}
+	}
+
+	rs.Infof("opened upload session %s for %s/%s/%s/%s", id, namespace, name, provider, version)
+
+	return session, direct, nil
+}
+
+// Get returns an upload session that has not expired yet.
+func (s *UploadService) Get(rs app.RequestScope, id string) (*models.UploadSession, error) {
+	session, err := s.load(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if rs.Now().After(session.ExpiresAt) {
+		return nil, ErrNotFound
+	}
+
+	return session, nil
+}
+
+// Receive stores the archive for a session, for backends that cannot accept
+// uploads directly.
+func (s *UploadService) Receive(rs app.RequestScope, id string, data io.Reader) error {
+	if _, err := s.Get(rs, id); err != nil {
+		return err
+	}
+
+	return s.storage().PutObject(stagedKey(id), data)
+}
+
+// Offset returns how many bytes of a resumable upload have been stored.
+func (s *UploadService) Offset(rs app.RequestScope, id string) (int64, error) {
+	if _, err := s.Get(rs, id); err != nil {
+		return 0, err
+	}
+
+	parts, err := s.parts(id)
+	if err != nil {
+		return 0, err
+	}
+
+	var offset int64
+	for _, p := range parts {
+		offset = p.offset + p.length
+	}
+	return offset, nil
+}
+
+// Append stores the next chunk of a resumable upload. The chunk must start
+// exactly where the previously stored data ends; the new offset is returned.
+// Concurrent chunks for the same offset are stored one at a time, so all but
+// the first fail with ErrOffsetMismatch.
+func (s *UploadService) Append(rs app.RequestScope, id string, offset int64, data io.Reader) (int64, error) {
+	defer s.lockSession(id)()
+
+	current, err := s.Offset(rs, id)
+	if err != nil {
+		return 0, err
+	}
+	if offset != current {
+		return current, ErrOffsetMismatch
+	}
+
+	chunk := &bytes.Buffer{}
+	if _, err := chunk.ReadFrom(data); err != nil {
+		return current, err
+	}
+	if chunk.Len() == 0 {
+		return current, nil
+	}
+
+	length := int64(chunk.Len())
+	if err := s.storage().PutObject(partKey(id, offset, length), chunk); err != nil {
+		return current, err
+	}
+
+	return offset + length, nil
+}
+
+// Finalize publishes the staged archive through the regular publish path and
+// removes the session.
+func (s *UploadService) Finalize(rs app.RequestScope, id string) (*models.Module, error) {
+	defer s.lockSession(id)()
+
+	session, err := s.Get(rs, id)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := s.staged(id)
+	if err != nil {
+		return nil, err
+	}
+	defer data.Close()
+
+	// publishing refuses existing versions, also when they were published
+	// after the session was opened
+	if err := s.Modules.Publish(rs, session.Namespace, session.Name, session.Provider, session.Version, data); err != nil {
+		return nil, err
+	}
+
+	s.remove(id)
+
+	return &models.Module{
+		Namespace: session.Namespace,
+		Name:      session.Name,
+		Provider:  session.Provider,
+		Version:   session.Version,
+	}, nil
+}
+
+// Cleanup removes sessions that expired before now, together with any staged
+// data, and returns the number of removed sessions.
+func (s *UploadService) Cleanup(now time.Time) (int, error) {
+	keys, err := s.storage().ListObjects("uploads/")
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, key := range keys {
+		if !strings.HasSuffix(key, ".json") {
+			continue
+		}
+
+		id := strings.TrimSuffix(strings.TrimPrefix(key, "uploads/"), ".json")
+		session, err := s.load(id)
+		if err != nil || now.After(session.ExpiresAt) {
+			s.remove(id)
+			removed++
+		}
+	}
+
+	return removed, nil
+}
+
+func (s *UploadService) storage() registry.Registry {
+	return s.Modules.Registry
+}
+
+func (s *UploadService) load(id string) (*models.UploadSession, error) {
+	if _, err := hex.DecodeString(id); err != nil || len(id) != 32 {
+		return nil, ErrNotFound
+	}
+
+	r, err := s.storage().GetObject(sessionKey(id))
+	if err == registry.ErrNotFound {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var session models.UploadSession
+	if err := json.NewDecoder(r).Decode(&session); err != nil {
+		return nil, err
+	}
+
+	return &session, nil
+}
+
+// staged opens the uploaded archive, either stored in one piece or assembled
+// from the chunks of a resumable upload.
+func (s *UploadService) staged(id string) (io.ReadCloser, error) {
+	data, err := s.storage().GetObject(stagedKey(id))
+	if err != registry.ErrNotFound {
+		return data, err
+	}
+
+	parts, err := s.parts(id)
+	if err != nil {
+		return nil, err
+	}
+	if len(parts) == 0 {
+		return nil, &ValidationError{[]string{"no archive has been uploaded for this session"}}
+	}
+
+	readers := make([]io.Reader, 0, len(parts))
+	closers := make(multiCloser, 0, len(parts))
+	for _, p := range parts {
+		r, err := s.storage().GetObject(p.key)
+		if err != nil {
+			closers.Close()
+			return nil, err
+		}
+		readers = append(readers, r)
+		closers = append(closers, r)
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(readers...), closers}, nil
+}
+
+// parts lists the stored chunks of a resumable upload in order. Chunks are
+// named after their offset and length, so no extra bookkeeping is needed.
+func (s *UploadService) parts(id string) ([]uploadPart, error) {
+	keys, err := s.storage().ListObjects(partsPrefix(id))
+	if err != nil {
+		return nil, err
+	}
+
+	var parts []uploadPart
+	var expected int64
+	for _, key := range keys {
+		var p uploadPart
+		if _, err := fmt.Sscanf(strings.TrimPrefix(key, partsPrefix(id)), "%020d-%d", &p.offset, &p.length); err != nil {
+			continue
+		}
+		if p.offset != expected {
+			return nil, fmt.Errorf("upload %s is missing data at offset %d", id, expected)
+		}
+		p.key = key
+		parts = append(parts, p)
+		expected = p.offset + p.length
+	}
+
+	return parts, nil
+}
+
+// lockSession serializes appending to and finalizing a session, so that no
+// chunk is stored while the staged data is being published. It returns the
+// function that releases the lock.
+func (s *UploadService) lockSession(id string) func() {
+	lock, _ := s.sessionLocks.LoadOrStore(id, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	return lock.(*sync.Mutex).Unlock
+}
+
+func (s *UploadService) remove(id string) {
+	s.sessionLocks.Delete(id)
+
+	if keys, err := s.storage().ListObjects(partsPrefix(id)); err == nil {
+		for _, key := range keys {
+			s.storage().DeleteObject(key)
+		}
+	}
+	s.storage().DeleteObject(stagedKey(id))
+	s.storage().DeleteObject(sessionKey(id))
+}
+
+type uploadPart struct {
+	key    string
+	offset int64
+	length int64
+}
+
+type multiCloser []io.Closer
+
+func (m multiCloser) Close() error {
+	var err error
+	for _, c := range m {
+		if e := c.Close(); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func newSessionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func sessionKey(id string) string {
+	return "uploads/" + id + ".json"
+}
+
+func stagedKey(id string) string {
+	return "uploads/" + id + ".tgz"
+}
+
+func partsPrefix(id string) string {
+	return "uploads/" + id + ".parts/"
+}
+
+func partKey(id string, offset, length int64) string {
+	return fmt.Sprintf("%s%020d-%d", partsPrefix(id), offset, length)
+}
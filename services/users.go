@@ -0,0 +1,65 @@
+package services
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/erikvanbrakel/anthology/app"
+	"github.com/erikvanbrakel/anthology/models"
+	"golang.org/x/crypto/bcrypt"
+	"os"
+	"strings"
+)
+
+// UserStore authenticates users against an htpasswd file with bcrypt hashed
+// passwords, as written by `htpasswd -B`.
+type UserStore struct {
+	users map[string][]byte
+}
+
+// unknownUserHash is compared against for unknown users, so they take as long
+// to reject as a wrong password.
+var unknownUserHash, _ = bcrypt.GenerateFromPassword([]byte("unknown"), bcrypt.DefaultCost)
+
+func LoadUserStore(path string) (*UserStore, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	s := &UserStore{users: map[string][]byte{}}
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(text, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("%s:%d: expected <user>:<bcrypt hash>", path, line)
+		}
+		if _, err := bcrypt.Cost([]byte(parts[1])); err != nil {
+			return nil, fmt.Errorf("%s:%d: password of %s is not a bcrypt hash", path, line, parts[0])
+		}
+
+		s.users[parts[0]] = []byte(parts[1])
+	}
+
+	return s, scanner.Err()
+}
+
+// Authenticate checks the password of a user.
+func (s *UserStore) Authenticate(username, password string) (*models.Principal, error) {
+	hash, ok := s.users[username]
+	if !ok {
+		hash = unknownUserHash
+	}
+
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil || !ok {
+		return nil, app.ErrInvalidCredentials
+	}
+
+	return &models.Principal{Type: models.PrincipalUser, Name: username}, nil
+}
@@ -0,0 +1,181 @@
+package services
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"github.com/blang/semver"
+	"github.com/erikvanbrakel/anthology/app"
+	"github.com/erikvanbrakel/anthology/models"
+	"io"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	variablePattern = regexp.MustCompile(`(?m)^\s*variable\s+"([^"]+)"`)
+	outputPattern   = regexp.MustCompile(`(?m)^\s*output\s+"([^"]+)"`)
+)
+
+// Validate runs every check a publish of the archive would run, without
+// storing anything, and describes what would be published. Besides the
+// errors that would reject the publish, the report warns about things like
+// versions that skip ahead or go back and modules without a README.
+func (s *ModuleService) Validate(rs app.RequestScope, namespace, name, provider, version string, data io.Reader, metadata *models.ModuleMetadata) (*models.ValidationReport, error) {
+	if err := s.Authorize(rs, namespace, RolePublisher); err != nil {
+		return nil, err
+	}
+
+	archive, err := ioutil.ReadAll(data)
+	if err != nil {
+		return nil, err
+	}
+
+	report, err := s.inspect(rs, namespace, name, provider, version, archive, metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	exists, err := s.Exists(rs, namespace, name, provider, version)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		report.Errors = append(report.Errors, ErrConflict.Error())
+	}
+
+	report.Valid = len(report.Errors) == 0
+	return report, nil
+}
+
+// inspect checks a module version the way a publish does, apart from
+// conflicts with existing versions.
+func (s *ModuleService) inspect(rs app.RequestScope, namespace, name, provider, version string, archive []byte, metadata *models.ModuleMetadata) (*models.ValidationReport, error) {
+	report := &models.ValidationReport{
+		Namespace: namespace,
+		Name:      name,
+		Provider:  provider,
+		Version:   version,
+		Errors:    []string{},
+		Warnings:  []string{},
+		Files:     []string{},
+		Variables: []string{},
+		Outputs:   []string{},
+		Metadata:  metadata,
+		Checksum:  fmt.Sprintf("sha256:%x", sha256.Sum256(archive)),
+		Size:      len(archive),
+	}
+
+	report.Errors = append(report.Errors, validateCoordinates(namespace, name, provider, version)...)
+
+	if v, err := semver.Parse(version); err == nil {
+		existing, err := s.QueryVersions(rs, namespace, name, provider)
+		if err != nil {
+			return nil, err
+		}
+		report.Warnings = append(report.Warnings, versionWarnings(v, existing)...)
+	}
+
+	if err := validateArchive(archive); err != nil {
+		report.Errors = append(report.Errors, err.(*ValidationError).Errors...)
+	} else {
+		report.Warnings = append(report.Warnings, describeArchive(archive, report)...)
+	}
+
+	if metadata != nil {
+		if err := validateMetadata(metadata); err != nil {
+			report.Errors = append(report.Errors, err.(*ValidationError).Errors...)
+		}
+	}
+
+	return report, nil
+}
+
+// versionWarnings compares a new version to the published ones: a new
+// version is expected to be the next major, minor or patch release of the
+// latest one.
+func versionWarnings(v semver.Version, existing []models.Module) []string {
+	var latest *semver.Version
+	for _, m := range existing {
+		if e, err := semver.Parse(m.Version); err == nil && (latest == nil || e.GT(*latest)) {
+			latest = &e
+		}
+	}
+
+	var warnings []string
+	if len(v.Pre) > 0 {
+		warnings = append(warnings, fmt.Sprintf("%s is a pre-release", v))
+	}
+
+	switch {
+	case latest == nil:
+	case v.LT(*latest):
+		warnings = append(warnings, fmt.Sprintf("%s is older than the latest version %s", v, latest))
+	case v.Major > latest.Major+1,
+		v.Major == latest.Major && v.Minor > latest.Minor+1,
+		v.Major == latest.Major && v.Minor == latest.Minor && v.Patch > latest.Patch+1,
+		v.Major > latest.Major && (v.Minor != 0 || v.Patch != 0),
+		v.Major == latest.Major && v.Minor > latest.Minor && v.Patch != 0:
+		warnings = append(warnings, fmt.Sprintf("%s skips versions after the latest version %s", v, latest))
+	}
+
+	return warnings
+}
+
+// describeArchive lists the files of a valid archive and the variables and
+// outputs of the root module in the report, and warns about missing
+// documentation and Terraform files.
+func describeArchive(archive []byte, report *models.ValidationReport) []string {
+	gz, _ := gzip.NewReader(bytes.NewReader(archive))
+	defer gz.Close()
+
+	readme, terraform := false, false
+
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			break
+		}
+		if !header.FileInfo().Mode().IsRegular() {
+			continue
+		}
+
+		name := strings.TrimPrefix(path.Clean("/"+header.Name), "/")
+		report.Files = append(report.Files, name)
+
+		if strings.HasPrefix(strings.ToLower(name), "readme") && !strings.Contains(name, "/") {
+			readme = true
+		}
+		if path.Ext(name) != ".tf" || strings.Contains(name, "/") {
+			continue
+		}
+
+		terraform = true
+		content, _ := ioutil.ReadAll(tr)
+		for _, match := range variablePattern.FindAllSubmatch(content, -1) {
+			report.Variables = append(report.Variables, string(match[1]))
+		}
+		for _, match := range outputPattern.FindAllSubmatch(content, -1) {
+			report.Outputs = append(report.Outputs, string(match[1]))
+		}
+	}
+
+	sort.Strings(report.Files)
+	sort.Strings(report.Variables)
+	sort.Strings(report.Outputs)
+
+	var warnings []string
+	if !terraform {
+		warnings = append(warnings, "the archive has no .tf files at its root")
+	}
+	if !readme && (report.Metadata == nil || report.Metadata.Readme == "") {
+		warnings = append(warnings, "the module has no README")
+	}
+	return warnings
+}
@@ -0,0 +1,493 @@
+package services
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/erikvanbrakel/anthology/app"
+	"github.com/erikvanbrakel/anthology/models"
+	"github.com/erikvanbrakel/anthology/registry"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Event types sent to webhooks.
+const (
+	EventModulePublished    = "module.published"
+	EventModuleDeleted      = "module.deleted"
+	EventModuleTagged       = "module.tagged"
+	EventModuleUntagged     = "module.untagged"
+	EventModuleDeprecated   = "module.deprecated"
+	EventModuleUndeprecated = "module.undeprecated"
+	EventProviderPublished  = "provider.published"
+)
+
+// maxRetryDelay caps the exponential backoff between delivery attempts.
+const maxRetryDelay = time.Hour
+
+// WebhookSubscription sends events of the given types in namespaces matching
+// the patterns to a URL. Empty filters match everything.
+type WebhookSubscription struct {
+	ID         string   `json:"id"`
+	URL        string   `json:"url"`
+	Secret     string   `json:"secret"`
+	Events     []string `json:"events"`
+	Namespaces []string `json:"namespaces"`
+}
+
+// WebhookService delivers events to subscribed URLs in the background, with a
+// fixed number of workers. Failed attempts wait in a retry queue until they
+// are due again. Every delivery is kept in storage with its outcome, pending
+// deliveries are resumed after a restart:
+//
+//	webhooks/deliveries/<id>.json
+//
+// Requests are signed with an HMAC-SHA256 of the body, keyed with the secret
+// of the subscription, in the X-Anthology-Signature header.
+type WebhookService struct {
+	Storage       registry.Storage
+	Subscriptions []WebhookSubscription
+	MaxAttempts   int
+	RetryDelay    time.Duration
+
+	// Retention is how long delivered entries are kept in the delivery log,
+	// they are kept forever when zero.
+	Retention time.Duration
+
+	// Policy limits the delivery log to namespaces the caller administers.
+	Policy *Policy
+
+	client *http.Client
+
+	// queue hands deliveries that are due to the workers, retries holds
+	// the ones waiting for their next attempt.
+	queue   chan *models.WebhookDelivery
+	wake    chan struct{}
+	mu      sync.Mutex
+	retries []scheduledDelivery
+
+	done      chan struct{}
+	closeOnce sync.Once
+	workers   sync.WaitGroup
+}
+
+type scheduledDelivery struct {
+	delivery *models.WebhookDelivery
+	at       time.Time
+}
+
+func NewWebhookService(s registry.Storage, subscriptions []WebhookSubscription, maxAttempts int, retryDelay time.Duration, workers int) (*WebhookService, error) {
+	ids := map[string]bool{}
+	for _, sub := range subscriptions {
+		switch {
+		case sub.ID == "" || sub.URL == "":
+			return nil, fmt.Errorf("a webhook subscription needs an id and a url")
+		case sub.Secret == "":
+			return nil, fmt.Errorf("webhook subscription %s needs a secret to sign its requests with", sub.ID)
+		case ids[sub.ID]:
+			return nil, fmt.Errorf("duplicate webhook subscription %s", sub.ID)
+		}
+		ids[sub.ID] = true
+	}
+	if workers < 1 {
+		return nil, fmt.Errorf("webhooks need at least one worker")
+	}
+
+	service := &WebhookService{
+		Storage:       s,
+		Subscriptions: subscriptions,
+		MaxAttempts:   maxAttempts,
+		RetryDelay:    retryDelay,
+		client:        &http.Client{Timeout: 30 * time.Second},
+		queue:         make(chan *models.WebhookDelivery),
+		wake:          make(chan struct{}, 1),
+		done:          make(chan struct{}),
+	}
+
+	service.workers.Add(workers + 1)
+	go service.dispatch()
+	for i := 0; i < workers; i++ {
+		go service.work()
+	}
+
+	return service, nil
+}
+
+func LoadWebhookService(s registry.Storage, filename string, maxAttempts int, retryDelay time.Duration, workers int) (*WebhookService, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var config struct {
+		Subscriptions []WebhookSubscription `json:"subscriptions"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+
+	return NewWebhookService(s, config.Subscriptions, maxAttempts, retryDelay, workers)
+}
+
+// Notify queues an event for every matching subscription. Notifying a nil
+// service does nothing.
+func (s *WebhookService) Notify(rs app.RequestScope, event models.Event) {
+	if s == nil {
+		return
+	}
+
+	event.ID = newOrderedID()
+	event.Time = rs.Now().UTC()
+	event.Principal = principalName(rs)
+
+	for _, sub := range s.Subscriptions {
+		if !sub.matches(event) {
+			continue
+		}
+
+		d := &models.WebhookDelivery{
+			ID:           newOrderedID(),
+			Subscription: sub.ID,
+			Event:        event,
+			Status:       models.DeliveryPending,
+			CreatedAt:    event.Time,
+			UpdatedAt:    event.Time,
+		}
+
+		if err := s.save(d); err != nil {
+			rs.Errorf("unable to queue %s event for webhook %s: %s", event.Type, sub.ID, err)
+			continue
+		}
+
+		s.schedule(d, event.Time)
+	}
+}
+
+// Resume restarts deliveries that were still pending when the server
+// stopped.
+func (s *WebhookService) Resume() error {
+	deliveries, err := s.load(func(d *models.WebhookDelivery) bool { return d.Status == models.DeliveryPending })
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for i := range deliveries {
+		s.schedule(&deliveries[i], now)
+	}
+
+	return nil
+}
+
+// Close stops the workers after the attempts in progress. Deliveries waiting
+// for a retry stay pending and are resumed after a restart.
+func (s *WebhookService) Close() {
+	s.closeOnce.Do(func() { close(s.done) })
+	s.workers.Wait()
+}
+
+// Deliveries lists the delivery log, oldest first, together with the number
+// of matching deliveries. A limit of zero returns all of them. A nil request
+// scope skips the access check, without a policy the log is only available to
+// authenticated callers.
+func (s *WebhookService) Deliveries(rs app.RequestScope, subscription, status string, offset, limit int) ([]models.WebhookDelivery, int, error) {
+	if rs != nil && s.Policy == nil && rs.Principal() == nil {
+		return nil, 0, ErrForbidden
+	}
+
+	deliveries, err := s.load(func(d *models.WebhookDelivery) bool {
+		switch {
+		case subscription != "" && d.Subscription != subscription,
+			status != "" && d.Status != status,
+			rs != nil && s.Policy != nil && !s.Policy.Allows(rs.Principal(), d.Event.Namespace, RoleAdmin):
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	total := len(deliveries)
+	switch {
+	case offset < 0:
+		offset = 0
+	case offset > total:
+		offset = total
+	}
+	if limit > 0 && offset+limit < total {
+		return deliveries[offset : offset+limit], total, nil
+	}
+	return deliveries[offset:], total, nil
+}
+
+// Cleanup removes delivered entries that are older than the retention
+// period from the delivery log. Failed deliveries are kept.
+func (s *WebhookService) Cleanup(now time.Time) (int, error) {
+	if s.Retention == 0 {
+		return 0, nil
+	}
+
+	expired, err := s.load(func(d *models.WebhookDelivery) bool {
+		return d.Status == models.DeliveryDelivered && d.UpdatedAt.Add(s.Retention).Before(now)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for i, d := range expired {
+		if err := s.Storage.DeleteObject(deliveryKey(d.ID)); err != nil {
+			return i, err
+		}
+	}
+
+	return len(expired), nil
+}
+
+// load reads the deliveries matching filter, oldest first.
+func (s *WebhookService) load(filter func(d *models.WebhookDelivery) bool) ([]models.WebhookDelivery, error) {
+	keys, err := s.Storage.ListObjects("webhooks/deliveries/")
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := []models.WebhookDelivery{}
+	for _, key := range keys {
+		r, err := s.Storage.GetObject(key)
+		if err == registry.ErrNotFound {
+			// removed by a cleanup since it was listed
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var d models.WebhookDelivery
+		err = json.NewDecoder(r).Decode(&d)
+		r.Close()
+		if err != nil {
+			return nil, fmt.Errorf("unreadable delivery %s: %s", key, err)
+		}
+
+		if filter(&d) {
+			deliveries = append(deliveries, d)
+		}
+	}
+
+	sort.Slice(deliveries, func(i, j int) bool { return deliveries[i].ID < deliveries[j].ID })
+	return deliveries, nil
+}
+
+// schedule queues a delivery for an attempt at the given time.
+func (s *WebhookService) schedule(d *models.WebhookDelivery, at time.Time) {
+	s.mu.Lock()
+	s.retries = append(s.retries, scheduledDelivery{d, at})
+	s.mu.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// due removes the deliveries that are due at now from the retry queue and
+// returns them, with the time until the next one is due.
+func (s *WebhookService) due(now time.Time) ([]*models.WebhookDelivery, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var due []*models.WebhookDelivery
+	next := maxRetryDelay
+	waiting := s.retries[:0]
+	for _, r := range s.retries {
+		if wait := r.at.Sub(now); wait > 0 {
+			if wait < next {
+				next = wait
+			}
+			waiting = append(waiting, r)
+			continue
+		}
+		due = append(due, r.delivery)
+	}
+	s.retries = waiting
+
+	return due, next
+}
+
+// dispatch hands deliveries to the workers once they are due.
+func (s *WebhookService) dispatch() {
+	defer s.workers.Done()
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-s.wake:
+		case <-timer.C:
+		}
+
+		due, next := s.due(time.Now())
+		for _, d := range due {
+			select {
+			case s.queue <- d:
+			case <-s.done:
+				return
+			}
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(next)
+	}
+}
+
+func (s *WebhookService) work() {
+	defer s.workers.Done()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case d := <-s.queue:
+			s.attempt(d)
+		}
+	}
+}
+
+// attempt sends an event once. Failed attempts are retried until the
+// attempts run out, waiting twice as long after every failed attempt.
+func (s *WebhookService) attempt(d *models.WebhookDelivery) {
+	sub, ok := s.subscription(d.Subscription)
+	if !ok {
+		d.Status, d.LastError = models.DeliveryFailed, "subscription no longer exists"
+		s.update(d)
+		return
+	}
+
+	d.Attempts++
+	d.LastStatusCode, d.LastError = 0, ""
+
+	status, err := s.send(sub, d)
+	d.LastStatusCode = status
+
+	switch {
+	case err == nil:
+		d.Status = models.DeliveryDelivered
+	case d.Attempts >= s.MaxAttempts:
+		d.Status, d.LastError = models.DeliveryFailed, err.Error()
+		logrus.Warnf("giving up on delivering %s to webhook %s after %d attempts: %s", d.Event.Type, sub.ID, d.Attempts, err)
+	default:
+		d.LastError = err.Error()
+	}
+
+	s.update(d)
+
+	if d.Status == models.DeliveryPending {
+		s.schedule(d, time.Now().Add(s.retryDelay(d.Attempts)))
+	}
+}
+
+func (s *WebhookService) send(sub WebhookSubscription, d *models.WebhookDelivery) (int, error) {
+	body, _ := json.Marshal(d.Event)
+
+	req, err := http.NewRequest(http.MethodPost, sub.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Anthology-Event", d.Event.Type)
+	req.Header.Set("X-Anthology-Delivery", d.ID)
+	req.Header.Set("X-Anthology-Signature", SignWebhook(sub.Secret, body))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected response %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+func (s *WebhookService) retryDelay(attempts int) time.Duration {
+	delay := s.RetryDelay
+	for i := 1; i < attempts && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay
+}
+
+func (s *WebhookService) update(d *models.WebhookDelivery) {
+	d.UpdatedAt = time.Now().UTC()
+	if err := s.save(d); err != nil {
+		logrus.Errorf("unable to update webhook delivery %s: %s", d.ID, err)
+	}
+}
+
+func (s *WebhookService) save(d *models.WebhookDelivery) error {
+	data, _ := json.Marshal(d)
+	return s.Storage.PutObject(deliveryKey(d.ID), bytes.NewReader(data))
+}
+
+func deliveryKey(id string) string {
+	return "webhooks/deliveries/" + id + ".json"
+}
+
+func (s *WebhookService) subscription(id string) (WebhookSubscription, bool) {
+	for _, sub := range s.Subscriptions {
+		if sub.ID == id {
+			return sub, true
+		}
+	}
+	return WebhookSubscription{}, false
+}
+
+func (sub WebhookSubscription) matches(event models.Event) bool {
+	if len(sub.Namespaces) > 0 && !matchesAny(sub.Namespaces, event.Namespace) {
+		return false
+	}
+	if len(sub.Events) == 0 {
+		return true
+	}
+	for _, t := range sub.Events {
+		if t == event.Type {
+			return true
+		}
+	}
+	return false
+}
+
+// SignWebhook returns the signature header value for a webhook body.
+func SignWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// newOrderedID returns a random ID that sorts by creation time.
+func newOrderedID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return fmt.Sprintf("%016x%s", time.Now().UnixNano(), hex.EncodeToString(b))
+}
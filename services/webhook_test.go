@@ -0,0 +1,35 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWebhookRetryDelay(t *testing.T) {
+	s := &WebhookService{RetryDelay: time.Second}
+
+	tests := []struct {
+		attempts int
+		delay    time.Duration
+	}{
+		{0, time.Second},
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{10, 512 * time.Second},
+		{12, 2048 * time.Second},
+		{13, maxRetryDelay},
+		{1000, maxRetryDelay},
+	}
+
+	for _, test := range tests {
+		if delay := s.retryDelay(test.attempts); delay != test.delay {
+			t.Errorf("after %d attempts: expected %s, got %s", test.attempts, test.delay, delay)
+		}
+	}
+
+	s.RetryDelay = 2 * time.Hour
+	if delay := s.retryDelay(1); delay != maxRetryDelay {
+		t.Errorf("expected the first delay to be capped at %s, got %s", maxRetryDelay, delay)
+	}
+}